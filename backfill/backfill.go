@@ -0,0 +1,257 @@
+package backfill
+
+import (
+	"context"
+	"cti/db"
+	"cti/ds"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	defaultPageSize  = 1000
+	defaultPageDelay = time.Millisecond * 250
+)
+
+type Checkpoint interface {
+	Last(symbol string) (time.Time, error)
+	Save(symbol string, ts time.Time) error
+}
+
+type Job struct {
+	Symbols     []string
+	From        time.Time
+	Until       time.Time
+	Granularity ds.Granularity
+}
+
+func (job Job) Validate() error {
+	if len(job.Symbols) == 0 {
+		return ErrInvalidJob.WithAttrs(map[string]any{"field": "symbols"})
+	}
+	if !job.From.Before(job.Until) {
+		return ErrInvalidJob.WithAttrs(map[string]any{"field": "from", "details": "from must be before until"})
+	}
+	if job.Granularity.Duration() == 0 {
+		return ErrInvalidJob.WithAttrs(map[string]any{"field": "granularity", "details": "granularity without fixed duration"})
+	}
+	return nil
+}
+
+// checkpointKey keys the checkpoint of symbol by the parameters of the job, jobs sharing a
+// checkpoint file only resume their own progress.
+func (job Job) checkpointKey(symbol string) string {
+	return fmt.Sprintf("%s/%s/%d-%d", symbol, job.Granularity, job.From.Unix(), job.Until.Unix())
+}
+
+// Backfiller pulls candles page by page from a candle datasource and writes them
+// through a db.Writer. The last written candle of every symbol is checkpointed
+// after every page, a rerun of the same job resumes from the checkpoint. The checkpoint
+// is keyed by the symbol and the range and granularity of the job.
+type Backfiller struct {
+	source     ds.CandleDataSource
+	writer     db.Writer
+	checkpoint Checkpoint
+	pageSize   int
+	pageDelay  time.Duration
+	progress   io.Writer
+	now        func() time.Time
+}
+
+func NewBackfiller(source ds.CandleDataSource, writer db.Writer, checkpoint Checkpoint, options ...BackfillerOption) (*Backfiller, error) {
+	backfiller := &Backfiller{
+		source:     source,
+		writer:     writer,
+		checkpoint: checkpoint,
+		pageSize:   defaultPageSize,
+		pageDelay:  defaultPageDelay,
+		progress:   io.Discard,
+		now:        time.Now,
+	}
+
+	for _, option := range options {
+		err := option(backfiller)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return backfiller, nil
+}
+
+type progress struct {
+	total     int64
+	done      int64
+	written   int64
+	startedAt time.Time
+}
+
+func (backfiller *Backfiller) Run(ctx context.Context, job Job) error {
+	err := job.Validate()
+	if err != nil {
+		return err
+	}
+
+	step := job.Granularity.Duration()
+	from := job.From.Truncate(step)
+	perSymbol := int64(job.Until.Sub(from) / step)
+
+	p := &progress{total: perSymbol * int64(len(job.Symbols)), startedAt: backfiller.now()}
+
+	for _, symbol := range job.Symbols {
+		err := backfiller.runSymbol(ctx, job.checkpointKey(symbol), symbol, from, job.Until, job.Granularity, p)
+		if err != nil {
+			return fmt.Errorf("backfill %s fail: %w", symbol, err)
+		}
+	}
+
+	elapsed := backfiller.now().Sub(p.startedAt)
+	fmt.Fprintf(backfiller.progress, "done: %d points written in %s\n", p.written, elapsed.Truncate(time.Second))
+	return nil
+}
+
+func (backfiller *Backfiller) runSymbol(ctx context.Context, checkpointKey string, symbol string, from time.Time, until time.Time, granularity ds.Granularity, p *progress) error {
+	step := granularity.Duration()
+
+	last, err := backfiller.checkpoint.Last(checkpointKey)
+	if err != nil {
+		return err
+	}
+
+	start := from
+	if !last.IsZero() && !last.Before(from) {
+		start = last.Add(step)
+		if start.After(until) {
+			start = until
+		}
+		fmt.Fprintf(backfiller.progress, "%s: resume from %s\n", symbol, start.UTC().Format(time.RFC3339))
+	}
+	p.done += int64(start.Sub(from) / step)
+
+	for pageFrom := start; pageFrom.Before(until); {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		pageUntil := pageFrom.Add(step * time.Duration(backfiller.pageSize))
+		if pageUntil.After(until) {
+			pageUntil = until
+		}
+
+		candles, err := backfiller.source.Candles(symbol, pageFrom, pageUntil, granularity)
+		if err != nil {
+			return err
+		}
+
+		points := make([]db.Point, 0, len(candles))
+		for _, candle := range candles {
+			points = append(points, db.Point{Symbol: symbol, Price: candle.Open, Ts: candle.Ts})
+		}
+
+		err = backfiller.write(points)
+		if err != nil {
+			return err
+		}
+
+		err = backfiller.checkpoint.Save(checkpointKey, pageUntil.Add(-step))
+		if err != nil {
+			return err
+		}
+
+		p.done += int64(pageUntil.Sub(pageFrom) / step)
+		p.written += int64(len(points))
+		backfiller.report(symbol, pageUntil, p)
+
+		pageFrom = pageUntil
+		if pageFrom.Before(until) && backfiller.pageDelay > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backfiller.pageDelay):
+			}
+		}
+	}
+
+	return nil
+}
+
+// flusher is a writer which buffers its points, e.g. a db.BatchWriter.
+type flusher interface {
+	Flush() error
+}
+
+// write writes the points of a page, a buffering writer is flushed so the checkpoint saved
+// afterwards never gets ahead of the stored points.
+func (backfiller *Backfiller) write(points []db.Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+
+	if pointsWriter, ok := backfiller.writer.(db.PointsWriter); ok {
+		err := pointsWriter.WritePoints(points)
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, point := range points {
+			err := backfiller.writer.WritePrice(point.Symbol, point.Price, point.Ts)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if f, ok := backfiller.writer.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+func (backfiller *Backfiller) report(symbol string, ts time.Time, p *progress) {
+	elapsed := backfiller.now().Sub(p.startedAt).Seconds()
+	throughput := 0.0
+	if elapsed > 0 {
+		throughput = float64(p.written) / elapsed
+	}
+
+	eta := "-"
+	if p.done > 0 && elapsed > 0 {
+		remaining := time.Duration(float64(p.total-p.done) / float64(p.done) * elapsed * float64(time.Second))
+		eta = remaining.Truncate(time.Second).String()
+	}
+
+	fmt.Fprintf(backfiller.progress, "%s: %s, %d/%d (%.1f%%), %.0f points/s, eta %s\n",
+		symbol, ts.UTC().Format(time.RFC3339), p.done, p.total, float64(p.done)/float64(p.total)*100, throughput, eta)
+}
+
+type BackfillerOption func(*Backfiller) error
+
+func BackfillerPageSizeOption(pageSize int) BackfillerOption {
+	return func(backfiller *Backfiller) error {
+		if pageSize <= 0 {
+			return fmt.Errorf("page size must be positive: %d", pageSize)
+		}
+		backfiller.pageSize = pageSize
+		return nil
+	}
+}
+
+func BackfillerPageDelayOption(delay time.Duration) BackfillerOption {
+	return func(backfiller *Backfiller) error {
+		if delay < 0 {
+			return fmt.Errorf("page delay must not be negative: %s", delay)
+		}
+		backfiller.pageDelay = delay
+		return nil
+	}
+}
+
+func BackfillerProgressOption(w io.Writer) BackfillerOption {
+	return func(backfiller *Backfiller) error {
+		backfiller.progress = w
+		return nil
+	}
+}
@@ -0,0 +1,224 @@
+package backfill
+
+import (
+	"bytes"
+	"context"
+	"cti/db"
+	"cti/ds"
+	"cti/periodic"
+	"errors"
+	"github.com/stretchr/testify/suite"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeCandleDataSource struct {
+	mu      sync.Mutex
+	calls   int
+	failAt  int
+	onCall  func()
+	missing map[int64]bool
+}
+
+func (source *fakeCandleDataSource) Candles(symbol string, from time.Time, until time.Time, granularity ds.Granularity) ([]ds.Candle, error) {
+	source.mu.Lock()
+	source.calls++
+	calls := source.calls
+	source.mu.Unlock()
+
+	if source.onCall != nil {
+		source.onCall()
+	}
+
+	if source.failAt > 0 && calls == source.failAt {
+		return nil, errors.New("source down")
+	}
+
+	var candles []ds.Candle
+	for ts := from; ts.Before(until); ts = ts.Add(granularity.Duration()) {
+		if source.missing[ts.Unix()] {
+			continue
+		}
+		candles = append(candles, ds.Candle{Ts: ts, Open: float64(ts.Unix())})
+	}
+	return candles, nil
+}
+
+type fakePointsWriter struct {
+	mu     sync.Mutex
+	points map[string]map[int64]float64
+}
+
+func (writer *fakePointsWriter) WritePrice(symbol string, price float64, ts time.Time) error {
+	return writer.WritePoints([]db.Point{{Symbol: symbol, Price: price, Ts: ts}})
+}
+
+func (writer *fakePointsWriter) WritePoints(points []db.Point) error {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+
+	if writer.points == nil {
+		writer.points = make(map[string]map[int64]float64)
+	}
+	for _, point := range points {
+		if writer.points[point.Symbol] == nil {
+			writer.points[point.Symbol] = make(map[int64]float64)
+		}
+		writer.points[point.Symbol][point.Ts.Unix()] = point.Price
+	}
+	return nil
+}
+
+type BackfillerTestSuite struct {
+	source     *fakeCandleDataSource
+	writer     *fakePointsWriter
+	checkpoint *periodic.FileCheckpoint
+	path       string
+	job        Job
+	progress   *bytes.Buffer
+	suite.Suite
+}
+
+func (suite *BackfillerTestSuite) SetupTest() {
+	suite.source = &fakeCandleDataSource{}
+	suite.writer = &fakePointsWriter{}
+	suite.path = filepath.Join(suite.T().TempDir(), "checkpoint.json")
+	suite.progress = &bytes.Buffer{}
+
+	checkpoint, err := periodic.NewFileCheckpoint(suite.path)
+	suite.Nil(err)
+	suite.checkpoint = checkpoint
+
+	from := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	suite.job = Job{
+		Symbols:     []string{"BTCUSD", "ETHUSD"},
+		From:        from,
+		Until:       from.Add(time.Minute * 25),
+		Granularity: ds.Granularity1m,
+	}
+}
+
+func (suite *BackfillerTestSuite) newBackfiller() *Backfiller {
+	backfiller, err := NewBackfiller(suite.source, suite.writer, suite.checkpoint,
+		BackfillerPageSizeOption(10),
+		BackfillerPageDelayOption(0),
+		BackfillerProgressOption(suite.progress))
+	suite.Nil(err)
+	return backfiller
+}
+
+func (suite *BackfillerTestSuite) TestRun() {
+	suite.Nil(suite.newBackfiller().Run(context.Background(), suite.job))
+
+	for _, symbol := range suite.job.Symbols {
+		suite.Len(suite.writer.points[symbol], 25)
+	}
+	// 3 pages per symbol
+	suite.Equal(6, suite.source.calls)
+	suite.Contains(suite.progress.String(), "50/50 (100.0%)")
+	suite.Contains(suite.progress.String(), "eta")
+}
+
+func (suite *BackfillerTestSuite) TestResume() {
+	suite.source.failAt = 2
+	suite.NotNil(suite.newBackfiller().Run(context.Background(), suite.job))
+	suite.Len(suite.writer.points["BTCUSD"], 10)
+
+	// a new process with the same checkpoint file
+	checkpoint, err := periodic.NewFileCheckpoint(suite.path)
+	suite.Nil(err)
+	suite.checkpoint = checkpoint
+	suite.source.failAt = 0
+	suite.source.calls = 0
+
+	suite.Nil(suite.newBackfiller().Run(context.Background(), suite.job))
+	suite.Len(suite.writer.points["BTCUSD"], 25)
+	suite.Len(suite.writer.points["ETHUSD"], 25)
+	suite.Equal(5, suite.source.calls)
+	suite.Contains(suite.progress.String(), "BTCUSD: resume from 2022-01-01T00:10:00Z")
+}
+
+func (suite *BackfillerTestSuite) TestJobsShareCheckpoint() {
+	suite.Nil(suite.newBackfiller().Run(context.Background(), suite.job))
+
+	// an earlier range and another granularity in the same checkpoint file are not resumed
+	earlier := suite.job
+	earlier.From = suite.job.From.Add(-time.Minute * 25)
+	earlier.Until = suite.job.From
+	suite.Nil(suite.newBackfiller().Run(context.Background(), earlier))
+	hourly := suite.job
+	hourly.From = suite.job.From.Add(-time.Hour * 5)
+	hourly.Granularity = ds.Granularity1h
+	suite.Nil(suite.newBackfiller().Run(context.Background(), hourly))
+
+	for _, symbol := range suite.job.Symbols {
+		// 25 + 25 minutes and the 5 hours before the first job
+		suite.Len(suite.writer.points[symbol], 55)
+	}
+	suite.NotContains(suite.progress.String(), "resume")
+
+	suite.source.calls = 0
+	suite.Nil(suite.newBackfiller().Run(context.Background(), earlier))
+	suite.Equal(0, suite.source.calls)
+}
+
+func (suite *BackfillerTestSuite) TestBatchWriter() {
+	batchWriter, err := db.NewBatchWriter(suite.writer, db.BatchWriterBatchSizeOption(4), db.BatchWriterFlushIntervalOption(time.Hour))
+	suite.Nil(err)
+	defer batchWriter.Close()
+	backfiller, err := NewBackfiller(suite.source, batchWriter, suite.checkpoint, BackfillerPageSizeOption(10), BackfillerPageDelayOption(0))
+	suite.Nil(err)
+
+	// every page is stored before its checkpoint
+	suite.source.failAt = 2
+	suite.NotNil(backfiller.Run(context.Background(), suite.job))
+	suite.Len(suite.writer.points["BTCUSD"], 10)
+	last, err := suite.checkpoint.Last(suite.job.checkpointKey("BTCUSD"))
+	suite.Nil(err)
+	suite.Equal(suite.job.From.Add(time.Minute*9).Unix(), last.Unix())
+}
+
+func (suite *BackfillerTestSuite) TestMissingCandles() {
+	suite.source.missing = map[int64]bool{suite.job.From.Add(time.Minute).Unix(): true}
+	suite.job.Symbols = suite.job.Symbols[:1]
+
+	suite.Nil(suite.newBackfiller().Run(context.Background(), suite.job))
+	suite.Len(suite.writer.points["BTCUSD"], 24)
+}
+
+func (suite *BackfillerTestSuite) TestCancel() {
+	ctx, cancel := context.WithCancel(context.Background())
+	suite.source.onCall = cancel
+
+	err := suite.newBackfiller().Run(ctx, suite.job)
+	suite.ErrorIs(err, context.Canceled)
+	suite.Equal(1, suite.source.calls)
+}
+
+func (suite *BackfillerTestSuite) TestInvalidJob() {
+	backfiller := suite.newBackfiller()
+
+	jobs := []Job{
+		{From: suite.job.From, Until: suite.job.Until, Granularity: ds.Granularity1m},
+		{Symbols: suite.job.Symbols, From: suite.job.Until, Until: suite.job.From, Granularity: ds.Granularity1m},
+		{Symbols: suite.job.Symbols, From: suite.job.From, Until: suite.job.Until, Granularity: ds.Granularity1M},
+	}
+
+	for _, job := range jobs {
+		suite.NotNil(backfiller.Run(context.Background(), job))
+	}
+}
+
+func (suite *BackfillerTestSuite) TestInvalidOptions() {
+	_, err := NewBackfiller(suite.source, suite.writer, suite.checkpoint, BackfillerPageSizeOption(0))
+	suite.NotNil(err)
+
+	_, err = NewBackfiller(suite.source, suite.writer, suite.checkpoint, BackfillerPageDelayOption(-time.Second))
+	suite.NotNil(err)
+}
+
+func TestBackfillerTestSuite(t *testing.T) {
+	suite.Run(t, new(BackfillerTestSuite))
+}
@@ -0,0 +1,7 @@
+package backfill
+
+import "cti/erro"
+
+var (
+	ErrInvalidJob = erro.NewError("INVALID_JOB", "invalid backfill job", nil)
+)
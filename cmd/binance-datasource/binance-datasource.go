@@ -1,20 +1,28 @@
 package main
 
 import (
+	"context"
+	"cti/config"
 	"cti/ds"
-	"log"
+	"cti/lifecycle"
+	"cti/logging"
+	"cti/tracing"
+	"golang.org/x/exp/slog"
 	"os"
 )
 
 var Version = "-"
 
 func main() {
-	log.Printf("version: %s", Version)
-	var options []ds.BinanceApiOption
-	baseurl, listenAddr := envVars()
+	cfg := config.MustParse(config.SectionLog, config.SectionBinance)
+	if err := logging.Setup("binance-datasource", cfg.Log.Level, cfg.Log.Format); err != nil {
+		panic(err)
+	}
+	slog.Info("starting", "version", Version)
 
-	if baseurl != "" {
-		options = append(options, ds.BinanceApiBaseUrlOption(baseurl))
+	var options []ds.BinanceApiOption
+	if cfg.Binance.BaseUrl != "" {
+		options = append(options, ds.BinanceApiBaseUrlOption(cfg.Binance.BaseUrl))
 	}
 
 	datasource, err := ds.NewBinanceDataSource(options...)
@@ -22,16 +30,36 @@ func main() {
 		panic(err)
 	}
 
-	server := ds.NewDataSourceApiServer(datasource, listenAddr)
-	log.Fatalln(server.ListenAndServe())
-}
+	server := ds.NewDataSourceApiServer(datasource, cfg.Binance.ListenAddr)
+	if serverTls := cfg.Binance.Tls; serverTls.Enabled() {
+		err = server.EnableTLS(serverTls.CertFile, serverTls.KeyFile, serverTls.ClientCaFile)
+		if err != nil {
+			panic(err)
+		}
+	}
 
-func envVars() (baseurl string, listenAddr string) {
-	baseurl = os.Getenv("BINANCE_BASEURL")
+	ctx, stop := lifecycle.SignalContext(context.Background())
+	defer stop()
 
-	listenAddr = os.Getenv("BINANCE_LISTEN_ADDR")
-	if listenAddr == "" {
-		listenAddr = ":80"
+	shutdownTracing, err := tracing.Setup(ctx, "binance-datasource")
+	if err != nil {
+		panic(err)
+	}
+	defer shutdownTracing(context.Background())
+
+	var servers lifecycle.Server = server
+	if cfg.Binance.GrpcListenAddr != "" {
+		grpcServer, err := server.GrpcServer(cfg.Binance.GrpcListenAddr)
+		if err != nil {
+			panic(err)
+		}
+		servers = lifecycle.Group{server, grpcServer}
+	}
+
+	err = lifecycle.Serve(ctx, servers, cfg.Binance.DrainTimeout.Duration())
+	if err != nil {
+		slog.Error("serve fail", err)
+		os.Exit(1)
 	}
-	return
+	slog.Info("stopped")
 }
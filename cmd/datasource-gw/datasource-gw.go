@@ -1,86 +1,195 @@
 package main
 
 import (
+	"context"
+	"cti/config"
 	"cti/ds"
 	"cti/gw"
-	"log"
+	"cti/lifecycle"
+	"cti/logging"
+	"cti/tlsutil"
+	"cti/tracing"
+	"fmt"
+	"golang.org/x/exp/slog"
 	"os"
-	"strings"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
 var Version = "-"
 
 func main() {
-	log.Printf("version: %s", Version)
+	cfg := config.MustParse(config.SectionLog, config.SectionGateway)
+	if err := logging.Setup("datasource-gw", cfg.Log.Level, cfg.Log.Format); err != nil {
+		panic(err)
+	}
+	slog.Info("starting", "version", Version)
 
-	envPriceDataSource, envAverageDataSources, listenAddr, symbol := envVars()
-	priceDataSources := parsePriceDataSources(envPriceDataSource)
-	averageDataSources := parseAverageDataSources(envAverageDataSources)
+	gateway := cfg.Gateway
+	server := gw.NewDataSourceApiGw(nil, nil, gateway.Symbol, gateway.ListenAddr)
+	if serverTls := gateway.Tls; serverTls.Enabled() {
+		err := server.EnableTLS(serverTls.CertFile, serverTls.KeyFile, serverTls.ClientCaFile)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if upstreamTls := gateway.UpstreamTls; upstreamTls.Enabled() {
+		tlsConfig, err := tlsutil.ClientConfig(upstreamTls.CaFile, upstreamTls.CertFile, upstreamTls.KeyFile)
+		if err != nil {
+			panic(err)
+		}
+		server.SetUpstreamOptions(ds.DefaultDataSourceApiClientTlsOption(tlsConfig))
+		server.SetUpstreamGrpcOptions(ds.GrpcDataSourceApiClientTlsOption(tlsConfig))
+	}
+	server.SetStreamGranularity(ds.Granularity(gateway.StreamGranularity))
+	err := server.SetConfigDataSources(gateway.PriceDataSources, gateway.AverageDataSources)
+	if err != nil {
+		panic(err)
+	}
+	if gateway.Auth.Enabled() {
+		keys, err := gateway.Auth.LoadKeys()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		server.EnableAuth(keys)
+	}
+	if gateway.Admin.Token != "" {
+		server.EnableAdmin(gateway.Admin.Token, persistFunc(cfg.Path(), gateway.Admin.Persist, os.LookupEnv))
+	}
 
-	server := gw.NewDataSourceApiGw(priceDataSources, averageDataSources, symbol, listenAddr)
-	log.Fatalln(server.ListenAndServe())
-}
+	ctx, stop := lifecycle.SignalContext(context.Background())
+	defer stop()
 
-func envVars() (priceDataSource string, averageDataSources string, listenAddr string, symbol string) {
-	priceDataSource = os.Getenv("GW_PRICE_DATASOURCE")
-	averageDataSources = os.Getenv("GW_AVERAGE_DATASOURCE")
-	listenAddr = os.Getenv("GW_LISTEN_ADDR")
-	if listenAddr == "" {
-		listenAddr = ":80"
+	shutdownTracing, err := tracing.Setup(ctx, "datasource-gw")
+	if err != nil {
+		panic(err)
 	}
+	defer shutdownTracing(context.Background())
+
+	// SIGHUP is handled without a config file as well, it would stop the gateway otherwise
+	go watchConfig(ctx, newReloader(server, cfg.Path(), gateway.Symbol, gateway.Auth.Enabled()), gateway.ReloadInterval.Duration())
 
-	symbol = os.Getenv("GW_SYMBOL")
-	if symbol == "" {
-		panic("env GW_SYMBOL is required")
+	err = lifecycle.Serve(ctx, server, gateway.DrainTimeout.Duration())
+	if err != nil {
+		slog.Error("serve fail", err)
+		os.Exit(1)
 	}
-	return
+	slog.Info("stopped")
 }
 
-func parseDataSources(str string) []ds.DataSourceApiClient {
-	if str == "" {
-		return nil
+// reloader applies the datasources of the config file to a running gateway.
+type reloader struct {
+	mu     sync.Mutex
+	server *gw.DataSourceApiGw
+	path   string
+	symbol string
+	auth   bool
+}
+
+func newReloader(server *gw.DataSourceApiGw, path string, symbol string, auth bool) *reloader {
+	return &reloader{server: server, path: path, symbol: symbol, auth: auth}
+}
+
+// reload swaps the datasources and the API keys of the gateway, an invalid config is rejected
+// and the gateway keeps its current datasources and keys.
+func (reloader *reloader) reload() error {
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+
+	cfg, err := config.Load(reloader.path)
+	if err == nil {
+		err = cfg.Validate(config.SectionGateway)
+	}
+	if err != nil {
+		return err
 	}
 
-	var dsArr []ds.DataSourceApiClient
-	dsInfo := strings.Split(str, ",")
+	gateway := cfg.Gateway
+	if gateway.Symbol != reloader.symbol {
+		return fmt.Errorf("gateway.symbol changed from %s to %s, it needs a restart", reloader.symbol, gateway.Symbol)
+	}
+	if gateway.Auth.Enabled() != reloader.auth {
+		return fmt.Errorf("gateway.auth was enabled or disabled, it needs a restart")
+	}
 
-	for _, info := range dsInfo {
-		v := strings.SplitN(info, ":", 2)
-		dsApi, err := ds.NewDefaultDataSourceApiClient(v[1])
+	var keys []config.ApiKey
+	if reloader.auth {
+		keys, err = gateway.Auth.LoadKeys()
 		if err != nil {
-			panic(err)
+			return err
 		}
-
-		dsArr = append(dsArr, gw.NewDefaultDataSourceApiClient(v[0], dsApi))
 	}
 
-	return dsArr
+	err = reloader.server.SetConfigDataSources(gateway.PriceDataSources, gateway.AverageDataSources)
+	if err != nil {
+		return err
+	}
+	reloader.server.SetApiKeys(keys)
+	slog.Info("config reloaded", "path", reloader.path,
+		"price_datasources", dataSourceIds(gateway.PriceDataSources),
+		"average_datasources", dataSourceIds(gateway.AverageDataSources),
+		"api_keys", len(keys))
+	return nil
 }
 
-func parsePriceDataSources(str string) []ds.PriceDataSourceApi {
-	if str == "" {
-		return nil
+// watchConfig reloads on SIGHUP and, when interval is positive, when the config file changes.
+// Without a config file the env is not read again, SIGHUP is logged and ignored.
+func watchConfig(ctx context.Context, reloader *reloader, interval time.Duration) {
+	reload := func() {
+		if reloader.path == "" {
+			slog.Info("config reload skipped, no config file to reload")
+			return
+		}
+		if err := reloader.reload(); err != nil {
+			slog.Error("config reload rejected", err, "path", reloader.path)
+		}
 	}
 
-	var api []ds.PriceDataSourceApi
-	dataSources := parseDataSources(str)
-	for _, datasource := range dataSources {
-		api = append(api, datasource)
+	if interval > 0 && reloader.path != "" {
+		go config.Watch(ctx, reloader.path, interval, reload)
 	}
 
-	return api
-}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
 
-func parseAverageDataSources(str string) []ds.AverageDataSourceApi {
-	if str == "" {
-		return nil
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			reload()
+		}
 	}
+}
 
-	var api []ds.AverageDataSourceApi
-	dataSources := parseDataSources(str)
-	for _, datasource := range dataSources {
-		api = append(api, datasource)
+func dataSourceIds(dataSources config.DataSources) []string {
+	ids := make([]string, 0, len(dataSources))
+	for _, dataSource := range dataSources {
+		ids = append(ids, dataSource.Id)
 	}
+	return ids
+}
 
-	return api
+// persistFunc saves the upstreams changed by the admin API to the config file when persist is set.
+// When the env overrides the datasources of the file, a persisted change would be undone by the
+// next reload, so the changes are rejected.
+func persistFunc(path string, persist bool, lookup func(string) (string, bool)) gw.PersistFunc {
+	if !persist {
+		return nil
+	}
+	for _, name := range []string{"GW_PRICE_DATASOURCE", "GW_AVERAGE_DATASOURCE"} {
+		if _, ok := lookup(name); ok {
+			err := fmt.Errorf("env %s overrides the datasources of the config file", name)
+			return func(config.DataSources, config.DataSources) error {
+				return err
+			}
+		}
+	}
+	return func(price config.DataSources, average config.DataSources) error {
+		return config.SaveDataSources(path, price, average)
+	}
 }
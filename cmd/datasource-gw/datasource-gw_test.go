@@ -1,59 +1,78 @@
 package main
 
 import (
-	"cti/ds"
+	"context"
+	"cti/config"
 	"cti/gw"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 )
 
-func TestParseDataSource(t *testing.T) {
-	result := parseDataSources("influxdb:http://127.0.0.1:8082,binance:http://127.0.0.1:8081")
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cti.yaml")
+	write := func(content string) {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+	server := gw.NewDataSourceApiGw(nil, nil, "BTCUSD", ":0")
+	reloader := newReloader(server, path, "BTCUSD", false)
 
-	var expect []ds.DataSourceApiClient
-	dsApi, err := ds.NewDefaultDataSourceApiClient("http://127.0.0.1:8082")
-	assert.Nil(t, err)
-	expect = append(expect, gw.NewDefaultDataSourceApiClient("influxdb", dsApi))
-	dsApi, err = ds.NewDefaultDataSourceApiClient("http://127.0.0.1:8081")
-	assert.Nil(t, err)
-	expect = append(expect, gw.NewDefaultDataSourceApiClient("binance", dsApi))
+	write("gateway:\n  symbol: BTCUSD\n  price_datasources:\n    - id: binance\n      url: http://127.0.0.1:8081\n")
+	assert.NoError(t, reloader.reload())
+	assert.Equal(t, "binance", server.Upstreams().Price[0].Id)
 
-	assert.Equal(t, expect, result)
+	write("gateway:\n  symbol: BTCUSD\n  price_datasources:\n    - id: binance\n      url: not-a-url\n")
+	assert.Equal(t, []string{`gateway.price_datasources[0].url is not a http(s) or grpc(s) url: "not-a-url"`}, config.Problems(reloader.reload()))
 
-	result = parseDataSources("")
-	assert.Nil(t, result)
+	write("gateway:\n  symbol: ETHUSD\n  price_datasources:\n    - id: binance\n      url: http://127.0.0.1:8081\n")
+	assert.ErrorContains(t, reloader.reload(), "needs a restart")
+	assert.Equal(t, "http://127.0.0.1:8081", server.Upstreams().Price[0].Url)
 }
 
-func TestParsePriceDataSources(t *testing.T) {
-	result := parsePriceDataSources("influxdb:http://127.0.0.1:8082,binance:http://127.0.0.1:8081")
+func TestWatchConfigWithoutFile(t *testing.T) {
+	server := gw.NewDataSourceApiGw(nil, nil, "BTCUSD", ":0")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watchConfig(ctx, newReloader(server, "", "BTCUSD", false), time.Second)
+	}()
+	time.Sleep(time.Millisecond * 50)
 
-	var expect []ds.PriceDataSourceApi
-	dsApi, err := ds.NewDefaultDataSourceApiClient("http://127.0.0.1:8082")
-	assert.Nil(t, err)
-	expect = append(expect, gw.NewDefaultDataSourceApiClient("influxdb", dsApi))
-	dsApi, err = ds.NewDefaultDataSourceApiClient("http://127.0.0.1:8081")
-	assert.Nil(t, err)
-	expect = append(expect, gw.NewDefaultDataSourceApiClient("binance", dsApi))
-
-	assert.Equal(t, expect, result)
-
-	result = parsePriceDataSources("")
-	assert.Nil(t, result)
+	// the gateway configured by the env is not stopped by SIGHUP
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	time.Sleep(time.Millisecond * 50)
+	cancel()
+	<-done
 }
 
-func TestParseAverageDataSources(t *testing.T) {
-	result := parseAverageDataSources("influxdb:http://127.0.0.1:8082,binance:http://127.0.0.1:8081")
+func TestPersistFunc(t *testing.T) {
+	noEnv := func(string) (string, bool) { return "", false }
+	assert.Nil(t, persistFunc("cti.yaml", false, noEnv))
 
-	var expect []ds.AverageDataSourceApi
-	dsApi, err := ds.NewDefaultDataSourceApiClient("http://127.0.0.1:8082")
-	assert.Nil(t, err)
-	expect = append(expect, gw.NewDefaultDataSourceApiClient("influxdb", dsApi))
-	dsApi, err = ds.NewDefaultDataSourceApiClient("http://127.0.0.1:8081")
-	assert.Nil(t, err)
-	expect = append(expect, gw.NewDefaultDataSourceApiClient("binance", dsApi))
+	path := filepath.Join(t.TempDir(), "cti.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("gateway:\n  symbol: BTCUSD\n"), 0644))
+	persist := persistFunc(path, true, noEnv)
+	require.NoError(t, persist(config.DataSources{{Id: "binance", Url: "http://127.0.0.1:8081"}}, nil))
+
+	cfg, err := config.Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, "binance", cfg.Gateway.PriceDataSources[0].Id)
+}
 
-	assert.Equal(t, expect, result)
+func TestPersistFuncEnvOverride(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cti.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("gateway:\n  symbol: BTCUSD\n"), 0644))
+	persist := persistFunc(path, true, func(name string) (string, bool) {
+		return "http://127.0.0.1:8081", name == "GW_AVERAGE_DATASOURCE"
+	})
+	assert.ErrorContains(t, persist(config.DataSources{{Id: "binance", Url: "http://127.0.0.1:8081"}}, nil), "GW_AVERAGE_DATASOURCE")
 
-	result = parseAverageDataSources("")
-	assert.Nil(t, result)
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "gateway:\n  symbol: BTCUSD\n", string(content))
 }
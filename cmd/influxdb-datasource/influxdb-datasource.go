@@ -1,45 +1,61 @@
 package main
 
 import (
+	"context"
+	"cti/config"
 	"cti/ds"
-	"log"
+	"cti/lifecycle"
+	"cti/logging"
+	"cti/tracing"
+	"golang.org/x/exp/slog"
 	"os"
 )
 
 var Version = "-"
 
 func main() {
-	log.Printf("version: %s", Version)
-	serverUrl, org, token, bucket, listenAddr := envVars()
-	datasource, err := ds.NewInfluxDbDataSource(serverUrl, org, bucket, token)
-	if err != nil {
+	cfg := config.MustParse(config.SectionLog, config.SectionInfluxDb)
+	if err := logging.Setup("influxdb-datasource", cfg.Log.Level, cfg.Log.Format); err != nil {
 		panic(err)
 	}
+	slog.Info("starting", "version", Version)
 
-	server := ds.NewDataSourceApiServer(datasource, listenAddr)
-	log.Fatalln(server.ListenAndServe())
-}
-
-func envVars() (serverUrl string, org string, token string, bucket string, listenAddr string) {
-	serverUrl = os.Getenv("IDB_SERVER_URL")
-	if serverUrl == "" {
-		panic("env IDB_SERVER_URL is required")
+	influxDb := cfg.InfluxDb
+	datasource, err := ds.NewInfluxDbDataSource(influxDb.ServerUrl, influxDb.Org, influxDb.Bucket, influxDb.Token)
+	if err != nil {
+		panic(err)
 	}
-	org = os.Getenv("IDB_ORG")
-	if org == "" {
-		panic("env IDB_ORG is required")
+
+	server := ds.NewDataSourceApiServer(datasource, influxDb.ListenAddr)
+	if serverTls := influxDb.Tls; serverTls.Enabled() {
+		err = server.EnableTLS(serverTls.CertFile, serverTls.KeyFile, serverTls.ClientCaFile)
+		if err != nil {
+			panic(err)
+		}
 	}
-	token = os.Getenv("IDB_TOKEN")
-	if token == "" {
-		panic("env IDB_TOKEN is required")
+
+	ctx, stop := lifecycle.SignalContext(context.Background())
+	defer stop()
+
+	shutdownTracing, err := tracing.Setup(ctx, "influxdb-datasource")
+	if err != nil {
+		panic(err)
 	}
-	bucket = os.Getenv("IDB_BUCKET")
-	if bucket == "" {
-		panic("env IDB_BUCKET is required")
+	defer shutdownTracing(context.Background())
+
+	var servers lifecycle.Server = server
+	if influxDb.GrpcListenAddr != "" {
+		grpcServer, err := server.GrpcServer(influxDb.GrpcListenAddr)
+		if err != nil {
+			panic(err)
+		}
+		servers = lifecycle.Group{server, grpcServer}
 	}
-	listenAddr = os.Getenv("IDB_LISTEN_ADDR")
-	if listenAddr == "" {
-		listenAddr = ":80"
+
+	err = lifecycle.Serve(ctx, servers, influxDb.DrainTimeout.Duration())
+	if err != nil {
+		slog.Error("serve fail", err)
+		os.Exit(1)
 	}
-	return
+	slog.Info("stopped")
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"cti/config"
+	"cti/ds"
+	"cti/lifecycle"
+	"cti/logging"
+	"cti/tracing"
+	"golang.org/x/exp/slog"
+	"os"
+)
+
+var Version = "-"
+
+func main() {
+	cfg := config.MustParse(config.SectionLog, config.SectionLocal)
+	if err := logging.Setup("local-datasource", cfg.Log.Level, cfg.Log.Format); err != nil {
+		panic(err)
+	}
+	slog.Info("starting", "version", Version)
+
+	datasource, err := ds.NewLocalStore(cfg.Local.DataDir)
+	if err != nil {
+		panic(err)
+	}
+
+	server := ds.NewDataSourceApiServer(datasource, cfg.Local.ListenAddr)
+	if serverTls := cfg.Local.Tls; serverTls.Enabled() {
+		err = server.EnableTLS(serverTls.CertFile, serverTls.KeyFile, serverTls.ClientCaFile)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	ctx, stop := lifecycle.SignalContext(context.Background())
+	defer stop()
+
+	shutdownTracing, err := tracing.Setup(ctx, "local-datasource")
+	if err != nil {
+		panic(err)
+	}
+	defer shutdownTracing(context.Background())
+
+	var servers lifecycle.Server = server
+	if cfg.Local.GrpcListenAddr != "" {
+		grpcServer, err := server.GrpcServer(cfg.Local.GrpcListenAddr)
+		if err != nil {
+			panic(err)
+		}
+		servers = lifecycle.Group{server, grpcServer}
+	}
+
+	err = lifecycle.Serve(ctx, servers, cfg.Local.DrainTimeout.Duration())
+	if err != nil {
+		slog.Error("serve fail", err)
+		os.Exit(1)
+	}
+	slog.Info("stopped")
+}
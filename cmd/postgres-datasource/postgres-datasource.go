@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"cti/config"
+	"cti/db"
+	"cti/ds"
+	"cti/lifecycle"
+	"cti/logging"
+	"cti/tracing"
+	"database/sql"
+	_ "github.com/lib/pq"
+	"golang.org/x/exp/slog"
+	"os"
+)
+
+var Version = "-"
+
+func main() {
+	cfg := config.MustParse(config.SectionLog, config.SectionPostgres)
+	if err := logging.Setup("postgres-datasource", cfg.Log.Level, cfg.Log.Format); err != nil {
+		panic(err)
+	}
+	slog.Info("starting", "version", Version)
+
+	database, err := sql.Open("postgres", cfg.Postgres.Dsn)
+	if err != nil {
+		panic(err)
+	}
+
+	err = db.MigratePostgres(database)
+	if err != nil {
+		panic(err)
+	}
+
+	datasource, err := ds.NewPostgresDataSource(database)
+	if err != nil {
+		panic(err)
+	}
+
+	server := ds.NewDataSourceApiServer(datasource, cfg.Postgres.ListenAddr)
+	if serverTls := cfg.Postgres.Tls; serverTls.Enabled() {
+		err = server.EnableTLS(serverTls.CertFile, serverTls.KeyFile, serverTls.ClientCaFile)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	ctx, stop := lifecycle.SignalContext(context.Background())
+	defer stop()
+
+	shutdownTracing, err := tracing.Setup(ctx, "postgres-datasource")
+	if err != nil {
+		panic(err)
+	}
+	defer shutdownTracing(context.Background())
+
+	var servers lifecycle.Server = server
+	if cfg.Postgres.GrpcListenAddr != "" {
+		grpcServer, err := server.GrpcServer(cfg.Postgres.GrpcListenAddr)
+		if err != nil {
+			panic(err)
+		}
+		servers = lifecycle.Group{server, grpcServer}
+	}
+
+	err = lifecycle.Serve(ctx, servers, cfg.Postgres.DrainTimeout.Duration())
+	if err != nil {
+		slog.Error("serve fail", err)
+		os.Exit(1)
+	}
+	slog.Info("stopped")
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"cti/backfill"
+	"cti/config"
+	"cti/db"
+	"cti/ds"
+	"cti/erro"
+	"cti/lifecycle"
+	"cti/logging"
+	"cti/periodic"
+	"cti/tracing"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	_ "github.com/lib/pq"
+	"golang.org/x/exp/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+var Version = "-"
+
+func main() {
+	symbols := flag.String("symbols", "", "comma separated symbols (e.g. BTCUSD,ETHUSD)")
+	from := flag.String("from", "", "start of the range, RFC3339 or 2006-01-02 (inclusive)")
+	until := flag.String("until", "", "end of the range, RFC3339 or 2006-01-02 (exclusive)")
+	granularity := flag.String("granularity", string(ds.Granularity1m), "candle granularity (1s,1m,1h,1d)")
+	source := flag.String("source", "binance", "candle source: binance or a datasource base url")
+	storage := flag.String("storage", "", "storage: influxdb, postgres or local, overrides backfill.storage.type of the config")
+	checkpointFile := flag.String("checkpoint", "price-backfill.checkpoint.json", "checkpoint file to resume from")
+	pageSize := flag.Int("page-size", 1000, "candles per request and write")
+	pageDelay := flag.Duration("page-delay", time.Millisecond*250, "delay between pages")
+	cfg := config.MustParse(config.SectionLog)
+	if err := logging.Setup("price-backfill", cfg.Log.Level, cfg.Log.Format); err != nil {
+		panic(err)
+	}
+	slog.Info("starting", "version", Version)
+
+	if *storage != "" {
+		cfg.Backfill.Storage.Type = *storage
+	}
+	if err := cfg.Validate(config.SectionBackfill); err != nil {
+		fatal("invalid config", err)
+	}
+
+	job, err := newJob(*symbols, *from, *until, *granularity)
+	if err != nil {
+		fatal("invalid job", err)
+	}
+
+	candleSource, err := newCandleSource(*source, cfg.Binance.BaseUrl)
+	if err != nil {
+		fatal("create candle source fail", err)
+	}
+
+	storageWriter, err := newWriter(cfg.Backfill.Storage)
+	if err != nil {
+		fatal("create writer fail", err)
+	}
+	// the backfiller flushes the writer after every page, before its checkpoint
+	writer, err := db.NewBatchWriter(storageWriter, db.BatchWriterBatchSizeOption(*pageSize))
+	if err != nil {
+		fatal("create writer fail", err)
+	}
+
+	checkpoint, err := periodic.NewFileCheckpoint(*checkpointFile)
+	if err != nil {
+		fatal("read checkpoint fail", err, "file", *checkpointFile)
+	}
+
+	backfiller, err := backfill.NewBackfiller(candleSource, writer, checkpoint,
+		backfill.BackfillerPageSizeOption(*pageSize),
+		backfill.BackfillerPageDelayOption(*pageDelay),
+		backfill.BackfillerProgressOption(os.Stdout))
+	if err != nil {
+		fatal("create backfiller fail", err)
+	}
+
+	ctx, stop := lifecycle.SignalContext(context.Background())
+	defer stop()
+
+	shutdownTracing, err := tracing.Setup(ctx, "price-backfill")
+	if err != nil {
+		fatal("setup tracing fail", err)
+	}
+
+	err = backfiller.Run(ctx, job)
+	shutdownTracing(context.Background())
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fatal("backfill fail, rerun with the same checkpoint file to resume", err, "checkpoint", *checkpointFile)
+	}
+	slog.Info("stopped")
+}
+
+// fatal logs err with the code and attrs of an erro.Error and exits with status 1.
+func fatal(msg string, err error, args ...any) {
+	var e *erro.Error
+	if errors.As(err, &e) {
+		args = append(args, "code", e.Code, "attr", e.Attr)
+	}
+	slog.Error(msg, err, args...)
+	os.Exit(1)
+}
+
+func newJob(symbols string, from string, until string, granularity string) (backfill.Job, error) {
+	job := backfill.Job{Granularity: ds.Granularity(granularity)}
+
+	for _, symbol := range strings.Split(symbols, ",") {
+		symbol = strings.TrimSpace(symbol)
+		if symbol != "" {
+			job.Symbols = append(job.Symbols, symbol)
+		}
+	}
+
+	var err error
+	job.From, err = parseTime(from)
+	if err != nil {
+		return job, fmt.Errorf("flag from is invalid: %w", err)
+	}
+	job.Until, err = parseTime(until)
+	if err != nil {
+		return job, fmt.Errorf("flag until is invalid: %w", err)
+	}
+
+	return job, job.Validate()
+}
+
+func parseTime(value string) (time.Time, error) {
+	ts, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return ts, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+func newCandleSource(source string, binanceBaseUrl string) (ds.CandleDataSource, error) {
+	if source == "binance" {
+		var options []ds.BinanceApiOption
+		if binanceBaseUrl != "" {
+			options = append(options, ds.BinanceApiBaseUrlOption(binanceBaseUrl))
+		}
+		return ds.NewBinanceDataSource(options...)
+	}
+
+	apiClient, err := ds.NewDefaultDataSourceApiClient(source)
+	if err != nil {
+		return nil, err
+	}
+	return ds.NewPriceCandleDataSource(apiClient), nil
+}
+
+func newWriter(storage config.Storage) (db.PointsWriter, error) {
+	switch storage.Type {
+	case "influxdb":
+		influxDb := storage.InfluxDb
+		return db.NewInfluxDbWriter(influxDb.ServerUrl, influxDb.Org, influxDb.Bucket, influxDb.Token), nil
+	case "postgres":
+		database, err := sql.Open("postgres", storage.Postgres.Dsn)
+		if err != nil {
+			return nil, err
+		}
+
+		err = db.MigratePostgres(database)
+		if err != nil {
+			return nil, err
+		}
+
+		return db.NewPostgresWriter(database), nil
+	case "local":
+		return ds.NewLocalStore(storage.Local.DataDir)
+	}
+
+	return nil, fmt.Errorf("storage is not supported: %s", storage.Type)
+}
@@ -1,53 +1,335 @@
 package main
 
 import (
+	"context"
+	"cti/config"
 	"cti/db"
 	"cti/ds"
+	"cti/lifecycle"
+	"cti/logging"
+	"cti/metrics"
 	"cti/periodic"
-	"log"
-	"os"
+	"cti/tlsutil"
+	"cti/tracing"
+	"database/sql"
+	"fmt"
+	_ "github.com/lib/pq"
+	"golang.org/x/exp/slog"
+	"io"
+	"time"
 )
 
 var Version = "-"
 
 func main() {
-	log.Printf("version: %s", Version)
+	cfg := config.MustParse(config.SectionLog, config.SectionCollector)
+	if err := logging.Setup("price-periodic-collector", cfg.Log.Level, cfg.Log.Format); err != nil {
+		panic(err)
+	}
+	slog.Info("starting", "version", Version)
+
+	collectorCfg := cfg.Collector
+	var clientOptions []ds.DefaultDataSourceApiClientOption
+	if clientTls := collectorCfg.DataSourceTls; clientTls.Enabled() {
+		tlsConfig, err := tlsutil.ClientConfig(clientTls.CaFile, clientTls.CertFile, clientTls.KeyFile)
+		if err != nil {
+			panic(err)
+		}
+		clientOptions = append(clientOptions, ds.DefaultDataSourceApiClientTlsOption(tlsConfig))
+	}
+	apiClient, err := ds.NewDefaultDataSourceApiClient(collectorCfg.DataSourceUrl, clientOptions...)
+	if err != nil {
+		panic(err)
+	}
 
-	dsBaseUrl, serverUrl, org, token, bucket, symbol := envVars()
-	apiClient, err := ds.NewDefaultDataSourceApiClient(dsBaseUrl)
+	pointsWriter, err := newPointsWriter(collectorCfg.Storage)
 	if err != nil {
 		panic(err)
 	}
 
-	dbWriter := db.NewInfluxDbWriter(serverUrl, org, bucket, token)
-	collector := periodic.NewCollector(apiClient, dbWriter, symbol)
-	collector.Start()
+	var storageWriter db.PointsWriter = pointsWriter
+	if collectorCfg.WalDir != "" {
+		wal, err := db.OpenWal(collectorCfg.WalDir)
+		if err != nil {
+			panic(err)
+		}
+
+		storageWriter, err = db.NewDurableWriter(pointsWriter, wal)
+		if err != nil {
+			panic(err)
+		}
+	}
+	// the points of all symbols and jobs are written in batches, in front of the wal
+	dbWriter, err := db.NewBatchWriter(storageWriter)
+	if err != nil {
+		panic(err)
+	}
+
+	options, err := collectorOptions(collectorCfg, pointsWriter)
+	if err != nil {
+		panic(err)
+	}
+
+	elector, err := newElector(collectorCfg)
+	if err != nil {
+		panic(err)
+	}
+	if elector != nil {
+		options = append(options, periodic.CollectorElectorOption(elector))
+	}
+
+	collector, err := periodic.NewCollector(apiClient, dbWriter, collectorCfg.Symbols, options...)
+	if err != nil {
+		panic(err)
+	}
+
+	scheduler := periodic.NewScheduler()
+	for _, job := range collectorCfg.Jobs {
+		jobCollector, err := newJobCollector(collectorCfg, job, apiClient, dbWriter, pointsWriter, elector)
+		if err != nil {
+			panic(err)
+		}
+		schedule, err := periodic.ParseCron(job.Schedule)
+		if err != nil {
+			panic(err)
+		}
+		err = scheduler.AddJob(job.Name, schedule, jobCollector.Collect)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	ctx, stop := lifecycle.SignalContext(context.Background())
+	defer stop()
+
+	shutdownTracing, err := tracing.Setup(ctx, "price-periodic-collector")
+	if err != nil {
+		panic(err)
+	}
+	defer shutdownTracing(context.Background())
+
+	if collectorCfg.MetricsAddr != "" {
+		go func() {
+			err := lifecycle.Serve(ctx, metrics.NewServer(collectorCfg.MetricsAddr), lifecycle.DefaultDrainTimeout)
+			if err != nil {
+				slog.Error("metrics server fail", err)
+			}
+		}()
+	}
+
+	err = run(ctx, collector, elector, collectorCfg.Schedule, scheduler)
+	if err != nil {
+		slog.Error("collector fail", err)
+	}
+
+	err = dbWriter.Close()
+	if err != nil {
+		slog.Error("close writer fail", err)
+	}
+	if closer, ok := storageWriter.(io.Closer); ok {
+		err = closer.Close()
+		if err != nil {
+			slog.Error("close writer fail", err)
+		}
+	}
+	slog.Info("stopped")
 }
 
-func envVars() (dsBaseUrl string, serverUrl string, org string, token string, bucket string, symbol string) {
-	dsBaseUrl = os.Getenv("PPC_DATASOURCE_BASEURL")
-	if dsBaseUrl == "" {
-		panic("env PPC_DATASOURCE_BASEURL is required")
+// run runs the collector on its interval, or as the collect job of the scheduler when a schedule
+// is set. The other jobs of the scheduler run next to it.
+func run(ctx context.Context, collector *periodic.Collector, elector periodic.Elector, expr string, scheduler *periodic.Scheduler) error {
+	if expr != "" {
+		schedule, err := periodic.ParseCron(expr)
+		if err != nil {
+			return err
+		}
+
+		err = scheduler.AddJob("collect", schedule, collector.Collect)
+		if err != nil {
+			return err
+		}
 	}
-	serverUrl = os.Getenv("PPC_INFLUX_SERVER_URL")
-	if serverUrl == "" {
-		panic("env PPC_INFLUX_SERVER_URL is required")
+
+	if len(scheduler.Status()) == 0 {
+		return collector.Run(ctx)
 	}
-	org = os.Getenv("PPC_INFLUX_ORG")
-	if org == "" {
-		panic("env PPC_INFLUX_ORG is required")
+	defer logJobStatus(scheduler)
+
+	if expr == "" {
+		// the collector runs the elector
+		collectorErr := make(chan error, 1)
+		go func() {
+			collectorErr <- collector.Run(ctx)
+		}()
+
+		err := scheduler.Run(ctx)
+		if runErr := <-collectorErr; err == nil {
+			err = runErr
+		}
+		return err
 	}
-	token = os.Getenv("PPC_INFLUX_TOKEN")
-	if token == "" {
-		panic("env PPC_INFLUX_TOKEN is required")
+
+	if elector != nil {
+		go func() {
+			err := elector.Run(ctx)
+			if err != nil {
+				slog.Error("elector fail", err)
+			}
+		}()
+	}
+
+	return scheduler.Run(ctx)
+}
+
+// logJobStatus logs the last run of every scheduler job, the metrics have it while running.
+func logJobStatus(scheduler *periodic.Scheduler) {
+	for _, status := range scheduler.Status() {
+		args := []any{"job", status.Name, "schedule", status.Schedule, "runs", status.Runs, "skipped", status.Skipped,
+			"last_run", status.LastRun, "last_duration", status.LastDuration}
+		if status.LastErr != nil {
+			args = append(args, "err", status.LastErr)
+		}
+		slog.Info("scheduler job status", args...)
+	}
+}
+
+// newJobCollector returns the collector of a job, it collects the price of the last complete step of
+// the job granularity. A checkpoint file is kept per job, the symbols of a job are not collected by
+// another one so the latest point in the store is its own.
+func newJobCollector(collectorCfg config.Collector, job config.CollectorJob, apiClient ds.DataSourceApiClient, dbWriter db.Writer, pointsWriter pointsWriter, elector periodic.Elector) (*periodic.Collector, error) {
+	granularity := ds.Granularity(job.Granularity)
+	if granularity == "" {
+		granularity = ds.Granularity(collectorCfg.Granularity)
+	}
+	if granularity == "" {
+		granularity = ds.Granularity1m
+	}
+
+	options := []periodic.CollectorOption{
+		periodic.CollectorIntervalOption(granularity.Duration()),
+		periodic.CollectorGranularityOption(granularity),
+	}
+	if collectorCfg.CheckpointFile != "" {
+		checkpoint, err := periodic.NewFileCheckpoint(collectorCfg.CheckpointFile + "." + job.Name)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, periodic.CollectorCheckpointOption(checkpoint))
+	} else if latestReader, ok := pointsWriter.(db.LatestReader); ok {
+		options = append(options, periodic.CollectorCheckpointOption(periodic.NewStoreCheckpoint(latestReader)))
+	}
+	if collectorCfg.BackfillMaxAge > 0 {
+		options = append(options, periodic.CollectorBackfillOption(60, time.Second, collectorCfg.BackfillMaxAge.Duration()))
+	}
+	if elector != nil {
+		options = append(options, periodic.CollectorElectorOption(elector))
+	}
+
+	return periodic.NewCollector(apiClient, dbWriter, job.Symbols, options...)
+}
+
+// newElector returns the elector of the election mode, or nil when the collector runs alone.
+func newElector(collectorCfg config.Collector) (periodic.Elector, error) {
+	switch election := collectorCfg.Election; election.Mode {
+	case "":
+		return nil, nil
+	case "file":
+		return periodic.NewFileLockElector(election.LockFile), nil
+	case "lease":
+		database, err := sql.Open("postgres", collectorCfg.Storage.Postgres.Dsn)
+		if err != nil {
+			return nil, err
+		}
+
+		err = db.MigratePostgres(database)
+		if err != nil {
+			return nil, err
+		}
+
+		var options []periodic.LeaseElectorOption
+		if election.LeaseTtl > 0 {
+			options = append(options, periodic.LeaseElectorTtlOption(election.LeaseTtl.Duration()))
+		}
+
+		return periodic.NewLeaseElector(db.NewPostgresLeaseStore(database), "price-periodic-collector", options...)
+	default:
+		return nil, fmt.Errorf("election is not supported: %s", election.Mode)
+	}
+}
+
+func collectorOptions(collectorCfg config.Collector, pointsWriter pointsWriter) ([]periodic.CollectorOption, error) {
+	var options []periodic.CollectorOption
+
+	if collectorCfg.CheckpointFile != "" {
+		checkpoint, err := periodic.NewFileCheckpoint(collectorCfg.CheckpointFile)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, periodic.CollectorCheckpointOption(checkpoint))
+	} else if latestReader, ok := pointsWriter.(db.LatestReader); ok {
+		options = append(options, periodic.CollectorCheckpointOption(periodic.NewStoreCheckpoint(latestReader)))
+	}
+
+	if collectorCfg.Interval > 0 {
+		options = append(options, periodic.CollectorIntervalOption(collectorCfg.Interval.Duration()))
+	}
+
+	if collectorCfg.Offset > 0 {
+		options = append(options, periodic.CollectorOffsetOption(collectorCfg.Offset.Duration()))
+	}
+
+	if collectorCfg.Granularity != "" {
+		options = append(options, periodic.CollectorGranularityOption(ds.Granularity(collectorCfg.Granularity)))
+	}
+
+	if collectorCfg.Field != "" {
+		options = append(options, periodic.CollectorFieldOption(periodic.CollectorField(collectorCfg.Field)))
 	}
-	bucket = os.Getenv("PPC_INFLUX_BUCKET")
-	if bucket == "" {
-		panic("env PPC_INFLUX_BUCKET is required")
+
+	if collectorCfg.BackfillMaxAge > 0 {
+		options = append(options, periodic.CollectorBackfillOption(60, time.Second, collectorCfg.BackfillMaxAge.Duration()))
 	}
-	symbol = os.Getenv("PPC_SYMBOL")
-	if symbol == "" {
-		panic("env PPC_SYMBOL is required")
+
+	if collectorCfg.Feed.Type == "binance" {
+		var streamOptions []ds.BinanceStreamOption
+		if collectorCfg.Feed.BinanceUrl != "" {
+			streamOptions = append(streamOptions, ds.BinanceStreamBaseUrlOption(collectorCfg.Feed.BinanceUrl))
+		}
+		stream, err := ds.NewBinanceStream(streamOptions...)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, periodic.CollectorFeedOption(periodic.NewBinanceKlineFeed(stream)))
 	}
-	return
+
+	return options, nil
+}
+
+type pointsWriter interface {
+	db.Writer
+	db.PointsWriter
+}
+
+func newPointsWriter(storage config.Storage) (pointsWriter, error) {
+	switch storage.Type {
+	case "influxdb":
+		influxDb := storage.InfluxDb
+		return db.NewInfluxDbWriter(influxDb.ServerUrl, influxDb.Org, influxDb.Bucket, influxDb.Token), nil
+	case "postgres":
+		database, err := sql.Open("postgres", storage.Postgres.Dsn)
+		if err != nil {
+			return nil, err
+		}
+
+		err = db.MigratePostgres(database)
+		if err != nil {
+			return nil, err
+		}
+
+		return db.NewPostgresWriter(database), nil
+	case "local":
+		return ds.NewLocalStore(storage.Local.DataDir)
+	}
+
+	return nil, fmt.Errorf("storage is not supported: %s", storage.Type)
 }
@@ -0,0 +1,441 @@
+// Package config loads the configuration shared by all commands from a YAML or JSON file
+// and the environment, the env vars override the file.
+package config
+
+import (
+	"bytes"
+	"cti/lifecycle"
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config has one section per command, a command only reads and validates its own sections.
+type Config struct {
+	// path of the loaded file, empty without file
+	path string
+
+	Log       Log                `yaml:"log" env:"LOG_"`
+	Binance   BinanceDataSource  `yaml:"binance" env:"BINANCE_"`
+	InfluxDb  InfluxDbDataSource `yaml:"influxdb" env:"IDB_"`
+	Postgres  PostgresDataSource `yaml:"postgres" env:"PG_"`
+	Local     LocalDataSource    `yaml:"local" env:"LOCAL_"`
+	Gateway   Gateway            `yaml:"gateway" env:"GW_"`
+	Collector Collector          `yaml:"collector" env:"PPC_"`
+	Backfill  Backfill           `yaml:"backfill" env:"BF_"`
+}
+
+type Log struct {
+	Level  string `yaml:"level" env:"LEVEL"`
+	Format string `yaml:"format" env:"FORMAT"`
+}
+
+type Server struct {
+	ListenAddr   string    `yaml:"listen_addr" env:"LISTEN_ADDR"`
+	DrainTimeout Duration  `yaml:"drain_timeout" env:"DRAIN_TIMEOUT"`
+	Tls          ServerTls `yaml:"tls" env:"TLS_"`
+}
+
+// DataSourceServer is the server of a datasource, which serves the gRPC API too when GrpcListenAddr is set.
+type DataSourceServer struct {
+	Server `yaml:",inline"`
+	// GrpcListenAddr uses the tls of the HTTP server.
+	GrpcListenAddr string `yaml:"grpc_listen_addr" env:"GRPC_LISTEN_ADDR"`
+}
+
+// ServerTls enables HTTPS when the files are set, the certificate is reloaded when they are rotated.
+type ServerTls struct {
+	CertFile string `yaml:"cert_file" env:"CERT_FILE"`
+	KeyFile  string `yaml:"key_file" env:"KEY_FILE"`
+	// ClientCaFile requires the clients to present a certificate signed by one of its CAs.
+	ClientCaFile string `yaml:"client_ca_file" env:"CLIENT_CA_FILE"`
+}
+
+func (tls ServerTls) Enabled() bool {
+	return tls.CertFile != "" || tls.KeyFile != ""
+}
+
+// ClientTls configures the https requests to the datasources.
+type ClientTls struct {
+	// CaFile is the CA bundle trusted instead of the system CAs.
+	CaFile string `yaml:"ca_file" env:"CA_FILE"`
+	// CertFile and KeyFile are the client certificate presented to servers requiring one.
+	CertFile string `yaml:"cert_file" env:"CERT_FILE"`
+	KeyFile  string `yaml:"key_file" env:"KEY_FILE"`
+}
+
+func (tls ClientTls) Enabled() bool {
+	return tls.CaFile != "" || tls.CertFile != "" || tls.KeyFile != ""
+}
+
+type InfluxDb struct {
+	ServerUrl string `yaml:"server_url" env:"SERVER_URL"`
+	Org       string `yaml:"org" env:"ORG"`
+	Token     string `yaml:"token" env:"TOKEN" secret:"true"`
+	Bucket    string `yaml:"bucket" env:"BUCKET"`
+}
+
+type Postgres struct {
+	Dsn string `yaml:"dsn" env:"DSN" secret:"true"`
+}
+
+type Local struct {
+	DataDir string `yaml:"data_dir" env:"DATA_DIR"`
+}
+
+type BinanceDataSource struct {
+	DataSourceServer `yaml:",inline"`
+	BaseUrl          string `yaml:"base_url" env:"BASEURL"`
+}
+
+type InfluxDbDataSource struct {
+	DataSourceServer `yaml:",inline"`
+	InfluxDb         `yaml:",inline"`
+}
+
+type PostgresDataSource struct {
+	DataSourceServer `yaml:",inline"`
+	Postgres         `yaml:",inline"`
+}
+
+type LocalDataSource struct {
+	DataSourceServer `yaml:",inline"`
+	Local            `yaml:",inline"`
+}
+
+type Gateway struct {
+	Server             `yaml:",inline"`
+	Symbol             string      `yaml:"symbol" env:"SYMBOL"`
+	PriceDataSources   DataSources `yaml:"price_datasources" env:"PRICE_DATASOURCE"`
+	AverageDataSources DataSources `yaml:"average_datasources" env:"AVERAGE_DATASOURCE"`
+	// ReloadInterval is how often the config file is checked for changed datasources, 0 disables it.
+	ReloadInterval Duration `yaml:"reload_interval" env:"RELOAD_INTERVAL"`
+	// StreamGranularity is the step of the prices of /api/v1/stream.
+	StreamGranularity string `yaml:"stream_granularity" env:"STREAM_GRANULARITY"`
+	Admin             Admin  `yaml:"admin" env:"ADMIN_"`
+	Auth              Auth   `yaml:"auth" env:"AUTH_"`
+	// UpstreamTls applies to the https and grpcs datasources.
+	UpstreamTls ClientTls `yaml:"upstream_tls" env:"UPSTREAM_TLS_"`
+}
+
+// Admin configures the admin API of the gateway, it is disabled without a token.
+type Admin struct {
+	Token string `yaml:"token" env:"TOKEN" secret:"true"`
+	// Persist writes the upstreams changed by the admin API back to the config file.
+	Persist bool `yaml:"persist" env:"PERSIST"`
+}
+
+// Auth configures the API keys of the gateway, every API request needs a key when any key or a keys file is set.
+type Auth struct {
+	Keys []ApiKey `yaml:"keys"`
+	// KeysFile is a YAML or JSON list of keys, added to Keys.
+	KeysFile string `yaml:"keys_file" env:"KEYS_FILE"`
+}
+
+// Enabled reports whether the API requests need a key.
+func (auth Auth) Enabled() bool {
+	return len(auth.Keys) > 0 || auth.KeysFile != ""
+}
+
+// LoadKeys returns Keys and the keys of KeysFile.
+func (auth Auth) LoadKeys() ([]ApiKey, error) {
+	keys := append([]ApiKey(nil), auth.Keys...)
+	if auth.KeysFile == "" {
+		return keys, nil
+	}
+
+	content, err := os.ReadFile(auth.KeysFile)
+	if err != nil {
+		return nil, err
+	}
+	var fileKeys []ApiKey
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(&fileKeys); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", auth.KeysFile, err)
+	}
+
+	keys = append(keys, fileKeys...)
+	if problems := validateApiKeys("gateway.auth", keys); len(problems) > 0 {
+		return nil, invalid(problems)
+	}
+	return keys, nil
+}
+
+// ApiKey is a key of the gateway API, only the hash of the key is stored.
+type ApiKey struct {
+	Name string `yaml:"name"`
+	// Hash is the hex encoded SHA-256 of the key, e.g. the output of `printf %s <key> | sha256sum`.
+	Hash string `yaml:"hash"`
+	// Rate is the sustained requests per second, unlimited when zero.
+	Rate float64 `yaml:"rate,omitempty"`
+	// Burst is the number of requests above Rate allowed at once, at least 1 and Rate by default.
+	Burst int `yaml:"burst,omitempty"`
+	// DailyQuota is the number of requests per UTC day, unlimited when zero.
+	DailyQuota int `yaml:"daily_quota,omitempty"`
+}
+
+// DataSource is an upstream datasource of the gateway.
+type DataSource struct {
+	Id  string `yaml:"id"`
+	Url string `yaml:"url"`
+	// Timeout of one request, the client default when zero.
+	Timeout Duration `yaml:"timeout,omitempty"`
+	// Weight orders the upstreams, the higher weights are tried first and equal weights keep their order.
+	Weight int `yaml:"weight,omitempty"`
+	// Symbols served by the upstream, all when empty.
+	Symbols []string `yaml:"symbols,omitempty"`
+	// Disabled upstreams get no requests, e.g. during a maintenance.
+	Disabled bool `yaml:"disabled,omitempty"`
+}
+
+// Serves reports whether the datasource serves symbol.
+func (dataSource DataSource) Serves(symbol string) bool {
+	if len(dataSource.Symbols) == 0 {
+		return true
+	}
+	for _, s := range dataSource.Symbols {
+		if s == symbol {
+			return true
+		}
+	}
+	return false
+}
+
+type DataSources []DataSource
+
+// UnmarshalEnv parses the `id:url,id:url` list of the env vars.
+func (dataSources *DataSources) UnmarshalEnv(value string) error {
+	var result DataSources
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		v := strings.SplitN(item, ":", 2)
+		if len(v) != 2 {
+			return fmt.Errorf("expect id:url, got %q", item)
+		}
+		result = append(result, DataSource{Id: v[0], Url: v[1]})
+	}
+
+	*dataSources = result
+	return nil
+}
+
+type Storage struct {
+	Type     string   `yaml:"type" env:"STORAGE"`
+	InfluxDb InfluxDb `yaml:"influxdb" env:"INFLUX_"`
+	Postgres Postgres `yaml:"postgres" env:"POSTGRES_"`
+	Local    Local    `yaml:"local" env:"LOCAL_"`
+}
+
+// Election runs the collector on the leader of its replicas only. The lease mode keeps the lease in
+// the postgres storage of the collector.
+type Election struct {
+	Mode     string   `yaml:"mode" env:"ELECTION"`
+	LockFile string   `yaml:"lock_file" env:"ELECTION_LOCK_FILE"`
+	LeaseTtl Duration `yaml:"lease_ttl" env:"ELECTION_LEASE_TTL"`
+}
+
+type Collector struct {
+	DataSourceUrl  string    `yaml:"datasource_url" env:"DATASOURCE_BASEURL"`
+	DataSourceTls  ClientTls `yaml:"datasource_tls" env:"DATASOURCE_TLS_"`
+	Symbols        []string  `yaml:"symbols" env:"SYMBOL"`
+	Storage        Storage   `yaml:"storage"`
+	WalDir         string    `yaml:"wal_dir" env:"WAL_DIR"`
+	CheckpointFile string    `yaml:"checkpoint_file" env:"CHECKPOINT_FILE"`
+	Interval       Duration  `yaml:"interval" env:"INTERVAL"`
+	Offset         Duration  `yaml:"offset" env:"OFFSET"`
+	Granularity    string    `yaml:"granularity" env:"GRANULARITY"`
+	Field          string    `yaml:"field" env:"FIELD"`
+	Schedule       string    `yaml:"schedule" env:"SCHEDULE"`
+	BackfillMaxAge Duration  `yaml:"backfill_max_age" env:"BACKFILL_MAX_AGE"`
+	MetricsAddr    string    `yaml:"metrics_addr" env:"METRICS_ADDR"`
+	Election       Election  `yaml:"election"`
+	Feed           Feed      `yaml:"feed" env:"FEED_"`
+	// Jobs run on their own schedules next to the collection above, they are read from the file only.
+	Jobs []CollectorJob `yaml:"jobs"`
+}
+
+// CollectorJob collects the price of the last complete step of its granularity on its schedule,
+// e.g. a daily-close snapshot with @daily and 1d. Its symbols are not collected by the collector or
+// another job, the granularity defaults to the one of the collector.
+type CollectorJob struct {
+	Name        string   `yaml:"name"`
+	Schedule    string   `yaml:"schedule"`
+	Symbols     []string `yaml:"symbols"`
+	Granularity string   `yaml:"granularity"`
+}
+
+// Feed replaces the polling of the collector by a push feed, the datasource still backfills the gaps.
+type Feed struct {
+	Type       string `yaml:"type" env:"TYPE"`
+	BinanceUrl string `yaml:"binance_url" env:"BINANCE_URL"`
+}
+
+type Backfill struct {
+	Storage Storage `yaml:"storage"`
+}
+
+// Duration is a time.Duration written as "1m30s" in the config file.
+type Duration time.Duration
+
+func (duration Duration) Duration() time.Duration {
+	return time.Duration(duration)
+}
+
+func (duration Duration) String() string {
+	return time.Duration(duration).String()
+}
+
+func (duration *Duration) UnmarshalYAML(value *yaml.Node) error {
+	d, err := time.ParseDuration(value.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", value.Line, err)
+	}
+	*duration = Duration(d)
+	return nil
+}
+
+func (duration Duration) MarshalYAML() (any, error) {
+	return duration.String(), nil
+}
+
+func (duration *Duration) UnmarshalEnv(value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*duration = Duration(d)
+	return nil
+}
+
+// Default returns the config used for everything neither the file nor the env sets.
+func Default() *Config {
+	server := Server{ListenAddr: ":80", DrainTimeout: Duration(lifecycle.DefaultDrainTimeout)}
+
+	return &Config{
+		Log:       Log{Level: "info", Format: "json"},
+		Binance:   BinanceDataSource{DataSourceServer: DataSourceServer{Server: server}},
+		InfluxDb:  InfluxDbDataSource{DataSourceServer: DataSourceServer{Server: server}},
+		Postgres:  PostgresDataSource{DataSourceServer: DataSourceServer{Server: server}},
+		Local:     LocalDataSource{DataSourceServer: DataSourceServer{Server: server}},
+		Gateway:   Gateway{Server: server, ReloadInterval: Duration(time.Second * 5), StreamGranularity: "1m"},
+		Collector: Collector{Storage: Storage{Type: "influxdb"}},
+		Backfill:  Backfill{Storage: Storage{Type: "influxdb"}},
+	}
+}
+
+// Load reads the config file at path on top of the defaults, path may be empty to only
+// use the env, then applies the env vars. The file and env errors are reported together.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	cfg.path = path
+	var problems []string
+
+	if path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, decode(content, cfg)...)
+	}
+
+	problems = append(problems, applyEnv(cfg, os.LookupEnv)...)
+	if len(problems) > 0 {
+		return nil, invalid(problems)
+	}
+
+	return cfg, nil
+}
+
+// decode decodes YAML, or JSON which is YAML as well, and rejects unknown keys.
+func decode(content []byte, cfg *Config) []string {
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+
+	err := decoder.Decode(cfg)
+	if err == nil || errors.Is(err, io.EOF) {
+		return nil
+	}
+
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		return typeErr.Errors
+	}
+	return []string{err.Error()}
+}
+
+// Path returns the path of the loaded config file, empty when there was none.
+func (cfg *Config) Path() string {
+	return cfg.path
+}
+
+// Print writes cfg as YAML with the secrets redacted.
+func (cfg *Config) Print(w io.Writer) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+
+	err := encoder.Encode(redact(cfg))
+	if err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// Flags are the config flags every command accepts.
+type Flags struct {
+	path        *string
+	printConfig *bool
+}
+
+// RegisterFlags registers -config, defaulting to $CTI_CONFIG, and -print-config on fs.
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	return &Flags{
+		path:        fs.String("config", os.Getenv("CTI_CONFIG"), "YAML or JSON config file, env vars override it"),
+		printConfig: fs.Bool("print-config", false, "print the effective config with the secrets redacted and exit"),
+	}
+}
+
+func (flags *Flags) Path() string {
+	return *flags.path
+}
+
+func (flags *Flags) Load() (*Config, error) {
+	return Load(*flags.path)
+}
+
+func (flags *Flags) PrintConfig() bool {
+	return *flags.printConfig
+}
+
+// MustParse registers the config flags, parses the command line and loads the config.
+// With -print-config it prints the config and exits, an invalid config exits with all
+// the problems of sections.
+func MustParse(sections ...Section) *Config {
+	flags := RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	cfg, err := flags.Load()
+	if err == nil && flags.PrintConfig() {
+		err = cfg.Print(os.Stdout)
+		if err == nil {
+			os.Exit(0)
+		}
+	}
+	if err == nil {
+		err = cfg.Validate(sections...)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	return cfg
+}
@@ -0,0 +1,302 @@
+package config
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testYaml = `
+log:
+  level: debug
+influxdb:
+  listen_addr: ":8082"
+  server_url: http://influxdb:8086
+  org: cti
+  token: secret-token
+  bucket: crypto
+gateway:
+  symbol: BTCUSD
+  drain_timeout: 3s
+  price_datasources:
+    - id: influxdb
+      url: http://influxdb-datasource
+      timeout: 2s
+    - id: binance
+      url: http://binance-datasource
+      weight: 10
+      symbols: [BTCUSD, ETHUSD]
+collector:
+  datasource_url: http://gw
+  symbols: [BTCUSD]
+  storage:
+    type: postgres
+    postgres:
+      dsn: postgres://user:password@db/crypto
+  interval: 1m
+  election:
+    mode: lease
+  jobs:
+    - name: daily-close
+      schedule: "@daily"
+      symbols: [ETHUSD]
+      granularity: 1d
+`
+
+func writeFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestLoadYaml(t *testing.T) {
+	cfg, err := Load(writeFile(t, "cti.yaml", testYaml))
+	require.NoError(t, err)
+
+	assert.Equal(t, "debug", cfg.Log.Level)
+	assert.Equal(t, "json", cfg.Log.Format)
+	assert.Equal(t, ":8082", cfg.InfluxDb.ListenAddr)
+	assert.Equal(t, "secret-token", cfg.InfluxDb.Token)
+	assert.Equal(t, ":80", cfg.Gateway.ListenAddr)
+	assert.Equal(t, 3*time.Second, cfg.Gateway.DrainTimeout.Duration())
+	assert.Equal(t, DataSources{
+		{Id: "influxdb", Url: "http://influxdb-datasource", Timeout: Duration(2 * time.Second)},
+		{Id: "binance", Url: "http://binance-datasource", Weight: 10, Symbols: []string{"BTCUSD", "ETHUSD"}},
+	}, cfg.Gateway.PriceDataSources)
+	assert.Equal(t, time.Minute, cfg.Collector.Interval.Duration())
+	assert.Equal(t, "postgres", cfg.Collector.Storage.Type)
+	assert.Equal(t, []CollectorJob{{Name: "daily-close", Schedule: "@daily", Symbols: []string{"ETHUSD"}, Granularity: "1d"}}, cfg.Collector.Jobs)
+
+	assert.NoError(t, cfg.Validate(SectionLog, SectionInfluxDb, SectionGateway, SectionCollector))
+}
+
+func TestLoadJson(t *testing.T) {
+	cfg, err := Load(writeFile(t, "cti.json", `{"local": {"data_dir": "/data", "drain_timeout": "1s"}}`))
+	require.NoError(t, err)
+	assert.Equal(t, "/data", cfg.Local.DataDir)
+	assert.Equal(t, time.Second, cfg.Local.DrainTimeout.Duration())
+}
+
+func TestLoadWithoutFile(t *testing.T) {
+	t.Setenv("LOCAL_DATA_DIR", "/data")
+	cfg, err := Load("")
+	require.NoError(t, err)
+	assert.Equal(t, "/data", cfg.Local.DataDir)
+	assert.NoError(t, cfg.Validate(SectionLocal))
+}
+
+func TestEnvOverridesFile(t *testing.T) {
+	t.Setenv("IDB_TOKEN", "env-token")
+	t.Setenv("IDB_LISTEN_ADDR", ":9000")
+	t.Setenv("GW_PRICE_DATASOURCE", "local:http://127.0.0.1:8083, binance:http://127.0.0.1:8081")
+	t.Setenv("GW_DRAIN_TIMEOUT", "5s")
+	t.Setenv("PPC_SYMBOL", "BTCUSD, ETHUSD,")
+	t.Setenv("PPC_POSTGRES_DSN", "postgres://env")
+	t.Setenv("PPC_ELECTION_LEASE_TTL", "15s")
+	t.Setenv("LOG_FORMAT", "text")
+
+	cfg, err := Load(writeFile(t, "cti.yaml", testYaml))
+	require.NoError(t, err)
+
+	assert.Equal(t, "env-token", cfg.InfluxDb.Token)
+	assert.Equal(t, ":9000", cfg.InfluxDb.ListenAddr)
+	assert.Equal(t, "cti", cfg.InfluxDb.Org)
+	assert.Equal(t, DataSources{
+		{Id: "local", Url: "http://127.0.0.1:8083"},
+		{Id: "binance", Url: "http://127.0.0.1:8081"},
+	}, cfg.Gateway.PriceDataSources)
+	assert.Equal(t, 5*time.Second, cfg.Gateway.DrainTimeout.Duration())
+	assert.Equal(t, []string{"BTCUSD", "ETHUSD"}, cfg.Collector.Symbols)
+	assert.Equal(t, "postgres://env", cfg.Collector.Storage.Postgres.Dsn)
+	assert.Equal(t, 15*time.Second, cfg.Collector.Election.LeaseTtl.Duration())
+	assert.Equal(t, "text", cfg.Log.Format)
+}
+
+func TestLoadReportsAllErrors(t *testing.T) {
+	t.Setenv("GW_DRAIN_TIMEOUT", "soon")
+	t.Setenv("GW_AVERAGE_DATASOURCE", "no-url")
+
+	_, err := Load(writeFile(t, "cti.yaml", "gateway:\n  symbl: BTCUSD\n  listen_addr: [1]\n"))
+	require.Error(t, err)
+
+	problems := Problems(err)
+	assert.Len(t, problems, 4)
+	assert.Contains(t, err.Error(), "symbl")
+	assert.Contains(t, err.Error(), "env GW_DRAIN_TIMEOUT is invalid")
+	assert.Contains(t, err.Error(), "env GW_AVERAGE_DATASOURCE is invalid")
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Default()
+	cfg.Log.Level = "trace"
+	cfg.Gateway.PriceDataSources = DataSources{
+		{Id: "a", Url: "http://a"},
+		{Id: "a", Url: "ftp://b", Timeout: Duration(-time.Second)},
+		{Url: "http://c", Weight: -1},
+	}
+	cfg.Collector.Storage.Type = "s3"
+	cfg.Collector.Field = "close"
+	cfg.Collector.Schedule = "* *"
+	cfg.Collector.Granularity = "5m"
+	cfg.Collector.Election.Mode = "file"
+	cfg.Collector.Feed = Feed{Type: "binance", BinanceUrl: "https://stream.binance.us"}
+	cfg.Collector.Jobs = []CollectorJob{
+		{Name: "collect", Schedule: "@daily", Symbols: []string{"BTCUSD"}},
+		{Schedule: "* *", Granularity: "1M"},
+		{Name: "hourly", Schedule: "@hourly", Symbols: []string{"ETHUSD", "BTCUSD"}},
+	}
+
+	err := cfg.Validate(SectionLog, SectionGateway, SectionCollector)
+	require.Error(t, err)
+	assert.Equal(t, []string{
+		`log.level must be debug, info, warn or error: "trace"`,
+		"gateway.symbol is required",
+		`gateway.price_datasources[1].id "a" is duplicated`,
+		`gateway.price_datasources[1].url is not a http(s) or grpc(s) url: "ftp://b"`,
+		"gateway.price_datasources[1].timeout must not be negative",
+		"gateway.price_datasources[2].id is required",
+		"gateway.price_datasources[2].weight must not be negative",
+		"collector.datasource_url is required",
+		"collector.symbols is required",
+		`collector.storage.type must be influxdb, postgres or local: "s3"`,
+		`collector.granularity is not supported: "5m"`,
+		`collector.field must be price or average: "close"`,
+		"collector.schedule is invalid: invalid cron expression",
+		"collector.election.lock_file is required",
+		`collector.jobs[0].name must be unique and not collect: "collect"`,
+		"collector.jobs[1].name is required",
+		"collector.jobs[1].symbols is required",
+		"collector.jobs[1].schedule is invalid: invalid cron expression",
+		`collector.jobs[1].granularity must be one of 1s, 1m, 1h, 1d: "1M"`,
+		`collector.jobs[2].symbols "BTCUSD" is collected by collector.jobs[0] already`,
+		`collector.feed.binance_url is not a ws(s) url: "https://stream.binance.us"`,
+		"collector.feed collects the price field only",
+		"collector.feed cannot be used with schedule",
+	}, Problems(err))
+
+	assert.NoError(t, Default().Validate(SectionLog))
+	assert.Error(t, Default().Validate(SectionInfluxDb))
+}
+
+func TestValidateLeaseElection(t *testing.T) {
+	cfg := Default()
+	cfg.Collector.DataSourceUrl = "http://gw"
+	cfg.Collector.Symbols = []string{"BTCUSD"}
+	cfg.Collector.Storage = Storage{Type: "local", Local: Local{DataDir: "data"}}
+	cfg.Collector.Election.Mode = "lease"
+
+	assert.Equal(t, []string{
+		`collector.election.mode lease requires storage.type postgres: "local"`,
+	}, Problems(cfg.Validate(SectionCollector)))
+
+	cfg.Collector.Storage = Storage{Type: "postgres", Postgres: Postgres{Dsn: "postgres://db/crypto"}}
+	assert.NoError(t, cfg.Validate(SectionCollector))
+}
+
+func TestValidateTls(t *testing.T) {
+	cfg := Default()
+	cfg.Binance.Tls = ServerTls{ClientCaFile: "ca.pem"}
+	cfg.Local.Tls = ServerTls{CertFile: "local.pem"}
+	cfg.Local.DataDir = "data"
+	cfg.Gateway.Symbol = "BTCUSD"
+	cfg.Gateway.PriceDataSources = DataSources{{Id: "binance", Url: "https://binance-datasource"}}
+	cfg.Gateway.Tls = ServerTls{CertFile: "gw.pem", KeyFile: "gw-key.pem", ClientCaFile: "ca.pem"}
+	cfg.Gateway.UpstreamTls = ClientTls{CaFile: "ca.pem", KeyFile: "gw-client-key.pem"}
+
+	assert.Equal(t, []string{
+		"binance.tls.client_ca_file needs cert_file and key_file",
+		"local.tls needs both cert_file and key_file",
+		"gateway.upstream_tls needs both cert_file and key_file",
+	}, Problems(cfg.Validate(SectionBinance, SectionLocal, SectionGateway)))
+}
+
+func TestValidateGrpc(t *testing.T) {
+	t.Setenv("BINANCE_GRPC_LISTEN_ADDR", ":9081")
+	cfg, err := Load("")
+	require.NoError(t, err)
+	assert.Equal(t, ":9081", cfg.Binance.GrpcListenAddr)
+	cfg.Local.DataDir = "data"
+	cfg.Local.GrpcListenAddr = cfg.Local.ListenAddr
+	cfg.Gateway.Symbol = "BTCUSD"
+	cfg.Gateway.PriceDataSources = DataSources{
+		{Id: "binance", Url: "grpc://binance-datasource:9081"},
+		{Id: "influxdb", Url: "grpcs://influxdb-datasource:9082"},
+		{Id: "local", Url: "grpc:///local"},
+	}
+
+	assert.Equal(t, []string{
+		"local.grpc_listen_addr must differ from listen_addr",
+		`gateway.price_datasources[2].url is not a http(s) or grpc(s) url: "grpc:///local"`,
+	}, Problems(cfg.Validate(SectionBinance, SectionLocal, SectionGateway)))
+}
+
+func TestPrintRedactsSecrets(t *testing.T) {
+	cfg, err := Load(writeFile(t, "cti.yaml", testYaml))
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, cfg.Print(buf))
+	assert.NotContains(t, buf.String(), "secret-token")
+	assert.NotContains(t, buf.String(), "password")
+	assert.Contains(t, buf.String(), "token: '******'")
+	assert.Contains(t, buf.String(), "drain_timeout: 3s")
+	assert.Contains(t, buf.String(), "server_url: http://influxdb:8086")
+
+	// the printed config loads again
+	_, err = Load(writeFile(t, "printed.yaml", buf.String()))
+	assert.NoError(t, err)
+	// redaction does not touch the config
+	assert.Equal(t, "secret-token", cfg.InfluxDb.Token)
+}
+
+func TestSaveDataSources(t *testing.T) {
+	path := writeFile(t, "cti.yaml", testYaml)
+
+	price := DataSources{
+		{Id: "binance", Url: "http://binance-datasource", Symbols: []string{"BTCUSD"}},
+		{Id: "influxdb", Url: "http://influxdb-datasource", Timeout: Duration(time.Second * 2), Disabled: true},
+	}
+	average := DataSources{{Id: "local", Url: "http://local-datasource"}}
+	require.NoError(t, SaveDataSources(path, price, average))
+
+	cfg, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, price, cfg.Gateway.PriceDataSources)
+	assert.Equal(t, average, cfg.Gateway.AverageDataSources)
+	assert.Equal(t, "BTCUSD", cfg.Gateway.Symbol)
+	assert.Equal(t, "debug", cfg.Log.Level)
+	assert.Equal(t, "secret-token", cfg.InfluxDb.Token)
+
+	path = writeFile(t, "empty.yaml", "")
+	require.NoError(t, SaveDataSources(path, price, nil))
+	cfg, err = Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, price, cfg.Gateway.PriceDataSources)
+	assert.Empty(t, cfg.Gateway.AverageDataSources)
+}
+
+func TestLoadApiKeys(t *testing.T) {
+	hash := "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b"
+	keysFile := writeFile(t, "keys.yaml", "- name: partner\n  hash: "+strings.ToUpper(hash)+"\n  daily_quota: 1000\n")
+	auth := Auth{Keys: []ApiKey{{Name: "internal", Hash: hash[:63] + "c", Rate: 5}}, KeysFile: keysFile}
+	assert.True(t, auth.Enabled())
+	assert.False(t, Auth{}.Enabled())
+
+	keys, err := auth.LoadKeys()
+	require.NoError(t, err)
+	assert.Equal(t, []ApiKey{auth.Keys[0], {Name: "partner", Hash: strings.ToUpper(hash), DailyQuota: 1000}}, keys)
+
+	auth.Keys = []ApiKey{{Name: "partner", Hash: hash}, {Name: "invalid", Hash: "secret", Rate: -1}}
+	_, err = auth.LoadKeys()
+	assert.Equal(t, []string{
+		`gateway.auth[1].hash must be a hex encoded SHA-256`,
+		`gateway.auth[1].rate, burst and daily_quota must not be negative`,
+		`gateway.auth[2].name "partner" is duplicated`,
+		`gateway.auth[2].hash is duplicated`,
+	}, Problems(err))
+}
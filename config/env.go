@@ -0,0 +1,109 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// envUnmarshaler is implemented by the fields with their own env format.
+type envUnmarshaler interface {
+	UnmarshalEnv(value string) error
+}
+
+const redacted = "******"
+
+// applyEnv sets every field whose env var is set. The env name of a field is the
+// concatenation of the `env` tags from the section down to the field, e.g. IDB_ + TOKEN.
+func applyEnv(cfg *Config, lookup func(string) (string, bool)) []string {
+	return applyEnvStruct(reflect.ValueOf(cfg).Elem(), "", lookup)
+}
+
+func applyEnvStruct(v reflect.Value, prefix string, lookup func(string) (string, bool)) []string {
+	var problems []string
+
+	for i := 0; i < v.NumField(); i++ {
+		if !v.Type().Field(i).IsExported() {
+			continue
+		}
+		field := v.Field(i)
+		tag, tagged := v.Type().Field(i).Tag.Lookup("env")
+
+		if u, ok := field.Addr().Interface().(envUnmarshaler); ok {
+			if !tagged {
+				continue
+			}
+			if value, ok := lookup(prefix + tag); ok {
+				if err := u.UnmarshalEnv(value); err != nil {
+					problems = append(problems, fmt.Sprintf("env %s%s is invalid: %s", prefix, tag, err))
+				}
+			}
+			continue
+		}
+
+		if field.Kind() == reflect.Struct {
+			problems = append(problems, applyEnvStruct(field, prefix+tag, lookup)...)
+			continue
+		}
+		if !tagged {
+			continue
+		}
+
+		name := prefix + tag
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("env %s is invalid: %s", name, err))
+				continue
+			}
+			field.SetInt(int64(n))
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("env %s is invalid: %s", name, err))
+				continue
+			}
+			field.SetBool(b)
+		case reflect.Slice:
+			var items []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			field.Set(reflect.ValueOf(items))
+		default:
+			panic(fmt.Sprintf("config: env %s has unsupported kind %s", name, field.Kind()))
+		}
+	}
+
+	return problems
+}
+
+// redact returns a copy of cfg with the non-empty `secret` fields replaced.
+func redact(cfg *Config) *Config {
+	c := *cfg
+	redactStruct(reflect.ValueOf(&c).Elem())
+	return &c
+}
+
+func redactStruct(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		switch {
+		case field.Kind() == reflect.Struct:
+			redactStruct(field)
+		case v.Type().Field(i).Tag.Get("secret") == "true" && field.String() != "":
+			field.SetString(redacted)
+		}
+	}
+}
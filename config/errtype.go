@@ -0,0 +1,7 @@
+package config
+
+import "cti/erro"
+
+var (
+	ErrInvalidConfig = erro.NewError("INVALID_CONFIG", "config is invalid", nil)
+)
@@ -0,0 +1,360 @@
+package config
+
+import (
+	"crypto/sha256"
+	"cti/ds"
+	"cti/erro"
+	"cti/periodic"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Section names a part of the config validated for a command.
+type Section string
+
+const (
+	SectionLog       Section = "log"
+	SectionBinance   Section = "binance"
+	SectionInfluxDb  Section = "influxdb"
+	SectionPostgres  Section = "postgres"
+	SectionLocal     Section = "local"
+	SectionGateway   Section = "gateway"
+	SectionCollector Section = "collector"
+	SectionBackfill  Section = "backfill"
+)
+
+// Validate checks the sections a command uses and reports all their problems in one error.
+func (cfg *Config) Validate(sections ...Section) error {
+	var problems []string
+	for _, section := range sections {
+		switch section {
+		case SectionLog:
+			problems = append(problems, cfg.Log.validate("log")...)
+		case SectionBinance:
+			problems = append(problems, cfg.Binance.DataSourceServer.validate("binance")...)
+			if cfg.Binance.BaseUrl != "" {
+				problems = append(problems, validateUrl("binance.base_url", cfg.Binance.BaseUrl)...)
+			}
+		case SectionInfluxDb:
+			problems = append(problems, cfg.InfluxDb.DataSourceServer.validate("influxdb")...)
+			problems = append(problems, cfg.InfluxDb.InfluxDb.validate("influxdb")...)
+		case SectionPostgres:
+			problems = append(problems, cfg.Postgres.DataSourceServer.validate("postgres")...)
+			problems = append(problems, cfg.Postgres.Postgres.validate("postgres")...)
+		case SectionLocal:
+			problems = append(problems, cfg.Local.DataSourceServer.validate("local")...)
+			problems = append(problems, cfg.Local.Local.validate("local")...)
+		case SectionGateway:
+			problems = append(problems, cfg.Gateway.validate("gateway")...)
+			if cfg.Gateway.Admin.Persist && cfg.path == "" {
+				problems = append(problems, "gateway.admin.persist needs a config file")
+			}
+		case SectionCollector:
+			problems = append(problems, cfg.Collector.validate("collector")...)
+		case SectionBackfill:
+			problems = append(problems, cfg.Backfill.Storage.validate("backfill.storage")...)
+		default:
+			problems = append(problems, fmt.Sprintf("unknown section %s", section))
+		}
+	}
+
+	if len(problems) > 0 {
+		return invalid(problems)
+	}
+	return nil
+}
+
+func invalid(problems []string) error {
+	return fmt.Errorf("%w:\n  %s", ErrInvalidConfig.WithAttrs(map[string]any{"errors": problems}), strings.Join(problems, "\n  "))
+}
+
+// Problems returns every problem of an ErrInvalidConfig error.
+func Problems(err error) []string {
+	var e *erro.Error
+	if errors.As(err, &e) && e.Code == ErrInvalidConfig.Code {
+		problems, _ := e.Attr["errors"].([]string)
+		return problems
+	}
+	return nil
+}
+
+func required(path string, value string) []string {
+	if value == "" {
+		return []string{fmt.Sprintf("%s is required", path)}
+	}
+	return nil
+}
+
+func validateUrl(path string, value string) []string {
+	if value == "" {
+		return required(path, value)
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return []string{fmt.Sprintf("%s is not a http(s) url: %q", path, value)}
+	}
+	return nil
+}
+
+// validateDataSourceUrl accepts the grpc(s) urls of the datasource gRPC API too.
+func validateDataSourceUrl(path string, value string) []string {
+	if value == "" {
+		return required(path, value)
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "grpc" && u.Scheme != "grpcs") || u.Host == "" {
+		return []string{fmt.Sprintf("%s is not a http(s) or grpc(s) url: %q", path, value)}
+	}
+	return nil
+}
+
+func (log Log) validate(path string) []string {
+	var problems []string
+	switch log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		problems = append(problems, fmt.Sprintf("%s.level must be debug, info, warn or error: %q", path, log.Level))
+	}
+	switch log.Format {
+	case "json", "text":
+	default:
+		problems = append(problems, fmt.Sprintf("%s.format must be json or text: %q", path, log.Format))
+	}
+	return problems
+}
+
+func (server Server) validate(path string) []string {
+	problems := required(path+".listen_addr", server.ListenAddr)
+	if server.DrainTimeout < 0 {
+		problems = append(problems, fmt.Sprintf("%s.drain_timeout must not be negative", path))
+	}
+	if (server.Tls.CertFile == "") != (server.Tls.KeyFile == "") {
+		problems = append(problems, fmt.Sprintf("%s.tls needs both cert_file and key_file", path))
+	}
+	if server.Tls.ClientCaFile != "" && !server.Tls.Enabled() {
+		problems = append(problems, fmt.Sprintf("%s.tls.client_ca_file needs cert_file and key_file", path))
+	}
+	return problems
+}
+
+func (server DataSourceServer) validate(path string) []string {
+	problems := server.Server.validate(path)
+	if server.GrpcListenAddr != "" && server.GrpcListenAddr == server.ListenAddr {
+		problems = append(problems, fmt.Sprintf("%s.grpc_listen_addr must differ from listen_addr", path))
+	}
+	return problems
+}
+
+func (influxDb InfluxDb) validate(path string) []string {
+	var problems []string
+	problems = append(problems, validateUrl(path+".server_url", influxDb.ServerUrl)...)
+	problems = append(problems, required(path+".org", influxDb.Org)...)
+	problems = append(problems, required(path+".token", influxDb.Token)...)
+	problems = append(problems, required(path+".bucket", influxDb.Bucket)...)
+	return problems
+}
+
+func (postgres Postgres) validate(path string) []string {
+	return required(path+".dsn", postgres.Dsn)
+}
+
+func (local Local) validate(path string) []string {
+	return required(path+".data_dir", local.DataDir)
+}
+
+func (storage Storage) validate(path string) []string {
+	switch storage.Type {
+	case "influxdb":
+		return storage.InfluxDb.validate(path + ".influxdb")
+	case "postgres":
+		return storage.Postgres.validate(path + ".postgres")
+	case "local":
+		return storage.Local.validate(path + ".local")
+	}
+	return []string{fmt.Sprintf("%s.type must be influxdb, postgres or local: %q", path, storage.Type)}
+}
+
+func (gateway Gateway) validate(path string) []string {
+	problems := gateway.Server.validate(path)
+	problems = append(problems, required(path+".symbol", gateway.Symbol)...)
+	if gateway.ReloadInterval < 0 {
+		problems = append(problems, fmt.Sprintf("%s.reload_interval must not be negative", path))
+	}
+	if ds.Granularity(gateway.StreamGranularity).Duration() == 0 {
+		problems = append(problems, fmt.Sprintf("%s.stream_granularity must be one of 1s, 1m, 1h, 1d: %q", path, gateway.StreamGranularity))
+	}
+	if len(gateway.PriceDataSources) == 0 && len(gateway.AverageDataSources) == 0 {
+		problems = append(problems, fmt.Sprintf("%s needs at least one price or average datasource", path))
+	}
+	problems = append(problems, gateway.PriceDataSources.validate(path+".price_datasources")...)
+	problems = append(problems, gateway.AverageDataSources.validate(path+".average_datasources")...)
+	problems = append(problems, validateApiKeys(path+".auth.keys", gateway.Auth.Keys)...)
+	problems = append(problems, gateway.UpstreamTls.validate(path+".upstream_tls")...)
+	return problems
+}
+
+func (tls ClientTls) validate(path string) []string {
+	if (tls.CertFile == "") != (tls.KeyFile == "") {
+		return []string{fmt.Sprintf("%s needs both cert_file and key_file", path)}
+	}
+	return nil
+}
+
+func validateApiKeys(path string, keys []ApiKey) []string {
+	var problems []string
+	names := make(map[string]bool)
+	hashes := make(map[string]bool)
+	for i, key := range keys {
+		p := fmt.Sprintf("%s[%d]", path, i)
+		problems = append(problems, required(p+".name", key.Name)...)
+		if names[key.Name] {
+			problems = append(problems, fmt.Sprintf("%s.name %q is duplicated", p, key.Name))
+		}
+		names[key.Name] = true
+
+		if hash, err := hex.DecodeString(key.Hash); err != nil || len(hash) != sha256.Size {
+			problems = append(problems, fmt.Sprintf("%s.hash must be a hex encoded SHA-256", p))
+		} else if hashes[strings.ToLower(key.Hash)] {
+			problems = append(problems, fmt.Sprintf("%s.hash is duplicated", p))
+		}
+		hashes[strings.ToLower(key.Hash)] = true
+
+		if key.Rate < 0 || key.Burst < 0 || key.DailyQuota < 0 {
+			problems = append(problems, fmt.Sprintf("%s.rate, burst and daily_quota must not be negative", p))
+		}
+	}
+	return problems
+}
+
+// Validate checks a datasource list, e.g. one changed at runtime, path names the list in the problems.
+func (dataSources DataSources) Validate(path string) error {
+	if problems := dataSources.validate(path); len(problems) > 0 {
+		return invalid(problems)
+	}
+	return nil
+}
+
+func (dataSources DataSources) validate(path string) []string {
+	var problems []string
+	ids := make(map[string]bool)
+	for i, dataSource := range dataSources {
+		p := fmt.Sprintf("%s[%d]", path, i)
+		problems = append(problems, required(p+".id", dataSource.Id)...)
+		if ids[dataSource.Id] {
+			problems = append(problems, fmt.Sprintf("%s.id %q is duplicated", p, dataSource.Id))
+		}
+		ids[dataSource.Id] = true
+		problems = append(problems, validateDataSourceUrl(p+".url", dataSource.Url)...)
+		if dataSource.Timeout < 0 {
+			problems = append(problems, fmt.Sprintf("%s.timeout must not be negative", p))
+		}
+		if dataSource.Weight < 0 {
+			problems = append(problems, fmt.Sprintf("%s.weight must not be negative", p))
+		}
+	}
+	return problems
+}
+
+func (collector Collector) validate(path string) []string {
+	problems := validateUrl(path+".datasource_url", collector.DataSourceUrl)
+	problems = append(problems, collector.DataSourceTls.validate(path+".datasource_tls")...)
+	if len(collector.Symbols) == 0 {
+		problems = append(problems, fmt.Sprintf("%s.symbols is required", path))
+	}
+	problems = append(problems, collector.Storage.validate(path+".storage")...)
+
+	if collector.Interval < 0 {
+		problems = append(problems, fmt.Sprintf("%s.interval must not be negative", path))
+	}
+	if collector.Offset < 0 {
+		problems = append(problems, fmt.Sprintf("%s.offset must not be negative", path))
+	}
+	if collector.BackfillMaxAge < 0 {
+		problems = append(problems, fmt.Sprintf("%s.backfill_max_age must not be negative", path))
+	}
+	if collector.Granularity != "" && !ds.Granularity(collector.Granularity).IsValid() {
+		problems = append(problems, fmt.Sprintf("%s.granularity is not supported: %q", path, collector.Granularity))
+	}
+	switch periodic.CollectorField(collector.Field) {
+	case "", periodic.CollectorFieldPrice, periodic.CollectorFieldAverage:
+	default:
+		problems = append(problems, fmt.Sprintf("%s.field must be price or average: %q", path, collector.Field))
+	}
+	if collector.Schedule != "" {
+		if _, err := periodic.ParseCron(collector.Schedule); err != nil {
+			problems = append(problems, fmt.Sprintf("%s.schedule is invalid: %s", path, err))
+		}
+	}
+
+	switch collector.Election.Mode {
+	case "":
+	case "file":
+		problems = append(problems, required(path+".election.lock_file", collector.Election.LockFile)...)
+	case "lease":
+		// the lease is kept in the postgres storage, the other storages have no lease
+		if collector.Storage.Type != "postgres" {
+			problems = append(problems, fmt.Sprintf("%s.election.mode lease requires storage.type postgres: %q", path, collector.Storage.Type))
+		}
+		if collector.Election.LeaseTtl < 0 {
+			problems = append(problems, fmt.Sprintf("%s.election.lease_ttl must not be negative", path))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("%s.election.mode must be file or lease: %q", path, collector.Election.Mode))
+	}
+
+	// the points of a symbol are one series without a granularity, and its latest point is the
+	// checkpoint of the store, so every symbol is collected by one job only
+	collectedBy := make(map[string]string)
+	for _, symbol := range collector.Symbols {
+		collectedBy[symbol] = path + ".symbols"
+	}
+	names := make(map[string]bool)
+	for i, job := range collector.Jobs {
+		p := fmt.Sprintf("%s.jobs[%d]", path, i)
+		problems = append(problems, required(p+".name", job.Name)...)
+		if job.Name == "collect" || names[job.Name] {
+			problems = append(problems, fmt.Sprintf("%s.name must be unique and not collect: %q", p, job.Name))
+		}
+		names[job.Name] = true
+		if len(job.Symbols) == 0 {
+			problems = append(problems, fmt.Sprintf("%s.symbols is required", p))
+		}
+		for _, symbol := range job.Symbols {
+			if owner, ok := collectedBy[symbol]; ok {
+				problems = append(problems, fmt.Sprintf("%s.symbols %q is collected by %s already", p, symbol, owner))
+				continue
+			}
+			collectedBy[symbol] = p
+		}
+		if _, err := periodic.ParseCron(job.Schedule); err != nil {
+			problems = append(problems, fmt.Sprintf("%s.schedule is invalid: %s", p, err))
+		}
+		if job.Granularity != "" && ds.Granularity(job.Granularity).Duration() == 0 {
+			problems = append(problems, fmt.Sprintf("%s.granularity must be one of 1s, 1m, 1h, 1d: %q", p, job.Granularity))
+		}
+	}
+
+	switch collector.Feed.Type {
+	case "":
+	case "binance":
+		if collector.Feed.BinanceUrl != "" {
+			u, err := url.Parse(collector.Feed.BinanceUrl)
+			if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+				problems = append(problems, fmt.Sprintf("%s.feed.binance_url is not a ws(s) url: %q", path, collector.Feed.BinanceUrl))
+			}
+		}
+		if collector.Field != "" && periodic.CollectorField(collector.Field) != periodic.CollectorFieldPrice {
+			problems = append(problems, fmt.Sprintf("%s.feed collects the price field only", path))
+		}
+		if collector.Schedule != "" {
+			problems = append(problems, fmt.Sprintf("%s.feed cannot be used with schedule", path))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("%s.feed.type must be binance: %q", path, collector.Feed.Type))
+	}
+
+	return problems
+}
@@ -0,0 +1,39 @@
+package config
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cti.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("log:\n  level: info\n"), 0644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := int32(0)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Watch(ctx, path, time.Millisecond*10, func() { atomic.AddInt32(&changes, 1) })
+	}()
+
+	time.Sleep(time.Millisecond * 50)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&changes))
+
+	require.NoError(t, os.WriteFile(path, []byte("log:\n  level: debug\n"), 0644))
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&changes) == 1 }, time.Second, time.Millisecond*10)
+
+	// a missing file is not a change
+	require.NoError(t, os.Remove(path))
+	time.Sleep(time.Millisecond * 50)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&changes))
+
+	cancel()
+	<-done
+}
@@ -0,0 +1,230 @@
+package db
+
+import (
+	"fmt"
+	"golang.org/x/exp/slog"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBatchSize     = 500
+	defaultFlushInterval = time.Second * 5
+	defaultMaxRetries    = 3
+	defaultRetryBackoff  = time.Millisecond * 500
+	maxRetryBackoff      = time.Second * 30
+)
+
+type BatchErrorHandler func(points []Point, err error)
+
+type BatchWriter struct {
+	writer        PointsWriter
+	batchSize     int
+	flushInterval time.Duration
+	maxRetries    int
+	retryBackoff  time.Duration
+	errorHandler  BatchErrorHandler
+
+	mu     sync.Mutex
+	buffer []Point
+	closed bool
+	// err is the error of the batches dropped since the last Flush
+	err     error
+	flushMu sync.Mutex
+
+	flushCh   chan struct{}
+	stopCh    chan struct{}
+	doneCh    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewBatchWriter(writer PointsWriter, options ...BatchWriterOption) (*BatchWriter, error) {
+	batchWriter := &BatchWriter{
+		writer:        writer,
+		batchSize:     defaultBatchSize,
+		flushInterval: defaultFlushInterval,
+		maxRetries:    defaultMaxRetries,
+		retryBackoff:  defaultRetryBackoff,
+		errorHandler: func(points []Point, err error) {
+			slog.Error("batch writer drop points", err, "points", len(points))
+		},
+		flushCh: make(chan struct{}, 1),
+		stopCh:  make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+
+	for _, option := range options {
+		err := option(batchWriter)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	go batchWriter.loop()
+
+	return batchWriter, nil
+}
+
+func (writer *BatchWriter) WritePrice(symbol string, price float64, ts time.Time) error {
+	return writer.WritePoints([]Point{{Symbol: symbol, Price: price, Ts: ts}})
+}
+
+func (writer *BatchWriter) WritePoints(points []Point) error {
+	writer.mu.Lock()
+	if writer.closed {
+		writer.mu.Unlock()
+		return ErrWriterClosed.WithAttrs(map[string]any{"points": len(points)})
+	}
+	writer.buffer = append(writer.buffer, points...)
+	full := len(writer.buffer) >= writer.batchSize
+	writer.mu.Unlock()
+
+	if full {
+		select {
+		case writer.flushCh <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+func (writer *BatchWriter) loop() {
+	defer close(writer.doneCh)
+
+	ticker := time.NewTicker(writer.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			writer.flush()
+		case <-writer.flushCh:
+			writer.flush()
+		case <-writer.stopCh:
+			return
+		}
+	}
+}
+
+// Flush writes all buffered points, in batches of the configured size. It returns the error of
+// the batches dropped since the last Flush, also by the background flushes, so every point
+// written before a Flush which returns nil is stored.
+func (writer *BatchWriter) Flush() error {
+	writer.flush()
+
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+	err := writer.err
+	writer.err = nil
+	return err
+}
+
+// flush writes the buffered points, the batches which still fail after retries are passed to
+// the error handler and dropped.
+func (writer *BatchWriter) flush() {
+	writer.flushMu.Lock()
+	defer writer.flushMu.Unlock()
+
+	for {
+		writer.mu.Lock()
+		n := len(writer.buffer)
+		if n > writer.batchSize {
+			n = writer.batchSize
+		}
+		batch := writer.buffer[:n:n]
+		writer.buffer = writer.buffer[n:]
+		writer.mu.Unlock()
+
+		if len(batch) == 0 {
+			return
+		}
+
+		err := writer.writeWithRetry(batch)
+		if err != nil {
+			writer.errorHandler(batch, err)
+			writer.mu.Lock()
+			writer.err = err
+			writer.mu.Unlock()
+		}
+	}
+}
+
+func (writer *BatchWriter) writeWithRetry(points []Point) error {
+	backoff := writer.retryBackoff
+
+	var err error
+	for attempt := 0; attempt <= writer.maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > maxRetryBackoff {
+				backoff = maxRetryBackoff
+			}
+		}
+
+		err = writer.writer.WritePoints(points)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s", ErrBatchWriteFailed.WithAttrs(map[string]any{"points": len(points), "attempts": writer.maxRetries + 1}), err)
+}
+
+// Close stops the background flushing and writes out whatever is still buffered.
+func (writer *BatchWriter) Close() error {
+	var err error
+	writer.closeOnce.Do(func() {
+		writer.mu.Lock()
+		writer.closed = true
+		writer.mu.Unlock()
+
+		close(writer.stopCh)
+		<-writer.doneCh
+
+		err = writer.Flush()
+	})
+
+	return err
+}
+
+type BatchWriterOption func(*BatchWriter) error
+
+func BatchWriterBatchSizeOption(batchSize int) BatchWriterOption {
+	return func(writer *BatchWriter) error {
+		if batchSize <= 0 {
+			return fmt.Errorf("batch size must be positive: %d", batchSize)
+		}
+		writer.batchSize = batchSize
+		return nil
+	}
+}
+
+func BatchWriterFlushIntervalOption(interval time.Duration) BatchWriterOption {
+	return func(writer *BatchWriter) error {
+		if interval <= 0 {
+			return fmt.Errorf("flush interval must be positive: %s", interval)
+		}
+		writer.flushInterval = interval
+		return nil
+	}
+}
+
+func BatchWriterRetryOption(maxRetries int, backoff time.Duration) BatchWriterOption {
+	return func(writer *BatchWriter) error {
+		if maxRetries < 0 {
+			return fmt.Errorf("max retries must not be negative: %d", maxRetries)
+		}
+		writer.maxRetries = maxRetries
+		writer.retryBackoff = backoff
+		return nil
+	}
+}
+
+func BatchWriterErrorHandlerOption(handler BatchErrorHandler) BatchWriterOption {
+	return func(writer *BatchWriter) error {
+		writer.errorHandler = handler
+		return nil
+	}
+}
@@ -0,0 +1,160 @@
+package db
+
+import (
+	"cti/erro"
+	"errors"
+	"github.com/stretchr/testify/suite"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakePointsWriter struct {
+	mu       sync.Mutex
+	batches  [][]Point
+	failures int
+	calls    int
+}
+
+func (writer *fakePointsWriter) WritePoints(points []Point) error {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+
+	writer.calls++
+	if writer.failures > 0 {
+		writer.failures--
+		return errors.New("write failed")
+	}
+
+	writer.batches = append(writer.batches, append([]Point(nil), points...))
+	return nil
+}
+
+func (writer *fakePointsWriter) written() []Point {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+
+	var points []Point
+	for _, batch := range writer.batches {
+		points = append(points, batch...)
+	}
+	return points
+}
+
+type BatchWriterTestSuite struct {
+	writer *fakePointsWriter
+	now    time.Time
+	suite.Suite
+}
+
+func (suite *BatchWriterTestSuite) SetupTest() {
+	suite.writer = &fakePointsWriter{}
+	suite.now = time.Now().Truncate(time.Minute)
+}
+
+func (suite *BatchWriterTestSuite) TestFlushOnBatchSize() {
+	batchWriter, err := NewBatchWriter(suite.writer, BatchWriterBatchSizeOption(2), BatchWriterFlushIntervalOption(time.Hour))
+	suite.Nil(err)
+	defer batchWriter.Close()
+
+	suite.Nil(batchWriter.WritePrice("BTCUSD", 1, suite.now))
+	suite.Nil(batchWriter.WritePrice("ETHUSD", 2, suite.now))
+
+	suite.Eventually(func() bool { return len(suite.writer.written()) == 2 }, time.Second, time.Millisecond*10)
+}
+
+func (suite *BatchWriterTestSuite) TestFlushOnInterval() {
+	batchWriter, err := NewBatchWriter(suite.writer, BatchWriterFlushIntervalOption(time.Millisecond*20))
+	suite.Nil(err)
+	defer batchWriter.Close()
+
+	suite.Nil(batchWriter.WritePrice("BTCUSD", 1, suite.now))
+
+	suite.Eventually(func() bool { return len(suite.writer.written()) == 1 }, time.Second, time.Millisecond*10)
+}
+
+func (suite *BatchWriterTestSuite) TestRetry() {
+	suite.writer.failures = 2
+	batchWriter, err := NewBatchWriter(suite.writer, BatchWriterRetryOption(2, time.Millisecond), BatchWriterFlushIntervalOption(time.Hour))
+	suite.Nil(err)
+	defer batchWriter.Close()
+
+	suite.Nil(batchWriter.WritePrice("BTCUSD", 1, suite.now))
+	suite.Nil(batchWriter.Flush())
+	suite.Equal(3, suite.writer.calls)
+	suite.Equal([]Point{{Symbol: "BTCUSD", Price: 1, Ts: suite.now}}, suite.writer.written())
+}
+
+func (suite *BatchWriterTestSuite) TestErrorHandler() {
+	suite.writer.failures = 10
+	var failed []Point
+	handler := func(points []Point, err error) {
+		suite.NotNil(err)
+		failed = append(failed, points...)
+	}
+
+	batchWriter, err := NewBatchWriter(suite.writer,
+		BatchWriterRetryOption(1, time.Millisecond),
+		BatchWriterFlushIntervalOption(time.Hour),
+		BatchWriterErrorHandlerOption(handler))
+	suite.Nil(err)
+	defer batchWriter.Close()
+
+	suite.Nil(batchWriter.WritePrice("BTCUSD", 1, suite.now))
+	suite.NotNil(batchWriter.Flush())
+	suite.Equal(2, suite.writer.calls)
+	suite.Equal([]Point{{Symbol: "BTCUSD", Price: 1, Ts: suite.now}}, failed)
+}
+
+func (suite *BatchWriterTestSuite) TestFlushReportsBackgroundFailures() {
+	suite.writer.failures = 10
+	batchWriter, err := NewBatchWriter(suite.writer,
+		BatchWriterBatchSizeOption(1),
+		BatchWriterRetryOption(0, 0),
+		BatchWriterFlushIntervalOption(time.Hour),
+		BatchWriterErrorHandlerOption(func([]Point, error) {}))
+	suite.Nil(err)
+	defer batchWriter.Close()
+
+	// the full batch is dropped by the background flush, the next Flush reports it once
+	suite.Nil(batchWriter.WritePrice("BTCUSD", 1, suite.now))
+	suite.Eventually(func() bool {
+		suite.writer.mu.Lock()
+		defer suite.writer.mu.Unlock()
+		return suite.writer.calls == 1
+	}, time.Second, time.Millisecond*10)
+	suite.NotNil(batchWriter.Flush())
+	suite.Nil(batchWriter.Flush())
+}
+
+func (suite *BatchWriterTestSuite) TestClose() {
+	batchWriter, err := NewBatchWriter(suite.writer, BatchWriterFlushIntervalOption(time.Hour))
+	suite.Nil(err)
+
+	suite.Nil(batchWriter.WritePrice("BTCUSD", 1, suite.now))
+	suite.Nil(batchWriter.Close())
+	suite.Len(suite.writer.written(), 1)
+
+	err = batchWriter.WritePrice("BTCUSD", 1, suite.now)
+	var e *erro.Error
+	suite.ErrorAs(err, &e)
+	suite.Equal(ErrWriterClosed.Code, e.Code)
+	suite.Nil(batchWriter.Close())
+}
+
+func (suite *BatchWriterTestSuite) TestInvalidOptions() {
+	options := []BatchWriterOption{
+		BatchWriterBatchSizeOption(0),
+		BatchWriterFlushIntervalOption(0),
+		BatchWriterRetryOption(-1, 0),
+	}
+
+	for _, option := range options {
+		_, err := NewBatchWriter(suite.writer, option)
+		suite.NotNil(err)
+	}
+}
+
+func TestBatchWriterTestSuite(t *testing.T) {
+	suite.Run(t, new(BatchWriterTestSuite))
+}
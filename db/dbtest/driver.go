@@ -0,0 +1,264 @@
+// Package dbtest provides an in-memory database/sql driver which understands the
+// statements issued by the PostgreSQL storage, so it can be tested without a server.
+package dbtest
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DriverName = "dbtest"
+
+var (
+	registerOnce sync.Once
+	stores       sync.Map
+	counter      int64
+)
+
+type row struct {
+	ts    time.Time
+	price float64
+}
+
+type lease struct {
+	holder    string
+	expiresAt time.Time
+}
+
+type store struct {
+	mu         sync.Mutex
+	prices     map[string][]row
+	leases     map[string]lease
+	migrations []int
+}
+
+// Open returns a *sql.DB backed by a new, empty in-memory store.
+func Open() (*sql.DB, error) {
+	registerOnce.Do(func() { sql.Register(DriverName, &fakeDriver{}) })
+
+	name := fmt.Sprintf("dbtest-%d", atomic.AddInt64(&counter, 1))
+	stores.Store(name, &store{prices: make(map[string][]row), leases: make(map[string]lease)})
+
+	return sql.Open(DriverName, name)
+}
+
+type fakeDriver struct{}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	s, ok := stores.Load(name)
+	if !ok {
+		return nil, fmt.Errorf("dbtest: unknown database %q", name)
+	}
+
+	return &conn{store: s.(*store)}, nil
+}
+
+type conn struct {
+	store *store
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return &stmt{store: c.store, query: normalize(query)}, nil
+}
+
+func (c *conn) Close() error {
+	return nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return tx{}, nil
+}
+
+type tx struct{}
+
+func (tx) Commit() error   { return nil }
+func (tx) Rollback() error { return nil }
+
+type stmt struct {
+	store *store
+	query string
+}
+
+func (s *stmt) Close() error {
+	return nil
+}
+
+func (s *stmt) NumInput() int {
+	return -1
+}
+
+var whitespace = regexp.MustCompile(`\s+`)
+
+func normalize(query string) string {
+	return strings.TrimSpace(whitespace.ReplaceAllString(query, " "))
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	switch {
+	case strings.HasPrefix(s.query, "CREATE "), strings.HasPrefix(s.query, "DO $$"):
+		return driver.RowsAffected(0), nil
+	case strings.HasPrefix(s.query, "INSERT INTO schema_migrations"):
+		s.store.migrations = append(s.store.migrations, int(args[0].(int64)))
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(s.query, "INSERT INTO price"):
+		s.store.upsert(args[0].(string), args[1].(time.Time), args[2].(float64))
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(s.query, "DELETE FROM leases WHERE name = $1 AND holder = $2"):
+		if l, ok := s.store.leases[args[0].(string)]; ok && l.holder == args[1].(string) {
+			delete(s.store.leases, args[0].(string))
+			return driver.RowsAffected(1), nil
+		}
+		return driver.RowsAffected(0), nil
+	}
+
+	return nil, fmt.Errorf("dbtest: unsupported exec %q", s.query)
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	switch {
+	case strings.HasPrefix(s.query, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations"):
+		version := 0
+		for _, v := range s.store.migrations {
+			if v > version {
+				version = v
+			}
+		}
+		return &rows{columns: []string{"version"}, values: [][]driver.Value{{int64(version)}}}, nil
+	case strings.HasPrefix(s.query, "SELECT open FROM price WHERE symbol = $1 AND time = $2"):
+		var values [][]driver.Value
+		for _, r := range s.store.prices[args[0].(string)] {
+			if r.ts.Equal(args[1].(time.Time)) {
+				values = append(values, []driver.Value{r.price})
+			}
+		}
+		return &rows{columns: []string{"open"}, values: values}, nil
+	case strings.HasPrefix(s.query, "SELECT symbol, time, open FROM price WHERE symbol = ANY($1::text[]) AND time = ANY($2::timestamptz[])"):
+		times := make(map[time.Time]bool)
+		for _, t := range parseArray(args[1]) {
+			ts, err := time.Parse(time.RFC3339Nano, t)
+			if err != nil {
+				return nil, err
+			}
+			times[ts.UTC()] = true
+		}
+		var values [][]driver.Value
+		for _, symbol := range parseArray(args[0]) {
+			for _, r := range s.store.prices[symbol] {
+				if times[r.ts] {
+					values = append(values, []driver.Value{symbol, r.ts, r.price})
+				}
+			}
+		}
+		return &rows{columns: []string{"symbol", "time", "open"}, values: values}, nil
+	case strings.HasPrefix(s.query, "SELECT MAX(time) FROM price WHERE symbol = $1"):
+		var latest driver.Value
+		if points := s.store.prices[args[0].(string)]; len(points) > 0 {
+			latest = points[len(points)-1].ts
+		}
+		return &rows{columns: []string{"max"}, values: [][]driver.Value{{latest}}}, nil
+	case strings.HasPrefix(s.query, "SELECT AVG(open), COUNT(*) FROM price WHERE symbol = $1 AND time >= $2 AND time < $3"):
+		sum, count := 0.0, int64(0)
+		for _, r := range s.store.between(args[0].(string), args[1].(time.Time), args[2].(time.Time)) {
+			sum += r.price
+			count++
+		}
+		var avg driver.Value
+		if count > 0 {
+			avg = sum / float64(count)
+		}
+		return &rows{columns: []string{"avg", "count"}, values: [][]driver.Value{{avg, count}}}, nil
+	case strings.HasPrefix(s.query, "INSERT INTO leases"):
+		name, holder := args[0].(string), args[1].(string)
+		now := time.Now()
+		if l, ok := s.store.leases[name]; ok && l.holder != holder && !l.expiresAt.Before(now) {
+			return &rows{columns: []string{"holder"}}, nil
+		}
+		ttl := time.Duration(args[2].(int64)) * time.Millisecond
+		s.store.leases[name] = lease{holder: holder, expiresAt: now.Add(ttl)}
+		return &rows{columns: []string{"holder"}, values: [][]driver.Value{{holder}}}, nil
+	}
+
+	return nil, fmt.Errorf("dbtest: unsupported query %q", s.query)
+}
+
+// parseArray parses the text of a PostgreSQL array of values without commas or quotes, e.g. {"a","b"}.
+func parseArray(value driver.Value) []string {
+	var text string
+	switch v := value.(type) {
+	case string:
+		text = v
+	case []byte:
+		text = string(v)
+	}
+
+	text = strings.TrimSuffix(strings.TrimPrefix(text, "{"), "}")
+	if text == "" {
+		return nil
+	}
+
+	items := strings.Split(text, ",")
+	for i, item := range items {
+		items[i] = strings.Trim(item, `"`)
+	}
+	return items
+}
+
+func (s *store) upsert(symbol string, ts time.Time, price float64) {
+	ts = ts.UTC()
+	for i, r := range s.prices[symbol] {
+		if r.ts.Equal(ts) {
+			s.prices[symbol][i].price = price
+			return
+		}
+	}
+
+	s.prices[symbol] = append(s.prices[symbol], row{ts: ts, price: price})
+	sort.Slice(s.prices[symbol], func(i, j int) bool { return s.prices[symbol][i].ts.Before(s.prices[symbol][j].ts) })
+}
+
+func (s *store) between(symbol string, from time.Time, until time.Time) []row {
+	var result []row
+	for _, r := range s.prices[symbol] {
+		if !r.ts.Before(from) && r.ts.Before(until) {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+type rows struct {
+	columns []string
+	values  [][]driver.Value
+	i       int
+}
+
+func (r *rows) Columns() []string {
+	return r.columns
+}
+
+func (r *rows) Close() error {
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.i >= len(r.values) {
+		return io.EOF
+	}
+	copy(dest, r.values[r.i])
+	r.i++
+	return nil
+}
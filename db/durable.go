@@ -0,0 +1,165 @@
+package db
+
+import (
+	"fmt"
+	"golang.org/x/exp/slog"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReplayInterval  = time.Second * 10
+	defaultReplayBatchSize = 500
+)
+
+// DurableWriter writes points through to the underlying writer and spills them
+// to a write-ahead log when the write fails. Spilled points are replayed in order
+// once the underlying writer recovers; while the log is not empty, new points are
+// queued behind it so that the write order is kept.
+type DurableWriter struct {
+	writer          PointsWriter
+	wal             *Wal
+	replayInterval  time.Duration
+	replayBatchSize int
+
+	mu        sync.Mutex
+	stopCh    chan struct{}
+	doneCh    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewDurableWriter(writer PointsWriter, wal *Wal, options ...DurableWriterOption) (*DurableWriter, error) {
+	durableWriter := &DurableWriter{
+		writer:          writer,
+		wal:             wal,
+		replayInterval:  defaultReplayInterval,
+		replayBatchSize: defaultReplayBatchSize,
+		stopCh:          make(chan struct{}),
+		doneCh:          make(chan struct{}),
+	}
+
+	for _, option := range options {
+		err := option(durableWriter)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	go durableWriter.loop()
+
+	return durableWriter, nil
+}
+
+func (writer *DurableWriter) WritePrice(symbol string, price float64, ts time.Time) error {
+	return writer.WritePoints([]Point{{Symbol: symbol, Price: price, Ts: ts}})
+}
+
+func (writer *DurableWriter) WritePoints(points []Point) error {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+
+	if writer.wal.Len() == 0 {
+		err := writer.writer.WritePoints(points)
+		if err == nil {
+			return nil
+		}
+		slog.Warn("durable writer write fail, spill to wal", "points", len(points), "err", err)
+	}
+
+	err := writer.wal.Append(points)
+	if err != nil {
+		return fmt.Errorf("wal append fail: %w", err)
+	}
+
+	return nil
+}
+
+func (writer *DurableWriter) loop() {
+	defer close(writer.doneCh)
+
+	ticker := time.NewTicker(writer.replayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := writer.Replay()
+			if err != nil {
+				slog.Warn("durable writer replay fail", "pending", writer.wal.Len(), "err", err)
+			}
+		case <-writer.stopCh:
+			return
+		}
+	}
+}
+
+// Replay writes the queued points to the underlying writer, oldest first, and
+// stops at the first failure.
+func (writer *DurableWriter) Replay() error {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+
+	for {
+		points, position, err := writer.wal.Peek(writer.replayBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(points) == 0 {
+			return nil
+		}
+
+		err = writer.writer.WritePoints(points)
+		if err != nil {
+			return err
+		}
+
+		err = writer.wal.Ack(position, len(points))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Pending returns the number of points waiting in the write-ahead log.
+func (writer *DurableWriter) Pending() int {
+	return writer.wal.Len()
+}
+
+func (writer *DurableWriter) Close() error {
+	var err error
+	writer.closeOnce.Do(func() {
+		close(writer.stopCh)
+		<-writer.doneCh
+
+		err = writer.Replay()
+		if err != nil {
+			slog.Warn("durable writer points left in wal", "pending", writer.wal.Len(), "err", err)
+		}
+
+		err = writer.wal.Close()
+	})
+
+	return err
+}
+
+type DurableWriterOption func(*DurableWriter) error
+
+func DurableWriterReplayIntervalOption(interval time.Duration) DurableWriterOption {
+	return func(writer *DurableWriter) error {
+		if interval <= 0 {
+			return fmt.Errorf("replay interval must be positive: %s", interval)
+		}
+		writer.replayInterval = interval
+		return nil
+	}
+}
+
+func DurableWriterReplayBatchSizeOption(batchSize int) DurableWriterOption {
+	return func(writer *DurableWriter) error {
+		if batchSize <= 0 {
+			return fmt.Errorf("replay batch size must be positive: %d", batchSize)
+		}
+		writer.replayBatchSize = batchSize
+		return nil
+	}
+}
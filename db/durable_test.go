@@ -0,0 +1,79 @@
+package db
+
+import (
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+)
+
+type DurableWriterTestSuite struct {
+	writer *fakePointsWriter
+	wal    *Wal
+	now    time.Time
+	suite.Suite
+}
+
+func (suite *DurableWriterTestSuite) SetupTest() {
+	wal, err := OpenWal(suite.T().TempDir())
+	suite.Nil(err)
+
+	suite.wal = wal
+	suite.writer = &fakePointsWriter{}
+	suite.now = time.Now().Truncate(time.Minute)
+}
+
+func (suite *DurableWriterTestSuite) TestWriteThrough() {
+	durableWriter, err := NewDurableWriter(suite.writer, suite.wal, DurableWriterReplayIntervalOption(time.Hour))
+	suite.Nil(err)
+	defer durableWriter.Close()
+
+	suite.Nil(durableWriter.WritePrice("BTCUSD", 1, suite.now))
+	suite.Len(suite.writer.written(), 1)
+	suite.Equal(0, durableWriter.Pending())
+}
+
+func (suite *DurableWriterTestSuite) TestSpillAndReplay() {
+	suite.writer.failures = 1
+	durableWriter, err := NewDurableWriter(suite.writer, suite.wal, DurableWriterReplayIntervalOption(time.Hour))
+	suite.Nil(err)
+	defer durableWriter.Close()
+
+	suite.Nil(durableWriter.WritePrice("BTCUSD", 1, suite.now))
+	suite.Equal(1, durableWriter.Pending())
+
+	// queued behind the spilled point to keep the write order
+	suite.Nil(durableWriter.WritePrice("BTCUSD", 2, suite.now.Add(time.Minute)))
+	suite.Equal(2, durableWriter.Pending())
+	suite.Len(suite.writer.written(), 0)
+
+	suite.Nil(durableWriter.Replay())
+	suite.Equal(0, durableWriter.Pending())
+
+	written := suite.writer.written()
+	suite.Len(written, 2)
+	suite.Equal(1.0, written[0].Price)
+	suite.Equal(2.0, written[1].Price)
+}
+
+func (suite *DurableWriterTestSuite) TestReplayInBackground() {
+	suite.writer.failures = 1
+	durableWriter, err := NewDurableWriter(suite.writer, suite.wal, DurableWriterReplayIntervalOption(time.Millisecond*20))
+	suite.Nil(err)
+	defer durableWriter.Close()
+
+	suite.Nil(durableWriter.WritePrice("BTCUSD", 1, suite.now))
+	suite.Eventually(func() bool { return durableWriter.Pending() == 0 }, time.Second, time.Millisecond*10)
+	suite.Len(suite.writer.written(), 1)
+}
+
+func (suite *DurableWriterTestSuite) TestInvalidOptions() {
+	_, err := NewDurableWriter(suite.writer, suite.wal, DurableWriterReplayIntervalOption(0))
+	suite.NotNil(err)
+
+	_, err = NewDurableWriter(suite.writer, suite.wal, DurableWriterReplayBatchSizeOption(0))
+	suite.NotNil(err)
+}
+
+func TestDurableWriterTestSuite(t *testing.T) {
+	suite.Run(t, new(DurableWriterTestSuite))
+}
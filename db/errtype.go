@@ -0,0 +1,11 @@
+package db
+
+import "cti/erro"
+
+var (
+	ErrWriterClosed     = erro.NewError("WRITER_CLOSED", "writer is closed", nil)
+	ErrBatchWriteFailed = erro.NewError("BATCH_WRITE_FAILED", "batch write failed", nil)
+	ErrWalClosed        = erro.NewError("WAL_CLOSED", "write-ahead log is closed", nil)
+	ErrWalFull          = erro.NewError("WAL_FULL", "write-ahead log size limit reached", nil)
+	ErrWalCorrupted     = erro.NewError("WAL_CORRUPTED", "write-ahead log record is corrupted", nil)
+)
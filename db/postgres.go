@@ -0,0 +1,170 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// postgresMigrations are applied in order, the index+1 is the schema version.
+// The hypertable is only created when the timescaledb extension is installed,
+// plain PostgreSQL keeps a regular table.
+var postgresMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS price (
+		symbol TEXT NOT NULL,
+		time TIMESTAMPTZ NOT NULL,
+		open DOUBLE PRECISION NOT NULL,
+		PRIMARY KEY (symbol, time)
+	)`,
+	`DO $$
+	BEGIN
+		IF EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb') THEN
+			PERFORM create_hypertable('price', 'time', if_not_exists => TRUE);
+		END IF;
+	END
+	$$`,
+	`CREATE TABLE IF NOT EXISTS leases (
+		name TEXT PRIMARY KEY,
+		holder TEXT NOT NULL,
+		expires_at TIMESTAMPTZ NOT NULL
+	)`,
+}
+
+const (
+	postgresCreateMigrationTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL
+	)`
+	postgresSelectMigrationVersion = `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`
+	postgresInsertMigrationVersion = `INSERT INTO schema_migrations (version, applied_at) VALUES ($1, $2)`
+	postgresSelectLatestTime       = `SELECT MAX(time) FROM price WHERE symbol = $1`
+	postgresUpsertPrice            = `INSERT INTO price (symbol, time, open) VALUES ($1, $2, $3)
+		ON CONFLICT (symbol, time) DO UPDATE SET open = EXCLUDED.open`
+	// the expiry is computed by the database clock, so the clocks of the holders do not matter
+	postgresAcquireLease = `INSERT INTO leases (name, holder, expires_at) VALUES ($1, $2, now() + $3 * interval '1 millisecond')
+		ON CONFLICT (name) DO UPDATE SET holder = EXCLUDED.holder, expires_at = EXCLUDED.expires_at
+		WHERE leases.holder = EXCLUDED.holder OR leases.expires_at < now()
+		RETURNING holder`
+	postgresReleaseLease = `DELETE FROM leases WHERE name = $1 AND holder = $2`
+)
+
+func MigratePostgres(database *sql.DB) error {
+	_, err := database.Exec(postgresCreateMigrationTable)
+	if err != nil {
+		return fmt.Errorf("create migration table fail: %w", err)
+	}
+
+	var version int
+	err = database.QueryRow(postgresSelectMigrationVersion).Scan(&version)
+	if err != nil {
+		return fmt.Errorf("query migration version fail: %w", err)
+	}
+
+	for i := version; i < len(postgresMigrations); i++ {
+		tx, err := database.Begin()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(postgresMigrations[i])
+		if err == nil {
+			_, err = tx.Exec(postgresInsertMigrationVersion, i+1, time.Now().UTC())
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("apply migration %d fail: %w", i+1, err)
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type PostgresWriter struct {
+	db *sql.DB
+}
+
+func NewPostgresWriter(database *sql.DB) *PostgresWriter {
+	return &PostgresWriter{db: database}
+}
+
+func (writer *PostgresWriter) WritePrice(symbol string, price float64, ts time.Time) error {
+	return writer.WritePoints([]Point{{Symbol: symbol, Price: price, Ts: ts}})
+}
+
+func (writer *PostgresWriter) WritePoints(points []Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+
+	tx, err := writer.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(postgresUpsertPrice)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, point := range points {
+		_, err = stmt.Exec(point.Symbol, point.Ts.UTC(), point.Price)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (writer *PostgresWriter) LatestTime(symbol string) (time.Time, error) {
+	var latest sql.NullTime
+	err := writer.db.QueryRow(postgresSelectLatestTime, symbol).Scan(&latest)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if !latest.Valid {
+		return time.Time{}, nil
+	}
+
+	return latest.Time, nil
+}
+
+// PostgresLeaseStore keeps named leases in the leases table, a lease is held by one holder
+// until it expires or is released.
+type PostgresLeaseStore struct {
+	db *sql.DB
+}
+
+func NewPostgresLeaseStore(database *sql.DB) *PostgresLeaseStore {
+	return &PostgresLeaseStore{db: database}
+}
+
+// AcquireLease takes the lease when it is free or expired, or renews it when holder already holds it.
+// It returns whether holder holds the lease for ttl from now.
+func (store *PostgresLeaseStore) AcquireLease(name string, holder string, ttl time.Duration) (bool, error) {
+	var current string
+	err := store.db.QueryRow(postgresAcquireLease, name, holder, ttl.Milliseconds()).Scan(&current)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return current == holder, nil
+}
+
+func (store *PostgresLeaseStore) ReleaseLease(name string, holder string) error {
+	_, err := store.db.Exec(postgresReleaseLease, name, holder)
+	return err
+}
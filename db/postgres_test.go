@@ -0,0 +1,123 @@
+package db
+
+import (
+	"cti/db/dbtest"
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+)
+
+type PostgresWriterTestSuite struct {
+	writer *PostgresWriter
+	suite.Suite
+}
+
+func (suite *PostgresWriterTestSuite) SetupTest() {
+	database, err := dbtest.Open()
+	suite.Nil(err)
+	suite.Nil(MigratePostgres(database))
+
+	suite.writer = NewPostgresWriter(database)
+}
+
+func (suite *PostgresWriterTestSuite) TestMigrateTwice() {
+	suite.Nil(MigratePostgres(suite.writer.db))
+
+	var version int
+	suite.Nil(suite.writer.db.QueryRow(postgresSelectMigrationVersion).Scan(&version))
+	suite.Equal(len(postgresMigrations), version)
+}
+
+func (suite *PostgresWriterTestSuite) TestWritePrice() {
+	now := time.Now().Truncate(time.Minute)
+	suite.Nil(suite.writer.WritePrice("BTCUSD", 1, now))
+
+	// upsert on the same symbol and time
+	suite.Nil(suite.writer.WritePrice("BTCUSD", 2, now))
+
+	var price float64
+	suite.Nil(suite.writer.db.QueryRow(`SELECT open FROM price WHERE symbol = $1 AND time = $2`, "BTCUSD", now.UTC()).Scan(&price))
+	suite.Equal(2.0, price)
+}
+
+func (suite *PostgresWriterTestSuite) TestWritePoints() {
+	now := time.Now().Truncate(time.Minute)
+	suite.Nil(suite.writer.WritePoints(nil))
+	suite.Nil(suite.writer.WritePoints([]Point{
+		{Symbol: "BTCUSD", Price: 1, Ts: now},
+		{Symbol: "ETHUSD", Price: 2, Ts: now},
+	}))
+
+	var price float64
+	suite.Nil(suite.writer.db.QueryRow(`SELECT open FROM price WHERE symbol = $1 AND time = $2`, "ETHUSD", now.UTC()).Scan(&price))
+	suite.Equal(2.0, price)
+}
+
+func TestPostgresWriterTestSuite(t *testing.T) {
+	suite.Run(t, new(PostgresWriterTestSuite))
+}
+
+type PostgresLeaseStoreTestSuite struct {
+	store *PostgresLeaseStore
+	suite.Suite
+}
+
+func (suite *PostgresLeaseStoreTestSuite) SetupTest() {
+	database, err := dbtest.Open()
+	suite.Nil(err)
+	suite.Nil(MigratePostgres(database))
+
+	suite.store = NewPostgresLeaseStore(database)
+}
+
+func (suite *PostgresLeaseStoreTestSuite) TestAcquire() {
+	ok, err := suite.store.AcquireLease("collector", "a", time.Minute)
+	suite.Nil(err)
+	suite.True(ok)
+
+	// renew by the holder
+	ok, err = suite.store.AcquireLease("collector", "a", time.Minute)
+	suite.Nil(err)
+	suite.True(ok)
+
+	ok, err = suite.store.AcquireLease("collector", "b", time.Minute)
+	suite.Nil(err)
+	suite.False(ok)
+
+	// another lease name is independent
+	ok, err = suite.store.AcquireLease("backfill", "b", time.Minute)
+	suite.Nil(err)
+	suite.True(ok)
+}
+
+func (suite *PostgresLeaseStoreTestSuite) TestExpire() {
+	ok, err := suite.store.AcquireLease("collector", "a", time.Millisecond*20)
+	suite.Nil(err)
+	suite.True(ok)
+
+	time.Sleep(time.Millisecond * 30)
+	ok, err = suite.store.AcquireLease("collector", "b", time.Minute)
+	suite.Nil(err)
+	suite.True(ok)
+}
+
+func (suite *PostgresLeaseStoreTestSuite) TestRelease() {
+	ok, err := suite.store.AcquireLease("collector", "a", time.Minute)
+	suite.Nil(err)
+	suite.True(ok)
+
+	// only the holder can release
+	suite.Nil(suite.store.ReleaseLease("collector", "b"))
+	ok, err = suite.store.AcquireLease("collector", "b", time.Minute)
+	suite.Nil(err)
+	suite.False(ok)
+
+	suite.Nil(suite.store.ReleaseLease("collector", "a"))
+	ok, err = suite.store.AcquireLease("collector", "b", time.Minute)
+	suite.Nil(err)
+	suite.True(ok)
+}
+
+func TestPostgresLeaseStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(PostgresLeaseStoreTestSuite))
+}
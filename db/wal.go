@@ -0,0 +1,579 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/exp/slog"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	walSegmentExt          = ".seg"
+	walCursorFile          = "cursor"
+	walRecordHeaderSize    = 8
+	defaultWalSegmentBytes = 8 << 20
+	defaultWalMaxBytes     = 256 << 20
+)
+
+type WalFullPolicy int
+
+const (
+	// WalFullPolicyReject refuses new points once the size cap is reached.
+	WalFullPolicyReject WalFullPolicy = iota
+	// WalFullPolicyDropOldest deletes the oldest segments to make room for new points.
+	WalFullPolicyDropOldest
+)
+
+// WalPosition is an opaque read position in the queue, returned by Peek.
+type WalPosition struct {
+	segment int64
+	offset  int64
+}
+
+// Wal is an append-only, disk-backed queue of points. Every record carries a
+// crc32 checksum and every append is fsynced before it returns. The read
+// cursor is persisted so that acknowledged points are not replayed after a restart.
+type Wal struct {
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+	fullPolicy   WalFullPolicy
+
+	mu        sync.Mutex
+	segments  []int64
+	sizes     map[int64]int64
+	writeFile *os.File
+	cursor    WalPosition
+	pending   int
+}
+
+func OpenWal(dir string, options ...WalOption) (*Wal, error) {
+	wal := &Wal{
+		dir:          dir,
+		maxBytes:     defaultWalMaxBytes,
+		segmentBytes: defaultWalSegmentBytes,
+		fullPolicy:   WalFullPolicyReject,
+		sizes:        make(map[int64]int64),
+	}
+
+	for _, option := range options {
+		err := option(wal)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = wal.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return wal, nil
+}
+
+func (wal *Wal) load() error {
+	entries, err := os.ReadDir(wal.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), walSegmentExt) {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSuffix(entry.Name(), walSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		wal.segments = append(wal.segments, id)
+	}
+	sort.Slice(wal.segments, func(i, j int) bool { return wal.segments[i] < wal.segments[j] })
+
+	cursor, err := wal.readCursor()
+	if err != nil {
+		return err
+	}
+	wal.cursor = cursor
+
+	for len(wal.segments) > 1 && wal.segments[0] < wal.cursor.segment {
+		err = os.Remove(wal.segmentPath(wal.segments[0]))
+		if err != nil {
+			return err
+		}
+		wal.segments = wal.segments[1:]
+	}
+
+	for i, id := range wal.segments {
+		offset := int64(0)
+		if id == wal.cursor.segment {
+			offset = wal.cursor.offset
+		}
+
+		n, validSize, err := wal.scanSegment(id, offset, i == len(wal.segments)-1)
+		if err != nil {
+			return err
+		}
+		if id >= wal.cursor.segment {
+			wal.pending += n
+		}
+
+		info, err := os.Stat(wal.segmentPath(id))
+		if err != nil {
+			return err
+		}
+		// a torn record or an unreadable tail at the end of the last segment comes from a crash
+		// during append, cut it off so that new records are appended after the last valid one
+		if i == len(wal.segments)-1 && info.Size() > validSize && offset <= validSize {
+			slog.Warn("wal truncate segment", "segment", id, "size", info.Size(), "valid_size", validSize)
+			err = os.Truncate(wal.segmentPath(id), validSize)
+			if err != nil {
+				return err
+			}
+		}
+		wal.sizes[id] = validSize
+	}
+
+	if len(wal.segments) == 0 {
+		return wal.rotate()
+	}
+
+	last := wal.segments[len(wal.segments)-1]
+	wal.writeFile, err = os.OpenFile(wal.segmentPath(last), os.O_WRONLY|os.O_APPEND, 0o644)
+	return err
+}
+
+// scanSegment counts the records of a segment from offset. A corrupted record followed by more
+// records is skipped, validSize ends before a torn or corrupted record at the end of the segment.
+// A record whose length is corrupted cannot be skipped: in the last segment it is the tail of a
+// crashed append, e.g. zeros of a preallocated write, and validSize ends before it, a sealed
+// segment is refused.
+func (wal *Wal) scanSegment(id int64, offset int64, last bool) (records int, validSize int64, err error) {
+	f, err := os.Open(wal.segmentPath(id))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	reader := bufio.NewReader(f)
+	validSize = offset
+	for {
+		_, size, err := ReadPointRecord(reader)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return records, validSize, nil
+		}
+		if err != nil {
+			if _, peekErr := reader.Peek(1); size == 0 || peekErr != nil {
+				if size > 0 {
+					return records, validSize, nil
+				}
+				if last {
+					slog.Warn("wal drop unreadable tail", "segment", id, "offset", validSize, "err", err)
+					return records, validSize, nil
+				}
+				return records, validSize, ErrWalCorrupted.WithAttrs(map[string]any{"segment": id, "offset": validSize})
+			}
+			slog.Error("wal skip corrupted record", err, "segment", id, "offset", validSize)
+			validSize += size
+			continue
+		}
+		records++
+		validSize += size
+	}
+}
+
+// Append persists points to the end of the queue.
+func (wal *Wal) Append(points []Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+
+	var buf []byte
+	for _, point := range points {
+		buf = AppendPointRecord(buf, point)
+	}
+
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if wal.writeFile == nil {
+		return ErrWalClosed.WithAttrs(map[string]any{"points": len(points)})
+	}
+
+	err := wal.reserve(int64(len(buf)))
+	if err != nil {
+		return err
+	}
+
+	last := wal.segments[len(wal.segments)-1]
+	if wal.sizes[last] > 0 && wal.sizes[last]+int64(len(buf)) > wal.segmentBytes {
+		err = wal.rotate()
+		if err != nil {
+			return err
+		}
+		last = wal.segments[len(wal.segments)-1]
+	}
+
+	_, err = wal.writeFile.Write(buf)
+	if err != nil {
+		return err
+	}
+
+	err = wal.writeFile.Sync()
+	if err != nil {
+		return err
+	}
+
+	wal.sizes[last] += int64(len(buf))
+	wal.pending += len(points)
+
+	return nil
+}
+
+func (wal *Wal) reserve(size int64) error {
+	if size > wal.maxBytes {
+		return ErrWalFull.WithAttrs(map[string]any{"size": size, "maxBytes": wal.maxBytes})
+	}
+
+	for wal.totalBytes()+size > wal.maxBytes {
+		if wal.fullPolicy != WalFullPolicyDropOldest {
+			return ErrWalFull.WithAttrs(map[string]any{"size": wal.totalBytes(), "maxBytes": wal.maxBytes})
+		}
+
+		if len(wal.segments) == 1 {
+			err := wal.rotate()
+			if err != nil {
+				return err
+			}
+		}
+
+		oldest := wal.segments[0]
+		dropped := 0
+		if oldest >= wal.cursor.segment {
+			offset := int64(0)
+			if oldest == wal.cursor.segment {
+				offset = wal.cursor.offset
+			}
+			n, _, err := wal.scanSegment(oldest, offset, false)
+			if err != nil {
+				return err
+			}
+			dropped = n
+		}
+		slog.Warn("wal size cap reached, drop segment", "segment", oldest, "points", dropped)
+
+		err := wal.removeSegment(oldest)
+		if err != nil {
+			return err
+		}
+		wal.pending -= dropped
+
+		if wal.cursor.segment <= oldest {
+			err = wal.writeCursor(WalPosition{segment: wal.segments[0]})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (wal *Wal) totalBytes() int64 {
+	total := int64(0)
+	for _, size := range wal.sizes {
+		total += size
+	}
+	return total
+}
+
+func (wal *Wal) rotate() error {
+	next := int64(1)
+	if len(wal.segments) > 0 {
+		next = wal.segments[len(wal.segments)-1] + 1
+	}
+
+	f, err := os.OpenFile(wal.segmentPath(next), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if wal.writeFile != nil {
+		wal.writeFile.Close()
+	}
+	wal.writeFile = f
+	wal.segments = append(wal.segments, next)
+	wal.sizes[next] = 0
+
+	if len(wal.segments) == 1 && wal.cursor.segment < next {
+		return wal.writeCursor(WalPosition{segment: next})
+	}
+
+	return nil
+}
+
+func (wal *Wal) removeSegment(id int64) error {
+	err := os.Remove(wal.segmentPath(id))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	delete(wal.sizes, id)
+	for i, segment := range wal.segments {
+		if segment == id {
+			wal.segments = append(wal.segments[:i], wal.segments[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+// Peek returns up to max points from the head of the queue without removing them.
+// Pass the returned position to Ack once the points are safely written elsewhere.
+func (wal *Wal) Peek(max int) ([]Point, WalPosition, error) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	var points []Point
+	position := wal.cursor
+
+	for _, id := range wal.segments {
+		if id < position.segment {
+			continue
+		}
+		if id > position.segment {
+			position = WalPosition{segment: id}
+		}
+
+		f, err := os.Open(wal.segmentPath(id))
+		if err != nil {
+			return nil, wal.cursor, err
+		}
+
+		_, err = f.Seek(position.offset, io.SeekStart)
+		if err != nil {
+			f.Close()
+			return nil, wal.cursor, err
+		}
+
+		reader := bufio.NewReader(io.LimitReader(f, wal.sizes[id]-position.offset))
+		for len(points) < max {
+			point, size, err := ReadPointRecord(reader)
+			if err != nil && size > 0 {
+				// skipped by scanSegment when the wal was opened
+				position.offset += size
+				continue
+			}
+			if err != nil {
+				break
+			}
+			points = append(points, point)
+			position.offset += size
+		}
+		f.Close()
+
+		if len(points) >= max {
+			break
+		}
+	}
+
+	return points, position, nil
+}
+
+// Ack removes every point before position from the queue.
+func (wal *Wal) Ack(position WalPosition, n int) error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	for len(wal.segments) > 1 && wal.segments[0] < position.segment {
+		err := wal.removeSegment(wal.segments[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	err := wal.writeCursor(position)
+	if err != nil {
+		return err
+	}
+
+	wal.pending -= n
+	if wal.pending < 0 {
+		wal.pending = 0
+	}
+
+	return nil
+}
+
+// Len returns the number of points waiting in the queue.
+func (wal *Wal) Len() int {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	return wal.pending
+}
+
+func (wal *Wal) Close() error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if wal.writeFile == nil {
+		return nil
+	}
+
+	err := wal.writeFile.Close()
+	wal.writeFile = nil
+	return err
+}
+
+func (wal *Wal) segmentPath(id int64) string {
+	return filepath.Join(wal.dir, fmt.Sprintf("%016d%s", id, walSegmentExt))
+}
+
+func (wal *Wal) readCursor() (WalPosition, error) {
+	b, err := os.ReadFile(filepath.Join(wal.dir, walCursorFile))
+	if errors.Is(err, os.ErrNotExist) {
+		if len(wal.segments) > 0 {
+			return WalPosition{segment: wal.segments[0]}, nil
+		}
+		return WalPosition{}, nil
+	}
+	if err != nil {
+		return WalPosition{}, err
+	}
+
+	var position WalPosition
+	_, err = fmt.Sscanf(string(b), "%d %d", &position.segment, &position.offset)
+	if err != nil {
+		return WalPosition{}, ErrWalCorrupted.WithAttrs(map[string]any{"file": walCursorFile, "err": err.Error()})
+	}
+
+	return position, nil
+}
+
+func (wal *Wal) writeCursor(position WalPosition) error {
+	tmp := filepath.Join(wal.dir, walCursorFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(f, "%d %d", position.segment, position.offset)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, filepath.Join(wal.dir, walCursorFile))
+	if err != nil {
+		return err
+	}
+
+	wal.cursor = position
+	return nil
+}
+
+// AppendPointRecord encodes point as a checksummed record and appends it to buf.
+// The record layout is length(4) | crc32(4) | ts(8) | price(8) | symbol.
+func AppendPointRecord(buf []byte, point Point) []byte {
+	payload := make([]byte, 16+len(point.Symbol))
+	binary.BigEndian.PutUint64(payload[0:8], uint64(point.Ts.UnixNano()))
+	binary.BigEndian.PutUint64(payload[8:16], math.Float64bits(point.Price))
+	copy(payload[16:], point.Symbol)
+
+	var header [walRecordHeaderSize]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+
+	buf = append(buf, header[:]...)
+	return append(buf, payload...)
+}
+
+// ReadPointRecord decodes the next record written by AppendPointRecord and returns
+// it with its encoded size. A torn or corrupted record returns an error, with the size of the
+// record when only its checksum does not match.
+func ReadPointRecord(reader io.Reader) (Point, int64, error) {
+	var header [walRecordHeaderSize]byte
+	_, err := io.ReadFull(reader, header[:])
+	if err != nil {
+		return Point{}, 0, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length < 16 || length > 1<<16 {
+		return Point{}, 0, ErrWalCorrupted.WithAttrs(map[string]any{"length": length})
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return Point{}, 0, err
+	}
+
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return Point{}, int64(walRecordHeaderSize) + int64(length), ErrWalCorrupted.WithAttrs(map[string]any{"reason": "checksum mismatch"})
+	}
+
+	point := Point{
+		Ts:     time.Unix(0, int64(binary.BigEndian.Uint64(payload[0:8]))),
+		Price:  math.Float64frombits(binary.BigEndian.Uint64(payload[8:16])),
+		Symbol: string(payload[16:]),
+	}
+
+	return point, int64(walRecordHeaderSize) + int64(length), nil
+}
+
+type WalOption func(*Wal) error
+
+func WalMaxBytesOption(maxBytes int64) WalOption {
+	return func(wal *Wal) error {
+		if maxBytes <= 0 {
+			return fmt.Errorf("max bytes must be positive: %d", maxBytes)
+		}
+		wal.maxBytes = maxBytes
+		return nil
+	}
+}
+
+func WalSegmentBytesOption(segmentBytes int64) WalOption {
+	return func(wal *Wal) error {
+		if segmentBytes <= 0 {
+			return fmt.Errorf("segment bytes must be positive: %d", segmentBytes)
+		}
+		wal.segmentBytes = segmentBytes
+		return nil
+	}
+}
+
+func WalFullPolicyOption(policy WalFullPolicy) WalOption {
+	return func(wal *Wal) error {
+		wal.fullPolicy = policy
+		return nil
+	}
+}
@@ -0,0 +1,251 @@
+package db
+
+import (
+	"cti/erro"
+	"github.com/stretchr/testify/suite"
+	"os"
+	"testing"
+	"time"
+)
+
+type WalTestSuite struct {
+	dir    string
+	points []Point
+	suite.Suite
+}
+
+func (suite *WalTestSuite) SetupTest() {
+	suite.dir = suite.T().TempDir()
+
+	now := time.Now().Truncate(time.Minute)
+	suite.points = []Point{
+		{Symbol: "BTCUSD", Price: 1, Ts: now},
+		{Symbol: "ETHUSD", Price: 2, Ts: now},
+		{Symbol: "BTCUSD", Price: 3, Ts: now.Add(time.Minute)},
+	}
+}
+
+func (suite *WalTestSuite) assertPoints(expect []Point, actual []Point) {
+	suite.Len(actual, len(expect))
+	for i := range expect {
+		suite.Equal(expect[i].Symbol, actual[i].Symbol)
+		suite.Equal(expect[i].Price, actual[i].Price)
+		suite.True(expect[i].Ts.Equal(actual[i].Ts))
+	}
+}
+
+func (suite *WalTestSuite) TestAppendPeekAck() {
+	wal, err := OpenWal(suite.dir)
+	suite.Nil(err)
+	defer wal.Close()
+
+	suite.Nil(wal.Append(suite.points))
+	suite.Equal(3, wal.Len())
+
+	points, position, err := wal.Peek(2)
+	suite.Nil(err)
+	suite.assertPoints(suite.points[:2], points)
+
+	suite.Nil(wal.Ack(position, len(points)))
+	suite.Equal(1, wal.Len())
+
+	points, _, err = wal.Peek(10)
+	suite.Nil(err)
+	suite.assertPoints(suite.points[2:], points)
+}
+
+func (suite *WalTestSuite) TestReopen() {
+	wal, err := OpenWal(suite.dir)
+	suite.Nil(err)
+	suite.Nil(wal.Append(suite.points))
+
+	points, position, err := wal.Peek(1)
+	suite.Nil(err)
+	suite.Nil(wal.Ack(position, len(points)))
+	suite.Nil(wal.Close())
+
+	wal, err = OpenWal(suite.dir)
+	suite.Nil(err)
+	defer wal.Close()
+
+	suite.Equal(2, wal.Len())
+	points, _, err = wal.Peek(10)
+	suite.Nil(err)
+	suite.assertPoints(suite.points[1:], points)
+}
+
+func (suite *WalTestSuite) TestTornRecord() {
+	wal, err := OpenWal(suite.dir)
+	suite.Nil(err)
+	suite.Nil(wal.Append(suite.points[:2]))
+	suite.Nil(wal.Close())
+
+	// simulate a crash in the middle of an append
+	f, err := os.OpenFile(wal.segmentPath(1), os.O_WRONLY|os.O_APPEND, 0o644)
+	suite.Nil(err)
+	_, err = f.Write(AppendPointRecord(nil, suite.points[2])[:10])
+	suite.Nil(err)
+	suite.Nil(f.Close())
+
+	wal, err = OpenWal(suite.dir)
+	suite.Nil(err)
+	defer wal.Close()
+	suite.Equal(2, wal.Len())
+
+	suite.Nil(wal.Append(suite.points[2:]))
+	points, _, err := wal.Peek(10)
+	suite.Nil(err)
+	suite.assertPoints(suite.points, points)
+}
+
+func (suite *WalTestSuite) TestCorruptedRecord() {
+	wal, err := OpenWal(suite.dir)
+	suite.Nil(err)
+	suite.Nil(wal.Append(suite.points))
+	suite.Nil(wal.Close())
+
+	b, err := os.ReadFile(wal.segmentPath(1))
+	suite.Nil(err)
+	b[len(b)-1] ^= 0xff
+	suite.Nil(os.WriteFile(wal.segmentPath(1), b, 0o644))
+
+	wal, err = OpenWal(suite.dir)
+	suite.Nil(err)
+	defer wal.Close()
+
+	points, _, err := wal.Peek(10)
+	suite.Nil(err)
+	suite.assertPoints(suite.points[:2], points)
+}
+
+func (suite *WalTestSuite) TestCorruptedRecordInTheMiddle() {
+	wal, err := OpenWal(suite.dir)
+	suite.Nil(err)
+	suite.Nil(wal.Append(suite.points))
+	suite.Nil(wal.Close())
+
+	b, err := os.ReadFile(wal.segmentPath(1))
+	suite.Nil(err)
+	size := len(b)
+	// the checksum of the second record
+	b[len(AppendPointRecord(nil, suite.points[0]))+walRecordHeaderSize+1] ^= 0xff
+	suite.Nil(os.WriteFile(wal.segmentPath(1), b, 0o644))
+
+	wal, err = OpenWal(suite.dir)
+	suite.Nil(err)
+	defer wal.Close()
+	suite.Equal(2, wal.Len())
+
+	// the records after it are kept and new records are appended after them
+	suite.Nil(wal.Append(suite.points[:1]))
+	info, err := os.Stat(wal.segmentPath(1))
+	suite.Nil(err)
+	suite.Greater(info.Size(), int64(size))
+	points, position, err := wal.Peek(10)
+	suite.Nil(err)
+	suite.assertPoints([]Point{suite.points[0], suite.points[2], suite.points[0]}, points)
+	suite.Nil(wal.Ack(position, len(points)))
+	suite.Equal(0, wal.Len())
+}
+
+func (suite *WalTestSuite) TestZeroFilledTail() {
+	wal, err := OpenWal(suite.dir)
+	suite.Nil(err)
+	suite.Nil(wal.Append(suite.points[:2]))
+	suite.Nil(wal.Close())
+
+	// a crash in the middle of a preallocated write leaves zeros
+	f, err := os.OpenFile(wal.segmentPath(1), os.O_WRONLY|os.O_APPEND, 0o644)
+	suite.Nil(err)
+	_, err = f.Write(make([]byte, 64))
+	suite.Nil(err)
+	suite.Nil(f.Close())
+
+	wal, err = OpenWal(suite.dir)
+	suite.Nil(err)
+	defer wal.Close()
+	suite.Equal(2, wal.Len())
+
+	suite.Nil(wal.Append(suite.points[2:]))
+	points, _, err := wal.Peek(10)
+	suite.Nil(err)
+	suite.assertPoints(suite.points, points)
+}
+
+func (suite *WalTestSuite) TestCorruptedRecordLength() {
+	recordSize := int64(len(AppendPointRecord(nil, suite.points[0])))
+	wal, err := OpenWal(suite.dir, WalSegmentBytesOption(recordSize))
+	suite.Nil(err)
+	suite.Nil(wal.Append(suite.points[:1]))
+	suite.Nil(wal.Append(suite.points[1:2]))
+	suite.Nil(wal.Close())
+	suite.Len(wal.segments, 2)
+
+	// the last segment is cut before the unreadable length
+	b, err := os.ReadFile(wal.segmentPath(2))
+	suite.Nil(err)
+	b[0] = 0xff
+	suite.Nil(os.WriteFile(wal.segmentPath(2), b, 0o644))
+	wal, err = OpenWal(suite.dir, WalSegmentBytesOption(recordSize))
+	suite.Nil(err)
+	suite.Equal(1, wal.Len())
+	suite.Nil(wal.Close())
+
+	// the records after it in a sealed segment cannot be found, the wal is not opened instead of dropping them
+	b, err = os.ReadFile(wal.segmentPath(1))
+	suite.Nil(err)
+	b[0] = 0xff
+	suite.Nil(os.WriteFile(wal.segmentPath(1), b, 0o644))
+	_, err = OpenWal(suite.dir, WalSegmentBytesOption(recordSize))
+	var e *erro.Error
+	suite.ErrorAs(err, &e)
+	suite.Equal(ErrWalCorrupted.Code, e.Code)
+}
+
+func (suite *WalTestSuite) TestFullReject() {
+	recordSize := int64(len(AppendPointRecord(nil, suite.points[0])))
+	wal, err := OpenWal(suite.dir, WalMaxBytesOption(recordSize*2))
+	suite.Nil(err)
+	defer wal.Close()
+
+	suite.Nil(wal.Append(suite.points[:2]))
+	err = wal.Append(suite.points[2:])
+	var e *erro.Error
+	suite.ErrorAs(err, &e)
+	suite.Equal(ErrWalFull.Code, e.Code)
+	suite.Equal(2, wal.Len())
+}
+
+func (suite *WalTestSuite) TestFullDropOldest() {
+	recordSize := int64(len(AppendPointRecord(nil, suite.points[0])))
+	wal, err := OpenWal(suite.dir,
+		WalMaxBytesOption(recordSize*2),
+		WalSegmentBytesOption(recordSize),
+		WalFullPolicyOption(WalFullPolicyDropOldest))
+	suite.Nil(err)
+	defer wal.Close()
+
+	for _, point := range suite.points {
+		suite.Nil(wal.Append([]Point{point}))
+	}
+
+	suite.Equal(2, wal.Len())
+	points, _, err := wal.Peek(10)
+	suite.Nil(err)
+	suite.assertPoints(suite.points[1:], points)
+}
+
+func (suite *WalTestSuite) TestAppendAfterClose() {
+	wal, err := OpenWal(suite.dir)
+	suite.Nil(err)
+	suite.Nil(wal.Close())
+
+	err = wal.Append(suite.points)
+	var e *erro.Error
+	suite.ErrorAs(err, &e)
+	suite.Equal(ErrWalClosed.Code, e.Code)
+}
+
+func TestWalTestSuite(t *testing.T) {
+	suite.Run(t, new(WalTestSuite))
+}
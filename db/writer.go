@@ -2,7 +2,11 @@ package db
 
 import (
 	"context"
+	"fmt"
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"strings"
 	"time"
 )
 
@@ -10,32 +14,84 @@ type Writer interface {
 	WritePrice(symbol string, price float64, ts time.Time) error
 }
 
+type Point struct {
+	Symbol string
+	Price  float64
+	Ts     time.Time
+}
+
+type PointsWriter interface {
+	WritePoints(points []Point) error
+}
+
+// LatestReader returns the timestamp of the latest stored point of a symbol,
+// or the zero time when there is none.
+type LatestReader interface {
+	LatestTime(symbol string) (time.Time, error)
+}
+
 type InfluxDbWriter struct {
-	client influxdb2.Client
-	org    string
-	bucket string
+	client   influxdb2.Client
+	writeApi api.WriteAPIBlocking
+	org      string
+	bucket   string
 }
 
 func NewInfluxDbWriter(serverUrl, org, bucket, token string) *InfluxDbWriter {
+	client := influxdb2.NewClient(serverUrl, token)
+
 	return &InfluxDbWriter{
-		client: influxdb2.NewClient(serverUrl, token),
-		org:    org,
-		bucket: bucket,
+		client:   client,
+		writeApi: client.WriteAPIBlocking(org, bucket),
+		org:      org,
+		bucket:   bucket,
 	}
 }
 
 func (writer *InfluxDbWriter) WritePrice(symbol string, price float64, ts time.Time) error {
-	w := writer.client.WriteAPIBlocking(writer.org, writer.bucket)
+	return writer.WritePoints([]Point{{Symbol: symbol, Price: price, Ts: ts}})
+}
 
-	p := influxdb2.NewPoint("price",
-		map[string]string{"symbol": symbol},
-		map[string]interface{}{"open": price},
-		ts)
+func (writer *InfluxDbWriter) WritePoints(points []Point) error {
+	if len(points) == 0 {
+		return nil
+	}
 
-	err := w.WritePoint(context.Background(), p)
+	ps := make([]*write.Point, 0, len(points))
+	for _, point := range points {
+		ps = append(ps, influxdb2.NewPoint("price",
+			map[string]string{"symbol": point.Symbol},
+			map[string]interface{}{"open": point.Price},
+			point.Ts))
+	}
+
+	err := writer.writeApi.WritePoint(context.Background(), ps...)
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+func (writer *InfluxDbWriter) LatestTime(symbol string) (time.Time, error) {
+	query := fmt.Sprintf(`from(bucket: "%s")
+				|> range(start: 0)
+				|> filter(fn: (r) => r["_measurement"] == "price")
+				|> filter(fn: (r) => r["_field"] == "open")
+				|> filter(fn: (r) => r["symbol"] == "%s")
+				|> last()
+			`, strings.ReplaceAll(writer.bucket, "\"", "\\\""), strings.ReplaceAll(symbol, "\"", "\\\""))
+
+	result, err := writer.client.QueryAPI(writer.org).Query(context.Background(), query)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer result.Close()
+
+	latest := time.Time{}
+	for result.Next() {
+		latest = result.Record().Time()
+	}
+
+	return latest, result.Err()
+}
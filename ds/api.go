@@ -1,22 +1,34 @@
 package ds
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"cti/erro"
+	"cti/logging"
+	"cti/metrics"
+	"cti/tlsutil"
+	"cti/tracing"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 )
 
 const DataSourceApiServerRouteGroupV1 = "/api/v1"
 const DataSourceApiServerRoutePrice = "/price"
 const DataSourceApiServerRouteAverage = "/average"
+const DataSourceApiServerRoutePrices = "/prices"
+const DataSourceApiServerRouteSeries = "/series"
 
 type ErrorPayload struct {
 	Code string         `json:"code"`
@@ -40,19 +52,33 @@ func (err ErrorPayload) Error() string {
 	return err.Msg
 }
 
+// errorPayload returns the payload of err and adds its code to the request log line.
+func errorPayload(r *http.Request, err error) ErrorPayload {
+	payload := NewErrorPayload(err)
+	logging.AddFields(r.Context(), "error_code", payload.Code)
+	return payload
+}
+
 type DataSourceApiServer struct {
 	listenAddr string
 	dataSource DataSource
+	events     *PriceEvents
 	Router     *chi.Mux
+	httpServer *http.Server
 }
 
 func NewDataSourceApiServer(dataSource DataSource, listenAddr string) *DataSourceApiServer {
 	server := &DataSourceApiServer{dataSource: dataSource, listenAddr: listenAddr}
+	server.events, _ = NewPriceEvents(dataSource)
 
 	r := chi.NewRouter()
-	r.Use(middleware.Logger)
+	r.Use(logging.Middleware("datasource"))
+	r.Use(metrics.Middleware("datasource"))
+	r.Use(tracing.Middleware("datasource"))
 	r.Route("/api/v1", server.v1Route)
+	r.Handle(metrics.Route, metrics.Handler())
 	server.Router = r
+	server.httpServer = &http.Server{Addr: listenAddr, Handler: r}
 
 	return server
 }
@@ -60,33 +86,109 @@ func NewDataSourceApiServer(dataSource DataSource, listenAddr string) *DataSourc
 func (server *DataSourceApiServer) v1Route(r chi.Router) {
 	r.Get(DataSourceApiServerRoutePrice, server.Price)
 	r.Get(DataSourceApiServerRouteAverage, server.Average)
+	r.Get(DataSourceApiServerRouteEvents, server.Events)
+	r.Post(DataSourceApiServerRoutePrices, server.Prices)
+	r.Get(DataSourceApiServerRouteSeries, server.Series)
+}
+
+// Series returns a page of the points of a series, next_cursor of the page is passed as cursor to
+// read the next page.
+func (server *DataSourceApiServer) Series(w http.ResponseWriter, r *http.Request) {
+	logging.AddFields(r.Context(), "symbol", r.URL.Query().Get("symbol"), "granularity", r.URL.Query().Get("granularity"))
+	query, err := ParseSeriesQuery(r.URL.Query())
+	if err == nil && query.Symbol == "" {
+		err = fmt.Errorf("%w: symbol", ErrDataSourceApiServerQueryStringIsRequired.WithAttrs(map[string]any{"field": "symbol"}))
+	}
+	if err != nil {
+		render.Status(r, 400)
+		render.JSON(w, r, errorPayload(r, err))
+		return
+	}
+
+	seriesDataSource, ok := server.dataSource.(SeriesDataSource)
+	if !ok {
+		render.Status(r, 501)
+		render.JSON(w, r, errorPayload(r, &ErrSeriesNotSupported))
+		return
+	}
+
+	page, err := SeriesPage(r.Context(), seriesDataSource, query)
+	if err != nil {
+		render.Status(r, 400)
+		render.JSON(w, r, errorPayload(r, err))
+		return
+	}
+
+	render.Status(r, 200)
+	render.JSON(w, r, page)
+}
+
+// Prices answers a batch of prices in the order of the queries, a failed query has its error in
+// its result. The datasources which support it resolve the batch with a few queries to their source.
+func (server *DataSourceApiServer) Prices(w http.ResponseWriter, r *http.Request) {
+	queries, err := DecodePricesRequest(r)
+	if err != nil {
+		render.Status(r, 400)
+		render.JSON(w, r, errorPayload(r, err))
+		return
+	}
+	logging.AddFields(r.Context(), "queries", len(queries))
+
+	results, err := PricesOf(r.Context(), server.dataSource, queries)
+	if err != nil {
+		render.Status(r, 400)
+		render.JSON(w, r, errorPayload(r, err))
+		return
+	}
+
+	render.Status(r, 200)
+	render.JSON(w, r, NewPricesApiModel(queries, results))
+}
+
+// Events serves the prices of symbol as Server-Sent Events, see PriceEvents.
+func (server *DataSourceApiServer) Events(w http.ResponseWriter, r *http.Request) {
+	symbol := r.URL.Query().Get("symbol")
+	logging.AddFields(r.Context(), "symbol", symbol, "granularity", r.URL.Query().Get("granularity"))
+	if symbol == "" {
+		render.Status(r, 400)
+		render.JSON(w, r, errorPayload(r, fmt.Errorf("%w: symbol", ErrDataSourceApiServerQueryStringIsRequired.WithAttrs(map[string]interface{}{"field": "symbol"}))))
+		return
+	}
+
+	server.events.Serve(w, r, symbol)
 }
 
 func (server *DataSourceApiServer) Price(w http.ResponseWriter, r *http.Request) {
 	symbol := r.URL.Query().Get("symbol")
+	logging.AddFields(r.Context(), "symbol", symbol, "ts", r.URL.Query().Get("ts"))
 	if symbol == "" {
 		render.Status(r, 400)
-		render.JSON(w, r, NewErrorPayload(fmt.Errorf("%w: symbol", ErrDataSourceApiServerQueryStringIsRequired.WithAttrs(map[string]interface{}{"field": "symbol"}))))
+		render.JSON(w, r, errorPayload(r, fmt.Errorf("%w: symbol", ErrDataSourceApiServerQueryStringIsRequired.WithAttrs(map[string]interface{}{"field": "symbol"}))))
 		return
 	}
 	queryTs := r.URL.Query().Get("ts")
 	if queryTs == "" {
 		render.Status(r, 400)
-		render.JSON(w, r, NewErrorPayload(fmt.Errorf("%w: ts", ErrDataSourceApiServerQueryStringIsRequired.WithAttrs(map[string]interface{}{"field": "ts"}))))
+		render.JSON(w, r, errorPayload(r, fmt.Errorf("%w: ts", ErrDataSourceApiServerQueryStringIsRequired.WithAttrs(map[string]interface{}{"field": "ts"}))))
 		return
 	}
 
 	ts, err := strconv.ParseInt(queryTs, 10, 64)
 	if err != nil {
 		render.Status(r, 400)
-		render.JSON(w, r, NewErrorPayload(fmt.Errorf("convert querystring ts error: %w", err)))
+		render.JSON(w, r, errorPayload(r, fmt.Errorf("convert querystring ts error: %w", err)))
 		return
 	}
 
-	price, err := server.dataSource.Price(symbol, time.Unix(ts, 0))
+	var price float64
+	if dataSource, ok := server.dataSource.(PriceDataSourceContext); ok {
+		price, err = dataSource.PriceContext(r.Context(), symbol, time.Unix(ts, 0))
+	} else {
+		price, err = server.dataSource.Price(symbol, time.Unix(ts, 0))
+	}
 	if err != nil {
 		render.Status(r, 400)
-		render.JSON(w, r, NewErrorPayload(err))
+		render.JSON(w, r, errorPayload(r, err))
 		return
 	}
 
@@ -96,37 +198,38 @@ func (server *DataSourceApiServer) Price(w http.ResponseWriter, r *http.Request)
 
 func (server *DataSourceApiServer) Average(w http.ResponseWriter, r *http.Request) {
 	symbol := r.URL.Query().Get("symbol")
+	logging.AddFields(r.Context(), "symbol", symbol, "from", r.URL.Query().Get("from"), "until", r.URL.Query().Get("until"))
 	if symbol == "" {
 		render.Status(r, 400)
-		render.JSON(w, r, NewErrorPayload(fmt.Errorf("%w: symbol", ErrDataSourceApiServerQueryStringIsRequired.WithAttrs(map[string]any{"field": "symbol"}))))
+		render.JSON(w, r, errorPayload(r, fmt.Errorf("%w: symbol", ErrDataSourceApiServerQueryStringIsRequired.WithAttrs(map[string]any{"field": "symbol"}))))
 		return
 	}
 
 	queryFrom := r.URL.Query().Get("from")
 	if queryFrom == "" {
 		render.Status(r, 400)
-		render.JSON(w, r, NewErrorPayload(fmt.Errorf("%w: from", ErrDataSourceApiServerQueryStringIsRequired.WithAttrs(map[string]any{"field": "from"}))))
+		render.JSON(w, r, errorPayload(r, fmt.Errorf("%w: from", ErrDataSourceApiServerQueryStringIsRequired.WithAttrs(map[string]any{"field": "from"}))))
 		return
 	}
 
 	from, err := strconv.ParseInt(queryFrom, 10, 64)
 	if err != nil {
 		render.Status(r, 400)
-		render.JSON(w, r, NewErrorPayload(fmt.Errorf("%w: from", ErrDataSourceApiServerQueryStringIsInvalid.WithAttrs(map[string]any{"field": "until", "details": err}))))
+		render.JSON(w, r, errorPayload(r, fmt.Errorf("%w: from", ErrDataSourceApiServerQueryStringIsInvalid.WithAttrs(map[string]any{"field": "until", "details": err}))))
 		return
 	}
 
 	queryUntil := r.URL.Query().Get("until")
 	if queryUntil == "" {
 		render.Status(r, 400)
-		render.JSON(w, r, NewErrorPayload(fmt.Errorf("%w: until", ErrDataSourceApiServerQueryStringIsRequired.WithAttrs(map[string]any{"field": "until", "details": err}))))
+		render.JSON(w, r, errorPayload(r, fmt.Errorf("%w: until", ErrDataSourceApiServerQueryStringIsRequired.WithAttrs(map[string]any{"field": "until", "details": err}))))
 		return
 	}
 
 	until, err := strconv.ParseInt(queryUntil, 10, 64)
 	if err != nil {
 		render.Status(r, 400)
-		render.JSON(w, r, NewErrorPayload(fmt.Errorf("%w: until", ErrDataSourceApiServerQueryStringIsInvalid.WithAttrs(map[string]any{"field": "until", "details": err}))))
+		render.JSON(w, r, errorPayload(r, fmt.Errorf("%w: until", ErrDataSourceApiServerQueryStringIsInvalid.WithAttrs(map[string]any{"field": "until", "details": err}))))
 		return
 	}
 
@@ -137,14 +240,20 @@ func (server *DataSourceApiServer) Average(w http.ResponseWriter, r *http.Reques
 
 	if !granularity.IsValid() {
 		render.Status(r, 400)
-		render.JSON(w, r, NewErrorPayload(fmt.Errorf(`%w: "%s" granularity is not support`, ErrDataSourceApiServerQueryStringIsInvalid.WithAttrs(map[string]any{"field": "until"}), granularity)))
+		render.JSON(w, r, errorPayload(r, fmt.Errorf(`%w: "%s" granularity is not support`, ErrDataSourceApiServerQueryStringIsInvalid.WithAttrs(map[string]any{"field": "until"}), granularity)))
 		return
 	}
 
-	result, exactFrom, exactUntil, err := server.dataSource.Average(symbol, time.Unix(from, 0), time.Unix(until, 0), granularity)
+	var result float64
+	var exactFrom, exactUntil time.Time
+	if dataSource, ok := server.dataSource.(AverageDataSourceContext); ok {
+		result, exactFrom, exactUntil, err = dataSource.AverageContext(r.Context(), symbol, time.Unix(from, 0), time.Unix(until, 0), granularity)
+	} else {
+		result, exactFrom, exactUntil, err = server.dataSource.Average(symbol, time.Unix(from, 0), time.Unix(until, 0), granularity)
+	}
 	if err != nil {
 		render.Status(r, 400)
-		render.JSON(w, r, NewErrorPayload(fmt.Errorf("request average error: %w", err)))
+		render.JSON(w, r, errorPayload(r, fmt.Errorf("request average error: %w", err)))
 		return
 	}
 
@@ -152,13 +261,47 @@ func (server *DataSourceApiServer) Average(w http.ResponseWriter, r *http.Reques
 	render.JSON(w, r, PriceAverageApiModel{result, exactFrom.Unix(), exactUntil.Unix()})
 }
 
+// EnableTLS serves HTTPS with the certificate of certFile and keyFile, it is reloaded when the
+// files are rotated. With clientCaFile the clients need a certificate signed by one of its CAs.
+// It must be called before the server is started.
+func (server *DataSourceApiServer) EnableTLS(certFile string, keyFile string, clientCaFile string) error {
+	config, err := tlsutil.ServerConfig(certFile, keyFile, clientCaFile)
+	if err != nil {
+		return err
+	}
+	server.httpServer.TLSConfig = config
+	return nil
+}
+
+// GrpcServer returns the gRPC server of the same datasource, with the TLS config of EnableTLS.
+func (server *DataSourceApiServer) GrpcServer(listenAddr string) (*DataSourceGrpcServer, error) {
+	var options []DataSourceGrpcServerOption
+	if server.httpServer.TLSConfig != nil {
+		options = append(options, DataSourceGrpcServerTlsOption(server.httpServer.TLSConfig))
+	}
+	return NewDataSourceGrpcServer(server.dataSource, listenAddr, options...)
+}
+
 func (server *DataSourceApiServer) ListenAndServe() error {
-	return http.ListenAndServe(server.listenAddr, server.Router)
+	if server.httpServer.TLSConfig != nil {
+		return server.httpServer.ListenAndServeTLS("", "")
+	}
+	return server.httpServer.ListenAndServe()
+}
+
+// Shutdown stops accepting connections and waits for the in-flight requests until ctx is done.
+// The event streams are closed right away.
+func (server *DataSourceApiServer) Shutdown(ctx context.Context) error {
+	server.events.Close()
+	return server.httpServer.Shutdown(ctx)
 }
 
 type DefaultDataSourceApiClient struct {
 	baseUrl    string
 	httpClient *http.Client
+
+	streamOnce       sync.Once
+	streamHttpClient *http.Client
 }
 
 func NewDefaultDataSourceApiClient(baseUrl string, options ...DefaultDataSourceApiClientOption) (*DefaultDataSourceApiClient, error) {
@@ -184,6 +327,10 @@ func NewDefaultDataSourceApiClient(baseUrl string, options ...DefaultDataSourceA
 }
 
 func (client *DefaultDataSourceApiClient) Price(symbol string, ts time.Time) (PriceApiModel, error) {
+	return client.PriceContext(context.Background(), symbol, ts)
+}
+
+func (client *DefaultDataSourceApiClient) PriceContext(ctx context.Context, symbol string, ts time.Time) (PriceApiModel, error) {
 	u, err := UrlParseWithJoin(client.baseUrl, DataSourceApiServerRouteGroupV1, DataSourceApiServerRoutePrice)
 	if err != nil {
 		return PriceApiModel{}, err
@@ -194,7 +341,7 @@ func (client *DefaultDataSourceApiClient) Price(symbol string, ts time.Time) (Pr
 	query.Add("ts", strconv.Itoa(int(ts.Unix())))
 	u.RawQuery = query.Encode()
 
-	resp, err := client.httpClient.Get(u.String())
+	resp, err := client.get(ctx, "DataSourceApiClient.Price", u.String())
 	if err != nil {
 		return PriceApiModel{}, err
 	}
@@ -209,6 +356,10 @@ func (client *DefaultDataSourceApiClient) Price(symbol string, ts time.Time) (Pr
 }
 
 func (client *DefaultDataSourceApiClient) Average(symbol string, from time.Time, until time.Time, granularity Granularity) (PriceAverageApiModel, error) {
+	return client.AverageContext(context.Background(), symbol, from, until, granularity)
+}
+
+func (client *DefaultDataSourceApiClient) AverageContext(ctx context.Context, symbol string, from time.Time, until time.Time, granularity Granularity) (PriceAverageApiModel, error) {
 	u, err := UrlParseWithJoin(client.baseUrl, DataSourceApiServerRouteGroupV1, DataSourceApiServerRouteAverage)
 	if err != nil {
 		return PriceAverageApiModel{}, err
@@ -221,7 +372,7 @@ func (client *DefaultDataSourceApiClient) Average(symbol string, from time.Time,
 	query.Add("granularity", string(granularity))
 	u.RawQuery = query.Encode()
 
-	resp, err := client.httpClient.Get(u.String())
+	resp, err := client.get(ctx, "DataSourceApiClient.Average", u.String())
 	if err != nil {
 		return PriceAverageApiModel{}, err
 	}
@@ -235,6 +386,155 @@ func (client *DefaultDataSourceApiClient) Average(symbol string, from time.Time,
 	return averageApiModel, nil
 }
 
+// Prices resolves queries with POST /api/v1/prices, in requests of up to MaxPriceQueries queries.
+// The results are in the order of the queries.
+func (client *DefaultDataSourceApiClient) Prices(ctx context.Context, queries []PriceQuery) ([]PriceResult, error) {
+	u, err := UrlParseWithJoin(client.baseUrl, DataSourceApiServerRouteGroupV1, DataSourceApiServerRoutePrices)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]PriceResult, 0, len(queries))
+	for start := 0; start < len(queries); start += MaxPriceQueries {
+		end := start + MaxPriceQueries
+		if end > len(queries) {
+			end = len(queries)
+		}
+
+		request := PricesRequestApiModel{Queries: make([]PriceQueryApiModel, 0, end-start)}
+		for _, query := range queries[start:end] {
+			request.Queries = append(request.Queries, PriceQueryApiModel{Symbol: query.Symbol, Ts: query.Ts.Unix()})
+		}
+		body, err := json.Marshal(request)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := client.do(ctx, "DataSourceApiClient.Prices", http.MethodPost, u.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+
+		var pricesApiModel PricesApiModel
+		_, err = client.decodeRespPayload(resp, &pricesApiModel)
+		if err != nil {
+			return nil, err
+		}
+		if len(pricesApiModel.Results) != end-start {
+			return nil, ErrInvalidResultFormat.WithAttrs(map[string]any{"expect": end - start, "actual": len(pricesApiModel.Results)})
+		}
+
+		for _, result := range pricesApiModel.Results {
+			if result.Error != nil {
+				results = append(results, PriceResult{Err: *result.Error})
+				continue
+			}
+			results = append(results, PriceResult{Price: PriceApiModel{Price: result.Price}})
+		}
+	}
+
+	return results, nil
+}
+
+// SeriesPage reads a page of a series with GET /api/v1/series.
+func (client *DefaultDataSourceApiClient) SeriesPage(ctx context.Context, query SeriesQuery) (SeriesApiModel, error) {
+	u, err := UrlParseWithJoin(client.baseUrl, DataSourceApiServerRouteGroupV1, DataSourceApiServerRouteSeries)
+	if err != nil {
+		return SeriesApiModel{}, err
+	}
+	u.RawQuery = query.Values().Encode()
+
+	resp, err := client.get(ctx, "DataSourceApiClient.Series", u.String())
+	if err != nil {
+		return SeriesApiModel{}, err
+	}
+
+	var seriesApiModel SeriesApiModel
+	_, err = client.decodeRespPayload(resp, &seriesApiModel)
+	if err != nil {
+		return SeriesApiModel{}, err
+	}
+
+	return seriesApiModel, nil
+}
+
+// StreamPrice streams the prices of symbol from GET /api/v1/events until ctx is done or the stream ends.
+func (client *DefaultDataSourceApiClient) StreamPrice(ctx context.Context, symbol string, granularity Granularity, onTick func(PriceTick)) error {
+	u, err := UrlParseWithJoin(client.baseUrl, DataSourceApiServerRouteGroupV1, DataSourceApiServerRouteEvents)
+	if err != nil {
+		return err
+	}
+
+	query := u.Query()
+	query.Add("symbol", symbol)
+	query.Add("granularity", string(granularity))
+	u.RawQuery = query.Encode()
+
+	resp, err := client.send(ctx, client.streamClient(), "DataSourceApiClient.StreamPrice", http.MethodGet, u.String(), nil)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		_, err = client.decodeRespPayload(resp, nil)
+		return err
+	}
+
+	return readPriceEvents(ctx, resp.Body, onTick)
+}
+
+// streamClient returns the client of the event streams. It has no timeout and its own
+// connections, so the open streams do not take the connections of the requests.
+func (client *DefaultDataSourceApiClient) streamClient() *http.Client {
+	client.streamOnce.Do(func() {
+		client.streamHttpClient = &http.Client{Transport: client.httpClient.Transport}
+		if transport, ok := client.httpClient.Transport.(*http.Transport); ok {
+			streamTransport := transport.Clone()
+			streamTransport.MaxConnsPerHost = 0
+			client.streamHttpClient.Transport = streamTransport
+		}
+	})
+	return client.streamHttpClient
+}
+
+func (client *DefaultDataSourceApiClient) get(ctx context.Context, spanName string, url string) (*http.Response, error) {
+	return client.do(ctx, spanName, http.MethodGet, url, nil)
+}
+
+func (client *DefaultDataSourceApiClient) do(ctx context.Context, spanName string, method string, url string, body io.Reader) (*http.Response, error) {
+	return client.send(ctx, client.httpClient, spanName, method, url, body)
+}
+
+// send sends a request with httpClient in a client span and propagates its trace context in the W3C headers.
+func (client *DefaultDataSourceApiClient) send(ctx context.Context, httpClient *http.Client, spanName string, method string, url string, body io.Reader) (*http.Response, error) {
+	ctx, span := tracing.Tracer().Start(ctx, spanName, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("http.method", method), attribute.String("http.url", url)))
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		tracing.End(span, err)
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	tracing.Inject(ctx, req.Header)
+	if requestId := logging.RequestId(ctx); requestId != "" {
+		req.Header.Set(logging.RequestIdHeader, requestId)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err == nil {
+		span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	}
+	tracing.End(span, err)
+
+	return resp, err
+}
+
 func (client *DefaultDataSourceApiClient) decodeRespPayload(resp *http.Response, model any) ([]byte, error) {
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -272,3 +572,23 @@ func DefaultDataSourceApiClientHttpClientOption(httpClient *http.Client) Default
 		return nil
 	}
 }
+
+// DefaultDataSourceApiClientTlsOption sets the TLS config of the https requests, e.g. from tlsutil.ClientConfig.
+func DefaultDataSourceApiClientTlsOption(tlsConfig *tls.Config) DefaultDataSourceApiClientOption {
+	return func(client *DefaultDataSourceApiClient) error {
+		transport, ok := client.httpClient.Transport.(*http.Transport)
+		if !ok {
+			return fmt.Errorf("the transport of the http client is not a *http.Transport")
+		}
+		transport.TLSClientConfig = tlsConfig
+		return nil
+	}
+}
+
+// DefaultDataSourceApiClientTimeoutOption limits the time of one request, including reading the response.
+func DefaultDataSourceApiClientTimeoutOption(timeout time.Duration) DefaultDataSourceApiClientOption {
+	return func(client *DefaultDataSourceApiClient) error {
+		client.httpClient.Timeout = timeout
+		return nil
+	}
+}
@@ -1,6 +1,7 @@
 package ds
 
 import (
+	"crypto/tls"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
@@ -203,3 +204,21 @@ func TestErrorPayload(t *testing.T) {
 	err := NewErrorPayload(fmt.Errorf("testing"))
 	assert.Equal(t, err.Error(), err.Msg)
 }
+
+func TestDefaultDataSourceApiClientTlsOption(t *testing.T) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	client, err := NewDefaultDataSourceApiClient("https://127.0.0.1:8443", DefaultDataSourceApiClientTlsOption(tlsConfig))
+	assert.Nil(t, err)
+	assert.Same(t, tlsConfig, client.httpClient.Transport.(*http.Transport).TLSClientConfig)
+
+	_, err = NewDefaultDataSourceApiClient("https://127.0.0.1:8443",
+		DefaultDataSourceApiClientHttpClientOption(&http.Client{Transport: http.NewFileTransport(http.Dir("."))}),
+		DefaultDataSourceApiClientTlsOption(tlsConfig))
+	assert.Error(t, err)
+}
+
+func TestDataSourceApiServerEnableTLS(t *testing.T) {
+	server := NewDataSourceApiServer(nil, ":0")
+	assert.Error(t, server.EnableTLS("missing.pem", "missing-key.pem", ""))
+	assert.Nil(t, server.httpServer.TLSConfig)
+}
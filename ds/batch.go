@@ -0,0 +1,157 @@
+package ds
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaxPriceQueries is the most queries of one POST /api/v1/prices request.
+const MaxPriceQueries = 10000
+
+const maxPricesRequestBytes = 1 << 20
+
+const batchPriceWorkers = 8
+
+// PricesOf resolves queries in one batch when dataSource is a BatchPriceDataSource,
+// with a bounded number of concurrent prices otherwise.
+func PricesOf(ctx context.Context, dataSource PriceDataSource, queries []PriceQuery) ([]PriceResult, error) {
+	if batch, ok := dataSource.(BatchPriceDataSource); ok {
+		return batch.Prices(ctx, queries)
+	}
+
+	return eachPrice(ctx, queries, func(query PriceQuery) PriceResult {
+		var price float64
+		var err error
+		if c, ok := dataSource.(PriceDataSourceContext); ok {
+			price, err = c.PriceContext(ctx, query.Symbol, query.Ts)
+		} else {
+			price, err = dataSource.Price(query.Symbol, query.Ts)
+		}
+		return PriceResult{Price: PriceApiModel{Price: price}, Err: err}
+	}), nil
+}
+
+// PricesWithContext calls Prices when api supports it, PriceWithContext for every query otherwise.
+func PricesWithContext(ctx context.Context, api PriceDataSourceApi, queries []PriceQuery) ([]PriceResult, error) {
+	if batch, ok := api.(BatchPriceDataSource); ok {
+		return batch.Prices(ctx, queries)
+	}
+
+	return eachPrice(ctx, queries, func(query PriceQuery) PriceResult {
+		price, err := PriceWithContext(ctx, api, query.Symbol, query.Ts)
+		return PriceResult{Price: price, Err: err}
+	}), nil
+}
+
+func eachPrice(ctx context.Context, queries []PriceQuery, price func(PriceQuery) PriceResult) []PriceResult {
+	results := make([]PriceResult, len(queries))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < batchPriceWorkers && i < len(queries); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				if err := ctx.Err(); err != nil {
+					results[index] = PriceResult{Err: err}
+					continue
+				}
+				results[index] = price(queries[index])
+			}
+		}()
+	}
+
+	for i := range queries {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return results
+}
+
+// DecodePricesRequest reads the queries of a POST /api/v1/prices request.
+func DecodePricesRequest(r *http.Request) ([]PriceQuery, error) {
+	var request PricesRequestApiModel
+	err := json.NewDecoder(io.LimitReader(r.Body, maxPricesRequestBytes)).Decode(&request)
+	if err != nil {
+		return nil, ErrInvalidRequestBody.WithAttrs(map[string]any{"reason": err.Error()})
+	}
+	if len(request.Queries) == 0 {
+		return nil, ErrInvalidRequestBody.WithAttrs(map[string]any{"reason": "queries is required"})
+	}
+	if len(request.Queries) > MaxPriceQueries {
+		return nil, ErrInvalidRequestBody.WithAttrs(map[string]any{"reason": "too many queries", "max": MaxPriceQueries})
+	}
+
+	queries := make([]PriceQuery, len(request.Queries))
+	for i, query := range request.Queries {
+		queries[i] = PriceQuery{Symbol: query.Symbol, Ts: time.Unix(query.Ts, 0)}
+	}
+	return queries, nil
+}
+
+// NewPricesApiModel answers every query with its result.
+func NewPricesApiModel(queries []PriceQuery, results []PriceResult) PricesApiModel {
+	model := PricesApiModel{Results: make([]PriceResultApiModel, len(queries))}
+	for i, query := range queries {
+		model.Results[i] = PriceResultApiModel{Symbol: query.Symbol, Ts: query.Ts.Unix()}
+		if err := results[i].Err; err != nil {
+			payload := NewErrorPayload(err)
+			model.Results[i].Error = &payload
+			continue
+		}
+		model.Results[i].Price = results[i].Price.Price
+	}
+	return model
+}
+
+// priceKey identifies a price of a batch by its symbol and unix time in milliseconds.
+type priceKey struct {
+	symbol string
+	ts     int64
+}
+
+// batchPriceResults answers queries from prices and the errors of the failed queries,
+// a query without either gets ErrNoData.
+func batchPriceResults(queries []PriceQuery, prices map[priceKey]float64, errs map[priceKey]error) []PriceResult {
+	results := make([]PriceResult, len(queries))
+	for i, query := range queries {
+		key := priceKey{query.Symbol, query.Ts.UnixMilli()}
+		if err, ok := errs[key]; ok {
+			results[i] = PriceResult{Err: err}
+			continue
+		}
+		price, ok := prices[key]
+		if !ok {
+			results[i] = PriceResult{Err: &ErrNoData}
+			continue
+		}
+		results[i] = PriceResult{Price: PriceApiModel{Price: price}}
+	}
+	return results
+}
+
+// timesBySymbol returns the distinct times of the queries of every symbol, in ascending order.
+func timesBySymbol(queries []PriceQuery) map[string][]time.Time {
+	seen := make(map[priceKey]bool)
+	bySymbol := make(map[string][]time.Time)
+	for _, query := range queries {
+		key := priceKey{query.Symbol, query.Ts.UnixMilli()}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		bySymbol[query.Symbol] = append(bySymbol[query.Symbol], query.Ts)
+	}
+
+	for _, times := range bySymbol {
+		sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	}
+	return bySymbol
+}
@@ -0,0 +1,64 @@
+package ds
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// batchTestDataSource answers the batches like grpcTestDataSource and counts them.
+type batchTestDataSource struct {
+	grpcTestDataSource
+	batches int
+}
+
+func (dataSource *batchTestDataSource) Prices(ctx context.Context, queries []PriceQuery) ([]PriceResult, error) {
+	dataSource.batches++
+	return PricesOf(ctx, &dataSource.grpcTestDataSource, queries)
+}
+
+func TestPrices(t *testing.T) {
+	batchDataSource := &batchTestDataSource{grpcTestDataSource: grpcTestDataSource{requestIds: make(chan string, 1)}}
+	queries := []PriceQuery{
+		{Symbol: "BTCUSD", Ts: time.Unix(100, 0)},
+		{Symbol: "ETHUSD", Ts: time.Unix(200, 0)},
+		{Symbol: "BTCUSD", Ts: time.Unix(300, 0)},
+	}
+
+	for _, dataSource := range []DataSource{batchDataSource, &batchDataSource.grpcTestDataSource} {
+		server := httptest.NewServer(NewDataSourceApiServer(dataSource, ":0").Router)
+		client, err := NewDefaultDataSourceApiClient(server.URL)
+		require.NoError(t, err)
+
+		results, err := client.Prices(context.Background(), queries)
+		require.NoError(t, err)
+		require.Len(t, results, 3)
+		assert.Equal(t, PriceResult{Price: PriceApiModel{Price: 100}}, results[0])
+		assert.True(t, IsErrorCode(results[1].Err, ErrNoData.Code))
+		assert.Equal(t, PriceResult{Price: PriceApiModel{Price: 300}}, results[2])
+
+		resp, err := server.Client().Post(server.URL+"/api/v1/prices", "application/json", strings.NewReader(`{"queries":[]}`))
+		require.NoError(t, err)
+		assert.Equal(t, 400, resp.StatusCode)
+		resp.Body.Close()
+		_, err = client.Prices(context.Background(), nil)
+		assert.NoError(t, err)
+		server.Close()
+	}
+	assert.Equal(t, 1, batchDataSource.batches)
+}
+
+func TestDecodePricesRequest(t *testing.T) {
+	queries, err := DecodePricesRequest(httptest.NewRequest("POST", "/api/v1/prices", strings.NewReader(`{"queries":[{"symbol":"BTCUSD","ts":1667457091}]}`)))
+	require.NoError(t, err)
+	assert.Equal(t, []PriceQuery{{Symbol: "BTCUSD", Ts: time.Unix(1667457091, 0)}}, queries)
+
+	for i, body := range []string{`not json`, `{}`, `{"queries":[` + strings.Repeat(`{"symbol":"BTCUSD","ts":1},`, MaxPriceQueries) + `{"symbol":"BTCUSD","ts":1}]}`} {
+		_, err = DecodePricesRequest(httptest.NewRequest("POST", "/api/v1/prices", strings.NewReader(body)))
+		assert.True(t, IsErrorCode(err, ErrInvalidRequestBody.Code), i)
+	}
+}
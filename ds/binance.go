@@ -1,9 +1,14 @@
 package ds
 
 import (
+	"context"
+	"cti/metrics"
+	"cti/tracing"
 	"encoding/json"
 	"fmt"
+	"go.opentelemetry.io/otel/attribute"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -28,8 +33,12 @@ func NewBinanceDataSource(options ...BinanceApiOption) (*BinanceDataSource, erro
 }
 
 func (binanceDataSource *BinanceDataSource) Price(symbol string, t time.Time) (float64, error) {
+	return binanceDataSource.PriceContext(context.Background(), symbol, t)
+}
+
+func (binanceDataSource *BinanceDataSource) PriceContext(ctx context.Context, symbol string, t time.Time) (float64, error) {
 	ts := t.UnixMilli()
-	result, err := binanceDataSource.api.Klines(symbol, "1s", ts, 0, 1)
+	result, err := binanceDataSource.api.KlinesContext(ctx, symbol, "1s", ts, 0, 1)
 	if err != nil {
 		return 0, ErrSourceError.WithAttrs(map[string]any{"err": err})
 	}
@@ -78,7 +87,51 @@ func (binanceDataSource *BinanceDataSource) Price(symbol string, t time.Time) (f
 	return open, nil
 }
 
+// Prices reads the 1s klines of every symbol in ranges of up to 1000 seconds, one request per range
+// instead of one per price. A failed range fails its queries only.
+func (binanceDataSource *BinanceDataSource) Prices(ctx context.Context, queries []PriceQuery) ([]PriceResult, error) {
+	prices := make(map[priceKey]float64)
+	errs := make(map[priceKey]error)
+	for symbol, times := range timesBySymbol(queries) {
+		for start := 0; start < len(times); {
+			from := times[start].UnixMilli()
+			last := from + (binanceKlinesLimit-1)*time.Second.Milliseconds()
+			end := start
+			for end < len(times) && times[end].UnixMilli() <= last {
+				end++
+			}
+
+			result, err := binanceDataSource.api.KlinesContext(ctx, symbol, BinanceApiInterval1s, from, times[end-1].UnixMilli(), binanceKlinesLimit)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if err != nil {
+				err = ErrSourceError.WithAttrs(map[string]any{"err": err})
+			}
+			for i := 0; err == nil && i < len(result); i++ {
+				var ts int64
+				var open float64
+				ts, open, err = parseKlineOpen(result[i])
+				prices[priceKey{symbol, ts}] = open
+			}
+			if err != nil {
+				for _, t := range times[start:end] {
+					errs[priceKey{symbol, t.UnixMilli()}] = err
+				}
+			}
+
+			start = end
+		}
+	}
+
+	return batchPriceResults(queries, prices, errs), nil
+}
+
 func (binanceDataSource *BinanceDataSource) Average(symbol string, from time.Time, until time.Time, granularity Granularity) (average float64, actualFrom time.Time, actualUntil time.Time, err error) {
+	return binanceDataSource.AverageContext(context.Background(), symbol, from, until, granularity)
+}
+
+func (binanceDataSource *BinanceDataSource) AverageContext(ctx context.Context, symbol string, from time.Time, until time.Time, granularity Granularity) (average float64, actualFrom time.Time, actualUntil time.Time, err error) {
 	fromTs := from.UnixMilli()
 	untilTs := until.UnixMilli()
 
@@ -86,7 +139,7 @@ func (binanceDataSource *BinanceDataSource) Average(symbol string, from time.Tim
 		return 0, time.Time{}, time.Time{}, &ErrInvalidGranularity
 	}
 
-	result, err := binanceDataSource.api.Klines(symbol, BinanceApiInterval(granularity), fromTs, untilTs, 1000)
+	result, err := binanceDataSource.api.KlinesContext(ctx, symbol, BinanceApiInterval(granularity), fromTs, untilTs, 1000)
 	if err != nil {
 		return 0, time.Time{}, time.Time{}, ErrSourceError.WithAttrs(map[string]any{"err": err})
 	}
@@ -154,6 +207,80 @@ func (binanceDataSource *BinanceDataSource) Average(symbol string, from time.Tim
 	return average, time.UnixMilli(actualFromTs), time.UnixMilli(actualUntilTs), nil
 }
 
+// Candles pages through the klines of [from, until), 1000 klines per request.
+func (binanceDataSource *BinanceDataSource) Candles(symbol string, from time.Time, until time.Time, granularity Granularity) ([]Candle, error) {
+	return binanceDataSource.Series(context.Background(), symbol, from, until, granularity, math.MaxInt)
+}
+
+// Series pages through the klines of [from, until) until limit klines are read.
+func (binanceDataSource *BinanceDataSource) Series(ctx context.Context, symbol string, from time.Time, until time.Time, granularity Granularity, limit int) ([]Candle, error) {
+	if !granularity.IsValid() {
+		return nil, &ErrInvalidGranularity
+	}
+
+	var candles []Candle
+	startTs := from.UnixMilli()
+	endTs := until.UnixMilli() - 1
+	for startTs <= endTs && len(candles) < limit {
+		n := limit - len(candles)
+		if n > binanceKlinesLimit {
+			n = binanceKlinesLimit
+		}
+		result, err := binanceDataSource.api.KlinesContext(ctx, symbol, BinanceApiInterval(granularity), startTs, endTs, n)
+		if err != nil {
+			return nil, ErrSourceError.WithAttrs(map[string]any{"err": err})
+		}
+
+		for i, kline := range result {
+			ts, open, err := parseKlineOpen(kline)
+			if err != nil {
+				return nil, fmt.Errorf("kline[%d]: %w", len(candles)+i, err)
+			}
+			candles = append(candles, Candle{Ts: time.UnixMilli(ts), Open: open})
+		}
+
+		if len(result) < n {
+			break
+		}
+		startTs = candles[len(candles)-1].Ts.UnixMilli() + 1
+	}
+
+	return candles, nil
+}
+
+func parseKlineOpen(kline []any) (ts int64, open float64, err error) {
+	if len(kline) <= 2 {
+		return 0, 0, &ErrInvalidResultFormat
+	}
+
+	tsFloat, ok := kline[0].(float64)
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: (expect: float64, actual: %T)",
+			ErrResultTypeMismatch.WithAttrs(map[string]any{
+				"field":  "ts",
+				"expect": "float64",
+				"actual": fmt.Sprintf("%T", kline[0])}),
+			kline[0])
+	}
+
+	openString, ok := kline[1].(string)
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: (expect: string, actual: %T)",
+			ErrResultTypeMismatch.WithAttrs(map[string]any{
+				"field":  "open",
+				"expect": "string",
+				"actual": fmt.Sprintf("%T", kline[1])}),
+			kline[1])
+	}
+
+	open, err = strconv.ParseFloat(openString, 64)
+	if err != nil {
+		return 0, 0, ErrDataParseError.WithAttrs(map[string]any{"field": "open", "err": err.Error()})
+	}
+
+	return int64(tsFloat), open, nil
+}
+
 type BinanceApiOption func(*BinanceApi) error
 
 func BinanceApiBaseUrlOption(baseUrl string) BinanceApiOption {
@@ -179,6 +306,8 @@ func BinanceApiHttpClientOption(httpClient *http.Client) BinanceApiOption {
 	}
 }
 
+const binanceKlinesLimit = 1000
+
 type BinanceApiInterval string
 
 const (
@@ -233,6 +362,24 @@ func NewBinanceApi(options ...BinanceApiOption) (*BinanceApi, error) {
 }
 
 func (api *BinanceApi) Klines(symbol string, interval BinanceApiInterval, startTime int64, endTime int64, limit int) ([][]any, error) {
+	return api.KlinesContext(context.Background(), symbol, interval, startTime, endTime, limit)
+}
+
+func (api *BinanceApi) KlinesContext(ctx context.Context, symbol string, interval BinanceApiInterval, startTime int64, endTime int64, limit int) ([][]any, error) {
+	ctx, span := tracing.Start(ctx, "BinanceApi.Klines",
+		attribute.String("symbol", symbol),
+		attribute.String("interval", string(interval)),
+		attribute.Int64("startTime", startTime),
+		attribute.Int64("endTime", endTime),
+		attribute.Int("limit", limit),
+	)
+	result, err := api.klines(ctx, symbol, interval, startTime, endTime, limit)
+	tracing.End(span, err)
+
+	return result, err
+}
+
+func (api *BinanceApi) klines(ctx context.Context, symbol string, interval BinanceApiInterval, startTime int64, endTime int64, limit int) ([][]any, error) {
 	u, err := UrlParseWithJoin(api.baseUrl, "api/v3/klines")
 	if err != nil {
 		return nil, ErrDataParseError.WithAttrs(map[string]any{"field": "url", "err": err})
@@ -252,11 +399,21 @@ func (api *BinanceApi) Klines(symbol string, interval BinanceApiInterval, startT
 	query.Add("limit", strconv.FormatInt(int64(limit), 10))
 	u.RawQuery = query.Encode()
 
-	resp, err := api.httpClient.Get(u.String())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, ErrRequestFailed.WithAttrs(map[string]any{"err": err})
+	}
+
+	resp, err := api.httpClient.Do(req)
 	if err != nil {
 		return nil, ErrRequestFailed.WithAttrs(map[string]any{"err": err})
 	}
 	defer resp.Body.Close()
+	tracing.SetAttributes(ctx, attribute.Int("http.status_code", resp.StatusCode))
+
+	if weight, err := strconv.ParseFloat(resp.Header.Get("X-MBX-USED-WEIGHT-1M"), 64); err == nil {
+		metrics.BinanceUsedWeight.Set(weight)
+	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
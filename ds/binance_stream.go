@@ -0,0 +1,376 @@
+package ds
+
+import (
+	"context"
+	"cti/metrics"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"golang.org/x/exp/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultBinanceStreamMaxAge renews a connection before Binance closes it after 24 hours
+	defaultBinanceStreamMaxAge     = time.Hour * 23
+	defaultBinanceStreamMinBackoff = time.Second
+	defaultBinanceStreamMaxBackoff = time.Minute
+	binanceStreamSubscribeTimeout  = time.Second * 10
+	// binanceStreamReadTimeout drops a connection without messages or pings, Binance pings every few minutes
+	binanceStreamReadTimeout = time.Minute * 10
+)
+
+// BinanceKline is a closed kline of a Binance kline stream.
+type BinanceKline struct {
+	Symbol    string
+	Interval  BinanceApiInterval
+	OpenTime  time.Time
+	CloseTime time.Time
+	Open      float64
+	High      float64
+	Low       float64
+	Close     float64
+	Volume    float64
+}
+
+func (kline BinanceKline) Candle() Candle {
+	return Candle{Ts: kline.OpenTime, Open: kline.Open}
+}
+
+type BinanceStreamOption func(*BinanceStream) error
+
+func BinanceStreamBaseUrlOption(baseUrl string) BinanceStreamOption {
+	return func(stream *BinanceStream) error {
+		u, err := url.Parse(baseUrl)
+		if err != nil {
+			return err
+		}
+
+		if u.Scheme != "wss" && u.Scheme != "ws" {
+			return fmt.Errorf("%w: %s", ErrUnsupportedProtocolScheme.WithAttrs(map[string]any{"protocol": u.Scheme}), u.Scheme)
+		}
+
+		stream.baseUrl = strings.TrimSuffix(baseUrl, "/")
+		return nil
+	}
+}
+
+// BinanceStreamBackoffOption sets the delays between the reconnects, doubling from min up to max.
+func BinanceStreamBackoffOption(min time.Duration, max time.Duration) BinanceStreamOption {
+	return func(stream *BinanceStream) error {
+		if min <= 0 || max < min {
+			return fmt.Errorf("invalid backoff: min %s, max %s", min, max)
+		}
+		stream.minBackoff = min
+		stream.maxBackoff = max
+		return nil
+	}
+}
+
+// BinanceStreamMaxAgeOption sets the age after which a connection is replaced by a new one.
+func BinanceStreamMaxAgeOption(maxAge time.Duration) BinanceStreamOption {
+	return func(stream *BinanceStream) error {
+		if maxAge <= 0 {
+			return fmt.Errorf("max age must be positive: %s", maxAge)
+		}
+		stream.maxAge = maxAge
+		return nil
+	}
+}
+
+// BinanceStream is a client of the Binance WebSocket market streams.
+type BinanceStream struct {
+	baseUrl    string
+	dialer     *websocket.Dialer
+	maxAge     time.Duration
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+func NewBinanceStream(options ...BinanceStreamOption) (*BinanceStream, error) {
+	stream := &BinanceStream{
+		baseUrl:    "wss://stream.binance.us:9443",
+		dialer:     websocket.DefaultDialer,
+		maxAge:     defaultBinanceStreamMaxAge,
+		minBackoff: defaultBinanceStreamMinBackoff,
+		maxBackoff: defaultBinanceStreamMaxBackoff,
+	}
+
+	for _, option := range options {
+		err := option(stream)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return stream, nil
+}
+
+// Klines subscribes to the <symbol>@kline_<interval> streams of symbols and calls onKline with
+// every closed kline until ctx is done, it returns ctx.Err() then. A lost connection is
+// reconnected with backoff and subscribed again, a connection is replaced before it reaches the
+// 24 hours limit of Binance. The klines closed while no connection is up are missed.
+func (stream *BinanceStream) Klines(ctx context.Context, symbols []string, interval BinanceApiInterval, onKline func(BinanceKline)) error {
+	if !interval.isValid() {
+		return ErrInvalidGranularity.WithAttrs(map[string]any{"interval": interval})
+	}
+
+	names := make([]string, 0, len(symbols))
+	bySymbol := make(map[string]string, len(symbols))
+	for _, symbol := range symbols {
+		names = append(names, strings.ToLower(symbol)+"@kline_"+string(interval))
+		bySymbol[strings.ToUpper(symbol)] = symbol
+	}
+
+	klines := make(chan BinanceKline)
+	// last is the open time of the last emitted kline per symbol, the connections overlap while one is replaced
+	last := make(map[string]time.Time)
+
+	current := stream.reconnect(ctx, names, time.Duration(0))
+	if current == nil {
+		return ctx.Err()
+	}
+	go current.read(klines, bySymbol)
+	rotate := time.NewTimer(stream.maxAge)
+	defer func() {
+		rotate.Stop()
+		current.close()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case kline := <-klines:
+			if !kline.OpenTime.After(last[kline.Symbol]) {
+				continue
+			}
+			last[kline.Symbol] = kline.OpenTime
+			onKline(kline)
+		case <-current.done:
+			slog.Warn("binance stream disconnected, reconnect", "age", time.Since(current.since), "err", current.err)
+			metrics.BinanceStreamReconnects.Inc()
+			lost := current
+			// a connection which lived long reconnects right away, a short lived one waits first
+			var backoff time.Duration
+			if time.Since(lost.since) < stream.maxBackoff {
+				backoff = stream.minBackoff
+			}
+			current = stream.reconnect(ctx, names, backoff)
+			if current == nil {
+				current = lost
+				return ctx.Err()
+			}
+			go current.read(klines, bySymbol)
+			rotate.Reset(stream.maxAge)
+		case <-rotate.C:
+			next, err := stream.connect(ctx, names)
+			if err != nil {
+				slog.Warn("binance stream renew fail, retry", "retry_in", stream.minBackoff, "err", err)
+				rotate.Reset(stream.minBackoff)
+				continue
+			}
+			go next.read(klines, bySymbol)
+			current.close()
+			current = next
+			rotate.Reset(stream.maxAge)
+		}
+	}
+}
+
+// reconnect connects with backoff, starting at backoff, until it succeeds or ctx is done.
+func (stream *BinanceStream) reconnect(ctx context.Context, names []string, backoff time.Duration) *binanceStreamConn {
+	for {
+		if backoff > 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(backoff):
+			}
+		}
+
+		conn, err := stream.connect(ctx, names)
+		if err == nil {
+			return conn
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		backoff *= 2
+		if backoff < stream.minBackoff {
+			backoff = stream.minBackoff
+		}
+		if backoff > stream.maxBackoff {
+			backoff = stream.maxBackoff
+		}
+		slog.Warn("binance stream connect fail, retry", "retry_in", backoff, "err", err)
+	}
+}
+
+type binanceStreamRequest struct {
+	Method string   `json:"method"`
+	Params []string `json:"params"`
+	Id     int64    `json:"id"`
+}
+
+// binanceStreamMessage declares every key of the events, encoding/json would match e.g. "E" to
+// the field of "e" otherwise.
+type binanceStreamMessage struct {
+	Id    *int64 `json:"id"`
+	Error *struct {
+		Code int    `json:"code"`
+		Msg  string `json:"msg"`
+	} `json:"error"`
+	Event     string              `json:"e"`
+	EventTime int64               `json:"E"`
+	Symbol    string              `json:"s"`
+	Kline     *binanceStreamKline `json:"k"`
+}
+
+type binanceStreamKline struct {
+	OpenTime            int64  `json:"t"`
+	CloseTime           int64  `json:"T"`
+	Symbol              string `json:"s"`
+	Interval            string `json:"i"`
+	FirstTradeId        int64  `json:"f"`
+	LastTradeId         int64  `json:"L"`
+	Open                string `json:"o"`
+	Close               string `json:"c"`
+	High                string `json:"h"`
+	Low                 string `json:"l"`
+	Volume              string `json:"v"`
+	Trades              int64  `json:"n"`
+	Closed              bool   `json:"x"`
+	QuoteVolume         string `json:"q"`
+	TakerBuyVolume      string `json:"V"`
+	TakerBuyQuoteVolume string `json:"Q"`
+	Ignore              string `json:"B"`
+}
+
+// connect opens a connection and subscribes to the streams of names.
+func (stream *BinanceStream) connect(ctx context.Context, names []string) (*binanceStreamConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, binanceStreamSubscribeTimeout)
+	defer cancel()
+
+	conn, _, err := stream.dialer.DialContext(ctx, stream.baseUrl+"/ws", nil)
+	if err != nil {
+		return nil, ErrRequestFailed.WithAttrs(map[string]any{"err": err})
+	}
+
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetWriteDeadline(deadline)
+	_ = conn.SetReadDeadline(deadline)
+	err = conn.WriteJSON(binanceStreamRequest{Method: "SUBSCRIBE", Params: names, Id: 1})
+	if err != nil {
+		conn.Close()
+		return nil, ErrRequestFailed.WithAttrs(map[string]any{"err": err})
+	}
+
+	// the klines arriving before the answer are dropped, they are not closed yet
+	for {
+		var message binanceStreamMessage
+		if err = conn.ReadJSON(&message); err != nil {
+			conn.Close()
+			return nil, ErrRequestFailed.WithAttrs(map[string]any{"err": err})
+		}
+		if message.Id == nil || *message.Id != 1 {
+			continue
+		}
+		if message.Error != nil {
+			conn.Close()
+			return nil, ErrBadStatusCode.WithAttrs(map[string]any{"code": message.Error.Code, "resp": message.Error.Msg})
+		}
+		break
+	}
+
+	_ = conn.SetWriteDeadline(time.Time{})
+	_ = conn.SetReadDeadline(time.Now().Add(binanceStreamReadTimeout))
+	conn.SetPingHandler(func(data string) error {
+		_ = conn.SetReadDeadline(time.Now().Add(binanceStreamReadTimeout))
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(binanceStreamSubscribeTimeout))
+	})
+
+	return &binanceStreamConn{conn: conn, since: time.Now(), done: make(chan struct{}), quit: make(chan struct{})}, nil
+}
+
+type binanceStreamConn struct {
+	conn  *websocket.Conn
+	since time.Time
+	// done is closed when read stopped, err is why
+	done chan struct{}
+	err  error
+	quit chan struct{}
+}
+
+// read sends the closed klines to klines until the connection fails or is closed.
+func (c *binanceStreamConn) read(klines chan<- BinanceKline, bySymbol map[string]string) {
+	defer close(c.done)
+	for {
+		var message binanceStreamMessage
+		if c.err = c.conn.ReadJSON(&message); c.err != nil {
+			return
+		}
+		_ = c.conn.SetReadDeadline(time.Now().Add(binanceStreamReadTimeout))
+
+		if message.Event != "kline" || message.Kline == nil || !message.Kline.Closed {
+			continue
+		}
+		kline, err := parseStreamKline(message.Kline, bySymbol)
+		if err != nil {
+			slog.Warn("binance stream kline parse fail", "err", err)
+			continue
+		}
+
+		select {
+		case klines <- kline:
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+func (c *binanceStreamConn) close() {
+	select {
+	case <-c.quit:
+	default:
+		close(c.quit)
+		_ = c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		_ = c.conn.Close()
+	}
+}
+
+func parseStreamKline(k *binanceStreamKline, bySymbol map[string]string) (BinanceKline, error) {
+	symbol, ok := bySymbol[strings.ToUpper(k.Symbol)]
+	if !ok {
+		return BinanceKline{}, ErrInvalidSymbol.WithAttrs(map[string]any{"symbol": k.Symbol})
+	}
+
+	kline := BinanceKline{
+		Symbol:    symbol,
+		Interval:  BinanceApiInterval(k.Interval),
+		OpenTime:  time.UnixMilli(k.OpenTime),
+		CloseTime: time.UnixMilli(k.CloseTime),
+	}
+	for _, field := range []struct {
+		name  string
+		value string
+		dest  *float64
+	}{
+		{"open", k.Open, &kline.Open},
+		{"high", k.High, &kline.High},
+		{"low", k.Low, &kline.Low},
+		{"close", k.Close, &kline.Close},
+		{"volume", k.Volume, &kline.Volume},
+	} {
+		value, err := strconv.ParseFloat(field.value, 64)
+		if err != nil {
+			return BinanceKline{}, ErrDataParseError.WithAttrs(map[string]any{"field": field.name, "err": err.Error()})
+		}
+		*field.dest = value
+	}
+
+	return kline, nil
+}
@@ -0,0 +1,168 @@
+package ds
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeBinanceStream accepts the connections of /ws, answers their SUBSCRIBE request and hands
+// them to the test which pushes the kline events.
+type fakeBinanceStream struct {
+	server *httptest.Server
+	conns  chan *fakeBinanceStreamConn
+}
+
+type fakeBinanceStreamConn struct {
+	conn   *websocket.Conn
+	params []string
+}
+
+func newFakeBinanceStream() *fakeBinanceStream {
+	fake := &fakeBinanceStream{conns: make(chan *fakeBinanceStreamConn, 10)}
+	upgrader := websocket.Upgrader{}
+	fake.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ws" {
+			w.WriteHeader(404)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		var request binanceStreamRequest
+		if err = conn.ReadJSON(&request); err != nil || request.Method != "SUBSCRIBE" {
+			conn.Close()
+			return
+		}
+		// an open kline before the answer is dropped
+		_ = conn.WriteMessage(websocket.TextMessage, fakeKlineEvent("BTCUSD", 0, false))
+		_ = conn.WriteJSON(map[string]any{"result": nil, "id": request.Id})
+		fake.conns <- &fakeBinanceStreamConn{conn: conn, params: request.Params}
+	}))
+	return fake
+}
+
+func (fake *fakeBinanceStream) url() string {
+	return "ws" + strings.TrimPrefix(fake.server.URL, "http")
+}
+
+func (fake *fakeBinanceStream) accept(t *testing.T) *fakeBinanceStreamConn {
+	select {
+	case conn := <-fake.conns:
+		return conn
+	case <-time.After(time.Second * 5):
+		t.Fatal("no connection")
+		return nil
+	}
+}
+
+func (conn *fakeBinanceStreamConn) push(t *testing.T, symbol string, openTime int64, closed bool) {
+	require.NoError(t, conn.conn.WriteMessage(websocket.TextMessage, fakeKlineEvent(symbol, openTime, closed)))
+}
+
+func fakeKlineEvent(symbol string, openTime int64, closed bool) []byte {
+	return []byte(fmt.Sprintf(`{"e":"kline","E":%d,"s":"%s","k":{"t":%d,"T":%d,"s":"%s","i":"1m","f":100,"L":200,"o":"%d.5","c":"2","h":"3","l":"1","v":"10","n":100,"x":%t,"q":"20","V":"5","Q":"10","B":"0"}}`,
+		openTime+60000, symbol, openTime, openTime+59999, symbol, openTime/1000, closed))
+}
+
+func receiveKline(t *testing.T, klines chan BinanceKline) BinanceKline {
+	select {
+	case kline := <-klines:
+		return kline
+	case <-time.After(time.Second * 5):
+		t.Fatal("no kline")
+		return BinanceKline{}
+	}
+}
+
+func TestBinanceStreamKlines(t *testing.T) {
+	fake := newFakeBinanceStream()
+	defer fake.server.Close()
+
+	stream, err := NewBinanceStream(BinanceStreamBaseUrlOption(fake.url()), BinanceStreamBackoffOption(time.Millisecond*10, time.Millisecond*50))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	klines := make(chan BinanceKline, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- stream.Klines(ctx, []string{"BTCUSD", "ethusd"}, BinanceApiInterval1m, func(kline BinanceKline) { klines <- kline })
+	}()
+
+	conn := fake.accept(t)
+	assert.Equal(t, []string{"btcusd@kline_1m", "ethusd@kline_1m"}, conn.params)
+
+	// only the closed klines are emitted, with the requested symbol
+	conn.push(t, "BTCUSD", 60000, false)
+	conn.push(t, "BTCUSD", 60000, true)
+	conn.push(t, "ETHUSD", 60000, true)
+	kline := receiveKline(t, klines)
+	assert.Equal(t, "BTCUSD", kline.Symbol)
+	assert.Equal(t, BinanceApiInterval1m, kline.Interval)
+	assert.Equal(t, time.UnixMilli(60000), kline.OpenTime)
+	assert.Equal(t, Candle{Ts: time.UnixMilli(60000), Open: 60.5}, kline.Candle())
+	assert.Equal(t, 2.0, kline.Close)
+	assert.Equal(t, 10.0, kline.Volume)
+	assert.Equal(t, "ethusd", receiveKline(t, klines).Symbol)
+
+	// a dropped connection is reconnected and subscribed again, the klines seen before are skipped
+	conn.conn.Close()
+	conn = fake.accept(t)
+	assert.Equal(t, []string{"btcusd@kline_1m", "ethusd@kline_1m"}, conn.params)
+	conn.push(t, "BTCUSD", 60000, true)
+	conn.push(t, "BTCUSD", 120000, true)
+	assert.Equal(t, time.UnixMilli(120000), receiveKline(t, klines).OpenTime)
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+	assert.Empty(t, klines)
+}
+
+func TestBinanceStreamRenewsConnection(t *testing.T) {
+	fake := newFakeBinanceStream()
+	defer fake.server.Close()
+
+	stream, err := NewBinanceStream(BinanceStreamBaseUrlOption(fake.url()), BinanceStreamMaxAgeOption(time.Millisecond*200))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	klines := make(chan BinanceKline, 10)
+	go stream.Klines(ctx, []string{"BTCUSD"}, BinanceApiInterval1m, func(kline BinanceKline) { klines <- kline })
+
+	first := fake.accept(t)
+	first.push(t, "BTCUSD", 60000, true)
+	assert.Equal(t, time.UnixMilli(60000), receiveKline(t, klines).OpenTime)
+
+	// the new connection is up before the old one is closed
+	second := fake.accept(t)
+	second.push(t, "BTCUSD", 60000, true)
+	second.push(t, "BTCUSD", 120000, true)
+	assert.Equal(t, time.UnixMilli(120000), receiveKline(t, klines).OpenTime)
+
+	_ = first.conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = first.conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure))
+}
+
+func TestNewBinanceStream(t *testing.T) {
+	_, err := NewBinanceStream(BinanceStreamBaseUrlOption("https://stream.binance.us"))
+	assert.True(t, IsErrorCode(err, ErrUnsupportedProtocolScheme.Code))
+
+	_, err = NewBinanceStream(BinanceStreamBackoffOption(time.Minute, time.Second))
+	assert.Error(t, err)
+
+	stream, err := NewBinanceStream()
+	require.NoError(t, err)
+	err = stream.Klines(context.Background(), []string{"BTCUSD"}, BinanceApiInterval("2m"), func(BinanceKline) {})
+	assert.True(t, IsErrorCode(err, ErrInvalidGranularity.Code))
+}
@@ -1,6 +1,9 @@
 package ds
 
 import (
+	"context"
+	"cti/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/suite"
 	"net/http"
 	"testing"
@@ -156,3 +159,91 @@ func (suite *BinanceDataSourceTestSuite) TestWithOption() {
 func TestBinanceDataSourceTestSuite(t *testing.T) {
 	suite.Run(t, new(BinanceDataSourceTestSuite))
 }
+
+type BinanceCandlesTestSuite struct {
+	fake       *fakeBinance
+	datasource *BinanceDataSource
+	suite.Suite
+}
+
+func (suite *BinanceCandlesTestSuite) SetupTest() {
+	suite.fake = newFakeBinance()
+
+	datasource, err := NewBinanceDataSource(BinanceApiBaseUrlOption(suite.fake.server.URL))
+	suite.Nil(err)
+	suite.datasource = datasource
+}
+
+func (suite *BinanceCandlesTestSuite) TearDownTest() {
+	suite.fake.server.Close()
+}
+
+func (suite *BinanceCandlesTestSuite) TestCandles() {
+	from := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	until := from.Add(time.Minute * 2500)
+
+	candles, err := suite.datasource.Candles("BTCUSD", from, until, Granularity1m)
+	suite.Nil(err)
+	suite.Len(candles, 2500)
+	suite.Equal(3, suite.fake.requestCount())
+
+	for i, candle := range candles {
+		ts := from.Add(time.Minute * time.Duration(i))
+		suite.True(ts.Equal(candle.Ts))
+		suite.Equal(fakeKlineOpen(ts.UnixMilli()), candle.Open)
+	}
+}
+
+func (suite *BinanceCandlesTestSuite) TestUsedWeightMetric() {
+	from := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	_, err := suite.datasource.Candles("BTCUSD", from, from.Add(time.Minute*2500), Granularity1m)
+	suite.Nil(err)
+	suite.Equal(6.0, testutil.ToFloat64(metrics.BinanceUsedWeight))
+}
+
+func (suite *BinanceCandlesTestSuite) TestCandlesWithInvalidParams() {
+	from := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	_, err := suite.datasource.Candles("BTCUSD", from, from.Add(time.Hour), Granularity(""))
+	suite.NotNil(err)
+
+	_, err = suite.datasource.Candles("", from, from.Add(time.Hour), Granularity1m)
+	suite.NotNil(err)
+}
+
+func (suite *BinanceCandlesTestSuite) TestPrices() {
+	from := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	queries := []PriceQuery{
+		{Symbol: "BTCUSD", Ts: from},
+		{Symbol: "BTCUSD", Ts: from.Add(time.Second * 999)},
+		{Symbol: "BTCUSD", Ts: from.Add(time.Second * 1000)},
+		{Symbol: "BTCUSD", Ts: from},
+		{Symbol: "", Ts: from},
+	}
+
+	results, err := suite.datasource.Prices(context.Background(), queries)
+	suite.Nil(err)
+	// one range of 1000 seconds per request
+	suite.Equal(3, suite.fake.requestCount())
+	for i, query := range queries[:4] {
+		suite.Nil(results[i].Err)
+		suite.Equal(fakeKlineOpen(query.Ts.UnixMilli()), results[i].Price.Price)
+	}
+	suite.True(IsErrorCode(results[4].Err, ErrSourceError.Code))
+}
+
+func (suite *BinanceCandlesTestSuite) TestSeries() {
+	from := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	candles, err := suite.datasource.Series(context.Background(), "BTCUSD", from, from.Add(time.Minute*2500), Granularity1m, 1200)
+	suite.Nil(err)
+	suite.Len(candles, 1200)
+	// the second request asks for the 200 klines left only
+	suite.Equal(2, suite.fake.requestCount())
+	suite.True(from.Add(time.Minute * 1199).Equal(candles[1199].Ts))
+}
+
+func TestBinanceCandlesTestSuite(t *testing.T) {
+	suite.Run(t, new(BinanceCandlesTestSuite))
+}
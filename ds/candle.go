@@ -0,0 +1,36 @@
+package ds
+
+import (
+	"time"
+)
+
+// PriceCandleDataSource builds candles from the price of every granularity step,
+// so any PriceDataSourceApi can be used where candles are needed.
+type PriceCandleDataSource struct {
+	api PriceDataSourceApi
+}
+
+func NewPriceCandleDataSource(api PriceDataSourceApi) *PriceCandleDataSource {
+	return &PriceCandleDataSource{api: api}
+}
+
+func (dataSource *PriceCandleDataSource) Candles(symbol string, from time.Time, until time.Time, granularity Granularity) ([]Candle, error) {
+	step := granularity.Duration()
+	if step == 0 {
+		return nil, ErrInvalidGranularity.WithAttrs(map[string]any{"details": "granularity without fixed duration"})
+	}
+
+	var candles []Candle
+	for ts := from; ts.Before(until); ts = ts.Add(step) {
+		price, err := dataSource.api.Price(symbol, ts)
+		if err != nil {
+			if IsErrorCode(err, ErrNoData.Code) {
+				continue
+			}
+			return nil, err
+		}
+		candles = append(candles, Candle{Ts: ts, Open: price.Price})
+	}
+
+	return candles, nil
+}
@@ -0,0 +1,59 @@
+package ds
+
+import (
+	"github.com/stretchr/testify/suite"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type PriceCandleDataSourceTestSuite struct {
+	store     *LocalStore
+	apiServer *httptest.Server
+	from      time.Time
+	suite.Suite
+}
+
+func (suite *PriceCandleDataSourceTestSuite) SetupTest() {
+	store, err := NewLocalStore(suite.T().TempDir())
+	suite.Nil(err)
+	suite.store = store
+	suite.apiServer = httptest.NewServer(NewDataSourceApiServer(store, ":8080").Router)
+
+	suite.from = time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	suite.Nil(store.WritePrice("BTCUSD", 1, suite.from))
+	suite.Nil(store.WritePrice("BTCUSD", 3, suite.from.Add(time.Minute*2)))
+}
+
+func (suite *PriceCandleDataSourceTestSuite) TearDownTest() {
+	suite.apiServer.Close()
+}
+
+func (suite *PriceCandleDataSourceTestSuite) TestCandles() {
+	apiClient, err := NewDefaultDataSourceApiClient(suite.apiServer.URL)
+	suite.Nil(err)
+
+	candles, err := NewPriceCandleDataSource(apiClient).Candles("BTCUSD", suite.from, suite.from.Add(time.Minute*3), Granularity1m)
+	suite.Nil(err)
+
+	// the missing minute is skipped
+	suite.Len(candles, 2)
+	suite.Equal(1.0, candles[0].Open)
+	suite.Equal(3.0, candles[1].Open)
+	suite.Equal(suite.from.Add(time.Minute*2).Unix(), candles[1].Ts.Unix())
+}
+
+func (suite *PriceCandleDataSourceTestSuite) TestCandlesWithInvalidParams() {
+	apiClient, err := NewDefaultDataSourceApiClient(suite.apiServer.URL)
+	suite.Nil(err)
+
+	_, err = NewPriceCandleDataSource(apiClient).Candles("BTCUSD", suite.from, suite.from.Add(time.Minute), Granularity1M)
+	suite.NotNil(err)
+
+	_, err = NewPriceCandleDataSource(apiClient).Candles("../x", suite.from, suite.from.Add(time.Minute), Granularity1m)
+	suite.NotNil(err)
+}
+
+func TestPriceCandleDataSourceTestSuite(t *testing.T) {
+	suite.Run(t, new(PriceCandleDataSourceTestSuite))
+}
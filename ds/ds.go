@@ -1,6 +1,7 @@
 package ds
 
 import (
+	"context"
 	"time"
 )
 
@@ -17,6 +18,30 @@ type AverageDataSource interface {
 	Average(symbol string, from time.Time, until time.Time, granularity Granularity) (average float64, actualFrom time.Time, actualUntil time.Time, err error)
 }
 
+// PriceDataSourceContext is implemented by data sources which carry the request context, e.g. its trace, to their backend.
+type PriceDataSourceContext interface {
+	PriceContext(ctx context.Context, symbol string, ts time.Time) (float64, error)
+}
+
+type AverageDataSourceContext interface {
+	AverageContext(ctx context.Context, symbol string, from time.Time, until time.Time, granularity Granularity) (average float64, actualFrom time.Time, actualUntil time.Time, err error)
+}
+
+type CandleDataSource interface {
+	Candles(symbol string, from time.Time, until time.Time, granularity Granularity) ([]Candle, error)
+}
+
+// SeriesDataSource returns the points of symbol in [from, until) at granularity, oldest first and
+// at most limit. The price of a point is the price at its timestamp, like the open of a candle.
+type SeriesDataSource interface {
+	Series(ctx context.Context, symbol string, from time.Time, until time.Time, granularity Granularity, limit int) ([]Candle, error)
+}
+
+type Candle struct {
+	Ts   time.Time
+	Open float64
+}
+
 type PriceApiModel struct {
 	Price float64 `json:"price"`
 }
@@ -27,6 +52,75 @@ type PriceAverageApiModel struct {
 	Until   int64   `json:"until"`
 }
 
+// PriceQuery is one price of a batch.
+type PriceQuery struct {
+	Symbol string
+	Ts     time.Time
+}
+
+// PriceResult is the answer of one PriceQuery, either the price or the error.
+type PriceResult struct {
+	Price PriceApiModel
+	Err   error
+}
+
+// PricesRequestApiModel is the body of POST /api/v1/prices.
+type PricesRequestApiModel struct {
+	Queries []PriceQueryApiModel `json:"queries"`
+}
+
+type PriceQueryApiModel struct {
+	Symbol string `json:"symbol"`
+	Ts     int64  `json:"ts"`
+}
+
+// PricesApiModel answers every query of a PricesRequestApiModel in order.
+type PricesApiModel struct {
+	Results []PriceResultApiModel `json:"results"`
+}
+
+// PriceResultApiModel has either the price or the error of its query, Source is set by the gateway.
+type PriceResultApiModel struct {
+	Symbol string        `json:"symbol"`
+	Ts     int64         `json:"ts"`
+	Price  float64       `json:"price"`
+	Error  *ErrorPayload `json:"error,omitempty"`
+	Source *string       `json:"source,omitempty"`
+}
+
+// SeriesApiModel is a page of the points of a series, NextCursor is set when more points follow.
+type SeriesApiModel struct {
+	Symbol      string                `json:"symbol"`
+	Granularity Granularity           `json:"granularity"`
+	Points      []SeriesPointApiModel `json:"points"`
+	NextCursor  string                `json:"next_cursor,omitempty"`
+}
+
+type SeriesPointApiModel struct {
+	Ts    int64   `json:"ts"`
+	Price float64 `json:"price"`
+}
+
+// BatchPriceDataSource resolves a batch of prices with fewer queries to its source than one per price.
+// The results are in the order of the queries, the error fails the whole batch. The api clients implement it too.
+type BatchPriceDataSource interface {
+	Prices(ctx context.Context, queries []PriceQuery) ([]PriceResult, error)
+}
+
+// AverageQuery is one average of a batch.
+type AverageQuery struct {
+	Symbol      string
+	From        time.Time
+	Until       time.Time
+	Granularity Granularity
+}
+
+// AverageResult is the answer of one AverageQuery, either the average or the error.
+type AverageResult struct {
+	Average PriceAverageApiModel
+	Err     error
+}
+
 type Granularity string
 
 const (
@@ -54,6 +148,33 @@ func (granularity Granularity) IsValid() bool {
 	return false
 }
 
+// Duration returns the length of one granularity step, 1M has no fixed length and returns 0.
+func (granularity Granularity) Duration() time.Duration {
+	switch granularity {
+	case Granularity1s:
+		return time.Second
+	case Granularity1m:
+		return time.Minute
+	case Granularity1h:
+		return time.Hour
+	case Granularity1d:
+		return time.Hour * 24
+	}
+
+	return 0
+}
+
+// GranularityOf returns the granularity whose step is exactly duration.
+func GranularityOf(duration time.Duration) (Granularity, bool) {
+	for _, granularity := range []Granularity{Granularity1s, Granularity1m, Granularity1h, Granularity1d} {
+		if granularity.Duration() == duration {
+			return granularity, true
+		}
+	}
+
+	return "", false
+}
+
 type DataSourceApiClient interface {
 	PriceDataSourceApi
 	AverageDataSourceApi
@@ -66,3 +187,33 @@ type PriceDataSourceApi interface {
 type AverageDataSourceApi interface {
 	Average(symbol string, from time.Time, until time.Time, granularity Granularity) (PriceAverageApiModel, error)
 }
+
+// SeriesDataSourceApi reads the series pages of /api/v1/series.
+type SeriesDataSourceApi interface {
+	SeriesPage(ctx context.Context, query SeriesQuery) (SeriesApiModel, error)
+}
+
+// PriceDataSourceApiContext is implemented by api clients which carry the request context, e.g. its trace, to the server.
+type PriceDataSourceApiContext interface {
+	PriceContext(ctx context.Context, symbol string, ts time.Time) (PriceApiModel, error)
+}
+
+type AverageDataSourceApiContext interface {
+	AverageContext(ctx context.Context, symbol string, from time.Time, until time.Time, granularity Granularity) (PriceAverageApiModel, error)
+}
+
+// PriceWithContext calls PriceContext when api supports it, Price otherwise.
+func PriceWithContext(ctx context.Context, api PriceDataSourceApi, symbol string, ts time.Time) (PriceApiModel, error) {
+	if c, ok := api.(PriceDataSourceApiContext); ok {
+		return c.PriceContext(ctx, symbol, ts)
+	}
+	return api.Price(symbol, ts)
+}
+
+// AverageWithContext calls AverageContext when api supports it, Average otherwise.
+func AverageWithContext(ctx context.Context, api AverageDataSourceApi, symbol string, from time.Time, until time.Time, granularity Granularity) (PriceAverageApiModel, error) {
+	if c, ok := api.(AverageDataSourceApiContext); ok {
+		return c.AverageContext(ctx, symbol, from, until, granularity)
+	}
+	return api.Average(symbol, from, until, granularity)
+}
@@ -3,6 +3,7 @@ package ds
 import (
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func TestGranularity(t *testing.T) {
@@ -12,3 +13,19 @@ func TestGranularity(t *testing.T) {
 	invalidG := Granularity("")
 	assert.Equal(t, false, invalidG.IsValid())
 }
+
+func TestGranularityDuration(t *testing.T) {
+	assert.Equal(t, time.Minute, Granularity1m.Duration())
+	assert.Equal(t, time.Hour*24, Granularity1d.Duration())
+	assert.Equal(t, time.Duration(0), Granularity1M.Duration())
+	assert.Equal(t, time.Duration(0), Granularity("").Duration())
+}
+
+func TestGranularityOf(t *testing.T) {
+	granularity, ok := GranularityOf(time.Hour)
+	assert.True(t, ok)
+	assert.Equal(t, Granularity1h, granularity)
+
+	_, ok = GranularityOf(time.Minute * 5)
+	assert.False(t, ok)
+}
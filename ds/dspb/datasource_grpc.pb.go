@@ -0,0 +1,389 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             v3.21.12
+// source: datasource.proto
+
+package dspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// DataSourceClient is the client API for DataSource service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type DataSourceClient interface {
+	Price(ctx context.Context, in *PriceRequest, opts ...grpc.CallOption) (*PriceResponse, error)
+	Average(ctx context.Context, in *AverageRequest, opts ...grpc.CallOption) (*AverageResponse, error)
+	// StreamPrice answers every request of the stream in order, a failed request
+	// is answered with its error and does not end the stream.
+	StreamPrice(ctx context.Context, opts ...grpc.CallOption) (DataSource_StreamPriceClient, error)
+	StreamAverage(ctx context.Context, opts ...grpc.CallOption) (DataSource_StreamAverageClient, error)
+	// WatchPrice pushes the price of every step of the granularity once the step is over, from the
+	// last complete step, like /api/v1/events of the HTTP API.
+	WatchPrice(ctx context.Context, in *WatchPriceRequest, opts ...grpc.CallOption) (DataSource_WatchPriceClient, error)
+	// Series returns a page of the points of a series like /api/v1/series of the HTTP API, it fails
+	// with UNIMPLEMENTED when the datasource has no series.
+	Series(ctx context.Context, in *SeriesRequest, opts ...grpc.CallOption) (*SeriesResponse, error)
+}
+
+type dataSourceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewDataSourceClient(cc grpc.ClientConnInterface) DataSourceClient {
+	return &dataSourceClient{cc}
+}
+
+func (c *dataSourceClient) Price(ctx context.Context, in *PriceRequest, opts ...grpc.CallOption) (*PriceResponse, error) {
+	out := new(PriceResponse)
+	err := c.cc.Invoke(ctx, "/cti.datasource.v1.DataSource/Price", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dataSourceClient) Average(ctx context.Context, in *AverageRequest, opts ...grpc.CallOption) (*AverageResponse, error) {
+	out := new(AverageResponse)
+	err := c.cc.Invoke(ctx, "/cti.datasource.v1.DataSource/Average", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dataSourceClient) StreamPrice(ctx context.Context, opts ...grpc.CallOption) (DataSource_StreamPriceClient, error) {
+	stream, err := c.cc.NewStream(ctx, &DataSource_ServiceDesc.Streams[0], "/cti.datasource.v1.DataSource/StreamPrice", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &dataSourceStreamPriceClient{stream}
+	return x, nil
+}
+
+type DataSource_StreamPriceClient interface {
+	Send(*PriceRequest) error
+	Recv() (*PriceResponse, error)
+	grpc.ClientStream
+}
+
+type dataSourceStreamPriceClient struct {
+	grpc.ClientStream
+}
+
+func (x *dataSourceStreamPriceClient) Send(m *PriceRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *dataSourceStreamPriceClient) Recv() (*PriceResponse, error) {
+	m := new(PriceResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *dataSourceClient) StreamAverage(ctx context.Context, opts ...grpc.CallOption) (DataSource_StreamAverageClient, error) {
+	stream, err := c.cc.NewStream(ctx, &DataSource_ServiceDesc.Streams[1], "/cti.datasource.v1.DataSource/StreamAverage", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &dataSourceStreamAverageClient{stream}
+	return x, nil
+}
+
+type DataSource_StreamAverageClient interface {
+	Send(*AverageRequest) error
+	Recv() (*AverageResponse, error)
+	grpc.ClientStream
+}
+
+type dataSourceStreamAverageClient struct {
+	grpc.ClientStream
+}
+
+func (x *dataSourceStreamAverageClient) Send(m *AverageRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *dataSourceStreamAverageClient) Recv() (*AverageResponse, error) {
+	m := new(AverageResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *dataSourceClient) WatchPrice(ctx context.Context, in *WatchPriceRequest, opts ...grpc.CallOption) (DataSource_WatchPriceClient, error) {
+	stream, err := c.cc.NewStream(ctx, &DataSource_ServiceDesc.Streams[2], "/cti.datasource.v1.DataSource/WatchPrice", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &dataSourceWatchPriceClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type DataSource_WatchPriceClient interface {
+	Recv() (*PriceTick, error)
+	grpc.ClientStream
+}
+
+type dataSourceWatchPriceClient struct {
+	grpc.ClientStream
+}
+
+func (x *dataSourceWatchPriceClient) Recv() (*PriceTick, error) {
+	m := new(PriceTick)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *dataSourceClient) Series(ctx context.Context, in *SeriesRequest, opts ...grpc.CallOption) (*SeriesResponse, error) {
+	out := new(SeriesResponse)
+	err := c.cc.Invoke(ctx, "/cti.datasource.v1.DataSource/Series", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DataSourceServer is the server API for DataSource service.
+// All implementations must embed UnimplementedDataSourceServer
+// for forward compatibility
+type DataSourceServer interface {
+	Price(context.Context, *PriceRequest) (*PriceResponse, error)
+	Average(context.Context, *AverageRequest) (*AverageResponse, error)
+	// StreamPrice answers every request of the stream in order, a failed request
+	// is answered with its error and does not end the stream.
+	StreamPrice(DataSource_StreamPriceServer) error
+	StreamAverage(DataSource_StreamAverageServer) error
+	// WatchPrice pushes the price of every step of the granularity once the step is over, from the
+	// last complete step, like /api/v1/events of the HTTP API.
+	WatchPrice(*WatchPriceRequest, DataSource_WatchPriceServer) error
+	// Series returns a page of the points of a series like /api/v1/series of the HTTP API, it fails
+	// with UNIMPLEMENTED when the datasource has no series.
+	Series(context.Context, *SeriesRequest) (*SeriesResponse, error)
+	mustEmbedUnimplementedDataSourceServer()
+}
+
+// UnimplementedDataSourceServer must be embedded to have forward compatible implementations.
+type UnimplementedDataSourceServer struct {
+}
+
+func (UnimplementedDataSourceServer) Price(context.Context, *PriceRequest) (*PriceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Price not implemented")
+}
+func (UnimplementedDataSourceServer) Average(context.Context, *AverageRequest) (*AverageResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Average not implemented")
+}
+func (UnimplementedDataSourceServer) StreamPrice(DataSource_StreamPriceServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamPrice not implemented")
+}
+func (UnimplementedDataSourceServer) StreamAverage(DataSource_StreamAverageServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamAverage not implemented")
+}
+func (UnimplementedDataSourceServer) WatchPrice(*WatchPriceRequest, DataSource_WatchPriceServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchPrice not implemented")
+}
+func (UnimplementedDataSourceServer) Series(context.Context, *SeriesRequest) (*SeriesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Series not implemented")
+}
+func (UnimplementedDataSourceServer) mustEmbedUnimplementedDataSourceServer() {}
+
+// UnsafeDataSourceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to DataSourceServer will
+// result in compilation errors.
+type UnsafeDataSourceServer interface {
+	mustEmbedUnimplementedDataSourceServer()
+}
+
+func RegisterDataSourceServer(s grpc.ServiceRegistrar, srv DataSourceServer) {
+	s.RegisterService(&DataSource_ServiceDesc, srv)
+}
+
+func _DataSource_Price_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PriceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DataSourceServer).Price(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cti.datasource.v1.DataSource/Price",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DataSourceServer).Price(ctx, req.(*PriceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DataSource_Average_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AverageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DataSourceServer).Average(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cti.datasource.v1.DataSource/Average",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DataSourceServer).Average(ctx, req.(*AverageRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DataSource_StreamPrice_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(DataSourceServer).StreamPrice(&dataSourceStreamPriceServer{stream})
+}
+
+type DataSource_StreamPriceServer interface {
+	Send(*PriceResponse) error
+	Recv() (*PriceRequest, error)
+	grpc.ServerStream
+}
+
+type dataSourceStreamPriceServer struct {
+	grpc.ServerStream
+}
+
+func (x *dataSourceStreamPriceServer) Send(m *PriceResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *dataSourceStreamPriceServer) Recv() (*PriceRequest, error) {
+	m := new(PriceRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _DataSource_StreamAverage_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(DataSourceServer).StreamAverage(&dataSourceStreamAverageServer{stream})
+}
+
+type DataSource_StreamAverageServer interface {
+	Send(*AverageResponse) error
+	Recv() (*AverageRequest, error)
+	grpc.ServerStream
+}
+
+type dataSourceStreamAverageServer struct {
+	grpc.ServerStream
+}
+
+func (x *dataSourceStreamAverageServer) Send(m *AverageResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *dataSourceStreamAverageServer) Recv() (*AverageRequest, error) {
+	m := new(AverageRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _DataSource_WatchPrice_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchPriceRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DataSourceServer).WatchPrice(m, &dataSourceWatchPriceServer{stream})
+}
+
+type DataSource_WatchPriceServer interface {
+	Send(*PriceTick) error
+	grpc.ServerStream
+}
+
+type dataSourceWatchPriceServer struct {
+	grpc.ServerStream
+}
+
+func (x *dataSourceWatchPriceServer) Send(m *PriceTick) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _DataSource_Series_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SeriesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DataSourceServer).Series(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cti.datasource.v1.DataSource/Series",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DataSourceServer).Series(ctx, req.(*SeriesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// DataSource_ServiceDesc is the grpc.ServiceDesc for DataSource service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var DataSource_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "cti.datasource.v1.DataSource",
+	HandlerType: (*DataSourceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Price",
+			Handler:    _DataSource_Price_Handler,
+		},
+		{
+			MethodName: "Average",
+			Handler:    _DataSource_Average_Handler,
+		},
+		{
+			MethodName: "Series",
+			Handler:    _DataSource_Series_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamPrice",
+			Handler:       _DataSource_StreamPrice_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "StreamAverage",
+			Handler:       _DataSource_StreamAverage_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "WatchPrice",
+			Handler:       _DataSource_WatchPrice_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "datasource.proto",
+}
@@ -1,6 +1,9 @@
 package ds
 
-import "cti/erro"
+import (
+	"cti/erro"
+	"errors"
+)
 
 var (
 	ErrNoData                                   = erro.NewError("NO_DATA", "no data", nil)
@@ -15,4 +18,26 @@ var (
 	ErrDataParseError                           = erro.NewError("DATA_PARSE_ERROR", "data parse error", nil)
 	ErrBadStatusCode                            = erro.NewError("BAD_STATUS_CODE", "bad status code", nil)
 	ErrRequestFailed                            = erro.NewError("REQUEST_FAILED", "failed to send request", nil)
+	ErrInvalidSymbol                            = erro.NewError("INVALID_SYMBOL", "invalid symbol", nil)
+	ErrInvalidRequestBody                       = erro.NewError("INVALID_REQUEST_BODY", "invalid request body", nil)
+	ErrSeriesNotSupported                       = erro.NewError("SERIES_NOT_SUPPORTED", "series is not supported by the datasource", nil)
+	ErrStreamNotSupported                       = erro.NewError("STREAM_NOT_SUPPORTED", "price stream is not supported by the datasource", nil)
+	ErrStreamClosed                             = erro.NewError("STREAM_CLOSED", "price stream closed", nil)
+	ErrLocalStoreCorrupted                      = erro.NewError("LOCAL_STORE_CORRUPTED", "local store file has an unreadable record", nil)
 )
+
+// IsErrorCode reports whether err carries code, either as an *erro.Error from a
+// datasource or as an ErrorPayload decoded from a datasource API response.
+func IsErrorCode(err error, code string) bool {
+	var e *erro.Error
+	if errors.As(err, &e) {
+		return e.Code == code
+	}
+
+	var payload ErrorPayload
+	if errors.As(err, &payload) {
+		return payload.Code == code
+	}
+
+	return false
+}
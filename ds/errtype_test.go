@@ -0,0 +1,16 @@
+package ds
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestIsErrorCode(t *testing.T) {
+	assert.True(t, IsErrorCode(&ErrNoData, ErrNoData.Code))
+	assert.True(t, IsErrorCode(fmt.Errorf("wrap: %w", ErrNoData.WithAttrs(nil)), ErrNoData.Code))
+	assert.True(t, IsErrorCode(NewErrorPayload(&ErrNoData), ErrNoData.Code))
+	assert.False(t, IsErrorCode(&ErrSourceError, ErrNoData.Code))
+	assert.False(t, IsErrorCode(errors.New("no data"), ErrNoData.Code))
+}
@@ -0,0 +1,398 @@
+package ds
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/render"
+	"golang.org/x/exp/slog"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DataSourceApiServerRouteEvents = "/events"
+
+const (
+	defaultPriceEventsHeartbeat = time.Second * 15
+	defaultPriceEventsPoll      = time.Second
+	// priceEventsMaxReplay bounds the events sent again to a client resuming with Last-Event-ID
+	priceEventsMaxReplay = 1000
+	priceEventsRetry     = time.Second * 3
+	// priceEventsBuffer is how many prices a client may fall behind its feed
+	priceEventsBuffer = 64
+)
+
+type PriceEventsOption func(*PriceEvents) error
+
+// PriceEventsHeartbeatOption sets how often a comment is sent to keep an idle connection alive.
+func PriceEventsHeartbeatOption(heartbeat time.Duration) PriceEventsOption {
+	return func(events *PriceEvents) error {
+		if heartbeat <= 0 {
+			return fmt.Errorf("heartbeat must be positive: %s", heartbeat)
+		}
+		events.heartbeat = heartbeat
+		return nil
+	}
+}
+
+// PriceEventsPollOption sets how often the datasource is asked for a price which is due.
+func PriceEventsPollOption(poll time.Duration) PriceEventsOption {
+	return func(events *PriceEvents) error {
+		if poll <= 0 {
+			return fmt.Errorf("poll must be positive: %s", poll)
+		}
+		events.poll = poll
+		return nil
+	}
+}
+
+// PriceEvents serves the prices of a symbol as Server-Sent Events, for the clients which cannot
+// use a WebSocket. The price of every step of the granularity is sent once the step is over,
+// the event id is its timestamp so a client reconnecting with Last-Event-ID resumes after it.
+// The clients of the same symbol and granularity share one feed asking the datasource for the prices.
+type PriceEvents struct {
+	dataSource PriceDataSource
+	heartbeat  time.Duration
+	poll       time.Duration
+	now        func() time.Time
+
+	mu    sync.Mutex
+	feeds map[priceFeedKey]*priceFeed
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+type priceFeedKey struct {
+	symbol      string
+	granularity Granularity
+}
+
+// priceFeed asks the datasource for the price of every step of a symbol once it is due and
+// publishes it to the subscribers, it runs while it has subscribers.
+type priceFeed struct {
+	key priceFeedKey
+	// next is the step asked for next, the steps before are published or skipped
+	next        time.Time
+	subscribers map[*priceSubscriber]struct{}
+	cancel      context.CancelFunc
+}
+
+// priceSubscriber receives the prices of a feed. A subscriber which falls priceEventsBuffer
+// prices behind is dropped, its client resumes with Last-Event-ID.
+type priceSubscriber struct {
+	feed    *priceFeed
+	ticks   chan PriceTick
+	dropped chan struct{}
+}
+
+func NewPriceEvents(dataSource PriceDataSource, options ...PriceEventsOption) (*PriceEvents, error) {
+	events := &PriceEvents{
+		dataSource: dataSource,
+		heartbeat:  defaultPriceEventsHeartbeat,
+		poll:       defaultPriceEventsPoll,
+		now:        time.Now,
+		feeds:      make(map[priceFeedKey]*priceFeed),
+		done:       make(chan struct{}),
+	}
+
+	for _, option := range options {
+		err := option(events)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return events, nil
+}
+
+// Serve streams the prices of symbol at the granularity of the query string (default 1m) until
+// the client disconnects or Close is called. Without Last-Event-ID the stream starts with the
+// last complete step. A step whose price fails is skipped once the following step is over.
+func (events *PriceEvents) Serve(w http.ResponseWriter, r *http.Request, symbol string) {
+	granularity := Granularity(r.URL.Query().Get("granularity"))
+	if granularity == "" {
+		granularity = Granularity1m
+	}
+	if _, ok := GranularityOf(granularity.Duration()); !ok {
+		render.Status(r, 400)
+		render.JSON(w, r, errorPayload(r, ErrInvalidGranularity.WithAttrs(map[string]any{"granularity": granularity})))
+		return
+	}
+	step := granularity.Duration()
+
+	now := events.now()
+	next := now.Truncate(step).Add(-step)
+	if lastEventId := r.Header.Get("Last-Event-ID"); lastEventId != "" {
+		ts, err := strconv.ParseInt(lastEventId, 10, 64)
+		if err != nil {
+			render.Status(r, 400)
+			render.JSON(w, r, errorPayload(r, ErrDataSourceApiServerQueryStringIsInvalid.WithAttrs(map[string]any{"field": "Last-Event-ID"})))
+			return
+		}
+		next = time.Unix(ts, 0).Truncate(step).Add(step)
+		if oldest := now.Truncate(step).Add(-step * priceEventsMaxReplay); next.Before(oldest) {
+			next = oldest
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		render.Status(r, 500)
+		render.JSON(w, r, errorPayload(r, fmt.Errorf("streaming is not supported by %T", w)))
+		return
+	}
+
+	subscriber, from := events.subscribe(symbol, granularity)
+	defer events.unsubscribe(subscriber)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// disables the response buffering of nginx
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, "retry: %d\n\n", priceEventsRetry.Milliseconds())
+	flusher.Flush()
+
+	write := func(tick PriceTick) bool {
+		data, _ := json.Marshal(tick)
+		_, err := fmt.Fprintf(w, "id: %d\nevent: price\ndata: %s\n\n", tick.Ts, data)
+		flusher.Flush()
+		return err == nil
+	}
+
+	ctx := r.Context()
+	for _, tick := range events.replay(ctx, symbol, granularity, next, from) {
+		if !write(tick) {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(events.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-events.done:
+			return
+		case <-subscriber.dropped:
+			return
+		case tick := <-subscriber.ticks:
+			if !write(tick) {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// StreamPrice calls onTick with the price of every step of symbol once the step is over, from the
+// last complete step, until ctx is done or Close is called, e.g. for the gRPC stream of the prices.
+func (events *PriceEvents) StreamPrice(ctx context.Context, symbol string, granularity Granularity, onTick func(PriceTick)) error {
+	return events.stream(ctx, symbol, granularity, func(tick PriceTick) error {
+		onTick(tick)
+		return nil
+	})
+}
+
+func (events *PriceEvents) stream(ctx context.Context, symbol string, granularity Granularity, send func(PriceTick) error) error {
+	if _, ok := GranularityOf(granularity.Duration()); !ok {
+		return ErrInvalidGranularity.WithAttrs(map[string]any{"granularity": granularity})
+	}
+	step := granularity.Duration()
+
+	subscriber, from := events.subscribe(symbol, granularity)
+	defer events.unsubscribe(subscriber)
+
+	for _, tick := range events.replay(ctx, symbol, granularity, events.now().Truncate(step).Add(-step), from) {
+		if err := send(tick); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-events.done:
+			return ErrStreamClosed.WithAttrs(map[string]any{"reason": "shutdown"})
+		case <-subscriber.dropped:
+			return ErrStreamClosed.WithAttrs(map[string]any{"reason": "too slow"})
+		case tick := <-subscriber.ticks:
+			if err := send(tick); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// readPriceEvents calls onTick with the price events of an event stream until it ends.
+func readPriceEvents(ctx context.Context, body io.Reader, onTick func(PriceTick)) error {
+	scanner := bufio.NewScanner(body)
+	var event, data string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if event == "price" && data != "" {
+				var tick PriceTick
+				if err := json.Unmarshal([]byte(data), &tick); err != nil {
+					return ErrDataParseError.WithAttrs(map[string]any{"reason": err.Error()})
+				}
+				onTick(tick)
+			}
+			event, data = "", ""
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return ErrStreamClosed.WithAttrs(map[string]any{"reason": "end of stream"})
+}
+
+// subscribe returns a subscriber of the feed of symbol and granularity, which is started when it
+// is not running, and the first step the subscriber receives.
+func (events *PriceEvents) subscribe(symbol string, granularity Granularity) (*priceSubscriber, time.Time) {
+	events.mu.Lock()
+	defer events.mu.Unlock()
+
+	key := priceFeedKey{symbol: symbol, granularity: granularity}
+	feed, ok := events.feeds[key]
+	if !ok {
+		step := granularity.Duration()
+		ctx, cancel := context.WithCancel(context.Background())
+		feed = &priceFeed{
+			key:         key,
+			next:        events.now().Truncate(step).Add(-step),
+			subscribers: make(map[*priceSubscriber]struct{}),
+			cancel:      cancel,
+		}
+		events.feeds[key] = feed
+		go events.run(ctx, feed, feed.next)
+	}
+
+	subscriber := &priceSubscriber{feed: feed, ticks: make(chan PriceTick, priceEventsBuffer), dropped: make(chan struct{})}
+	feed.subscribers[subscriber] = struct{}{}
+	return subscriber, feed.next
+}
+
+// unsubscribe stops the feed of subscriber once it has no subscriber left.
+func (events *PriceEvents) unsubscribe(subscriber *priceSubscriber) {
+	events.mu.Lock()
+	defer events.mu.Unlock()
+
+	feed := subscriber.feed
+	delete(feed.subscribers, subscriber)
+	if len(feed.subscribers) == 0 && events.feeds[feed.key] == feed {
+		feed.cancel()
+		delete(events.feeds, feed.key)
+	}
+}
+
+// run asks for the price of every step from next once it is due until ctx is done.
+func (events *PriceEvents) run(ctx context.Context, feed *priceFeed, next time.Time) {
+	step := feed.key.granularity.Duration()
+	poll := time.NewTicker(events.poll)
+	defer poll.Stop()
+
+	for {
+		for now := events.now(); !next.Add(step).After(now) && ctx.Err() == nil; next = next.Add(step) {
+			price, err := events.price(ctx, feed.key.symbol, next)
+			if err != nil {
+				if next.Add(step * 2).After(now) {
+					break
+				}
+				slog.Debug("price event skipped", "symbol", feed.key.symbol, "ts", next.Unix(), "err", err)
+			}
+			events.publish(feed, next, price, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-poll.C:
+		}
+	}
+}
+
+// publish sends the price of the step ts to the subscribers of feed, unless it failed, and
+// moves the feed to the following step.
+func (events *PriceEvents) publish(feed *priceFeed, ts time.Time, price float64, err error) {
+	events.mu.Lock()
+	defer events.mu.Unlock()
+
+	feed.next = ts.Add(feed.key.granularity.Duration())
+	if err != nil {
+		return
+	}
+
+	tick := PriceTick{Symbol: feed.key.symbol, Price: price, Ts: ts.Unix()}
+	for subscriber := range feed.subscribers {
+		select {
+		case subscriber.ticks <- tick:
+		default:
+			delete(feed.subscribers, subscriber)
+			close(subscriber.dropped)
+		}
+	}
+}
+
+// replay returns the prices of the steps from from until until with one batch of the datasource,
+// the steps whose price fails are skipped.
+func (events *PriceEvents) replay(ctx context.Context, symbol string, granularity Granularity, from time.Time, until time.Time) []PriceTick {
+	var queries []PriceQuery
+	for ts := from; ts.Before(until); ts = ts.Add(granularity.Duration()) {
+		queries = append(queries, PriceQuery{Symbol: symbol, Ts: ts})
+	}
+	if len(queries) == 0 {
+		return nil
+	}
+
+	results, err := PricesOf(ctx, events.dataSource, queries)
+	if err != nil {
+		slog.Warn("price events replay fail", "symbol", symbol, "from", from.Unix(), "until", until.Unix(), "err", err)
+		return nil
+	}
+
+	ticks := make([]PriceTick, 0, len(queries))
+	for i, result := range results {
+		if result.Err != nil {
+			slog.Debug("price event skipped", "symbol", symbol, "ts", queries[i].Ts.Unix(), "err", result.Err)
+			continue
+		}
+		ticks = append(ticks, PriceTick{Symbol: symbol, Price: result.Price.Price, Ts: queries[i].Ts.Unix()})
+	}
+	return ticks
+}
+
+func (events *PriceEvents) price(ctx context.Context, symbol string, ts time.Time) (float64, error) {
+	if dataSource, ok := events.dataSource.(PriceDataSourceContext); ok {
+		return dataSource.PriceContext(ctx, symbol, ts)
+	}
+	return events.dataSource.Price(symbol, ts)
+}
+
+// Close ends the running streams, the clients reconnect after the retry delay.
+func (events *PriceEvents) Close() {
+	events.closeOnce.Do(func() { close(events.done) })
+}
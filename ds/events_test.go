@@ -0,0 +1,258 @@
+package ds
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type priceEventsClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (clock *priceEventsClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	return clock.now
+}
+
+func (clock *priceEventsClock) set(now time.Time) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	clock.now = now
+}
+
+// readPriceEvent returns the next price event of reader, the heartbeats are counted.
+func readPriceEvent(t *testing.T, reader *bufio.Reader, heartbeats *int) (string, PriceTick) {
+	var id string
+	var tick PriceTick
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case line == ": heartbeat":
+			*heartbeats++
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &tick))
+		case line == "" && id != "":
+			return id, tick
+		}
+	}
+}
+
+func TestPriceEvents(t *testing.T) {
+	// base is a minute boundary
+	base := time.Unix(1699999980, 0)
+	clock := &priceEventsClock{now: base.Add(time.Second * 30)}
+	server := NewDataSourceApiServer(&grpcTestDataSource{requestIds: make(chan string, 1)}, ":0")
+	events, err := NewPriceEvents(server.dataSource, PriceEventsPollOption(time.Millisecond*5), PriceEventsHeartbeatOption(time.Millisecond*20))
+	require.NoError(t, err)
+	events.now = clock.Now
+	server.events = events
+	httpServer := httptest.NewServer(server.Router)
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	open := func(query string, lastEventId string) *http.Response {
+		request, err := http.NewRequestWithContext(ctx, "GET", httpServer.URL+"/api/v1/events?"+query, nil)
+		require.NoError(t, err)
+		if lastEventId != "" {
+			request.Header.Set("Last-Event-ID", lastEventId)
+		}
+		resp, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		return resp
+	}
+
+	// the stream starts with the last complete minute
+	resp := open("symbol=BTCUSD", "")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	reader := bufio.NewReader(resp.Body)
+	heartbeats := 0
+	id, tick := readPriceEvent(t, reader, &heartbeats)
+	assert.Equal(t, "1699999920", id)
+	assert.Equal(t, PriceTick{Symbol: "BTCUSD", Price: 1699999920, Ts: 1699999920}, tick)
+
+	// the idle connection gets heartbeats until the minute is over
+	time.Sleep(time.Millisecond * 50)
+	clock.set(base.Add(time.Minute))
+	id, _ = readPriceEvent(t, reader, &heartbeats)
+	assert.Equal(t, "1699999980", id)
+	assert.NotZero(t, heartbeats)
+
+	// Close ends the stream
+	events.Close()
+	_, err = reader.ReadString('\n')
+	for err == nil {
+		_, err = reader.ReadString('\n')
+	}
+	resp.Body.Close()
+
+	// a reconnecting client resumes after its last event
+	events, err = NewPriceEvents(server.dataSource, PriceEventsPollOption(time.Millisecond*5))
+	require.NoError(t, err)
+	events.now = clock.Now
+	server.events = events
+	resp = open("symbol=BTCUSD", "1699999860")
+	reader = bufio.NewReader(resp.Body)
+	id, _ = readPriceEvent(t, reader, &heartbeats)
+	assert.Equal(t, "1699999920", id)
+	id, _ = readPriceEvent(t, reader, &heartbeats)
+	assert.Equal(t, "1699999980", id)
+	resp.Body.Close()
+
+	resp = open("symbol=BTCUSD&granularity=1M", "")
+	assert.Equal(t, 400, resp.StatusCode)
+	resp.Body.Close()
+	resp = open("symbol=BTCUSD", "yesterday")
+	assert.Equal(t, 400, resp.StatusCode)
+	resp.Body.Close()
+	resp = open("", "")
+	assert.Equal(t, 400, resp.StatusCode)
+	resp.Body.Close()
+}
+
+func TestPriceEventsSkipsMissingPrices(t *testing.T) {
+	base := time.Unix(1699999980, 0)
+	clock := &priceEventsClock{now: base.Add(time.Second * 30)}
+	dataSource := &priceEventsDataSource{missing: base.Add(-time.Minute)}
+	events, err := NewPriceEvents(dataSource, PriceEventsPollOption(time.Millisecond*5))
+	require.NoError(t, err)
+	events.now = clock.Now
+
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events.Serve(w, r, "BTCUSD")
+	}))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "retry: 3000\n", line)
+
+	// the missing minute is waited for until the next minute is over
+	time.Sleep(time.Millisecond * 20)
+	clock.set(base.Add(time.Minute))
+	heartbeats := 0
+	id, _ := readPriceEvent(t, reader, &heartbeats)
+	assert.Equal(t, "1699999980", id)
+}
+
+// priceEventsDataSource has no price at missing.
+type priceEventsDataSource struct {
+	missing time.Time
+}
+
+func (dataSource *priceEventsDataSource) Price(symbol string, ts time.Time) (float64, error) {
+	if ts.Equal(dataSource.missing) {
+		return 0, &ErrNoData
+	}
+	return float64(ts.Unix()), nil
+}
+
+func TestPriceEventsShareOneFeed(t *testing.T) {
+	base := time.Unix(1699999980, 0)
+	clock := &priceEventsClock{now: base.Add(time.Second * 30)}
+	dataSource := &priceEventsBatchDataSource{}
+	events, err := NewPriceEvents(dataSource, PriceEventsPollOption(time.Millisecond*5))
+	require.NoError(t, err)
+	events.now = clock.Now
+
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events.Serve(w, r, "BTCUSD")
+	}))
+	// the cleanups run last first, the bodies are closed before the server
+	t.Cleanup(httpServer.Close)
+
+	open := func(lastEventId string) *bufio.Reader {
+		request, err := http.NewRequest("GET", httpServer.URL, nil)
+		require.NoError(t, err)
+		if lastEventId != "" {
+			request.Header.Set("Last-Event-ID", lastEventId)
+		}
+		resp, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return bufio.NewReader(resp.Body)
+	}
+
+	heartbeats := 0
+	first := open("")
+	second := open("")
+	for _, reader := range []*bufio.Reader{first, second} {
+		id, _ := readPriceEvent(t, reader, &heartbeats)
+		assert.Equal(t, "1699999920", id)
+	}
+
+	// the replay of a client resuming ten minutes back is one batch
+	third := open("1699999320")
+	for ts := 1699999380; ts <= 1699999920; ts += 60 {
+		id, _ := readPriceEvent(t, third, &heartbeats)
+		assert.Equal(t, strconv.Itoa(ts), id)
+	}
+
+	clock.set(base.Add(time.Minute))
+	for _, reader := range []*bufio.Reader{first, second, third} {
+		id, _ := readPriceEvent(t, reader, &heartbeats)
+		assert.Equal(t, "1699999980", id)
+	}
+
+	prices, batches := dataSource.counts()
+	assert.Equal(t, 2, prices)
+	assert.LessOrEqual(t, batches, 2)
+	events.mu.Lock()
+	assert.Len(t, events.feeds, 1)
+	events.mu.Unlock()
+}
+
+// priceEventsBatchDataSource counts the prices and the batches it is asked for.
+type priceEventsBatchDataSource struct {
+	mu      sync.Mutex
+	prices  int
+	batches int
+}
+
+func (dataSource *priceEventsBatchDataSource) Price(symbol string, ts time.Time) (float64, error) {
+	dataSource.mu.Lock()
+	defer dataSource.mu.Unlock()
+	dataSource.prices++
+	return float64(ts.Unix()), nil
+}
+
+func (dataSource *priceEventsBatchDataSource) Prices(ctx context.Context, queries []PriceQuery) ([]PriceResult, error) {
+	dataSource.mu.Lock()
+	defer dataSource.mu.Unlock()
+	dataSource.batches++
+	results := make([]PriceResult, len(queries))
+	for i, query := range queries {
+		results[i] = PriceResult{Price: PriceApiModel{Price: float64(query.Ts.Unix())}}
+	}
+	return results, nil
+}
+
+func (dataSource *priceEventsBatchDataSource) counts() (int, int) {
+	dataSource.mu.Lock()
+	defer dataSource.mu.Unlock()
+	return dataSource.prices, dataSource.batches
+}
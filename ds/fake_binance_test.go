@@ -0,0 +1,68 @@
+package ds
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+)
+
+// fakeBinance serves /api/v3/klines with one kline per interval step,
+// the open price of a kline is its open time in seconds.
+type fakeBinance struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	requests int
+}
+
+func newFakeBinance() *fakeBinance {
+	fake := &fakeBinance{}
+	fake.server = httptest.NewServer(http.HandlerFunc(fake.klines))
+	return fake
+}
+
+func fakeKlineOpen(ts int64) float64 {
+	return float64(ts / 1000)
+}
+
+func (fake *fakeBinance) requestCount() int {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	return fake.requests
+}
+
+func (fake *fakeBinance) klines(w http.ResponseWriter, r *http.Request) {
+	fake.mu.Lock()
+	fake.requests++
+	weight := fake.requests * 2
+	fake.mu.Unlock()
+
+	w.Header().Set("X-MBX-USED-WEIGHT-1M", strconv.Itoa(weight))
+
+	query := r.URL.Query()
+	step := Granularity(query.Get("interval")).Duration().Milliseconds()
+	if r.URL.Path != "/api/v3/klines" || step == 0 || query.Get("symbol") == "" {
+		w.WriteHeader(400)
+		w.Write([]byte(`{"code":-1121,"msg":"Invalid symbol."}`))
+		return
+	}
+
+	startTime, _ := strconv.ParseInt(query.Get("startTime"), 10, 64)
+	endTime, err := strconv.ParseInt(query.Get("endTime"), 10, 64)
+	if err != nil {
+		endTime = startTime + step*1000
+	}
+	limit, _ := strconv.Atoi(query.Get("limit"))
+
+	klines := [][]any{}
+	first := (startTime + step - 1) / step * step
+	for ts := first; ts <= endTime && len(klines) < limit; ts += step {
+		klines = append(klines, []any{ts, strconv.FormatFloat(fakeKlineOpen(ts), 'f', -1, 64), "0", "0", "0"})
+	}
+
+	b, _ := json.Marshal(klines)
+	w.Write(b)
+}
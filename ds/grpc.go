@@ -0,0 +1,669 @@
+package ds
+
+import (
+	"context"
+	"crypto/tls"
+	"cti/ds/dspb"
+	"cti/logging"
+	"cti/tracing"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"time"
+)
+
+// grpcRequestIdKey is the metadata key of the request id, the gRPC counterpart of X-Request-ID.
+const grpcRequestIdKey = "x-request-id"
+
+// DataSourceGrpcServer serves a DataSource over gRPC, the counterpart of DataSourceApiServer.
+type DataSourceGrpcServer struct {
+	dspb.UnimplementedDataSourceServer
+	dataSource DataSource
+	events     *PriceEvents
+	listenAddr string
+	tlsConfig  *tls.Config
+	grpcServer *grpc.Server
+}
+
+type DataSourceGrpcServerOption func(*DataSourceGrpcServer) error
+
+// DataSourceGrpcServerTlsOption serves TLS, e.g. with the config of tlsutil.ServerConfig.
+func DataSourceGrpcServerTlsOption(tlsConfig *tls.Config) DataSourceGrpcServerOption {
+	return func(server *DataSourceGrpcServer) error {
+		server.tlsConfig = tlsConfig
+		return nil
+	}
+}
+
+func NewDataSourceGrpcServer(dataSource DataSource, listenAddr string, options ...DataSourceGrpcServerOption) (*DataSourceGrpcServer, error) {
+	server := &DataSourceGrpcServer{dataSource: dataSource, listenAddr: listenAddr}
+	server.events, _ = NewPriceEvents(dataSource)
+	for _, option := range options {
+		err := option(server)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	serverOptions := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(grpcUnaryServerInterceptor),
+		grpc.ChainStreamInterceptor(grpcStreamServerInterceptor),
+	}
+	if server.tlsConfig != nil {
+		serverOptions = append(serverOptions, grpc.Creds(credentials.NewTLS(server.tlsConfig)))
+	}
+	server.grpcServer = grpc.NewServer(serverOptions...)
+	dspb.RegisterDataSourceServer(server.grpcServer, server)
+
+	return server, nil
+}
+
+// ListenAndServe returns http.ErrServerClosed after Shutdown, like the HTTP servers.
+func (server *DataSourceGrpcServer) ListenAndServe() error {
+	listener, err := net.Listen("tcp", server.listenAddr)
+	if err != nil {
+		return err
+	}
+	return server.Serve(listener)
+}
+
+func (server *DataSourceGrpcServer) Serve(listener net.Listener) error {
+	err := server.grpcServer.Serve(listener)
+	if err == nil || errors.Is(err, grpc.ErrServerStopped) {
+		return http.ErrServerClosed
+	}
+	return err
+}
+
+// Shutdown stops accepting connections and waits for the in-flight calls until ctx is done,
+// then closes the remaining connections. The price streams are closed right away.
+func (server *DataSourceGrpcServer) Shutdown(ctx context.Context) error {
+	server.events.Close()
+	stopped := make(chan struct{})
+	go func() {
+		server.grpcServer.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		server.grpcServer.Stop()
+		return ctx.Err()
+	}
+}
+
+func (server *DataSourceGrpcServer) Price(ctx context.Context, req *dspb.PriceRequest) (*dspb.PriceResponse, error) {
+	logging.AddFields(ctx, "symbol", req.Symbol, "ts", req.Ts)
+	price, err := server.price(ctx, req)
+	if err != nil {
+		return nil, grpcStatus(ctx, err)
+	}
+	return &dspb.PriceResponse{Price: price}, nil
+}
+
+func (server *DataSourceGrpcServer) Average(ctx context.Context, req *dspb.AverageRequest) (*dspb.AverageResponse, error) {
+	logging.AddFields(ctx, "symbol", req.Symbol, "from", req.From, "until", req.Until)
+	resp, err := server.average(ctx, req)
+	if err != nil {
+		return nil, grpcStatus(ctx, err)
+	}
+	return resp, nil
+}
+
+func (server *DataSourceGrpcServer) StreamPrice(stream dspb.DataSource_StreamPriceServer) error {
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		resp := &dspb.PriceResponse{}
+		resp.Price, err = server.price(stream.Context(), req)
+		if err != nil {
+			resp = &dspb.PriceResponse{Error: protoError(err)}
+		}
+		if err = stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+func (server *DataSourceGrpcServer) StreamAverage(stream dspb.DataSource_StreamAverageServer) error {
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		resp, err := server.average(stream.Context(), req)
+		if err != nil {
+			resp = &dspb.AverageResponse{Error: protoError(err)}
+		}
+		if err = stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// WatchPrice pushes the prices of the symbol of req, the clients of a symbol and granularity
+// share one feed, see PriceEvents.
+func (server *DataSourceGrpcServer) WatchPrice(req *dspb.WatchPriceRequest, stream dspb.DataSource_WatchPriceServer) error {
+	ctx := stream.Context()
+	logging.AddFields(ctx, "symbol", req.Symbol, "granularity", req.Granularity)
+	if req.Symbol == "" {
+		return grpcStatus(ctx, fmt.Errorf("%w: symbol", ErrDataSourceApiServerQueryStringIsRequired.WithAttrs(map[string]any{"field": "symbol"})))
+	}
+	granularity := Granularity(req.Granularity)
+	if granularity == "" {
+		granularity = Granularity1m
+	}
+
+	err := server.events.stream(ctx, req.Symbol, granularity, func(tick PriceTick) error {
+		return stream.Send(&dspb.PriceTick{Symbol: tick.Symbol, Price: tick.Price, Ts: tick.Ts})
+	})
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return grpcStatus(ctx, err)
+}
+
+// Series answers a page of a series like DataSourceApiServer.Series, the request is validated
+// as its query string.
+func (server *DataSourceGrpcServer) Series(ctx context.Context, req *dspb.SeriesRequest) (*dspb.SeriesResponse, error) {
+	logging.AddFields(ctx, "symbol", req.Symbol, "granularity", req.Granularity)
+	values := neturl.Values{}
+	values.Set("symbol", req.Symbol)
+	values.Set("from", strconv.FormatInt(req.From, 10))
+	values.Set("until", strconv.FormatInt(req.Until, 10))
+	values.Set("granularity", req.Granularity)
+	values.Set("cursor", req.Cursor)
+	if req.Limit != 0 {
+		values.Set("limit", strconv.Itoa(int(req.Limit)))
+	}
+	query, err := ParseSeriesQuery(values)
+	if err == nil && query.Symbol == "" {
+		err = fmt.Errorf("%w: symbol", ErrDataSourceApiServerQueryStringIsRequired.WithAttrs(map[string]any{"field": "symbol"}))
+	}
+	if err != nil {
+		return nil, grpcStatus(ctx, err)
+	}
+
+	seriesDataSource, ok := server.dataSource.(SeriesDataSource)
+	if !ok {
+		return nil, grpcStatus(ctx, &ErrSeriesNotSupported)
+	}
+	page, err := SeriesPage(ctx, seriesDataSource, query)
+	if err != nil {
+		return nil, grpcStatus(ctx, err)
+	}
+
+	resp := &dspb.SeriesResponse{Symbol: page.Symbol, Granularity: string(page.Granularity), NextCursor: page.NextCursor}
+	for _, point := range page.Points {
+		resp.Points = append(resp.Points, &dspb.SeriesPoint{Ts: point.Ts, Price: point.Price})
+	}
+	return resp, nil
+}
+
+func (server *DataSourceGrpcServer) price(ctx context.Context, req *dspb.PriceRequest) (float64, error) {
+	if req.Symbol == "" {
+		return 0, fmt.Errorf("%w: symbol", ErrDataSourceApiServerQueryStringIsRequired.WithAttrs(map[string]any{"field": "symbol"}))
+	}
+
+	if dataSource, ok := server.dataSource.(PriceDataSourceContext); ok {
+		return dataSource.PriceContext(ctx, req.Symbol, time.Unix(req.Ts, 0))
+	}
+	return server.dataSource.Price(req.Symbol, time.Unix(req.Ts, 0))
+}
+
+func (server *DataSourceGrpcServer) average(ctx context.Context, req *dspb.AverageRequest) (*dspb.AverageResponse, error) {
+	if req.Symbol == "" {
+		return nil, fmt.Errorf("%w: symbol", ErrDataSourceApiServerQueryStringIsRequired.WithAttrs(map[string]any{"field": "symbol"}))
+	}
+	granularity := Granularity(req.Granularity)
+	if granularity == "" {
+		granularity = Granularity1s
+	}
+	if !granularity.IsValid() {
+		return nil, fmt.Errorf(`%w: "%s" granularity is not support`, ErrDataSourceApiServerQueryStringIsInvalid.WithAttrs(map[string]any{"field": "granularity"}), granularity)
+	}
+
+	var result float64
+	var exactFrom, exactUntil time.Time
+	var err error
+	if dataSource, ok := server.dataSource.(AverageDataSourceContext); ok {
+		result, exactFrom, exactUntil, err = dataSource.AverageContext(ctx, req.Symbol, time.Unix(req.From, 0), time.Unix(req.Until, 0), granularity)
+	} else {
+		result, exactFrom, exactUntil, err = server.dataSource.Average(req.Symbol, time.Unix(req.From, 0), time.Unix(req.Until, 0), granularity)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &dspb.AverageResponse{Average: result, From: exactFrom.Unix(), Until: exactUntil.Unix()}, nil
+}
+
+// protoError converts err like the error payload of the HTTP API.
+func protoError(err error) *dspb.Error {
+	payload := NewErrorPayload(err)
+	e := &dspb.Error{Code: payload.Code, Msg: payload.Msg}
+	if len(payload.Attr) > 0 {
+		e.Attr = make(map[string]string, len(payload.Attr))
+		for k, v := range payload.Attr {
+			e.Attr[k] = fmt.Sprint(v)
+		}
+	}
+	return e
+}
+
+// grpcStatus returns the status of a failed call with the error as detail.
+func grpcStatus(ctx context.Context, err error) error {
+	if ctx.Err() != nil && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+		return status.FromContextError(err).Err()
+	}
+
+	e := protoError(err)
+	code := codes.Unavailable
+	switch e.Code {
+	case ErrNoData.Code:
+		code = codes.NotFound
+	case ErrSeriesNotSupported.Code:
+		code = codes.Unimplemented
+	case ErrDataSourceApiServerQueryStringIsRequired.Code, ErrDataSourceApiServerQueryStringIsInvalid.Code, ErrInvalidGranularity.Code, ErrInvalidSymbol.Code:
+		code = codes.InvalidArgument
+	}
+
+	s, detailErr := status.New(code, e.Msg).WithDetails(e)
+	if detailErr != nil {
+		return status.Error(code, e.Msg)
+	}
+	return s.Err()
+}
+
+// grpcError returns the ErrorPayload of a failed call, like the HTTP client, or err itself
+// when the call failed before the server answered.
+func grpcError(err error) error {
+	s, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	for _, detail := range s.Details() {
+		if e, ok := detail.(*dspb.Error); ok {
+			return errorPayloadOf(e)
+		}
+	}
+	return err
+}
+
+func errorPayloadOf(e *dspb.Error) ErrorPayload {
+	payload := ErrorPayload{Code: e.Code, Msg: e.Msg}
+	if len(e.Attr) > 0 {
+		payload.Attr = make(map[string]any, len(e.Attr))
+		for k, v := range e.Attr {
+			payload.Attr[k] = v
+		}
+	}
+	return payload
+}
+
+// metadataCarrier carries the trace context in the metadata of a call.
+type metadataCarrier metadata.MD
+
+func (carrier metadataCarrier) Get(key string) string {
+	values := metadata.MD(carrier).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (carrier metadataCarrier) Set(key string, value string) {
+	metadata.MD(carrier).Set(key, value)
+}
+
+func (carrier metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(carrier))
+	for key := range carrier {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// startGrpcCall continues the trace and the request id of the incoming call, the returned
+// func ends its span and writes its request log line.
+func startGrpcCall(ctx context.Context, method string) (context.Context, func(err error)) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = tracing.ExtractCarrier(ctx, metadataCarrier(md))
+	ctx, request := logging.StartRequest(ctx, metadataCarrier(md).Get(grpcRequestIdKey))
+	ctx, span := tracing.Tracer().Start(ctx, method, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("rpc.system", "grpc"), attribute.String("service", "datasource")))
+
+	return ctx, func(err error) {
+		code := status.Code(err)
+		span.SetAttributes(attribute.String("rpc.grpc.status_code", code.String()))
+
+		level := slog.LevelInfo
+		switch code {
+		case codes.OK:
+		case codes.Unknown, codes.Internal, codes.Unavailable, codes.DataLoss:
+			level = slog.LevelError
+			tracing.End(span, err)
+		default:
+			level = slog.LevelWarn
+		}
+		if level != slog.LevelError {
+			span.End()
+		}
+
+		request.End(ctx, level, "service", "datasource", "method", "grpc", "route", method, "status", code.String())
+	}
+}
+
+func grpcUnaryServerInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, end := startGrpcCall(ctx, info.FullMethod)
+	resp, err := handler(ctx, req)
+	end(err)
+	return resp, err
+}
+
+func grpcStreamServerInterceptor(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, end := startGrpcCall(stream.Context(), info.FullMethod)
+	err := handler(srv, &contextServerStream{ServerStream: stream, ctx: ctx})
+	end(err)
+	return err
+}
+
+type contextServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (stream *contextServerStream) Context() context.Context {
+	return stream.ctx
+}
+
+// outgoingContext adds the trace context and the request id of ctx to the metadata of a call.
+func outgoingContext(ctx context.Context) context.Context {
+	md := metadata.MD{}
+	tracing.InjectCarrier(ctx, metadataCarrier(md))
+	if requestId := logging.RequestId(ctx); requestId != "" {
+		md.Set(grpcRequestIdKey, requestId)
+	}
+	if existing, ok := metadata.FromOutgoingContext(ctx); ok {
+		md = metadata.Join(existing, md)
+	}
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+func grpcUnaryClientInterceptor(ctx context.Context, method string, req any, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	ctx, span := tracing.Tracer().Start(ctx, method, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("rpc.system", "grpc"), attribute.String("net.peer.name", cc.Target())))
+	err := invoker(outgoingContext(ctx), method, req, reply, cc, opts...)
+	tracing.End(span, err)
+	return err
+}
+
+func grpcStreamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(outgoingContext(ctx), desc, cc, method, opts...)
+}
+
+// GrpcDataSourceApiClient is a DataSourceApiClient of a DataSourceGrpcServer.
+type GrpcDataSourceApiClient struct {
+	conn      *grpc.ClientConn
+	client    dspb.DataSourceClient
+	tlsConfig *tls.Config
+	timeout   time.Duration
+}
+
+type GrpcDataSourceApiClientOption func(*GrpcDataSourceApiClient) error
+
+// GrpcDataSourceApiClientTlsOption sets the TLS config of grpcs:// urls, e.g. from tlsutil.ClientConfig.
+func GrpcDataSourceApiClientTlsOption(tlsConfig *tls.Config) GrpcDataSourceApiClientOption {
+	return func(client *GrpcDataSourceApiClient) error {
+		client.tlsConfig = tlsConfig
+		return nil
+	}
+}
+
+// GrpcDataSourceApiClientTimeoutOption limits the time of one call, or of one stream of Prices or Averages.
+func GrpcDataSourceApiClientTimeoutOption(timeout time.Duration) GrpcDataSourceApiClientOption {
+	return func(client *GrpcDataSourceApiClient) error {
+		client.timeout = timeout
+		return nil
+	}
+}
+
+// NewGrpcDataSourceApiClient connects to grpc://host:port, or grpcs://host:port over TLS.
+// The connection is established lazily and reconnects on failures.
+func NewGrpcDataSourceApiClient(target string, options ...GrpcDataSourceApiClientOption) (*GrpcDataSourceApiClient, error) {
+	u, err := neturl.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &GrpcDataSourceApiClient{}
+	for _, option := range options {
+		err = option(client)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var creds credentials.TransportCredentials
+	switch u.Scheme {
+	case "grpc":
+		creds = insecure.NewCredentials()
+	case "grpcs":
+		tlsConfig := client.tlsConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	default:
+		return nil, ErrUnsupportedProtocolScheme.WithAttrs(map[string]any{"scheme": u.Scheme})
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("grpc url has no host: %s", target)
+	}
+
+	client.conn, err = grpc.Dial(u.Host,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithChainUnaryInterceptor(grpcUnaryClientInterceptor),
+		grpc.WithChainStreamInterceptor(grpcStreamClientInterceptor))
+	if err != nil {
+		return nil, err
+	}
+	client.client = dspb.NewDataSourceClient(client.conn)
+
+	return client, nil
+}
+
+func (client *GrpcDataSourceApiClient) callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if client.timeout > 0 {
+		return context.WithTimeout(ctx, client.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func (client *GrpcDataSourceApiClient) Price(symbol string, ts time.Time) (PriceApiModel, error) {
+	return client.PriceContext(context.Background(), symbol, ts)
+}
+
+func (client *GrpcDataSourceApiClient) PriceContext(ctx context.Context, symbol string, ts time.Time) (PriceApiModel, error) {
+	ctx, cancel := client.callContext(ctx)
+	defer cancel()
+
+	resp, err := client.client.Price(ctx, &dspb.PriceRequest{Symbol: symbol, Ts: ts.Unix()})
+	if err != nil {
+		return PriceApiModel{}, grpcError(err)
+	}
+	return PriceApiModel{Price: resp.Price}, nil
+}
+
+func (client *GrpcDataSourceApiClient) Average(symbol string, from time.Time, until time.Time, granularity Granularity) (PriceAverageApiModel, error) {
+	return client.AverageContext(context.Background(), symbol, from, until, granularity)
+}
+
+func (client *GrpcDataSourceApiClient) AverageContext(ctx context.Context, symbol string, from time.Time, until time.Time, granularity Granularity) (PriceAverageApiModel, error) {
+	ctx, cancel := client.callContext(ctx)
+	defer cancel()
+
+	resp, err := client.client.Average(ctx, &dspb.AverageRequest{Symbol: symbol, From: from.Unix(), Until: until.Unix(), Granularity: string(granularity)})
+	if err != nil {
+		return PriceAverageApiModel{}, grpcError(err)
+	}
+	return PriceAverageApiModel{Average: resp.Average, From: resp.From, Until: resp.Until}, nil
+}
+
+// SeriesPage reads a page of a series with the Series call.
+func (client *GrpcDataSourceApiClient) SeriesPage(ctx context.Context, query SeriesQuery) (SeriesApiModel, error) {
+	ctx, cancel := client.callContext(ctx)
+	defer cancel()
+
+	resp, err := client.client.Series(ctx, &dspb.SeriesRequest{
+		Symbol:      query.Symbol,
+		From:        query.From.Unix(),
+		Until:       query.Until.Unix(),
+		Granularity: string(query.Granularity),
+		Limit:       int32(query.Limit),
+		Cursor:      query.Cursor,
+	})
+	if err != nil {
+		return SeriesApiModel{}, grpcError(err)
+	}
+
+	page := SeriesApiModel{Symbol: resp.Symbol, Granularity: Granularity(resp.Granularity), Points: make([]SeriesPointApiModel, 0, len(resp.Points)), NextCursor: resp.NextCursor}
+	for _, point := range resp.Points {
+		page.Points = append(page.Points, SeriesPointApiModel{Ts: point.Ts, Price: point.Price})
+	}
+	return page, nil
+}
+
+// Prices requests the prices of queries on one stream, the result i is the answer of query i.
+// The error is set when the stream failed.
+func (client *GrpcDataSourceApiClient) Prices(ctx context.Context, queries []PriceQuery) ([]PriceResult, error) {
+	ctx, span := tracing.Start(ctx, "GrpcDataSourceApiClient.Prices", attribute.Int("queries", len(queries)))
+	ctx, cancel := client.callContext(ctx)
+	defer cancel()
+
+	stream, err := client.client.StreamPrice(ctx)
+	if err != nil {
+		tracing.End(span, err)
+		return nil, grpcError(err)
+	}
+	go func() {
+		for _, query := range queries {
+			if stream.Send(&dspb.PriceRequest{Symbol: query.Symbol, Ts: query.Ts.Unix()}) != nil {
+				return
+			}
+		}
+		_ = stream.CloseSend()
+	}()
+
+	results := make([]PriceResult, 0, len(queries))
+	for range queries {
+		resp, err := stream.Recv()
+		if err != nil {
+			tracing.End(span, err)
+			return nil, grpcError(err)
+		}
+
+		result := PriceResult{Price: PriceApiModel{Price: resp.Price}}
+		if resp.Error != nil {
+			result = PriceResult{Err: errorPayloadOf(resp.Error)}
+		}
+		results = append(results, result)
+	}
+
+	tracing.End(span, nil)
+	return results, nil
+}
+
+// Averages requests the averages of queries on one stream, the result i is the answer of query i.
+// The error is set when the stream failed.
+func (client *GrpcDataSourceApiClient) Averages(ctx context.Context, queries []AverageQuery) ([]AverageResult, error) {
+	ctx, span := tracing.Start(ctx, "GrpcDataSourceApiClient.Averages", attribute.Int("queries", len(queries)))
+	ctx, cancel := client.callContext(ctx)
+	defer cancel()
+
+	stream, err := client.client.StreamAverage(ctx)
+	if err != nil {
+		tracing.End(span, err)
+		return nil, grpcError(err)
+	}
+	go func() {
+		for _, query := range queries {
+			req := &dspb.AverageRequest{Symbol: query.Symbol, From: query.From.Unix(), Until: query.Until.Unix(), Granularity: string(query.Granularity)}
+			if stream.Send(req) != nil {
+				return
+			}
+		}
+		_ = stream.CloseSend()
+	}()
+
+	results := make([]AverageResult, 0, len(queries))
+	for range queries {
+		resp, err := stream.Recv()
+		if err != nil {
+			tracing.End(span, err)
+			return nil, grpcError(err)
+		}
+
+		result := AverageResult{Average: PriceAverageApiModel{Average: resp.Average, From: resp.From, Until: resp.Until}}
+		if resp.Error != nil {
+			result = AverageResult{Err: errorPayloadOf(resp.Error)}
+		}
+		results = append(results, result)
+	}
+
+	tracing.End(span, nil)
+	return results, nil
+}
+
+// StreamPrice streams the prices of symbol pushed by WatchPrice until ctx is done or the stream
+// ends, the timeout of the calls does not apply.
+func (client *GrpcDataSourceApiClient) StreamPrice(ctx context.Context, symbol string, granularity Granularity, onTick func(PriceTick)) error {
+	stream, err := client.client.WatchPrice(ctx, &dspb.WatchPriceRequest{Symbol: symbol, Granularity: string(granularity)})
+	if err != nil {
+		return grpcError(err)
+	}
+
+	for {
+		tick, err := stream.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, io.EOF) {
+				return ErrStreamClosed.WithAttrs(map[string]any{"reason": "end of stream"})
+			}
+			return grpcError(err)
+		}
+		onTick(PriceTick{Symbol: tick.Symbol, Price: tick.Price, Ts: tick.Ts})
+	}
+}
+
+// Close closes the connection, the calls in flight fail.
+func (client *GrpcDataSourceApiClient) Close() error {
+	return client.conn.Close()
+}
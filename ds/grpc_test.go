@@ -0,0 +1,206 @@
+package ds
+
+import (
+	"context"
+	"cti/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// grpcTestDataSource prices BTCUSD at its timestamp and records the request id of the calls.
+type grpcTestDataSource struct {
+	requestIds chan string
+}
+
+func (dataSource *grpcTestDataSource) Price(symbol string, ts time.Time) (float64, error) {
+	return dataSource.PriceContext(context.Background(), symbol, ts)
+}
+
+func (dataSource *grpcTestDataSource) PriceContext(ctx context.Context, symbol string, ts time.Time) (float64, error) {
+	select {
+	case dataSource.requestIds <- logging.RequestId(ctx):
+	default:
+	}
+	if symbol != "BTCUSD" {
+		return 0, &ErrNoData
+	}
+	return float64(ts.Unix()), nil
+}
+
+func (dataSource *grpcTestDataSource) Average(symbol string, from time.Time, until time.Time, granularity Granularity) (float64, time.Time, time.Time, error) {
+	if symbol != "BTCUSD" {
+		return 0, time.Time{}, time.Time{}, &ErrNoData
+	}
+	return 2, from.Truncate(time.Minute), until.Truncate(time.Minute), nil
+}
+
+// grpcSeriesDataSource adds a candle of every step at its timestamp to grpcTestDataSource.
+type grpcSeriesDataSource struct {
+	*grpcTestDataSource
+}
+
+func (dataSource grpcSeriesDataSource) Series(ctx context.Context, symbol string, from time.Time, until time.Time, granularity Granularity, limit int) ([]Candle, error) {
+	var candles []Candle
+	for ts := from; ts.Before(until) && len(candles) < limit; ts = ts.Add(granularity.Duration()) {
+		candles = append(candles, Candle{Ts: ts, Open: float64(ts.Unix())})
+	}
+	return candles, nil
+}
+
+type DataSourceGrpcTestSuite struct {
+	dataSource *grpcTestDataSource
+	server     *DataSourceGrpcServer
+	client     *GrpcDataSourceApiClient
+	serveErr   chan error
+	suite.Suite
+}
+
+func (suite *DataSourceGrpcTestSuite) SetupTest() {
+	suite.dataSource = &grpcTestDataSource{requestIds: make(chan string, 1)}
+
+	var err error
+	suite.server, err = NewDataSourceGrpcServer(suite.dataSource, "127.0.0.1:0")
+	suite.Require().Nil(err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	suite.Require().Nil(err)
+	suite.serveErr = make(chan error, 1)
+	go func() {
+		suite.serveErr <- suite.server.Serve(listener)
+	}()
+
+	suite.client, err = NewGrpcDataSourceApiClient("grpc://"+listener.Addr().String(), GrpcDataSourceApiClientTimeoutOption(time.Second*5))
+	suite.Require().Nil(err)
+}
+
+func (suite *DataSourceGrpcTestSuite) TearDownTest() {
+	suite.Nil(suite.client.Close())
+	suite.Nil(suite.server.Shutdown(context.Background()))
+	suite.ErrorIs(<-suite.serveErr, http.ErrServerClosed)
+}
+
+func (suite *DataSourceGrpcTestSuite) TestPrice() {
+	price, err := suite.client.Price("BTCUSD", time.Unix(1677000000, 0))
+	suite.Nil(err)
+	suite.Equal(PriceApiModel{Price: 1677000000}, price)
+}
+
+func (suite *DataSourceGrpcTestSuite) TestPriceRequestId() {
+	ctx, request := logging.StartRequest(context.Background(), "")
+	_, err := suite.client.PriceContext(ctx, "BTCUSD", time.Unix(1677000000, 0))
+	suite.Nil(err)
+	suite.Equal(request.Id, <-suite.dataSource.requestIds)
+}
+
+func (suite *DataSourceGrpcTestSuite) TestPriceErrors() {
+	_, err := suite.client.Price("", time.Unix(1677000000, 0))
+	suite.True(IsErrorCode(err, ErrDataSourceApiServerQueryStringIsRequired.Code))
+	suite.Equal(ErrorPayload{Code: ErrDataSourceApiServerQueryStringIsRequired.Code, Msg: "query string is required: symbol", Attr: map[string]any{"field": "symbol"}}, err)
+
+	_, err = suite.client.Price("ETHUSD", time.Unix(1677000000, 0))
+	suite.True(IsErrorCode(err, ErrNoData.Code))
+}
+
+func (suite *DataSourceGrpcTestSuite) TestAverage() {
+	average, err := suite.client.Average("BTCUSD", time.Unix(1677000030, 0), time.Unix(1677000330, 0), Granularity1m)
+	suite.Nil(err)
+	suite.Equal(PriceAverageApiModel{Average: 2, From: 1677000000, Until: 1677000300}, average)
+
+	_, err = suite.client.Average("BTCUSD", time.Unix(1677000030, 0), time.Unix(1677000330, 0), "5m")
+	suite.True(IsErrorCode(err, ErrDataSourceApiServerQueryStringIsInvalid.Code))
+}
+
+func (suite *DataSourceGrpcTestSuite) TestPrices() {
+	results, err := suite.client.Prices(context.Background(), []PriceQuery{
+		{Symbol: "BTCUSD", Ts: time.Unix(1677000000, 0)},
+		{Symbol: "ETHUSD", Ts: time.Unix(1677000000, 0)},
+		{Symbol: "BTCUSD", Ts: time.Unix(1677000060, 0)},
+	})
+	suite.Nil(err)
+	suite.Len(results, 3)
+	suite.Equal(PriceResult{Price: PriceApiModel{Price: 1677000000}}, results[0])
+	suite.True(IsErrorCode(results[1].Err, ErrNoData.Code))
+	suite.Equal(PriceResult{Price: PriceApiModel{Price: 1677000060}}, results[2])
+}
+
+func (suite *DataSourceGrpcTestSuite) TestAverages() {
+	results, err := suite.client.Averages(context.Background(), []AverageQuery{
+		{Symbol: "BTCUSD", From: time.Unix(1677000030, 0), Until: time.Unix(1677000330, 0), Granularity: Granularity1m},
+		{Symbol: "BTCUSD", From: time.Unix(1677000030, 0), Until: time.Unix(1677000330, 0), Granularity: "5m"},
+	})
+	suite.Nil(err)
+	suite.Len(results, 2)
+	suite.Equal(AverageResult{Average: PriceAverageApiModel{Average: 2, From: 1677000000, Until: 1677000300}}, results[0])
+	suite.True(IsErrorCode(results[1].Err, ErrDataSourceApiServerQueryStringIsInvalid.Code))
+}
+
+func (suite *DataSourceGrpcTestSuite) TestSeries() {
+	server, err := NewDataSourceGrpcServer(grpcSeriesDataSource{suite.dataSource}, "127.0.0.1:0")
+	suite.Require().Nil(err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	suite.Require().Nil(err)
+	go func() { _ = server.Serve(listener) }()
+	defer func() { suite.Nil(server.Shutdown(context.Background())) }()
+	client, err := NewGrpcDataSourceApiClient("grpc://"+listener.Addr().String(), GrpcDataSourceApiClientTimeoutOption(time.Second*5))
+	suite.Require().Nil(err)
+	defer client.Close()
+
+	query := SeriesQuery{Symbol: "BTCUSD", From: time.Unix(1677000000, 0), Until: time.Unix(1677000300, 0), Granularity: Granularity1m, Limit: 3}
+	page, err := client.SeriesPage(context.Background(), query)
+	suite.Nil(err)
+	suite.Equal("BTCUSD", page.Symbol)
+	suite.Equal(Granularity1m, page.Granularity)
+	suite.Equal([]SeriesPointApiModel{{Ts: 1677000000, Price: 1677000000}, {Ts: 1677000060, Price: 1677000060}, {Ts: 1677000120, Price: 1677000120}}, page.Points)
+	suite.NotEmpty(page.NextCursor)
+
+	query.Cursor = page.NextCursor
+	page, err = client.SeriesPage(context.Background(), query)
+	suite.Nil(err)
+	suite.Equal([]SeriesPointApiModel{{Ts: 1677000180, Price: 1677000180}, {Ts: 1677000240, Price: 1677000240}}, page.Points)
+	suite.Empty(page.NextCursor)
+
+	query.Cursor = "invalid"
+	_, err = client.SeriesPage(context.Background(), query)
+	suite.True(IsErrorCode(err, ErrDataSourceApiServerQueryStringIsInvalid.Code))
+	_, err = client.SeriesPage(context.Background(), SeriesQuery{From: query.From, Until: query.Until})
+	suite.True(IsErrorCode(err, ErrDataSourceApiServerQueryStringIsRequired.Code))
+}
+
+func (suite *DataSourceGrpcTestSuite) TestSeriesNotSupported() {
+	_, err := suite.client.SeriesPage(context.Background(), SeriesQuery{Symbol: "BTCUSD", From: time.Unix(1677000000, 0), Until: time.Unix(1677000300, 0)})
+	suite.True(IsErrorCode(err, ErrSeriesNotSupported.Code))
+}
+
+func (suite *DataSourceGrpcTestSuite) TestStreamPrice() {
+	ctx, cancel := context.WithCancel(context.Background())
+	ticks := make(chan PriceTick, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- suite.client.StreamPrice(ctx, "BTCUSD", Granularity1s, func(tick PriceTick) { ticks <- tick })
+	}()
+
+	tick := <-ticks
+	suite.Equal("BTCUSD", tick.Symbol)
+	suite.Equal(float64(tick.Ts), tick.Price)
+	cancel()
+	suite.ErrorIs(<-done, context.Canceled)
+
+	err := suite.client.StreamPrice(context.Background(), "BTCUSD", "1M", func(PriceTick) {})
+	suite.True(IsErrorCode(err, ErrInvalidGranularity.Code))
+	err = suite.client.StreamPrice(context.Background(), "", Granularity1s, func(PriceTick) {})
+	suite.True(IsErrorCode(err, ErrDataSourceApiServerQueryStringIsRequired.Code))
+}
+
+func TestDataSourceGrpcTestSuite(t *testing.T) {
+	suite.Run(t, new(DataSourceGrpcTestSuite))
+}
+
+func TestNewGrpcDataSourceApiClient(t *testing.T) {
+	_, err := NewGrpcDataSourceApiClient("http://127.0.0.1:8081")
+	assert.True(t, IsErrorCode(err, ErrUnsupportedProtocolScheme.Code))
+	_, err = NewGrpcDataSourceApiClient("grpc://")
+	assert.Error(t, err)
+}
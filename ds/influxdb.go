@@ -2,9 +2,13 @@ package ds
 
 import (
 	"context"
+	"cti/tracing"
 	"errors"
 	"fmt"
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"go.opentelemetry.io/otel/attribute"
+	"strings"
 	"time"
 )
 
@@ -28,6 +32,10 @@ func NewInfluxDbDataSource(url string, org string, bucket string, token string)
 }
 
 func (influxDbDataSource *InfluxDbDataSource) Price(symbol string, ts time.Time) (float64, error) {
+	return influxDbDataSource.PriceContext(context.Background(), symbol, ts)
+}
+
+func (influxDbDataSource *InfluxDbDataSource) PriceContext(ctx context.Context, symbol string, ts time.Time) (float64, error) {
 	queryAPI := influxDbDataSource.client.QueryAPI(influxDbDataSource.org)
 	tRfc3339 := ts.UTC().Format(time.RFC3339)
 
@@ -40,7 +48,7 @@ func (influxDbDataSource *InfluxDbDataSource) Price(symbol string, ts time.Time)
 				|> filter(fn: (r) => r["_time"] == %s)
 			`, EscapeDoubleQuote(influxDbDataSource.bucket), tRfc3339, symbol, tRfc3339)
 
-	result, err := queryAPI.Query(context.Background(), query)
+	result, err := influxDbDataSource.query(ctx, queryAPI, query)
 	if err != nil {
 		if err.Error() == "invalid: error in building plan while starting program: cannot query an empty range" {
 			return 0, &ErrNoData
@@ -72,7 +80,106 @@ func (influxDbDataSource *InfluxDbDataSource) Price(symbol string, ts time.Time)
 	return *price, nil
 }
 
+// Prices reads the prices of all queries with a single Flux query over the range of their timestamps.
+func (influxDbDataSource *InfluxDbDataSource) Prices(ctx context.Context, queries []PriceQuery) ([]PriceResult, error) {
+	if len(queries) == 0 {
+		return nil, nil
+	}
+
+	var symbols []string
+	var times []string
+	var first, last time.Time
+	for symbol, symbolTimes := range timesBySymbol(queries) {
+		symbols = append(symbols, fmt.Sprintf(`"%s"`, EscapeDoubleQuote(symbol)))
+		for _, t := range symbolTimes {
+			times = append(times, t.UTC().Format(time.RFC3339Nano))
+		}
+		if first.IsZero() || symbolTimes[0].Before(first) {
+			first = symbolTimes[0]
+		}
+		if last.Before(symbolTimes[len(symbolTimes)-1]) {
+			last = symbolTimes[len(symbolTimes)-1]
+		}
+	}
+
+	query := fmt.Sprintf(`from(bucket: "%s")
+				|> range(start: %s, stop: %s)
+				|> filter(fn: (r) => r["_measurement"] == "price")
+				|> filter(fn: (r) => r["_field"] == "open")
+				|> filter(fn: (r) => contains(value: r["symbol"], set: [%s]))
+				|> filter(fn: (r) => contains(value: r["_time"], set: [%s]))
+			`, EscapeDoubleQuote(influxDbDataSource.bucket), first.UTC().Format(time.RFC3339Nano), last.Add(time.Second).UTC().Format(time.RFC3339Nano),
+		strings.Join(symbols, ", "), strings.Join(times, ", "))
+
+	queryAPI := influxDbDataSource.client.QueryAPI(influxDbDataSource.org)
+	result, err := influxDbDataSource.query(ctx, queryAPI, query)
+	if err != nil {
+		return nil, ErrSourceError.WithAttrs(map[string]any{"err": err.Error()})
+	}
+	defer result.Close()
+
+	prices := make(map[priceKey]float64)
+	for result.Next() {
+		record := result.Record()
+		symbol, _ := record.ValueByKey("symbol").(string)
+		price, ok := record.Value().(float64)
+		if !ok {
+			return nil, errors.New("price type is not valid")
+		}
+		prices[priceKey{symbol, record.Time().UnixMilli()}] = price
+	}
+	if result.Err() != nil {
+		return nil, ErrSourceError.WithAttrs(map[string]any{"err": result.Err().Error()})
+	}
+
+	return batchPriceResults(queries, prices, nil), nil
+}
+
+// Series reads the first price of each window of granularity in [from, until).
+func (influxDbDataSource *InfluxDbDataSource) Series(ctx context.Context, symbol string, from time.Time, until time.Time, granularity Granularity, limit int) ([]Candle, error) {
+	every, ok := influxDbWindows[granularity]
+	if !ok {
+		return nil, &ErrInvalidGranularity
+	}
+
+	query := fmt.Sprintf(`from(bucket: "%s")
+				|> range(start: %s, stop: %s)
+				|> filter(fn: (r) => r["_measurement"] == "price")
+				|> filter(fn: (r) => r["_field"] == "open")
+				|> filter(fn: (r) => r["symbol"] == "%s")
+				|> aggregateWindow(every: %s, fn: first, createEmpty: false, timeSrc: "_start")
+				|> limit(n: %d)
+			`, EscapeDoubleQuote(influxDbDataSource.bucket), from.UTC().Format(time.RFC3339), until.UTC().Format(time.RFC3339),
+		EscapeDoubleQuote(symbol), every, limit)
+
+	queryAPI := influxDbDataSource.client.QueryAPI(influxDbDataSource.org)
+	result, err := influxDbDataSource.query(ctx, queryAPI, query)
+	if err != nil {
+		return nil, ErrSourceError.WithAttrs(map[string]any{"err": err.Error()})
+	}
+	defer result.Close()
+
+	var candles []Candle
+	for result.Next() {
+		record := result.Record()
+		price, ok := record.Value().(float64)
+		if !ok {
+			return nil, errors.New("price type is not valid")
+		}
+		candles = append(candles, Candle{Ts: record.Time(), Open: price})
+	}
+	if result.Err() != nil {
+		return nil, ErrSourceError.WithAttrs(map[string]any{"err": result.Err().Error()})
+	}
+
+	return candles, nil
+}
+
 func (influxDbDataSource *InfluxDbDataSource) Average(symbol string, from time.Time, until time.Time, granularity Granularity) (average float64, actualFrom time.Time, actualUntil time.Time, err error) {
+	return influxDbDataSource.AverageContext(context.Background(), symbol, from, until, granularity)
+}
+
+func (influxDbDataSource *InfluxDbDataSource) AverageContext(ctx context.Context, symbol string, from time.Time, until time.Time, granularity Granularity) (average float64, actualFrom time.Time, actualUntil time.Time, err error) {
 	if !granularity.IsValid() {
 		return 0, time.Time{}, time.Time{}, &ErrInvalidGranularity
 	}
@@ -83,7 +190,7 @@ func (influxDbDataSource *InfluxDbDataSource) Average(symbol string, from time.T
 	}
 
 	// check whether from data point is exists
-	fromPrice, err := influxDbDataSource.Price(symbol, from)
+	fromPrice, err := influxDbDataSource.PriceContext(ctx, symbol, from)
 	if err != nil {
 		return 0, time.Time{}, time.Time{}, err
 	}
@@ -94,7 +201,7 @@ func (influxDbDataSource *InfluxDbDataSource) Average(symbol string, from time.T
 	}
 
 	// check whether until data point is exists
-	_, err = influxDbDataSource.Price(symbol, until)
+	_, err = influxDbDataSource.PriceContext(ctx, symbol, until)
 	if err != nil {
 		return 0, time.Time{}, time.Time{}, err
 	}
@@ -112,7 +219,7 @@ func (influxDbDataSource *InfluxDbDataSource) Average(symbol string, from time.T
   				|> mean()
 			`, EscapeDoubleQuote(influxDbDataSource.bucket), tfRfc3339, tuRfc3339, symbol)
 
-	result, err := queryAPI.Query(context.Background(), query)
+	result, err := influxDbDataSource.query(ctx, queryAPI, query)
 	if err != nil {
 		if err.Error() == "invalid: error in building plan while starting program: cannot query an empty range" {
 			return 0, time.Time{}, time.Time{}, &ErrNoData
@@ -158,3 +265,23 @@ func (influxDbDataSource *InfluxDbDataSource) Average(symbol string, from time.T
 
 	return *averagePrice, actualFrom, actualUntil, nil
 }
+
+// query runs a Flux query in a span, the span covers the request but not the reading of the result.
+func (influxDbDataSource *InfluxDbDataSource) query(ctx context.Context, queryAPI api.QueryAPI, query string) (*api.QueryTableResult, error) {
+	ctx, span := tracing.Start(ctx, "InfluxDb.Query",
+		attribute.String("db.system", "influxdb"),
+		attribute.String("db.statement", query),
+	)
+	result, err := queryAPI.Query(ctx, query)
+	tracing.End(span, err)
+
+	return result, err
+}
+
+var influxDbWindows = map[Granularity]string{
+	Granularity1s: "1s",
+	Granularity1m: "1m",
+	Granularity1h: "1h",
+	Granularity1d: "1d",
+	Granularity1M: "1mo",
+}
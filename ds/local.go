@@ -0,0 +1,311 @@
+package ds
+
+import (
+	"bufio"
+	"cti/db"
+	"cti/erro"
+	"cti/metrics"
+	"errors"
+	"fmt"
+	"golang.org/x/exp/slog"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+const localStoreFileExt = ".dat"
+
+var localStoreSymbolPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+type localPoint struct {
+	ts    time.Time
+	price float64
+}
+
+type localSeries struct {
+	points []localPoint
+	offset int64
+	// unreadable is set when the record at offset has an unreadable length and is not at the end
+	// of the file, the records after it cannot be found
+	unreadable bool
+}
+
+// LocalStore is a file-based time-series store with one append-only file per symbol.
+// It implements both db.Writer and DataSource, so the whole pipeline can run without
+// an external database. Files written by another process are picked up on read.
+type LocalStore struct {
+	dir string
+
+	mu     sync.Mutex
+	series map[string]*localSeries
+}
+
+func NewLocalStore(dir string) (*LocalStore, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalStore{dir: dir, series: make(map[string]*localSeries)}, nil
+}
+
+func (store *LocalStore) WritePrice(symbol string, price float64, ts time.Time) error {
+	return store.WritePoints([]db.Point{{Symbol: symbol, Price: price, Ts: ts}})
+}
+
+func (store *LocalStore) WritePoints(points []db.Point) error {
+	bySymbol := make(map[string][]byte)
+	for _, point := range points {
+		if !localStoreSymbolPattern.MatchString(point.Symbol) {
+			return ErrInvalidSymbol.WithAttrs(map[string]any{"symbol": point.Symbol})
+		}
+		bySymbol[point.Symbol] = db.AppendPointRecord(bySymbol[point.Symbol], point)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for symbol, buf := range bySymbol {
+		err := store.truncateTornTail(symbol)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(store.path(symbol), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+
+		_, err = f.Write(buf)
+		if err == nil {
+			err = f.Sync()
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+
+		err = store.refresh(symbol)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (store *LocalStore) Price(symbol string, ts time.Time) (float64, error) {
+	points, err := store.load(symbol)
+	if err != nil {
+		return 0, err
+	}
+
+	i := sort.Search(len(points), func(i int) bool { return !points[i].ts.Before(ts) })
+	if i >= len(points) || !points[i].ts.Equal(ts) {
+		return 0, &ErrNoData
+	}
+
+	return points[i].price, nil
+}
+
+// Average has the same semantics as InfluxDbDataSource.Average: only 1m granularity,
+// both ends must exist and the range is [from, until).
+func (store *LocalStore) Average(symbol string, from time.Time, until time.Time, granularity Granularity) (average float64, actualFrom time.Time, actualUntil time.Time, err error) {
+	if !granularity.IsValid() {
+		return 0, time.Time{}, time.Time{}, &ErrInvalidGranularity
+	}
+
+	// only support granularity 1m
+	if granularity != Granularity1m {
+		return 0, time.Time{}, time.Time{}, ErrInvalidGranularity.WithAttrs(map[string]any{"details": "only support 1m"})
+	}
+
+	// check whether from data point is exists
+	fromPrice, err := store.Price(symbol, from)
+	if err != nil {
+		return 0, time.Time{}, time.Time{}, err
+	}
+
+	// from and until is equal, return from data point directly
+	if from.Equal(until) {
+		return fromPrice, from, until, nil
+	}
+
+	// check whether until data point is exists
+	_, err = store.Price(symbol, until)
+	if err != nil {
+		return 0, time.Time{}, time.Time{}, err
+	}
+
+	points, err := store.load(symbol)
+	if err != nil {
+		return 0, time.Time{}, time.Time{}, err
+	}
+
+	start := sort.Search(len(points), func(i int) bool { return !points[i].ts.Before(from) })
+	end := sort.Search(len(points), func(i int) bool { return !points[i].ts.Before(until) })
+	if start >= end {
+		return 0, time.Time{}, time.Time{}, &ErrNoData
+	}
+
+	sum := 0.0
+	for _, point := range points[start:end] {
+		sum += point.price
+	}
+
+	return sum / float64(end-start), from, until, nil
+}
+
+func (store *LocalStore) LatestTime(symbol string) (time.Time, error) {
+	points, err := store.load(symbol)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if len(points) == 0 {
+		return time.Time{}, nil
+	}
+
+	return points[len(points)-1].ts, nil
+}
+
+func (store *LocalStore) load(symbol string) ([]localPoint, error) {
+	if !localStoreSymbolPattern.MatchString(symbol) {
+		return nil, ErrInvalidSymbol.WithAttrs(map[string]any{"symbol": symbol})
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	err := store.refresh(symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	series, ok := store.series[symbol]
+	if !ok {
+		return nil, nil
+	}
+
+	return series.points, nil
+}
+
+// refresh reads the records appended to the symbol file since the last read.
+func (store *LocalStore) refresh(symbol string) error {
+	series, ok := store.series[symbol]
+	if !ok {
+		series = &localSeries{}
+	}
+
+	f, err := os.Open(store.path(symbol))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if ok && info.Size() == series.offset {
+		metrics.CacheRequests.WithLabelValues("local_store", "hit").Inc()
+		return nil
+	}
+	metrics.CacheRequests.WithLabelValues("local_store", "miss").Inc()
+
+	_, err = f.Seek(series.offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	// copy on write, slices handed out by load stay untouched
+	points := append([]localPoint(nil), series.points...)
+	offset := series.offset
+	unreadable := false
+	reader := bufio.NewReader(f)
+	for {
+		point, size, err := db.ReadPointRecord(reader)
+		if err != nil && size > 0 {
+			// a corrupted record followed by more records is skipped, at the end of the file
+			// it may still be written
+			if _, peekErr := reader.Peek(1); peekErr == nil {
+				slog.Error("local store skip corrupted record", err, "symbol", symbol, "offset", offset)
+				offset += size
+				continue
+			}
+		}
+		if err != nil && (errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || size > 0) {
+			// the end of the file or a record torn at it
+			break
+		}
+		if err != nil {
+			var e *erro.Error
+			if !errors.As(err, &e) || e.Code != db.ErrWalCorrupted.Code {
+				return err
+			}
+			// the length cannot be read, the records after it cannot be found
+			unreadable = true
+			break
+		}
+		offset += size
+		points = insertLocalPoint(points, localPoint{ts: point.Ts, price: point.Price})
+	}
+
+	store.series[symbol] = &localSeries{points: points, offset: offset, unreadable: unreadable}
+	return nil
+}
+
+// truncateTornTail cuts the file of symbol after its last valid record, a record torn by a crash
+// during an append would hide every record appended after it otherwise. A record with an unreadable
+// length may be followed by valid records, the file is not cut and not appended to then.
+func (store *LocalStore) truncateTornTail(symbol string) error {
+	err := store.refresh(symbol)
+	if err != nil {
+		return err
+	}
+
+	series, ok := store.series[symbol]
+	if !ok {
+		return nil
+	}
+	if series.unreadable {
+		return ErrLocalStoreCorrupted.WithAttrs(map[string]any{"symbol": symbol, "offset": series.offset})
+	}
+
+	info, err := os.Stat(store.path(symbol))
+	if err != nil {
+		return err
+	}
+	if info.Size() <= series.offset {
+		return nil
+	}
+
+	slog.Warn("local store truncate torn record", "symbol", symbol, "size", info.Size(), "valid_size", series.offset)
+	return os.Truncate(store.path(symbol), series.offset)
+}
+
+func insertLocalPoint(points []localPoint, point localPoint) []localPoint {
+	i := sort.Search(len(points), func(i int) bool { return !points[i].ts.Before(point.ts) })
+	if i < len(points) && points[i].ts.Equal(point.ts) {
+		points[i] = point
+		return points
+	}
+
+	points = append(points, localPoint{})
+	copy(points[i+1:], points[i:])
+	points[i] = point
+	return points
+}
+
+func (store *LocalStore) path(symbol string) string {
+	return filepath.Join(store.dir, fmt.Sprintf("%s%s", symbol, localStoreFileExt))
+}
@@ -0,0 +1,176 @@
+package ds
+
+import (
+	"cti/db"
+	"github.com/stretchr/testify/suite"
+	"os"
+	"testing"
+	"time"
+)
+
+type LocalStoreTestSuite struct {
+	dir    string
+	store  *LocalStore
+	from   time.Time
+	symbol string
+	suite.Suite
+}
+
+func (suite *LocalStoreTestSuite) SetupTest() {
+	suite.dir = suite.T().TempDir()
+	suite.symbol = "BTCUSD"
+	suite.from = time.Now().Add(-time.Hour).Truncate(time.Minute)
+
+	store, err := NewLocalStore(suite.dir)
+	suite.Nil(err)
+	suite.store = store
+
+	// written out of order on purpose
+	for _, i := range []int{2, 0, 1} {
+		suite.Nil(suite.store.WritePrice(suite.symbol, float64(i+1), suite.from.Add(time.Minute*time.Duration(i))))
+	}
+}
+
+func (suite *LocalStoreTestSuite) TestPrice() {
+	price, err := suite.store.Price(suite.symbol, suite.from.Add(time.Minute))
+	suite.Nil(err)
+	suite.Equal(2.0, price)
+
+	_, err = suite.store.Price(suite.symbol, suite.from.Add(time.Second))
+	suite.ErrorIs(err, &ErrNoData)
+
+	_, err = suite.store.Price("ETHUSD", suite.from)
+	suite.ErrorIs(err, &ErrNoData)
+
+	_, err = suite.store.Price("../BTCUSD", suite.from)
+	suite.NotNil(err)
+}
+
+func (suite *LocalStoreTestSuite) TestOverwrite() {
+	suite.Nil(suite.store.WritePrice(suite.symbol, 10, suite.from))
+
+	price, err := suite.store.Price(suite.symbol, suite.from)
+	suite.Nil(err)
+	suite.Equal(10.0, price)
+}
+
+func (suite *LocalStoreTestSuite) TestAverage() {
+	until := suite.from.Add(time.Minute * 2)
+	average, actualFrom, actualUntil, err := suite.store.Average(suite.symbol, suite.from, until, Granularity1m)
+	suite.Nil(err)
+	suite.Equal(1.5, average)
+	suite.Equal(suite.from, actualFrom)
+	suite.Equal(until, actualUntil)
+
+	average, _, _, err = suite.store.Average(suite.symbol, suite.from, suite.from, Granularity1m)
+	suite.Nil(err)
+	suite.Equal(1.0, average)
+}
+
+func (suite *LocalStoreTestSuite) TestAverageWithInvalidParams() {
+	_, _, _, err := suite.store.Average(suite.symbol, suite.from, suite.from.Add(time.Minute), Granularity(""))
+	suite.NotNil(err)
+
+	_, _, _, err = suite.store.Average(suite.symbol, suite.from, suite.from.Add(time.Minute), Granularity1h)
+	suite.NotNil(err)
+
+	_, _, _, err = suite.store.Average(suite.symbol, suite.from, suite.from.Add(time.Hour), Granularity1m)
+	suite.ErrorIs(err, &ErrNoData)
+}
+
+func (suite *LocalStoreTestSuite) TestReadFromAnotherProcess() {
+	reader, err := NewLocalStore(suite.dir)
+	suite.Nil(err)
+
+	price, err := reader.Price(suite.symbol, suite.from)
+	suite.Nil(err)
+	suite.Equal(1.0, price)
+
+	suite.Nil(suite.store.WritePoints([]db.Point{{Symbol: suite.symbol, Price: 4, Ts: suite.from.Add(time.Minute * 3)}}))
+
+	price, err = reader.Price(suite.symbol, suite.from.Add(time.Minute*3))
+	suite.Nil(err)
+	suite.Equal(4.0, price)
+}
+
+func (suite *LocalStoreTestSuite) TestTornRecord() {
+	f, err := os.OpenFile(suite.store.path(suite.symbol), os.O_WRONLY|os.O_APPEND, 0o644)
+	suite.Nil(err)
+	_, err = f.Write(db.AppendPointRecord(nil, db.Point{Symbol: suite.symbol, Price: 5, Ts: suite.from.Add(time.Minute * 5)})[:10])
+	suite.Nil(err)
+	suite.Nil(f.Close())
+
+	reader, err := NewLocalStore(suite.dir)
+	suite.Nil(err)
+
+	_, err = reader.Price(suite.symbol, suite.from.Add(time.Minute*5))
+	suite.ErrorIs(err, &ErrNoData)
+
+	price, err := reader.Price(suite.symbol, suite.from.Add(time.Minute*2))
+	suite.Nil(err)
+	suite.Equal(3.0, price)
+}
+
+func (suite *LocalStoreTestSuite) TestAppendAfterTornRecord() {
+	f, err := os.OpenFile(suite.store.path(suite.symbol), os.O_WRONLY|os.O_APPEND, 0o644)
+	suite.Nil(err)
+	_, err = f.Write(db.AppendPointRecord(nil, db.Point{Symbol: suite.symbol, Price: 5, Ts: suite.from.Add(time.Minute * 5)})[:10])
+	suite.Nil(err)
+	suite.Nil(f.Close())
+
+	// a restarted writer appends after the last valid record
+	writer, err := NewLocalStore(suite.dir)
+	suite.Nil(err)
+	suite.Nil(writer.WritePrice(suite.symbol, 6, suite.from.Add(time.Minute*6)))
+
+	price, err := writer.Price(suite.symbol, suite.from.Add(time.Minute*6))
+	suite.Nil(err)
+	suite.Equal(6.0, price)
+
+	reader, err := NewLocalStore(suite.dir)
+	suite.Nil(err)
+	price, err = reader.Price(suite.symbol, suite.from.Add(time.Minute*6))
+	suite.Nil(err)
+	suite.Equal(6.0, price)
+	_, err = reader.Price(suite.symbol, suite.from.Add(time.Minute*5))
+	suite.ErrorIs(err, &ErrNoData)
+}
+
+func (suite *LocalStoreTestSuite) TestCorruptedRecordIsSkipped() {
+	b, err := os.ReadFile(suite.store.path(suite.symbol))
+	suite.Nil(err)
+	// the checksum of the first record
+	b[5] ^= 0xff
+	suite.Nil(os.WriteFile(suite.store.path(suite.symbol), b, 0o644))
+
+	reader, err := NewLocalStore(suite.dir)
+	suite.Nil(err)
+	_, err = reader.Price(suite.symbol, suite.from.Add(time.Minute*2))
+	suite.ErrorIs(err, &ErrNoData)
+	price, err := reader.Price(suite.symbol, suite.from)
+	suite.Nil(err)
+	suite.Equal(1.0, price)
+}
+
+func (suite *LocalStoreTestSuite) TestUnreadableLengthIsNotTruncated() {
+	b, err := os.ReadFile(suite.store.path(suite.symbol))
+	suite.Nil(err)
+	// the length of the first record, the records after it cannot be found
+	b[0] = 0xff
+	suite.Nil(os.WriteFile(suite.store.path(suite.symbol), b, 0o644))
+
+	writer, err := NewLocalStore(suite.dir)
+	suite.Nil(err)
+	_, err = writer.Price(suite.symbol, suite.from)
+	suite.ErrorIs(err, &ErrNoData)
+	err = writer.WritePrice(suite.symbol, 6, suite.from.Add(time.Minute*6))
+	suite.True(IsErrorCode(err, ErrLocalStoreCorrupted.Code))
+
+	after, err := os.ReadFile(suite.store.path(suite.symbol))
+	suite.Nil(err)
+	suite.Equal(b, after)
+}
+
+func TestLocalStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(LocalStoreTestSuite))
+}
@@ -0,0 +1,112 @@
+package ds
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/lib/pq"
+	"time"
+)
+
+const (
+	postgresSelectPrice   = `SELECT open FROM price WHERE symbol = $1 AND time = $2`
+	postgresSelectPrices  = `SELECT symbol, time, open FROM price WHERE symbol = ANY($1::text[]) AND time = ANY($2::timestamptz[])`
+	postgresSelectAverage = `SELECT AVG(open), COUNT(*) FROM price WHERE symbol = $1 AND time >= $2 AND time < $3`
+)
+
+type PostgresDataSource struct {
+	db *sql.DB
+}
+
+func NewPostgresDataSource(database *sql.DB) (*PostgresDataSource, error) {
+	return &PostgresDataSource{db: database}, nil
+}
+
+func (postgresDataSource *PostgresDataSource) Price(symbol string, ts time.Time) (float64, error) {
+	var price float64
+	err := postgresDataSource.db.QueryRow(postgresSelectPrice, symbol, ts.UTC()).Scan(&price)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, &ErrNoData
+		}
+		return 0, ErrSourceError.WithAttrs(map[string]any{"err": err.Error()})
+	}
+
+	return price, nil
+}
+
+// Prices reads the prices of all queries with a single query.
+func (postgresDataSource *PostgresDataSource) Prices(ctx context.Context, queries []PriceQuery) ([]PriceResult, error) {
+	var symbols, times []string
+	for symbol, symbolTimes := range timesBySymbol(queries) {
+		symbols = append(symbols, symbol)
+		for _, t := range symbolTimes {
+			times = append(times, t.UTC().Format(time.RFC3339Nano))
+		}
+	}
+
+	rows, err := postgresDataSource.db.QueryContext(ctx, postgresSelectPrices, pq.StringArray(symbols), pq.StringArray(times))
+	if err != nil {
+		return nil, ErrSourceError.WithAttrs(map[string]any{"err": err.Error()})
+	}
+	defer rows.Close()
+
+	prices := make(map[priceKey]float64)
+	for rows.Next() {
+		var symbol string
+		var ts time.Time
+		var price float64
+		if err = rows.Scan(&symbol, &ts, &price); err != nil {
+			return nil, ErrSourceError.WithAttrs(map[string]any{"err": err.Error()})
+		}
+		prices[priceKey{symbol, ts.UnixMilli()}] = price
+	}
+	if err = rows.Err(); err != nil {
+		return nil, ErrSourceError.WithAttrs(map[string]any{"err": err.Error()})
+	}
+
+	return batchPriceResults(queries, prices, nil), nil
+}
+
+// Average has the same semantics as InfluxDbDataSource.Average: only 1m granularity,
+// both ends must exist and the range is [from, until).
+func (postgresDataSource *PostgresDataSource) Average(symbol string, from time.Time, until time.Time, granularity Granularity) (average float64, actualFrom time.Time, actualUntil time.Time, err error) {
+	if !granularity.IsValid() {
+		return 0, time.Time{}, time.Time{}, &ErrInvalidGranularity
+	}
+
+	// only support granularity 1m
+	if granularity != Granularity1m {
+		return 0, time.Time{}, time.Time{}, ErrInvalidGranularity.WithAttrs(map[string]any{"details": "only support 1m"})
+	}
+
+	// check whether from data point is exists
+	fromPrice, err := postgresDataSource.Price(symbol, from)
+	if err != nil {
+		return 0, time.Time{}, time.Time{}, err
+	}
+
+	// from and until is equal, return from data point directly
+	if from.Equal(until) {
+		return fromPrice, from, until, nil
+	}
+
+	// check whether until data point is exists
+	_, err = postgresDataSource.Price(symbol, until)
+	if err != nil {
+		return 0, time.Time{}, time.Time{}, err
+	}
+
+	var avg sql.NullFloat64
+	var count int64
+	err = postgresDataSource.db.QueryRow(postgresSelectAverage, symbol, from.UTC(), until.UTC()).Scan(&avg, &count)
+	if err != nil {
+		return 0, time.Time{}, time.Time{}, ErrSourceError.WithAttrs(map[string]any{"err": err.Error()})
+	}
+
+	if !avg.Valid || count == 0 {
+		return 0, time.Time{}, time.Time{}, &ErrNoData
+	}
+
+	return avg.Float64, from, until, nil
+}
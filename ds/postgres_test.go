@@ -0,0 +1,91 @@
+package ds
+
+import (
+	"context"
+	"cti/db"
+	"cti/db/dbtest"
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+)
+
+type PostgresDataSourceTestSuite struct {
+	datasource *PostgresDataSource
+	from       time.Time
+	symbol     string
+	suite.Suite
+}
+
+func (suite *PostgresDataSourceTestSuite) SetupTest() {
+	database, err := dbtest.Open()
+	suite.Nil(err)
+	suite.Nil(db.MigratePostgres(database))
+
+	suite.symbol = "BTCUSD"
+	suite.from = time.Now().Add(-time.Hour).Truncate(time.Minute)
+
+	writer := db.NewPostgresWriter(database)
+	for i := 0; i < 3; i++ {
+		suite.Nil(writer.WritePrice(suite.symbol, float64(i+1), suite.from.Add(time.Minute*time.Duration(i))))
+	}
+
+	suite.datasource, err = NewPostgresDataSource(database)
+	suite.Nil(err)
+}
+
+func (suite *PostgresDataSourceTestSuite) TestPrice() {
+	price, err := suite.datasource.Price(suite.symbol, suite.from.Add(time.Minute))
+	suite.Nil(err)
+	suite.Equal(2.0, price)
+}
+
+func (suite *PostgresDataSourceTestSuite) TestPriceNoData() {
+	_, err := suite.datasource.Price(suite.symbol, suite.from.Add(time.Hour))
+	suite.ErrorIs(err, &ErrNoData)
+
+	_, err = suite.datasource.Price("ETHUSD", suite.from)
+	suite.ErrorIs(err, &ErrNoData)
+}
+
+func (suite *PostgresDataSourceTestSuite) TestPrices() {
+	results, err := suite.datasource.Prices(context.Background(), []PriceQuery{
+		{Symbol: suite.symbol, Ts: suite.from.Add(time.Minute * 2)},
+		{Symbol: "ETHUSD", Ts: suite.from},
+		{Symbol: suite.symbol, Ts: suite.from},
+	})
+	suite.Nil(err)
+	suite.Equal(3.0, results[0].Price.Price)
+	suite.True(IsErrorCode(results[1].Err, ErrNoData.Code))
+	suite.Equal(1.0, results[2].Price.Price)
+}
+
+func (suite *PostgresDataSourceTestSuite) TestAverage() {
+	until := suite.from.Add(time.Minute * 2)
+	average, actualFrom, actualUntil, err := suite.datasource.Average(suite.symbol, suite.from, until, Granularity1m)
+	suite.Nil(err)
+	suite.Equal(1.5, average)
+	suite.Equal(suite.from, actualFrom)
+	suite.Equal(until, actualUntil)
+
+	average, _, _, err = suite.datasource.Average(suite.symbol, suite.from, suite.from, Granularity1m)
+	suite.Nil(err)
+	suite.Equal(1.0, average)
+}
+
+func (suite *PostgresDataSourceTestSuite) TestAverageWithInvalidParams() {
+	_, _, _, err := suite.datasource.Average(suite.symbol, suite.from, suite.from.Add(time.Minute), Granularity(""))
+	suite.NotNil(err)
+
+	_, _, _, err = suite.datasource.Average(suite.symbol, suite.from, suite.from.Add(time.Minute), Granularity1s)
+	suite.NotNil(err)
+
+	_, _, _, err = suite.datasource.Average(suite.symbol, suite.from, suite.from.Add(time.Hour), Granularity1m)
+	suite.ErrorIs(err, &ErrNoData)
+
+	_, _, _, err = suite.datasource.Average(suite.symbol, suite.from.Add(-time.Minute), suite.from, Granularity1m)
+	suite.ErrorIs(err, &ErrNoData)
+}
+
+func TestPostgresDataSourceTestSuite(t *testing.T) {
+	suite.Run(t, new(PostgresDataSourceTestSuite))
+}
@@ -0,0 +1,136 @@
+package ds
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultSeriesLimit = 500
+	MaxSeriesLimit     = 1000
+)
+
+const seriesCursorPrefix = "ts:"
+
+// SeriesQuery is a page request of a series, Cursor continues after the last page.
+type SeriesQuery struct {
+	Symbol      string
+	From        time.Time
+	Until       time.Time
+	Granularity Granularity
+	Limit       int
+	Cursor      string
+}
+
+// ParseSeriesQuery reads the query string of /api/v1/series, the symbol is not required.
+func ParseSeriesQuery(values url.Values) (SeriesQuery, error) {
+	query := SeriesQuery{Symbol: values.Get("symbol"), Granularity: Granularity(values.Get("granularity")), Limit: DefaultSeriesLimit, Cursor: values.Get("cursor")}
+	if query.Granularity == "" {
+		query.Granularity = Granularity1m
+	}
+	if !query.Granularity.IsValid() {
+		return SeriesQuery{}, ErrInvalidGranularity.WithAttrs(map[string]any{"granularity": query.Granularity})
+	}
+
+	for _, field := range []struct {
+		name string
+		dest *time.Time
+	}{{"from", &query.From}, {"until", &query.Until}} {
+		value := values.Get(field.name)
+		if value == "" {
+			return SeriesQuery{}, fmt.Errorf("%w: %s", ErrDataSourceApiServerQueryStringIsRequired.WithAttrs(map[string]any{"field": field.name}), field.name)
+		}
+		ts, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return SeriesQuery{}, ErrDataSourceApiServerQueryStringIsInvalid.WithAttrs(map[string]any{"field": field.name})
+		}
+		*field.dest = time.Unix(ts, 0)
+	}
+	if !query.From.Before(query.Until) {
+		return SeriesQuery{}, ErrDataSourceApiServerQueryStringIsInvalid.WithAttrs(map[string]any{"field": "until", "details": "until must be after from"})
+	}
+
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > MaxSeriesLimit {
+			return SeriesQuery{}, ErrDataSourceApiServerQueryStringIsInvalid.WithAttrs(map[string]any{"field": "limit", "max": MaxSeriesLimit})
+		}
+		query.Limit = limit
+	}
+
+	if _, err := query.pageFrom(); err != nil {
+		return SeriesQuery{}, err
+	}
+
+	return query, nil
+}
+
+// Values returns the query string of the query.
+func (query SeriesQuery) Values() url.Values {
+	values := url.Values{}
+	values.Set("symbol", query.Symbol)
+	values.Set("from", strconv.FormatInt(query.From.Unix(), 10))
+	values.Set("until", strconv.FormatInt(query.Until.Unix(), 10))
+	values.Set("granularity", string(query.Granularity))
+	values.Set("limit", strconv.Itoa(query.Limit))
+	if query.Cursor != "" {
+		values.Set("cursor", query.Cursor)
+	}
+	return values
+}
+
+// pageFrom returns where the page of the cursor starts, the cursor must be within the range.
+func (query SeriesQuery) pageFrom() (time.Time, error) {
+	if query.Cursor == "" {
+		return query.From, nil
+	}
+
+	invalid := ErrDataSourceApiServerQueryStringIsInvalid.WithAttrs(map[string]any{"field": "cursor"})
+	decoded, err := base64.RawURLEncoding.DecodeString(query.Cursor)
+	if err != nil || !strings.HasPrefix(string(decoded), seriesCursorPrefix) {
+		return time.Time{}, invalid
+	}
+	ts, err := strconv.ParseInt(strings.TrimPrefix(string(decoded), seriesCursorPrefix), 10, 64)
+	if err != nil {
+		return time.Time{}, invalid
+	}
+
+	from := time.UnixMilli(ts)
+	if from.Before(query.From) || !from.Before(query.Until) {
+		return time.Time{}, invalid
+	}
+	return from, nil
+}
+
+func encodeSeriesCursor(ts time.Time) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(seriesCursorPrefix + strconv.FormatInt(ts.UnixMilli(), 10)))
+}
+
+// SeriesPage reads the page of query from dataSource, one point more than the limit tells
+// whether a next page follows.
+func SeriesPage(ctx context.Context, dataSource SeriesDataSource, query SeriesQuery) (SeriesApiModel, error) {
+	from, err := query.pageFrom()
+	if err != nil {
+		return SeriesApiModel{}, err
+	}
+
+	candles, err := dataSource.Series(ctx, query.Symbol, from, query.Until, query.Granularity, query.Limit+1)
+	if err != nil {
+		return SeriesApiModel{}, err
+	}
+
+	page := SeriesApiModel{Symbol: query.Symbol, Granularity: query.Granularity, Points: make([]SeriesPointApiModel, 0, len(candles))}
+	if len(candles) > query.Limit {
+		page.NextCursor = encodeSeriesCursor(candles[query.Limit].Ts)
+		candles = candles[:query.Limit]
+	}
+	for _, candle := range candles {
+		page.Points = append(page.Points, SeriesPointApiModel{Ts: candle.Ts.Unix(), Price: candle.Open})
+	}
+	return page, nil
+}
@@ -0,0 +1,82 @@
+package ds
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSeriesPages(t *testing.T) {
+	fake := newFakeBinance()
+	defer fake.server.Close()
+	binance, err := NewBinanceDataSource(BinanceApiBaseUrlOption(fake.server.URL))
+	require.NoError(t, err)
+	server := httptest.NewServer(NewDataSourceApiServer(binance, ":0").Router)
+	defer server.Close()
+	client, err := NewDefaultDataSourceApiClient(server.URL)
+	require.NoError(t, err)
+
+	from := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	query := SeriesQuery{Symbol: "BTCUSD", From: from, Until: from.Add(time.Minute * 2500), Granularity: Granularity1m, Limit: 1000}
+	var points []SeriesPointApiModel
+	pages := 0
+	for {
+		page, err := client.SeriesPage(context.Background(), query)
+		require.NoError(t, err)
+		pages++
+		points = append(points, page.Points...)
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+
+	assert.Equal(t, 3, pages)
+	require.Len(t, points, 2500)
+	for i, point := range points {
+		ts := from.Add(time.Minute * time.Duration(i))
+		assert.Equal(t, ts.Unix(), point.Ts)
+		assert.Equal(t, fakeKlineOpen(ts.UnixMilli()), point.Price)
+	}
+
+	// a cursor out of the range is rejected
+	query.Cursor = encodeSeriesCursor(query.Until)
+	_, err = client.SeriesPage(context.Background(), query)
+	assert.True(t, IsErrorCode(err, ErrDataSourceApiServerQueryStringIsInvalid.Code))
+	query.Cursor = "not a cursor"
+	_, err = client.SeriesPage(context.Background(), query)
+	assert.True(t, IsErrorCode(err, ErrDataSourceApiServerQueryStringIsInvalid.Code))
+}
+
+func TestSeriesNotSupported(t *testing.T) {
+	server := httptest.NewServer(NewDataSourceApiServer(&grpcTestDataSource{requestIds: make(chan string, 1)}, ":0").Router)
+	defer server.Close()
+	client, err := NewDefaultDataSourceApiClient(server.URL)
+	require.NoError(t, err)
+
+	from := time.Unix(1667457000, 0)
+	_, err = client.SeriesPage(context.Background(), SeriesQuery{Symbol: "BTCUSD", From: from, Until: from.Add(time.Hour), Granularity: Granularity1m, Limit: 10})
+	assert.True(t, IsErrorCode(err, ErrSeriesNotSupported.Code))
+}
+
+func TestParseSeriesQuery(t *testing.T) {
+	query, err := ParseSeriesQuery(url.Values{"symbol": {"BTCUSD"}, "from": {"1667457000"}, "until": {"1667460600"}})
+	require.NoError(t, err)
+	assert.Equal(t, Granularity1m, query.Granularity)
+	assert.Equal(t, DefaultSeriesLimit, query.Limit)
+
+	for _, values := range []url.Values{
+		{"until": {"1667460600"}},
+		{"from": {"1667457000"}, "until": {"1667457000"}},
+		{"from": {"1667457000"}, "until": {"1667460600"}, "granularity": {"2m"}},
+		{"from": {"1667457000"}, "until": {"1667460600"}, "limit": {"1001"}},
+		{"from": {"1667457000"}, "until": {"1667460600"}, "cursor": {encodeSeriesCursor(time.Unix(1667456999, 0))}},
+	} {
+		_, err = ParseSeriesQuery(values)
+		assert.Error(t, err, values.Encode())
+	}
+}
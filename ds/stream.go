@@ -0,0 +1,18 @@
+package ds
+
+import "context"
+
+// PriceTick is a price of symbol at Ts pushed by a PriceStreamer.
+type PriceTick struct {
+	Symbol string  `json:"symbol"`
+	Price  float64 `json:"price"`
+	Ts     int64   `json:"ts"`
+}
+
+// PriceStreamer pushes the prices of a symbol as they are known. PriceEvents and the api clients
+// of its streams implement it.
+type PriceStreamer interface {
+	// StreamPrice calls onTick with the price of every step of granularity until ctx is done or the
+	// stream fails, it returns ctx.Err() once ctx is done. onTick must not block.
+	StreamPrice(ctx context.Context, symbol string, granularity Granularity, onTick func(PriceTick)) error
+}
@@ -0,0 +1,47 @@
+package ds
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDataSourceApiClientStreamPrice(t *testing.T) {
+	base := time.Unix(1699999980, 0)
+	clock := &priceEventsClock{now: base.Add(time.Second * 30)}
+	server := NewDataSourceApiServer(&grpcTestDataSource{requestIds: make(chan string, 1)}, ":0")
+	events, err := NewPriceEvents(server.dataSource, PriceEventsPollOption(time.Millisecond*5))
+	require.NoError(t, err)
+	events.now = clock.Now
+	server.events = events
+	httpServer := httptest.NewServer(server.Router)
+	defer httpServer.Close()
+
+	client, err := NewDefaultDataSourceApiClient(httpServer.URL, DefaultDataSourceApiClientTimeoutOption(time.Millisecond*100))
+	require.NoError(t, err)
+
+	// the stream outlives the timeout of the requests
+	ticks := make(chan PriceTick, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- client.StreamPrice(context.Background(), "BTCUSD", Granularity1m, func(tick PriceTick) { ticks <- tick })
+	}()
+	assert.Equal(t, PriceTick{Symbol: "BTCUSD", Price: 1699999920, Ts: 1699999920}, <-ticks)
+	time.Sleep(time.Millisecond * 200)
+	clock.set(base.Add(time.Minute))
+	assert.Equal(t, PriceTick{Symbol: "BTCUSD", Price: 1699999980, Ts: 1699999980}, <-ticks)
+
+	// a closed stream ends with an error, the caller reconnects
+	events.Close()
+	assert.True(t, IsErrorCode(<-done, ErrStreamClosed.Code))
+
+	err = client.StreamPrice(context.Background(), "BTCUSD", "1M", func(PriceTick) {})
+	assert.True(t, IsErrorCode(err, ErrInvalidGranularity.Code))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, client.StreamPrice(ctx, "BTCUSD", Granularity1m, func(PriceTick) {}), context.Canceled)
+}
@@ -0,0 +1,302 @@
+package gw
+
+import (
+	"crypto/subtle"
+	"cti/config"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// upstreamsChange returns the upstreams changed by an admin request, current is not modified.
+type upstreamsChange func(current *upstreams) (*upstreams, error)
+
+// PersistFunc saves the upstream lists changed by the admin API, e.g. to the config file.
+type PersistFunc func(price config.DataSources, average config.DataSources) error
+
+type adminPayload struct {
+	Data any `json:"data"`
+}
+
+type addUpstreamRequest struct {
+	Id      string   `json:"id"`
+	Url     string   `json:"url"`
+	Timeout string   `json:"timeout"`
+	Symbols []string `json:"symbols"`
+	// Lists the upstream is appended to, both when empty.
+	Lists []string `json:"lists"`
+}
+
+type updateUpstreamRequest struct {
+	Enabled *bool   `json:"enabled"`
+	Timeout *string `json:"timeout"`
+}
+
+type orderUpstreamsRequest struct {
+	Ids []string `json:"ids"`
+}
+
+// EnableAdmin mounts the admin API on /admin, every request needs the header
+// `Authorization: Bearer <token>`. The changes are applied to the running gateway and, when
+// persist is not nil, saved with it first, a change which fails to persist is not applied.
+// Without persist, the changes are applied again to the datasources of every reload.
+// It must be called before the server is started.
+func (server *DataSourceApiGw) EnableAdmin(token string, persist PersistFunc) {
+	server.persist = persist
+	server.router.Route("/admin", func(r chi.Router) {
+		r.Use(adminAuth(token))
+		r.Get("/upstreams", server.adminUpstreams)
+		r.Post("/upstreams", server.adminAddUpstream)
+		r.Patch("/upstreams/{id}", server.adminUpdateUpstream)
+		r.Patch("/upstreams/{list}/{id}", server.adminUpdateListUpstream)
+		r.Put("/upstreams/{list}/order", server.adminOrderUpstreams)
+		r.Get("/keys", server.adminApiKeys)
+	})
+}
+
+func adminAuth(token string) func(http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				render.Status(r, 401)
+				render.JSON(w, r, errorPayload(r, &ErrUnauthorized))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (server *DataSourceApiGw) adminUpstreams(w http.ResponseWriter, r *http.Request) {
+	render.Status(r, 200)
+	render.JSON(w, r, adminPayload{server.Upstreams()})
+}
+
+func (server *DataSourceApiGw) adminApiKeys(w http.ResponseWriter, r *http.Request) {
+	usage := server.ApiKeys()
+	if usage == nil {
+		usage = []ApiKeyUsage{}
+	}
+	render.Status(r, 200)
+	render.JSON(w, r, adminPayload{usage})
+}
+
+func (server *DataSourceApiGw) adminAddUpstream(w http.ResponseWriter, r *http.Request) {
+	var req addUpstreamRequest
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+
+	lists := req.Lists
+	if len(lists) == 0 {
+		lists = []string{listPrice, listAverage}
+	}
+
+	server.update(w, r, func(current *upstreams) (*upstreams, error) {
+		timeout, err := parseTimeout(req.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		dataSource := config.DataSource{Id: req.Id, Url: req.Url, Timeout: timeout, Symbols: req.Symbols}
+		if err = (config.DataSources{dataSource}).Validate("upstream"); err != nil {
+			return nil, ErrInvalidUpstream.WithAttrs(map[string]any{"errors": config.Problems(err)})
+		}
+
+		next := &upstreams{price: current.price, average: current.average}
+		for _, list := range lists {
+			if list != listPrice && list != listAverage {
+				return nil, ErrInvalidUpstream.WithAttrs(map[string]any{"field": "lists", "list": list})
+			}
+			for _, u := range next.list(list) {
+				if u.named && u.config.Id == req.Id {
+					return nil, ErrUpstreamExists.WithAttrs(map[string]any{"id": req.Id, "list": list})
+				}
+			}
+
+			u, err := server.newUpstream(dataSource)
+			if err != nil {
+				return nil, ErrInvalidUpstream.WithAttrs(map[string]any{"errors": []string{err.Error()}})
+			}
+			next.set(list, append(copyList(next.list(list)), u))
+		}
+		return next, nil
+	})
+}
+
+// adminUpdateUpstream changes the named upstream in both lists, an unnamed upstream is changed
+// by its index in a list with adminUpdateListUpstream.
+func (server *DataSourceApiGw) adminUpdateUpstream(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	server.updateUpstream(w, r, []string{listPrice, listAverage}, id, func(i int, u *upstream) bool {
+		return u.named && u.config.Id == id
+	})
+}
+
+func (server *DataSourceApiGw) adminUpdateListUpstream(w http.ResponseWriter, r *http.Request) {
+	list := chi.URLParam(r, "list")
+	if list != listPrice && list != listAverage {
+		render.Status(r, 404)
+		render.JSON(w, r, errorPayload(r, ErrUpstreamNotFound.WithAttrs(map[string]any{"list": list})))
+		return
+	}
+	id := chi.URLParam(r, "id")
+	server.updateUpstream(w, r, []string{list}, id, func(i int, u *upstream) bool {
+		return u.label(i) == id
+	})
+}
+
+func (server *DataSourceApiGw) updateUpstream(w http.ResponseWriter, r *http.Request, lists []string, id string, match func(i int, u *upstream) bool) {
+	var req updateUpstreamRequest
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+
+	server.update(w, r, func(current *upstreams) (*upstreams, error) {
+		var timeout config.Duration
+		if req.Timeout != nil {
+			var err error
+			if timeout, err = parseTimeout(*req.Timeout); err != nil {
+				return nil, err
+			}
+		}
+
+		found := false
+		next := &upstreams{price: current.price, average: current.average}
+		for _, list := range lists {
+			result := copyList(current.list(list))
+			for i, u := range result {
+				if !match(i, u) {
+					continue
+				}
+				found = true
+				changed := *u
+				if req.Enabled != nil {
+					changed.config.Disabled = !*req.Enabled
+				}
+				if req.Timeout != nil {
+					changed.config.Timeout = timeout
+				}
+				result[i] = &changed
+			}
+			next.set(list, result)
+		}
+
+		if !found {
+			return nil, ErrUpstreamNotFound.WithAttrs(map[string]any{"id": id})
+		}
+		return next, nil
+	})
+}
+
+func (server *DataSourceApiGw) adminOrderUpstreams(w http.ResponseWriter, r *http.Request) {
+	var req orderUpstreamsRequest
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+	list := chi.URLParam(r, "list")
+	if list != listPrice && list != listAverage {
+		render.Status(r, 404)
+		render.JSON(w, r, errorPayload(r, ErrUpstreamNotFound.WithAttrs(map[string]any{"list": list})))
+		return
+	}
+
+	server.update(w, r, func(current *upstreams) (*upstreams, error) {
+		byId := make(map[string]*upstream)
+		for i, u := range current.list(list) {
+			byId[u.label(i)] = u
+		}
+		if len(req.Ids) != len(byId) {
+			return nil, ErrInvalidUpstream.WithAttrs(map[string]any{"field": "ids", "reason": "expect every upstream of the list once"})
+		}
+
+		result := make([]*upstream, 0, len(req.Ids))
+		for _, id := range req.Ids {
+			u, ok := byId[id]
+			if !ok {
+				return nil, ErrInvalidUpstream.WithAttrs(map[string]any{"field": "ids", "reason": fmt.Sprintf("unknown or duplicated id %s", id)})
+			}
+			delete(byId, id)
+
+			// the explicit order replaces the weights, so a reload of the persisted list keeps it
+			changed := *u
+			changed.config.Weight = 0
+			result = append(result, &changed)
+		}
+
+		next := &upstreams{price: current.price, average: current.average}
+		next.set(list, result)
+		return next, nil
+	})
+}
+
+// update applies change to the current upstreams, persists and stores the result and
+// responds with the new state. The changes are serialized with the reloads.
+func (server *DataSourceApiGw) update(w http.ResponseWriter, r *http.Request, change upstreamsChange) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	next, err := change(server.loadUpstreams())
+	if err != nil {
+		render.Status(r, adminStatus(err))
+		render.JSON(w, r, errorPayload(r, err))
+		return
+	}
+
+	if server.persist != nil {
+		if err = server.persist(next.configDataSources()); err != nil {
+			render.Status(r, 500)
+			render.JSON(w, r, errorPayload(r, ErrPersistFailed.WithAttrs(map[string]any{"reason": err.Error()})))
+			return
+		}
+	} else {
+		server.adminChanges = append(server.adminChanges, change)
+	}
+
+	server.upstreams.Store(next)
+	server.releaseGrpcClients(next)
+	render.Status(r, 200)
+	render.JSON(w, r, adminPayload{UpstreamsStatus{Price: upstreamStatuses(next.price), Average: upstreamStatuses(next.average)}})
+}
+
+func adminStatus(err error) int {
+	switch NewErrorPayload(err).Code {
+	case ErrUpstreamNotFound.Code:
+		return 404
+	case ErrUpstreamExists.Code:
+		return 409
+	}
+	return 400
+}
+
+func decodeAdminRequest(w http.ResponseWriter, r *http.Request, v any) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		render.Status(r, 400)
+		render.JSON(w, r, errorPayload(r, ErrInvalidUpstream.WithAttrs(map[string]any{"reason": err.Error()})))
+		return false
+	}
+	return true
+}
+
+// parseTimeout parses the timeout of an upstream, empty is no timeout.
+func parseTimeout(value string) (config.Duration, error) {
+	if strings.TrimSpace(value) == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, ErrInvalidUpstream.WithAttrs(map[string]any{"field": "timeout", "value": value})
+	}
+	return config.Duration(d), nil
+}
+
+func copyList(list []*upstream) []*upstream {
+	return append([]*upstream(nil), list...)
+}
@@ -0,0 +1,293 @@
+package gw
+
+import (
+	"bytes"
+	"cti/config"
+	"cti/ds"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testAdminToken = "admin-token"
+
+func adminRequest(server *DataSourceApiGw, method string, url string, body any) *httptest.ResponseRecorder {
+	var reader bytes.Buffer
+	if body != nil {
+		_ = json.NewEncoder(&reader).Encode(body)
+	}
+	req := httptest.NewRequest(method, url, &reader)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	return w
+}
+
+func decodeUpstreams(t *testing.T, w *httptest.ResponseRecorder) UpstreamsStatus {
+	var payload struct {
+		Data UpstreamsStatus `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &payload))
+	return payload.Data
+}
+
+func upstreamIds(statuses []UpstreamStatus) []string {
+	var ids []string
+	for _, status := range statuses {
+		ids = append(ids, status.Id)
+	}
+	return ids
+}
+
+func newAdminTestServer(t *testing.T, persist PersistFunc) *DataSourceApiGw {
+	server := NewDataSourceApiGw(nil, nil, "BTCUSD", ":0")
+	require.NoError(t, server.SetConfigDataSources(config.DataSources{
+		{Id: "influxdb", Url: "http://127.0.0.1:8082"},
+		{Id: "binance", Url: "http://127.0.0.1:8081", Weight: 10},
+		{Id: "local", Url: "http://127.0.0.1:8083", Symbols: []string{"ETHUSD"}},
+	}, config.DataSources{
+		{Id: "influxdb", Url: "http://127.0.0.1:8082"},
+	}))
+	server.EnableAdmin(testAdminToken, persist)
+	return server
+}
+
+func TestAdminUnauthorized(t *testing.T) {
+	server := newAdminTestServer(t, nil)
+
+	for _, header := range []string{"", "Bearer wrong", testAdminToken} {
+		req := httptest.NewRequest("GET", "/admin/upstreams", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		server.router.ServeHTTP(w, req)
+		assert.Equal(t, 401, w.Code, header)
+		assert.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+		assert.Equal(t, ErrUnauthorized.Code, decodeError(t, w).Code)
+	}
+}
+
+func TestAdminUpstreams(t *testing.T) {
+	server := newAdminTestServer(t, nil)
+
+	w := adminRequest(server, "GET", "/admin/upstreams", nil)
+	assert.Equal(t, 200, w.Code)
+	upstreams := decodeUpstreams(t, w)
+	assert.Equal(t, []string{"binance", "influxdb", "local"}, upstreamIds(upstreams.Price))
+	assert.Equal(t, UpstreamStatus{Id: "local", Url: "http://127.0.0.1:8083", Enabled: true, Health: "unknown", Breaker: BreakerClosed}, upstreams.Price[2])
+	assert.Equal(t, []string{"influxdb"}, upstreamIds(upstreams.Average))
+
+	w = adminRequest(server, "POST", "/admin/upstreams", map[string]any{"id": "postgres", "url": "http://127.0.0.1:8084", "timeout": "2s", "lists": []string{"price"}})
+	assert.Equal(t, 200, w.Code, w.Body.String())
+	upstreams = decodeUpstreams(t, w)
+	assert.Equal(t, []string{"binance", "influxdb", "local", "postgres"}, upstreamIds(upstreams.Price))
+	assert.Equal(t, "2s", upstreams.Price[3].Timeout)
+	assert.True(t, upstreams.Price[3].ServesSymbol)
+
+	w = adminRequest(server, "POST", "/admin/upstreams", map[string]any{"id": "postgres", "url": "http://127.0.0.1:8084"})
+	assert.Equal(t, 409, w.Code)
+	w = adminRequest(server, "POST", "/admin/upstreams", map[string]any{"id": "other", "url": "not-a-url"})
+	assert.Equal(t, 400, w.Code)
+	assert.Equal(t, ErrInvalidUpstream.Code, decodeError(t, w).Code)
+
+	w = adminRequest(server, "PATCH", "/admin/upstreams/influxdb", map[string]any{"enabled": false, "timeout": "500ms"})
+	assert.Equal(t, 200, w.Code)
+	upstreams = decodeUpstreams(t, w)
+	assert.False(t, upstreams.Price[1].Enabled)
+	assert.Equal(t, "500ms", upstreams.Price[1].Timeout)
+	assert.False(t, upstreams.Average[0].Enabled)
+	w = adminRequest(server, "PATCH", "/admin/upstreams/unknown", map[string]any{"enabled": false})
+	assert.Equal(t, 404, w.Code)
+
+	w = adminRequest(server, "PUT", "/admin/upstreams/price/order", map[string]any{"ids": []string{"postgres", "local", "influxdb", "binance"}})
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, []string{"postgres", "local", "influxdb", "binance"}, upstreamIds(decodeUpstreams(t, w).Price))
+	price, _ := server.loadUpstreams().configDataSources()
+	assert.Equal(t, 0, price[3].Weight)
+
+	for _, ids := range [][]string{{"postgres", "local"}, {"postgres", "postgres", "influxdb", "binance"}, {"x", "local", "influxdb", "binance"}} {
+		w = adminRequest(server, "PUT", "/admin/upstreams/price/order", map[string]any{"ids": ids})
+		assert.Equal(t, 400, w.Code, ids)
+	}
+	w = adminRequest(server, "PUT", "/admin/upstreams/candles/order", map[string]any{"ids": []string{}})
+	assert.Equal(t, 404, w.Code)
+}
+
+// unnamedDataSourceApi has no id, it is labeled by its position in each list
+type unnamedDataSourceApi struct{}
+
+func (api unnamedDataSourceApi) Price(symbol string, ts time.Time) (ds.PriceApiModel, error) {
+	return ds.PriceApiModel{}, nil
+}
+
+func (api unnamedDataSourceApi) Average(symbol string, from time.Time, until time.Time, granularity ds.Granularity) (ds.PriceAverageApiModel, error) {
+	return ds.PriceAverageApiModel{}, nil
+}
+
+func TestAdminUpdateUnnamedUpstream(t *testing.T) {
+	server := NewDataSourceApiGw([]ds.PriceDataSourceApi{unnamedDataSourceApi{}}, []ds.AverageDataSourceApi{unnamedDataSourceApi{}}, "BTCUSD", ":0")
+	server.EnableAdmin(testAdminToken, nil)
+
+	// the label is the same in both lists, only the list given is changed
+	w := adminRequest(server, "PATCH", "/admin/upstreams/price/0", map[string]any{"enabled": false})
+	assert.Equal(t, 200, w.Code, w.Body.String())
+	upstreams := decodeUpstreams(t, w)
+	assert.False(t, upstreams.Price[0].Enabled)
+	assert.True(t, upstreams.Average[0].Enabled)
+
+	w = adminRequest(server, "PATCH", "/admin/upstreams/0", map[string]any{"enabled": false})
+	assert.Equal(t, 404, w.Code)
+	w = adminRequest(server, "PATCH", "/admin/upstreams/candles/0", map[string]any{"enabled": false})
+	assert.Equal(t, 404, w.Code)
+	assert.True(t, server.Upstreams().Average[0].Enabled)
+}
+
+func decodeError(t *testing.T, w *httptest.ResponseRecorder) ErrorPayload {
+	var payload ErrorPayload
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &payload))
+	return payload
+}
+
+func TestAdminPersist(t *testing.T) {
+	var persisted config.DataSources
+	persistErr := errors.New("read-only file system")
+	var fail bool
+	server := newAdminTestServer(t, func(price config.DataSources, average config.DataSources) error {
+		if fail {
+			return persistErr
+		}
+		persisted = price
+		return nil
+	})
+
+	w := adminRequest(server, "PATCH", "/admin/upstreams/binance", map[string]any{"enabled": false})
+	assert.Equal(t, 200, w.Code)
+	assert.True(t, persisted[0].Disabled)
+
+	// a change which is not persisted is not applied
+	fail = true
+	w = adminRequest(server, "PATCH", "/admin/upstreams/binance", map[string]any{"enabled": true})
+	assert.Equal(t, 500, w.Code)
+	assert.Equal(t, ErrPersistFailed.Code, decodeError(t, w).Code)
+	assert.False(t, server.Upstreams().Price[0].Enabled)
+}
+
+func TestAdminChangesKeptOnReload(t *testing.T) {
+	server := newAdminTestServer(t, nil)
+
+	w := adminRequest(server, "PATCH", "/admin/upstreams/binance", map[string]any{"enabled": false, "timeout": "2s"})
+	assert.Equal(t, 200, w.Code)
+	w = adminRequest(server, "POST", "/admin/upstreams", map[string]any{"id": "kraken", "url": "http://127.0.0.1:8084", "lists": []string{"price"}})
+	assert.Equal(t, 200, w.Code)
+	w = adminRequest(server, "PUT", "/admin/upstreams/average/order", map[string]any{"ids": []string{"influxdb"}})
+	assert.Equal(t, 200, w.Code)
+
+	// the reloaded file changed the url of binance and no longer has the average influxdb
+	require.NoError(t, server.SetConfigDataSources(config.DataSources{
+		{Id: "binance", Url: "http://127.0.0.1:9081"},
+		{Id: "influxdb", Url: "http://127.0.0.1:8082"},
+	}, config.DataSources{
+		{Id: "binance", Url: "http://127.0.0.1:9081"},
+	}))
+
+	upstreams := server.Upstreams()
+	assert.Equal(t, []string{"binance", "influxdb", "kraken"}, upstreamIds(upstreams.Price))
+	assert.Equal(t, "http://127.0.0.1:9081", upstreams.Price[0].Url)
+	assert.False(t, upstreams.Price[0].Enabled)
+	assert.Equal(t, "2s", upstreams.Price[0].Timeout)
+	assert.False(t, upstreams.Average[0].Enabled)
+	assert.Equal(t, []string{"binance"}, upstreamIds(upstreams.Average))
+
+	// the dropped order change is not applied again
+	require.NoError(t, server.SetConfigDataSources(config.DataSources{
+		{Id: "binance", Url: "http://127.0.0.1:9081"},
+	}, config.DataSources{
+		{Id: "influxdb", Url: "http://127.0.0.1:8082"},
+		{Id: "local", Url: "http://127.0.0.1:8083"},
+	}))
+	assert.Equal(t, []string{"influxdb", "local"}, upstreamIds(server.Upstreams().Average))
+	assert.Len(t, server.adminChanges, 2)
+}
+
+func TestAdminDisabledUpstreamIsSkipped(t *testing.T) {
+	first := &fakeDataSourceApiClient{id: "first", price: 1}
+	second := &fakeDataSourceApiClient{id: "second", price: 2}
+	server := NewDataSourceApiGw([]ds.PriceDataSourceApi{first, second}, nil, "BTCUSD", ":0")
+	server.EnableAdmin(testAdminToken, nil)
+
+	w := adminRequest(server, "PATCH", "/admin/upstreams/first", map[string]any{"enabled": false})
+	assert.Equal(t, 200, w.Code)
+
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/price?ts=1667457091", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.JSONEq(t, `{"data":{"price":2},"source":"second"}`, w.Body.String())
+}
+
+func TestCircuitBreakerSkipsFailingUpstream(t *testing.T) {
+	down := &fakeDataSourceApiClient{id: "breaker-down", err: &ds.ErrSourceError}
+	up := &fakeDataSourceApiClient{id: "breaker-up", price: 1}
+	server := NewDataSourceApiGw([]ds.PriceDataSourceApi{down, up}, nil, "BTCUSD", ":0")
+
+	for i := 0; i < defaultBreakerThreshold+1; i++ {
+		w := httptest.NewRecorder()
+		server.router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/price?ts=1667457091", nil))
+		assert.Equal(t, 200, w.Code)
+	}
+
+	status := server.Upstreams().Price
+	assert.Equal(t, BreakerOpen, status[0].Breaker)
+	assert.Equal(t, "down", status[0].Health)
+	assert.Equal(t, defaultBreakerThreshold, status[0].ConsecutiveFailures)
+	assert.Equal(t, "up", status[1].Health)
+
+	// no data is an answer of a healthy upstream
+	noData := &fakeDataSourceApiClient{id: "breaker-no-data", err: &ds.ErrNoData}
+	server.SetDataSources([]ds.PriceDataSourceApi{noData}, nil)
+	for i := 0; i < defaultBreakerThreshold; i++ {
+		w := httptest.NewRecorder()
+		server.router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/price?ts=1667457091", nil))
+	}
+	assert.Equal(t, BreakerClosed, server.Upstreams().Price[0].Breaker)
+}
+
+func TestAdminConcurrentChanges(t *testing.T) {
+	server := newAdminTestServer(t, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			w := adminRequest(server, "POST", "/admin/upstreams", map[string]any{"id": fmt.Sprintf("added-%d", i), "url": "http://127.0.0.1:8085"})
+			assert.Equal(t, 200, w.Code)
+		}(i)
+		go func() {
+			defer wg.Done()
+			w := adminRequest(server, "GET", "/admin/upstreams", nil)
+			assert.Equal(t, 200, w.Code)
+		}()
+	}
+	wg.Wait()
+
+	upstreams := server.Upstreams()
+	assert.Len(t, upstreams.Price, 23)
+	assert.Len(t, upstreams.Average, 21)
+}
+
+func TestAdminRejectsUnknownFields(t *testing.T) {
+	server := newAdminTestServer(t, nil)
+	req := httptest.NewRequest("PATCH", "/admin/upstreams/binance", bytes.NewBufferString(`{"enable": true}`))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,294 @@
+package gw
+
+import (
+	"context"
+	"crypto/sha256"
+	"cti/config"
+	"cti/ds"
+	"cti/logging"
+	"cti/metrics"
+	"encoding/hex"
+	"github.com/go-chi/render"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ApiKeyHeader = "X-API-Key"
+
+// HashApiKey returns the hash of key as it is configured in config.ApiKey.
+func HashApiKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// keyState is the rate limit and quota state of one API key. The tokens never go below zero and
+// the daily quota is a hard cap, a request which does not fit is rejected and takes nothing.
+type keyState struct {
+	config.ApiKey
+	// tokens of the bucket at updatedAt
+	tokens    float64
+	updatedAt time.Time
+	// day is the UTC day dayCount counts the requests of
+	day      time.Time
+	dayCount int
+
+	allowed       int64
+	rateLimited   int64
+	quotaExceeded int64
+}
+
+func (state *keyState) burst() float64 {
+	if state.Burst > 0 {
+		return float64(state.Burst)
+	}
+	return math.Max(1, math.Ceil(state.Rate))
+}
+
+// take takes n requests of a batch of size requests from the bucket and the daily quota, the other
+// requests of the batch were taken before. The n requests are taken all or none, it returns the time
+// until they would be allowed when they are not, or 0 when the batch is larger than the burst or the
+// daily quota and is never allowed.
+func (state *keyState) take(now time.Time, n int, size int) (retryAfter time.Duration, result string) {
+	day := now.UTC().Truncate(time.Hour * 24)
+	if !day.Equal(state.day) {
+		state.day = day
+		state.dayCount = 0
+	}
+	if state.DailyQuota > 0 && (size > state.DailyQuota || state.dayCount+n > state.DailyQuota) {
+		state.quotaExceeded += int64(n)
+		if size > state.DailyQuota {
+			return 0, "quota_exceeded"
+		}
+		return day.Add(time.Hour * 24).Sub(now), "quota_exceeded"
+	}
+
+	if state.Rate > 0 {
+		if state.updatedAt.IsZero() {
+			state.tokens = state.burst()
+		} else {
+			state.tokens = math.Min(state.burst(), state.tokens+now.Sub(state.updatedAt).Seconds()*state.Rate)
+		}
+		state.updatedAt = now
+		if float64(size) > state.burst() {
+			state.rateLimited += int64(n)
+			return 0, "rate_limited"
+		}
+		if state.tokens < float64(n) {
+			state.rateLimited += int64(n)
+			return time.Duration((float64(n) - state.tokens) / state.Rate * float64(time.Second)), "rate_limited"
+		}
+		state.tokens -= float64(n)
+	}
+
+	state.dayCount += n
+	state.allowed += int64(n)
+	return 0, "allowed"
+}
+
+// keyring holds the API keys by hash, the state of a key is kept when the keys are replaced.
+type keyring struct {
+	mu     sync.Mutex
+	now    func() time.Time
+	byHash map[string]*keyState
+}
+
+func newKeyring() *keyring {
+	return &keyring{now: time.Now, byHash: make(map[string]*keyState)}
+}
+
+func (ring *keyring) set(keys []config.ApiKey) {
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+
+	byName := make(map[string]*keyState)
+	for _, state := range ring.byHash {
+		byName[state.Name] = state
+	}
+
+	byHash := make(map[string]*keyState)
+	for _, key := range keys {
+		state, ok := byName[key.Name]
+		if !ok {
+			state = &keyState{}
+		}
+		state.ApiKey = key
+		byHash[strings.ToLower(key.Hash)] = state
+	}
+	ring.byHash = byHash
+}
+
+// take counts n requests of a batch of size requests of the key with hash, the key name is empty
+// when the key is unknown.
+func (ring *keyring) take(hash string, n int, size int) (name string, retryAfter time.Duration, result string) {
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+
+	state, ok := ring.byHash[hash]
+	if !ok {
+		return "", 0, ""
+	}
+	retryAfter, result = state.take(ring.now(), n, size)
+	metrics.ApiKeyRequests.WithLabelValues(state.Name, result).Add(float64(n))
+	metrics.ApiKeyQuotaUsed.WithLabelValues(state.Name).Set(float64(state.dayCount))
+	return state.Name, retryAfter, result
+}
+
+type ApiKeyUsage struct {
+	Name           string  `json:"name"`
+	Rate           float64 `json:"rate,omitempty"`
+	Burst          int     `json:"burst,omitempty"`
+	DailyQuota     int     `json:"daily_quota,omitempty"`
+	UsedToday      int     `json:"used_today"`
+	RemainingToday *int    `json:"remaining_today,omitempty"`
+	Allowed        int64   `json:"allowed"`
+	RateLimited    int64   `json:"rate_limited"`
+	QuotaExceeded  int64   `json:"quota_exceeded"`
+}
+
+func (ring *keyring) usage() []ApiKeyUsage {
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+
+	today := ring.now().UTC().Truncate(time.Hour * 24)
+	usage := make([]ApiKeyUsage, 0, len(ring.byHash))
+	for _, state := range ring.byHash {
+		u := ApiKeyUsage{
+			Name:          state.Name,
+			Rate:          state.Rate,
+			Burst:         state.Burst,
+			DailyQuota:    state.DailyQuota,
+			Allowed:       state.allowed,
+			RateLimited:   state.rateLimited,
+			QuotaExceeded: state.quotaExceeded,
+		}
+		if state.day.Equal(today) {
+			u.UsedToday = state.dayCount
+		}
+		if state.DailyQuota > 0 {
+			remaining := state.DailyQuota - u.UsedToday
+			u.RemainingToday = &remaining
+		}
+		usage = append(usage, u)
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Name < usage[j].Name })
+	return usage
+}
+
+// EnableAuth requires one of keys in the X-API-Key or `Authorization: Bearer` header of
+// every API request. It must be called before the server is started.
+func (server *DataSourceApiGw) EnableAuth(keys []config.ApiKey) {
+	server.keyring = newKeyring()
+	server.keyring.set(keys)
+}
+
+// SetApiKeys replaces the API keys, the usage of the keys with the same name is kept.
+func (server *DataSourceApiGw) SetApiKeys(keys []config.ApiKey) {
+	if server.keyring != nil {
+		server.keyring.set(keys)
+	}
+}
+
+// ApiKeys returns the usage of the API keys, nil when the authentication is not enabled.
+func (server *DataSourceApiGw) ApiKeys() []ApiKeyUsage {
+	if server.keyring == nil {
+		return nil
+	}
+	return server.keyring.usage()
+}
+
+// authenticate checks the API key, its rate limit and daily quota.
+func (server *DataSourceApiGw) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if server.keyring == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var hash, name, result string
+		var retryAfter time.Duration
+		if key := requestApiKey(r); key != "" {
+			hash = HashApiKey(key)
+			name, retryAfter, result = server.keyring.take(hash, 1, 1)
+		}
+		if name == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			render.Status(r, 401)
+			render.JSON(w, r, errorPayload(r, &ErrUnauthorized))
+			return
+		}
+		logging.AddFields(r.Context(), "api_key", name)
+
+		if err := limitError(name, retryAfter, result); err != nil {
+			renderLimitError(w, r, retryAfter, err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyHashKey{}, hash)))
+	})
+}
+
+// apiKeyHashKey is the context key of the hash of the API key of a request.
+type apiKeyHashKey struct{}
+
+// charge counts n more requests of the API key of ctx, e.g. a stream subscription or the queries
+// of a batch of size requests next to the request itself, and returns the error of a key over its
+// rate limit or daily quota with the time until it is allowed. It allows every request without auth.
+func (server *DataSourceApiGw) charge(ctx context.Context, n int, size int) (time.Duration, error) {
+	if server.keyring == nil || n <= 0 {
+		return 0, nil
+	}
+	hash, _ := ctx.Value(apiKeyHashKey{}).(string)
+	name, retryAfter, result := server.keyring.take(hash, n, size)
+	if name == "" {
+		// the key was removed by a reload
+		return 0, &ErrUnauthorized
+	}
+	return retryAfter, limitError(name, retryAfter, result)
+}
+
+func renderLimitError(w http.ResponseWriter, r *http.Request, retryAfter time.Duration, err error) {
+	status := 429
+	if ds.IsErrorCode(err, ErrUnauthorized.Code) {
+		status = 401
+	} else if retryAfter > 0 {
+		w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+	}
+	render.Status(r, status)
+	render.JSON(w, r, errorPayload(r, err))
+}
+
+// limitError returns the error of a request over the rate limit or the daily quota of the key name,
+// without retryAfter the request is never allowed.
+func limitError(name string, retryAfter time.Duration, result string) error {
+	attrs := map[string]any{"key": name, "retryAfter": retryAfterSeconds(retryAfter)}
+	if retryAfter == 0 {
+		attrs = map[string]any{"key": name, "details": "batch is larger than the limit of the key"}
+	}
+	switch result {
+	case "rate_limited":
+		return ErrRateLimited.WithAttrs(attrs)
+	case "quota_exceeded":
+		return ErrQuotaExceeded.WithAttrs(attrs)
+	}
+	return nil
+}
+
+func requestApiKey(r *http.Request) string {
+	if key := r.Header.Get(ApiKeyHeader); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// retryAfterSeconds rounds up, a client retrying after the header value is never early.
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
@@ -0,0 +1,148 @@
+package gw
+
+import (
+	"cti/config"
+	"cti/ds"
+	"cti/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newAuthTestServer(keys ...config.ApiKey) *DataSourceApiGw {
+	client := &fakeDataSourceApiClient{id: "auth", price: 1}
+	server := NewDataSourceApiGw([]ds.PriceDataSourceApi{client}, []ds.AverageDataSourceApi{client}, "BTCUSD", ":0")
+	server.EnableAuth(keys)
+	return server
+}
+
+func priceRequest(server *DataSourceApiGw, header string, value string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/api/v1/price?ts=1667457091", nil)
+	if header != "" {
+		req.Header.Set(header, value)
+	}
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAuthenticate(t *testing.T) {
+	server := newAuthTestServer(config.ApiKey{Name: "auth-team", Hash: HashApiKey("secret-key")})
+
+	assert.Equal(t, 401, priceRequest(server, "", "").Code)
+	assert.Equal(t, 401, priceRequest(server, ApiKeyHeader, "wrong-key").Code)
+	assert.Equal(t, 200, priceRequest(server, ApiKeyHeader, "secret-key").Code)
+	assert.Equal(t, 200, priceRequest(server, "Authorization", "Bearer secret-key").Code)
+
+	// the metrics endpoint needs no key
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest("GET", metrics.Route, nil))
+	assert.Equal(t, 200, w.Code)
+
+	// no keys configured, no request is allowed
+	server.SetApiKeys(nil)
+	assert.Equal(t, 401, priceRequest(server, ApiKeyHeader, "secret-key").Code)
+}
+
+func TestRateLimit(t *testing.T) {
+	server := newAuthTestServer(config.ApiKey{Name: "auth-rate", Hash: HashApiKey("rate-key"), Rate: 0.5, Burst: 2})
+	now := time.Unix(1667457091, 0)
+	server.keyring.now = func() time.Time { return now }
+
+	assert.Equal(t, 200, priceRequest(server, ApiKeyHeader, "rate-key").Code)
+	assert.Equal(t, 200, priceRequest(server, ApiKeyHeader, "rate-key").Code)
+	w := priceRequest(server, ApiKeyHeader, "rate-key")
+	assert.Equal(t, 429, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+	assert.Equal(t, ErrRateLimited.Code, decodeError(t, w).Code)
+
+	now = now.Add(time.Second)
+	assert.Equal(t, "1", priceRequest(server, ApiKeyHeader, "rate-key").Header().Get("Retry-After"))
+	now = now.Add(time.Second)
+	assert.Equal(t, 200, priceRequest(server, ApiKeyHeader, "rate-key").Code)
+
+	assert.Equal(t, 3.0, testutil.ToFloat64(metrics.ApiKeyRequests.WithLabelValues("auth-rate", "allowed")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.ApiKeyRequests.WithLabelValues("auth-rate", "rate_limited")))
+}
+
+func TestDailyQuota(t *testing.T) {
+	server := newAuthTestServer(config.ApiKey{Name: "auth-quota", Hash: HashApiKey("quota-key"), DailyQuota: 2})
+	now := time.Date(2022, 11, 3, 23, 0, 0, 0, time.UTC)
+	server.keyring.now = func() time.Time { return now }
+
+	assert.Equal(t, 200, priceRequest(server, ApiKeyHeader, "quota-key").Code)
+	assert.Equal(t, 200, priceRequest(server, ApiKeyHeader, "quota-key").Code)
+	w := priceRequest(server, ApiKeyHeader, "quota-key")
+	assert.Equal(t, 429, w.Code)
+	assert.Equal(t, "3600", w.Header().Get("Retry-After"))
+	assert.Equal(t, ErrQuotaExceeded.Code, decodeError(t, w).Code)
+
+	remaining := 0
+	assert.Equal(t, []ApiKeyUsage{{Name: "auth-quota", DailyQuota: 2, UsedToday: 2, RemainingToday: &remaining, Allowed: 2, QuotaExceeded: 1}}, server.ApiKeys())
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.ApiKeyQuotaUsed.WithLabelValues("auth-quota")))
+
+	// the usage is kept when the keys are replaced
+	server.SetApiKeys([]config.ApiKey{{Name: "auth-quota", Hash: HashApiKey("new-quota-key"), DailyQuota: 2}})
+	assert.Equal(t, 429, priceRequest(server, ApiKeyHeader, "new-quota-key").Code)
+
+	now = now.Add(time.Hour)
+	assert.Equal(t, 200, priceRequest(server, ApiKeyHeader, "new-quota-key").Code)
+}
+
+func TestAdminApiKeys(t *testing.T) {
+	server := newAdminTestServer(t, nil)
+	w := adminRequest(server, "GET", "/admin/keys", nil)
+	assert.Equal(t, 200, w.Code)
+	assert.JSONEq(t, `{"data":[]}`, w.Body.String())
+
+	server.EnableAuth([]config.ApiKey{{Name: "auth-admin", Hash: HashApiKey("admin-key"), Rate: 10}})
+	w = adminRequest(server, "GET", "/admin/keys", nil)
+	assert.JSONEq(t, `{"data":[{"name":"auth-admin","rate":10,"used_today":0,"allowed":0,"rate_limited":0,"quota_exceeded":0}]}`, w.Body.String())
+}
+
+func pricesRequest(server *DataSourceApiGw, key string, queries int) *httptest.ResponseRecorder {
+	body := `{"queries":[` + strings.TrimSuffix(strings.Repeat(`{"symbol":"BTCUSD","ts":1667457091},`, queries), ",") + `]}`
+	req := httptest.NewRequest("POST", "/api/v1/prices", strings.NewReader(body))
+	req.Header.Set(ApiKeyHeader, key)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestPricesChargedByQuery(t *testing.T) {
+	server := newAuthTestServer(config.ApiKey{Name: "auth-batch", Hash: HashApiKey("batch-key"), Rate: 1, Burst: 3})
+	now := time.Unix(1667457091, 0)
+	server.keyring.now = func() time.Time { return now }
+
+	// a batch larger than the burst is never allowed
+	w := pricesRequest(server, "batch-key", 4)
+	assert.Equal(t, 429, w.Code)
+	assert.Equal(t, ErrRateLimited.Code, decodeError(t, w).Code)
+	assert.Empty(t, w.Header().Get("Retry-After"))
+
+	// the request itself took one of the tokens, the batch waits for the rest
+	w = pricesRequest(server, "batch-key", 3)
+	assert.Equal(t, 429, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	now = now.Add(time.Second * 3)
+	assert.Equal(t, 200, pricesRequest(server, "batch-key", 3).Code)
+	assert.Equal(t, 5, server.ApiKeys()[0].UsedToday)
+	w = priceRequest(server, ApiKeyHeader, "batch-key")
+	assert.Equal(t, 429, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+}
+
+func TestPricesOverLimitRejected(t *testing.T) {
+	server := newAuthTestServer(config.ApiKey{Name: "auth-small", Hash: HashApiKey("small-key"), Rate: 1, Burst: 1, DailyQuota: 1})
+
+	w := pricesRequest(server, "small-key", 100)
+	assert.Equal(t, 429, w.Code)
+	assert.Equal(t, ErrQuotaExceeded.Code, decodeError(t, w).Code)
+	usage := server.ApiKeys()[0]
+	assert.Equal(t, 1, usage.UsedToday)
+	assert.Equal(t, int64(99), usage.QuotaExceeded)
+}
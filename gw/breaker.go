@@ -0,0 +1,108 @@
+package gw
+
+import (
+	"sync"
+	"time"
+)
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = time.Second * 30
+)
+
+// breaker is a circuit breaker of one upstream. It opens after threshold consecutive
+// failures, skips the upstream for cooldown, then lets one trial request through.
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	state       BreakerState
+	failures    int
+	openedAt    time.Time
+	trial       bool
+	lastSuccess time.Time
+	lastErr     error
+	lastErrAt   time.Time
+}
+
+func newBreaker() *breaker {
+	return &breaker{
+		threshold: defaultBreakerThreshold,
+		cooldown:  defaultBreakerCooldown,
+		now:       time.Now,
+		state:     BreakerClosed,
+	}
+}
+
+// allow reports whether a request may be sent to the upstream.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.trial = true
+		return true
+	case BreakerHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	}
+	return true
+}
+
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+	if err == nil {
+		b.state = BreakerClosed
+		b.failures = 0
+		b.lastSuccess = b.now()
+		return
+	}
+
+	b.failures++
+	b.lastErr = err
+	b.lastErrAt = b.now()
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.state = BreakerOpen
+		b.openedAt = b.now()
+	}
+}
+
+type breakerStatus struct {
+	state       BreakerState
+	failures    int
+	lastSuccess time.Time
+	lastErr     error
+	lastErrAt   time.Time
+}
+
+func (b *breaker) status() breakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state := b.state
+	if state == BreakerOpen && b.now().Sub(b.openedAt) >= b.cooldown {
+		state = BreakerHalfOpen
+	}
+	return breakerStatus{state: state, failures: b.failures, lastSuccess: b.lastSuccess, lastErr: b.lastErr, lastErrAt: b.lastErrAt}
+}
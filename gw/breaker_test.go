@@ -0,0 +1,44 @@
+package gw
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Unix(1667457091, 0)
+	b := newBreaker()
+	b.now = func() time.Time { return now }
+	failure := errors.New("connection refused")
+
+	for i := 0; i < defaultBreakerThreshold-1; i++ {
+		assert.True(t, b.allow())
+		b.record(failure)
+	}
+	assert.Equal(t, BreakerClosed, b.status().state)
+
+	assert.True(t, b.allow())
+	b.record(failure)
+	assert.Equal(t, BreakerOpen, b.status().state)
+	assert.False(t, b.allow())
+
+	// one trial after the cooldown, a failing trial opens the breaker again
+	now = now.Add(defaultBreakerCooldown)
+	assert.Equal(t, BreakerHalfOpen, b.status().state)
+	assert.True(t, b.allow())
+	assert.False(t, b.allow())
+	b.record(failure)
+	assert.Equal(t, BreakerOpen, b.status().state)
+
+	now = now.Add(defaultBreakerCooldown)
+	assert.True(t, b.allow())
+	b.record(nil)
+	status := b.status()
+	assert.Equal(t, BreakerClosed, status.state)
+	assert.Equal(t, 0, status.failures)
+	assert.Equal(t, now, status.lastSuccess)
+	assert.Equal(t, failure, status.lastErr)
+	assert.True(t, b.allow())
+}
@@ -1,6 +1,10 @@
 package gw
 
-import "cti/ds"
+import (
+	"context"
+	"cti/ds"
+	"time"
+)
 
 type DataSourceApiClient interface {
 	ds.DataSourceApiClient
@@ -22,3 +26,27 @@ func NewDefaultDataSourceApiClient(id string, client ds.DataSourceApiClient) *De
 func (client DefaultDataSourceApiClient) Id() string {
 	return client.id
 }
+
+func (client DefaultDataSourceApiClient) PriceContext(ctx context.Context, symbol string, ts time.Time) (ds.PriceApiModel, error) {
+	return ds.PriceWithContext(ctx, client.DataSourceApiClient, symbol, ts)
+}
+
+func (client DefaultDataSourceApiClient) AverageContext(ctx context.Context, symbol string, from time.Time, until time.Time, granularity ds.Granularity) (ds.PriceAverageApiModel, error) {
+	return ds.AverageWithContext(ctx, client.DataSourceApiClient, symbol, from, until, granularity)
+}
+
+func (client DefaultDataSourceApiClient) SeriesPage(ctx context.Context, query ds.SeriesQuery) (ds.SeriesApiModel, error) {
+	seriesApi, ok := client.DataSourceApiClient.(ds.SeriesDataSourceApi)
+	if !ok {
+		return ds.SeriesApiModel{}, &ds.ErrSeriesNotSupported
+	}
+	return seriesApi.SeriesPage(ctx, query)
+}
+
+func (client DefaultDataSourceApiClient) StreamPrice(ctx context.Context, symbol string, granularity ds.Granularity, onTick func(ds.PriceTick)) error {
+	streamer, ok := client.DataSourceApiClient.(ds.PriceStreamer)
+	if !ok {
+		return &ds.ErrStreamNotSupported
+	}
+	return streamer.StreamPrice(ctx, symbol, granularity, onTick)
+}
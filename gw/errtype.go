@@ -6,4 +6,16 @@ var (
 	ErrQueryStringIsRequired = erro.NewError("QUERY_STRING_REQUIRED", "query string is required", nil)
 	ErrQueryStringInvalid    = erro.NewError("QUERY_STRING_INVALID", "query string is invalid", nil)
 	ErrNoDataSourceAvailable = erro.NewError("NO_DATA_SOURCE_AVAILABLE", "no data source available", nil)
+	ErrCircuitOpen           = erro.NewError("CIRCUIT_OPEN", "circuit breaker of the data source is open", nil)
+	ErrUnauthorized          = erro.NewError("UNAUTHORIZED", "unauthorized", nil)
+	ErrUpstreamNotFound      = erro.NewError("UPSTREAM_NOT_FOUND", "upstream not found", nil)
+	ErrUpstreamExists        = erro.NewError("UPSTREAM_EXISTS", "upstream already exists", nil)
+	ErrInvalidUpstream       = erro.NewError("INVALID_UPSTREAM", "upstream is invalid", nil)
+	ErrRateLimited           = erro.NewError("RATE_LIMITED", "rate limit of the api key exceeded", nil)
+	ErrQuotaExceeded         = erro.NewError("QUOTA_EXCEEDED", "daily quota of the api key exceeded", nil)
+	ErrPersistFailed         = erro.NewError("PERSIST_FAILED", "failed to persist upstreams", nil)
+	ErrInvalidStreamMessage  = erro.NewError("INVALID_STREAM_MESSAGE", "stream message is invalid", nil)
+	ErrTooManySubscriptions  = erro.NewError("TOO_MANY_SUBSCRIPTIONS", "too many subscribed symbols", nil)
+	ErrStreamFailed          = erro.NewError("STREAM_FAILED", "price stream failed, retrying", nil)
+	ErrSymbolNotServed       = erro.NewError("SYMBOL_NOT_SERVED", "symbol is not served by the gateway", nil)
 )
@@ -1,15 +1,23 @@
 package gw
 
 import (
+	"context"
 	"cti/ds"
 	"cti/erro"
+	"cti/logging"
+	"cti/metrics"
+	"cti/tlsutil"
+	"cti/tracing"
 	"errors"
 	"fmt"
 	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"net/http"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -39,87 +47,110 @@ func (err ErrorPayload) Error() string {
 	return err.Msg
 }
 
+// errorPayload returns the payload of err and adds its code to the request log line.
+func errorPayload(r *http.Request, err error) ErrorPayload {
+	payload := NewErrorPayload(err)
+	logging.AddFields(r.Context(), "error_code", payload.Code)
+	return payload
+}
+
 type DataSourceApiGw struct {
-	priceDataSource   []ds.PriceDataSourceApi
-	averageDataSource []ds.AverageDataSourceApi
-	router            *chi.Mux
-	symbol            string
-	listenAddr        string
+	// upstreams holds *upstreams, a request uses the snapshot it loads first until it is done
+	upstreams atomic.Value
+	// mu serializes the changes of the upstreams
+	mu       sync.Mutex
+	breakers map[string]*breaker
+	persist  PersistFunc
+	// adminChanges are the admin changes which are not persisted, they are applied again on reload
+	adminChanges []upstreamsChange
+	keyring      *keyring
+	// upstreamOptions and upstreamGrpcOptions are applied to the clients of the configured datasources
+	upstreamOptions     []ds.DefaultDataSourceApiClientOption
+	upstreamGrpcOptions []ds.GrpcDataSourceApiClientOption
+	grpcClients         map[string]*ds.GrpcDataSourceApiClient
+	hub                 *streamHub
+	events              *ds.PriceEvents
+	router              *chi.Mux
+	symbol              string
+	listenAddr          string
+	httpServer          *http.Server
 }
 
 func NewDataSourceApiGw(priceDataSource []ds.PriceDataSourceApi, averageDataSource []ds.AverageDataSourceApi, symbol string, listenAddr string) *DataSourceApiGw {
 	server := &DataSourceApiGw{
-		priceDataSource:   priceDataSource,
-		averageDataSource: averageDataSource,
-		symbol:            symbol,
-		listenAddr:        listenAddr,
+		breakers:    make(map[string]*breaker),
+		grpcClients: make(map[string]*ds.GrpcDataSourceApiClient),
+		symbol:      symbol,
+		listenAddr:  listenAddr,
 	}
+	server.SetDataSources(priceDataSource, averageDataSource)
+	server.hub = newStreamHub(server, DefaultStreamGranularity)
+	server.events, _ = ds.NewPriceEvents(server)
 
 	r := chi.NewRouter()
-	r.Use(middleware.Logger)
+	r.Use(logging.Middleware("gw"))
+	r.Use(metrics.Middleware("gw"))
+	r.Use(tracing.Middleware("gw"))
 	r.Route("/api/v1", server.v1Route)
+	r.Handle(metrics.Route, metrics.Handler())
 	server.router = r
+	server.httpServer = &http.Server{Addr: listenAddr, Handler: r}
 
 	return server
 }
 
 func (server *DataSourceApiGw) v1Route(r chi.Router) {
+	r.Use(server.authenticate)
 	r.Get("/price", server.price)
 	r.Get("/average", server.average)
+	r.Get("/stream", server.stream)
+	r.Get("/events", server.priceEvents)
+	r.Post("/prices", server.prices)
+	r.Get("/series", server.series)
 }
 
 func (server *DataSourceApiGw) price(w http.ResponseWriter, r *http.Request) {
 	queryTs := r.URL.Query().Get("ts")
+	logging.AddFields(r.Context(), "symbol", server.symbol, "ts", queryTs)
 	if queryTs == "" {
 		render.Status(r, 400)
-		render.JSON(w, r, NewErrorPayload(fmt.Errorf("%w: ts", ErrQueryStringIsRequired.WithAttrs(map[string]interface{}{"field": "ts"}))))
+		render.JSON(w, r, errorPayload(r, fmt.Errorf("%w: ts", ErrQueryStringIsRequired.WithAttrs(map[string]interface{}{"field": "ts"}))))
 		return
 	}
 
 	ts, err := strconv.ParseInt(queryTs, 10, 64)
 	if err != nil {
+		logging.AddFields(r.Context(), "error_code", ErrQueryStringInvalid.Code)
 		render.Status(r, 400)
 		render.JSON(w, r, ErrQueryStringInvalid.WithAttrs(map[string]any{"field": "ts"}))
 		return
 	}
 
-	errs := make(map[string]error)
-	for i, dataSource := range server.priceDataSource {
-		var sourceId *string
-		if d, ok := dataSource.(DataSourceApiClient); ok {
-			s := d.Id()
-			sourceId = &s
-		}
-
-		result, err := dataSource.Price(server.symbol, time.Unix(ts, 0))
-		if err != nil {
-			if sourceId != nil {
-				errs[*sourceId] = err
-			} else {
-				errs[fmt.Sprintf("%d", i)] = err
-			}
-			continue
-		}
-
+	result, sourceId, errs := server.failover(r.Context(), listPrice, server.symbol, func(ctx context.Context, u *upstream) (any, error) {
+		return ds.PriceWithContext(ctx, u.price, server.symbol, time.Unix(ts, 0))
+	})
+	if errs == nil {
 		render.Status(r, 200)
 		render.JSON(w, r, DefaultPayload{result, sourceId})
 		return
 	}
 
 	render.Status(r, 400)
-	render.JSON(w, r, NewErrorPayload(ErrNoDataSourceAvailable.WithAttrs(map[string]any{"errs": errs})))
+	render.JSON(w, r, errorPayload(r, ErrNoDataSourceAvailable.WithAttrs(map[string]any{"errs": errs})))
 }
 
 func (server *DataSourceApiGw) average(w http.ResponseWriter, r *http.Request) {
 	queryFrom := r.URL.Query().Get("from")
+	logging.AddFields(r.Context(), "symbol", server.symbol, "from", queryFrom, "until", r.URL.Query().Get("until"))
 	if queryFrom == "" {
 		render.Status(r, 400)
-		render.JSON(w, r, NewErrorPayload(fmt.Errorf("%w: from", ErrQueryStringIsRequired.WithAttrs(map[string]interface{}{"field": "from"}))))
+		render.JSON(w, r, errorPayload(r, fmt.Errorf("%w: from", ErrQueryStringIsRequired.WithAttrs(map[string]interface{}{"field": "from"}))))
 		return
 	}
 
 	from, err := strconv.ParseInt(queryFrom, 10, 64)
 	if err != nil {
+		logging.AddFields(r.Context(), "error_code", ErrQueryStringInvalid.Code)
 		render.Status(r, 400)
 		render.JSON(w, r, ErrQueryStringInvalid.WithAttrs(map[string]any{"field": "from"}))
 		return
@@ -128,12 +159,13 @@ func (server *DataSourceApiGw) average(w http.ResponseWriter, r *http.Request) {
 	queryUntil := r.URL.Query().Get("until")
 	if queryUntil == "" {
 		render.Status(r, 400)
-		render.JSON(w, r, NewErrorPayload(fmt.Errorf("%w: until", ErrQueryStringIsRequired.WithAttrs(map[string]interface{}{"field": "until"}))))
+		render.JSON(w, r, errorPayload(r, fmt.Errorf("%w: until", ErrQueryStringIsRequired.WithAttrs(map[string]interface{}{"field": "until"}))))
 		return
 	}
 
 	until, err := strconv.ParseInt(queryUntil, 10, 64)
 	if err != nil {
+		logging.AddFields(r.Context(), "error_code", ErrQueryStringInvalid.Code)
 		render.Status(r, 400)
 		render.JSON(w, r, ErrQueryStringInvalid.WithAttrs(map[string]any{"field": "until"}))
 		return
@@ -144,33 +176,296 @@ func (server *DataSourceApiGw) average(w http.ResponseWriter, r *http.Request) {
 		granularity = ds.Granularity1s
 	}
 
-	errs := make(map[string]error)
-	for i, dataSource := range server.averageDataSource {
-		var sourceId *string
-		if d, ok := dataSource.(DataSourceApiClient); ok {
-			s := d.Id()
-			sourceId = &s
+	result, sourceId, errs := server.failover(r.Context(), listAverage, server.symbol, func(ctx context.Context, u *upstream) (any, error) {
+		return ds.AverageWithContext(ctx, u.average, server.symbol, time.Unix(from, 0), time.Unix(until, 0), granularity)
+	})
+	if errs == nil {
+		render.Status(r, 200)
+		render.JSON(w, r, DefaultPayload{result, sourceId})
+		return
+	}
+
+	render.Status(r, 400)
+	render.JSON(w, r, errorPayload(r, ErrNoDataSourceAvailable.WithAttrs(map[string]any{"errs": errs})))
+}
+
+// prices answers a batch of prices, the queries of every symbol are sent as one batch to the
+// upstreams serving the symbol in order, the failed queries are sent again to the next upstream.
+// The result of every query has its source. Every query is charged to the API key like a request.
+func (server *DataSourceApiGw) prices(w http.ResponseWriter, r *http.Request) {
+	queries, err := ds.DecodePricesRequest(r)
+	if err != nil {
+		render.Status(r, 400)
+		render.JSON(w, r, errorPayload(r, err))
+		return
+	}
+	logging.AddFields(r.Context(), "queries", len(queries))
+	// the request itself is charged by authenticate as the first query
+	if retryAfter, err := server.charge(r.Context(), len(queries)-1, len(queries)); err != nil {
+		renderLimitError(w, r, retryAfter, err)
+		return
+	}
+
+	results, sources := server.batchPrices(r.Context(), queries)
+	model := ds.NewPricesApiModel(queries, results)
+	for i := range model.Results {
+		model.Results[i].Source = sources[i]
+	}
+
+	render.Status(r, 200)
+	render.JSON(w, r, DefaultPayload{Data: model})
+}
+
+// Prices answers queries like POST /api/v1/prices, so the gateway is a ds.BatchPriceDataSource,
+// e.g. of the replay of /api/v1/events.
+func (server *DataSourceApiGw) Prices(ctx context.Context, queries []ds.PriceQuery) ([]ds.PriceResult, error) {
+	results, _ := server.batchPrices(ctx, queries)
+	return results, nil
+}
+
+// batchPrices returns the result and the source of every query.
+func (server *DataSourceApiGw) batchPrices(ctx context.Context, queries []ds.PriceQuery) ([]ds.PriceResult, []*string) {
+	bySymbol := make(map[string][]int)
+	var symbols []string
+	for i, query := range queries {
+		if _, ok := bySymbol[query.Symbol]; !ok {
+			symbols = append(symbols, query.Symbol)
 		}
+		bySymbol[query.Symbol] = append(bySymbol[query.Symbol], i)
+	}
 
-		result, err := dataSource.Average(server.symbol, time.Unix(from, 0), time.Unix(until, 0), granularity)
-		if err != nil {
-			if sourceId != nil {
-				errs[*sourceId] = err
-			} else {
-				errs[fmt.Sprintf("%d", i)] = err
+	results := make([]ds.PriceResult, len(queries))
+	sources := make([]*string, len(queries))
+	for _, symbol := range symbols {
+		server.batchFailover(ctx, symbol, queries, bySymbol[symbol], results, sources)
+	}
+	return results, sources
+}
+
+// batchFailover resolves the queries of indexes like failover resolves one price: the pending
+// queries are sent to the upstreams serving symbol in order, until every query has a price. A
+// query no upstream answers gets the errors of every upstream, as GET /api/v1/price.
+func (server *DataSourceApiGw) batchFailover(ctx context.Context, symbol string, queries []ds.PriceQuery, indexes []int, results []ds.PriceResult, sources []*string) {
+	errs := make(map[int]map[string]error, len(indexes))
+	for _, index := range indexes {
+		errs[index] = make(map[string]error)
+	}
+
+	pending := indexes
+	candidates, labels := server.candidates(listPrice, symbol)
+	for i, u := range candidates {
+		batch := make([]ds.PriceQuery, len(pending))
+		for j, index := range pending {
+			batch[j] = queries[index]
+		}
+
+		result, err := server.attempt(ctx, listPrice, labels[i], i, u, func(ctx context.Context, u *upstream) (any, error) {
+			results, err := ds.PricesWithContext(ctx, u.price, batch)
+			if err != nil {
+				return nil, err
 			}
-			continue
+			return results, batchError(results)
+		})
+
+		answers, _ := result.([]ds.PriceResult)
+		var failed []int
+		for j, index := range pending {
+			queryErr := err
+			if answers != nil {
+				queryErr = answers[j].Err
+			}
+			if queryErr != nil {
+				errs[index][labels[i]] = queryErr
+				failed = append(failed, index)
+				continue
+			}
+			results[index] = answers[j]
+			sources[index] = u.sourceId()
+		}
+		if len(failed) < len(pending) {
+			logging.AddFields(ctx, "source", labels[i])
 		}
 
+		pending = failed
+		if len(pending) == 0 {
+			return
+		}
+		if i < len(candidates)-1 {
+			metrics.Failovers.WithLabelValues(listPrice, labels[i]).Inc()
+		}
+	}
+
+	for _, index := range pending {
+		results[index] = ds.PriceResult{Err: ErrNoDataSourceAvailable.WithAttrs(map[string]any{"errs": errs[index]})}
+	}
+}
+
+// series returns a page of the points of the symbol of the query string, by default the gateway
+// symbol, from the first average upstream which serves series. The cursor of a page is not bound to
+// its upstream, the next page may come from another one.
+func (server *DataSourceApiGw) series(w http.ResponseWriter, r *http.Request) {
+	logging.AddFields(r.Context(), "symbol", r.URL.Query().Get("symbol"), "granularity", r.URL.Query().Get("granularity"))
+	query, err := ds.ParseSeriesQuery(r.URL.Query())
+	if err != nil {
+		render.Status(r, 400)
+		render.JSON(w, r, errorPayload(r, err))
+		return
+	}
+	if query.Symbol == "" {
+		query.Symbol = server.symbol
+	}
+	if !streamSymbolPattern.MatchString(query.Symbol) {
+		render.Status(r, 400)
+		render.JSON(w, r, errorPayload(r, ds.ErrInvalidSymbol.WithAttrs(map[string]any{"symbol": query.Symbol})))
+		return
+	}
+
+	result, sourceId, errs := server.failover(r.Context(), listAverage, query.Symbol, func(ctx context.Context, u *upstream) (any, error) {
+		seriesApi, ok := u.average.(ds.SeriesDataSourceApi)
+		if !ok {
+			return nil, &ds.ErrSeriesNotSupported
+		}
+		return seriesApi.SeriesPage(ctx, query)
+	})
+	if errs == nil {
 		render.Status(r, 200)
 		render.JSON(w, r, DefaultPayload{result, sourceId})
 		return
 	}
 
 	render.Status(r, 400)
-	render.JSON(w, r, NewErrorPayload(ErrNoDataSourceAvailable.WithAttrs(map[string]any{"errs": errs})))
+	render.JSON(w, r, errorPayload(r, ErrNoDataSourceAvailable.WithAttrs(map[string]any{"errs": errs})))
+}
+
+// priceEvents serves the prices of the symbol of the query string, by default the gateway symbol,
+// as Server-Sent Events from the upstreams, see ds.PriceEvents.
+func (server *DataSourceApiGw) priceEvents(w http.ResponseWriter, r *http.Request) {
+	symbol := r.URL.Query().Get("symbol")
+	if symbol == "" {
+		symbol = server.symbol
+	}
+	logging.AddFields(r.Context(), "symbol", symbol, "granularity", r.URL.Query().Get("granularity"))
+	if !streamSymbolPattern.MatchString(symbol) {
+		render.Status(r, 400)
+		render.JSON(w, r, errorPayload(r, ds.ErrInvalidSymbol.WithAttrs(map[string]any{"symbol": symbol})))
+		return
+	}
+	if !server.streamsSymbol(symbol) {
+		render.Status(r, 404)
+		render.JSON(w, r, errorPayload(r, ErrSymbolNotServed.WithAttrs(map[string]any{"symbol": symbol})))
+		return
+	}
+
+	server.events.Serve(w, r, symbol)
+}
+
+// failover tries the enabled upstreams of list serving symbol in order until one succeeds,
+// it returns the errors of every upstream when none succeeds.
+func (server *DataSourceApiGw) failover(ctx context.Context, list string, symbol string, call func(ctx context.Context, u *upstream) (any, error)) (any, *string, map[string]error) {
+	candidates, labels := server.candidates(list, symbol)
+	errs := make(map[string]error)
+	for i, u := range candidates {
+		label := labels[i]
+		result, err := server.attempt(ctx, list, label, i, u, call)
+		if err != nil {
+			errs[label] = err
+			if i < len(candidates)-1 {
+				metrics.Failovers.WithLabelValues(list, label).Inc()
+			}
+			continue
+		}
+
+		logging.AddFields(ctx, "source", label)
+		return result, u.sourceId(), nil
+	}
+
+	return nil, nil, errs
+}
+
+// candidates returns the enabled upstreams of list serving symbol in order, with their labels.
+func (server *DataSourceApiGw) candidates(list string, symbol string) ([]*upstream, []string) {
+	var candidates []*upstream
+	var labels []string
+	for i, u := range server.loadUpstreams().list(list) {
+		if u.candidate(symbol) {
+			candidates = append(candidates, u)
+			labels = append(labels, u.label(i))
+		}
+	}
+	return candidates, labels
+}
+
+// attempt calls u unless its breaker is open, with the timeout of u, and records the outcome.
+func (server *DataSourceApiGw) attempt(ctx context.Context, list string, label string, i int, u *upstream, call func(ctx context.Context, u *upstream) (any, error)) (any, error) {
+	if !u.breaker.allow() {
+		return nil, &ErrCircuitOpen
+	}
+	start := time.Now()
+	attemptCtx, cancel := u.attemptContext(ctx)
+	defer cancel()
+	attemptCtx, span := upstreamSpan(attemptCtx, list, label, i)
+	result, err := call(attemptCtx, u)
+	tracing.End(span, err)
+	metrics.ObserveUpstream(label, list, start, err)
+	u.breaker.record(breakerError(err))
+	return result, err
+}
+
+// batchError returns an error of results when all of them failed and none is an answer of a
+// healthy upstream, the upstream is recorded as failed by its breaker then.
+func batchError(results []ds.PriceResult) error {
+	for _, result := range results {
+		if result.Err == nil || breakerError(result.Err) == nil {
+			return nil
+		}
+	}
+	if len(results) == 0 {
+		return nil
+	}
+	return results[0].Err
+}
+
+// breakerError returns err unless it is an answer of a healthy upstream, e.g. no data for the range.
+func breakerError(err error) error {
+	for _, code := range []string{ds.ErrNoData.Code, ds.ErrInvalidGranularity.Code, ds.ErrInvalidSymbol.Code, ds.ErrDataSourceApiServerQueryStringIsRequired.Code, ds.ErrDataSourceApiServerQueryStringIsInvalid.Code, ds.ErrSeriesNotSupported.Code, ds.ErrStreamNotSupported.Code} {
+		if ds.IsErrorCode(err, code) {
+			return nil
+		}
+	}
+	return err
+}
+
+// upstreamSpan starts the span of one attempt on an upstream datasource.
+func upstreamSpan(ctx context.Context, operation string, sourceId string, attempt int) (context.Context, trace.Span) {
+	return tracing.Start(ctx, "upstream "+operation,
+		attribute.String("datasource", sourceId),
+		attribute.Int("attempt", attempt),
+	)
+}
+
+// EnableTLS serves HTTPS with the certificate of certFile and keyFile, it is reloaded when the
+// files are rotated. With clientCaFile the clients need a certificate signed by one of its CAs.
+// It must be called before the server is started.
+func (server *DataSourceApiGw) EnableTLS(certFile string, keyFile string, clientCaFile string) error {
+	config, err := tlsutil.ServerConfig(certFile, keyFile, clientCaFile)
+	if err != nil {
+		return err
+	}
+	server.httpServer.TLSConfig = config
+	return nil
 }
 
 func (server *DataSourceApiGw) ListenAndServe() error {
-	return http.ListenAndServe(server.listenAddr, server.router)
+	if server.httpServer.TLSConfig != nil {
+		return server.httpServer.ListenAndServeTLS("", "")
+	}
+	return server.httpServer.ListenAndServe()
+}
+
+// Shutdown stops accepting connections and waits for the in-flight requests until ctx is done.
+// The stream and event stream connections are closed right away.
+func (server *DataSourceApiGw) Shutdown(ctx context.Context) error {
+	server.hub.close()
+	server.events.Close()
+	return server.httpServer.Shutdown(ctx)
 }
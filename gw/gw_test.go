@@ -1,13 +1,24 @@
 package gw
 
 import (
+	"context"
+	"cti/config"
 	"cti/ds"
+	"cti/lifecycle"
+	"cti/logging"
+	"cti/metrics"
+	"encoding/json"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 type DataSourceApiGwTestSuite struct {
@@ -161,3 +172,275 @@ func TestErrorPayload(t *testing.T) {
 	err := NewErrorPayload(fmt.Errorf("testing"))
 	assert.Equal(t, err.Error(), err.Msg)
 }
+
+func TestShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	listenAddr := listener.Addr().String()
+	assert.Nil(t, listener.Close())
+
+	server := NewDataSourceApiGw(nil, nil, "BTCUSD", listenAddr)
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- lifecycle.Serve(ctx, server, time.Second)
+	}()
+
+	assert.Eventually(t, func() bool {
+		resp, err := http.Get(fmt.Sprintf("http://%s/api/v1/price", listenAddr))
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return true
+	}, time.Second*2, time.Millisecond*10)
+
+	cancel()
+	assert.Nil(t, <-errCh)
+}
+
+type fakeDataSourceApiClient struct {
+	id    string
+	price float64
+	err   error
+}
+
+func (client *fakeDataSourceApiClient) Id() string {
+	return client.id
+}
+
+func (client *fakeDataSourceApiClient) Price(symbol string, ts time.Time) (ds.PriceApiModel, error) {
+	return ds.PriceApiModel{Price: client.price}, client.err
+}
+
+func (client *fakeDataSourceApiClient) Average(symbol string, from time.Time, until time.Time, granularity ds.Granularity) (ds.PriceAverageApiModel, error) {
+	return ds.PriceAverageApiModel{Average: client.price, From: from.Unix(), Until: until.Unix()}, client.err
+}
+
+func TestFailoverMetrics(t *testing.T) {
+	down := &fakeDataSourceApiClient{id: "metrics-down", err: &ds.ErrSourceError}
+	up := &fakeDataSourceApiClient{id: "metrics-up", price: 1}
+	server := NewDataSourceApiGw([]ds.PriceDataSourceApi{down, up}, []ds.AverageDataSourceApi{down, up}, "BTCUSD", ":0")
+	requests := testutil.ToFloat64(metrics.HttpRequests.WithLabelValues("gw", "GET", "/api/v1/price", "200"))
+
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/price?ts=1667457091", nil))
+	assert.Equal(t, 200, w.Code)
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/average?from=1667457091&until=1667457191", nil))
+	assert.Equal(t, 200, w.Code)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.Failovers.WithLabelValues("price", "metrics-down")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.Failovers.WithLabelValues("average", "metrics-down")))
+	assert.Equal(t, requests+1, testutil.ToFloat64(metrics.HttpRequests.WithLabelValues("gw", "GET", "/api/v1/price", "200")))
+
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest("GET", metrics.Route, nil))
+	assert.Contains(t, w.Body.String(), `cti_upstream_request_duration_seconds_count{datasource="metrics-up",operation="price",result="success"} 1`)
+	assert.Contains(t, w.Body.String(), `cti_upstream_request_duration_seconds_count{datasource="metrics-down",operation="average",result="error"} 1`)
+}
+
+func TestRequestIdPropagation(t *testing.T) {
+	var dsRequestId string
+	dsRouter := ds.NewDataSourceApiServer(&fakeDataSource{price: 2}, ":0").Router
+	dsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dsRequestId = r.Header.Get(logging.RequestIdHeader)
+		dsRouter.ServeHTTP(w, r)
+	}))
+	defer dsServer.Close()
+
+	apiClient, err := ds.NewDefaultDataSourceApiClient(dsServer.URL)
+	assert.NoError(t, err)
+	client := NewDefaultDataSourceApiClient("request-id", apiClient)
+	server := NewDataSourceApiGw([]ds.PriceDataSourceApi{client}, []ds.AverageDataSourceApi{client}, "BTCUSD", ":0")
+
+	req := httptest.NewRequest("GET", "/api/v1/price?ts=1667457091", nil)
+	req.Header.Set(logging.RequestIdHeader, "gw-request-1")
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "gw-request-1", w.Header().Get(logging.RequestIdHeader))
+	assert.Equal(t, "gw-request-1", dsRequestId)
+
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/average?from=1667457091&until=1667457191", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.NotEmpty(t, w.Header().Get(logging.RequestIdHeader))
+	assert.Equal(t, w.Header().Get(logging.RequestIdHeader), dsRequestId)
+}
+
+type blockingDataSourceApiClient struct {
+	fakeDataSourceApiClient
+	started chan struct{}
+	release chan struct{}
+}
+
+func (client *blockingDataSourceApiClient) Price(symbol string, ts time.Time) (ds.PriceApiModel, error) {
+	close(client.started)
+	<-client.release
+	return client.fakeDataSourceApiClient.Price(symbol, ts)
+}
+
+func TestSetDataSourcesKeepsInFlightRequests(t *testing.T) {
+	old := &blockingDataSourceApiClient{
+		fakeDataSourceApiClient: fakeDataSourceApiClient{id: "old", price: 1},
+		started:                 make(chan struct{}),
+		release:                 make(chan struct{}),
+	}
+	server := NewDataSourceApiGw([]ds.PriceDataSourceApi{old}, nil, "BTCUSD", ":0")
+
+	inFlight := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.router.ServeHTTP(inFlight, httptest.NewRequest("GET", "/api/v1/price?ts=1667457091", nil))
+	}()
+	<-old.started
+
+	replacement := &fakeDataSourceApiClient{id: "new", price: 2}
+	server.SetDataSources([]ds.PriceDataSourceApi{replacement}, []ds.AverageDataSourceApi{replacement})
+
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/price?ts=1667457091", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `"source":"new"`)
+
+	close(old.release)
+	<-done
+	assert.Equal(t, 200, inFlight.Code)
+	assert.Contains(t, inFlight.Body.String(), `"source":"old"`)
+}
+
+func TestGrpcUpstream(t *testing.T) {
+	dsServer, err := ds.NewDataSourceGrpcServer(&fakeDataSource{price: 2}, ":0")
+	assert.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go dsServer.Serve(listener)
+	defer dsServer.Shutdown(context.Background())
+
+	url := "grpc://" + listener.Addr().String()
+	server := NewDataSourceApiGw(nil, nil, "BTCUSD", ":0")
+	assert.NoError(t, server.SetConfigDataSources(config.DataSources{{Id: "grpc", Url: url}}, config.DataSources{{Id: "grpc", Url: url}}))
+	client := server.grpcClients[url]
+	assert.NotNil(t, client)
+
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/price?ts=1667457091", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `"source":"grpc"`)
+
+	// a reload keeps the connection of an unchanged url and releases the removed ones
+	assert.NoError(t, server.SetConfigDataSources(config.DataSources{{Id: "grpc", Url: url, Timeout: config.Duration(time.Second)}}, nil))
+	assert.Same(t, client, server.grpcClients[url])
+	assert.NoError(t, server.SetConfigDataSources(config.DataSources{{Id: "http", Url: "http://127.0.0.1:1"}}, nil))
+	assert.Empty(t, server.grpcClients)
+}
+
+func TestPrices(t *testing.T) {
+	down := &fakeDataSourceApiClient{id: "prices-down", err: &ds.ErrSourceError}
+	up := &fakeDataSourceApiClient{id: "prices-up", price: 3}
+	server := NewDataSourceApiGw([]ds.PriceDataSourceApi{down, up}, nil, "BTCUSD", ":0")
+
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/prices", strings.NewReader(`{"queries":[{"symbol":"BTCUSD","ts":1667457091},{"symbol":"ETHUSD","ts":1667457092}]}`)))
+	assert.Equal(t, 200, w.Code)
+	var payload struct {
+		Data ds.PricesApiModel `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &payload))
+	require.Len(t, payload.Data.Results, 2)
+	assert.Equal(t, "ETHUSD", payload.Data.Results[1].Symbol)
+	for _, result := range payload.Data.Results {
+		assert.Nil(t, result.Error)
+		assert.Equal(t, 3.0, result.Price)
+		assert.Equal(t, "prices-up", *result.Source)
+	}
+
+	server.SetDataSources([]ds.PriceDataSourceApi{down}, nil)
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/prices", strings.NewReader(`{"queries":[{"symbol":"BTCUSD","ts":1667457091}]}`)))
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &payload))
+	assert.Equal(t, ErrNoDataSourceAvailable.Code, payload.Data.Results[0].Error.Code)
+
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/prices", strings.NewReader(`[]`)))
+	assert.Equal(t, 400, w.Code)
+}
+
+// partialDataSourceApiClient has no price at missing.
+type partialDataSourceApiClient struct {
+	fakeDataSourceApiClient
+	missing int64
+}
+
+func (client *partialDataSourceApiClient) Price(symbol string, ts time.Time) (ds.PriceApiModel, error) {
+	if ts.Unix() == client.missing {
+		return ds.PriceApiModel{}, &ds.ErrNoData
+	}
+	return client.fakeDataSourceApiClient.Price(symbol, ts)
+}
+
+func TestPricesFailoverPerQuery(t *testing.T) {
+	first := &partialDataSourceApiClient{fakeDataSourceApiClient{id: "partial-first", price: 2}, 1667457092}
+	second := &partialDataSourceApiClient{fakeDataSourceApiClient{id: "partial-second", price: 3}, 1667457093}
+	server := NewDataSourceApiGw([]ds.PriceDataSourceApi{first, second}, nil, "BTCUSD", ":0")
+
+	queries := []ds.PriceQuery{{Symbol: "BTCUSD", Ts: time.Unix(1667457091, 0)}, {Symbol: "BTCUSD", Ts: time.Unix(1667457092, 0)}}
+	results, sources := server.batchPrices(context.Background(), queries)
+	assert.Equal(t, 2.0, results[0].Price.Price)
+	assert.Equal(t, "partial-first", *sources[0])
+	// only the failed query is sent again to the next upstream
+	assert.Equal(t, 3.0, results[1].Price.Price)
+	assert.Equal(t, "partial-second", *sources[1])
+
+	server.SetDataSources([]ds.PriceDataSourceApi{second, first}, nil)
+	results, sources = server.batchPrices(context.Background(), []ds.PriceQuery{{Symbol: "BTCUSD", Ts: time.Unix(1667457092, 0)}})
+	assert.Equal(t, 3.0, results[0].Price.Price)
+	assert.Equal(t, "partial-second", *sources[0])
+
+	server.SetDataSources([]ds.PriceDataSourceApi{first, &partialDataSourceApiClient{fakeDataSourceApiClient{id: "partial-third", price: 4}, 1667457092}}, nil)
+	results, sources = server.batchPrices(context.Background(), queries)
+	assert.Equal(t, "partial-first", *sources[0])
+	assert.Nil(t, sources[1])
+	assert.True(t, ds.IsErrorCode(results[1].Err, ErrNoDataSourceAvailable.Code))
+	assert.Len(t, NewErrorPayload(results[1].Err).Attr["errs"], 2)
+}
+
+// seriesDataSourceApiClient answers a page of one point at the start of the query.
+type seriesDataSourceApiClient struct {
+	fakeDataSourceApiClient
+}
+
+func (client *seriesDataSourceApiClient) SeriesPage(ctx context.Context, query ds.SeriesQuery) (ds.SeriesApiModel, error) {
+	points := []ds.SeriesPointApiModel{{Ts: query.From.Unix(), Price: client.price}}
+	return ds.SeriesApiModel{Symbol: query.Symbol, Granularity: query.Granularity, Points: points}, client.err
+}
+
+func TestSeries(t *testing.T) {
+	unsupported := &fakeDataSourceApiClient{id: "series-unsupported", price: 1}
+	up := &seriesDataSourceApiClient{fakeDataSourceApiClient{id: "series-up", price: 3}}
+	server := NewDataSourceApiGw(nil, []ds.AverageDataSourceApi{unsupported, up}, "BTCUSD", ":0")
+
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/series?from=1667457000&until=1667460600", nil))
+	assert.Equal(t, 200, w.Code)
+	var payload struct {
+		Data   ds.SeriesApiModel `json:"data"`
+		Source string            `json:"source"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &payload))
+	assert.Equal(t, ds.SeriesApiModel{Symbol: "BTCUSD", Granularity: ds.Granularity1m, Points: []ds.SeriesPointApiModel{{Ts: 1667457000, Price: 3}}}, payload.Data)
+	assert.Equal(t, "series-up", payload.Source)
+	// an upstream without series is healthy
+	assert.True(t, server.loadUpstreams().list(listAverage)[0].breaker.allow())
+
+	server.SetDataSources(nil, []ds.AverageDataSourceApi{unsupported})
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/series?from=1667457000&until=1667460600", nil))
+	assert.Equal(t, 400, w.Code)
+
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/series?symbol=BTC%2FUSD&from=1667457000&until=1667460600", nil))
+	assert.Equal(t, 400, w.Code)
+}
@@ -0,0 +1,484 @@
+package gw
+
+import (
+	"context"
+	"cti/ds"
+	"cti/metrics"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"golang.org/x/exp/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultStreamGranularity is the step of the stream prices, a price is pushed once its step is over.
+const DefaultStreamGranularity = ds.Granularity1m
+
+const (
+	streamWriteWait  = time.Second * 10
+	streamPongWait   = time.Second * 60
+	streamPingPeriod = streamPongWait * 9 / 10
+	streamRetryDelay = time.Second * 5
+	// streamMaxSymbols limits the subscriptions of one connection
+	streamMaxSymbols = 50
+	// streamMaxQueued limits the queued replies of a connection, a client which does not read
+	// them is disconnected
+	streamMaxQueued    = 64
+	streamMessageLimit = 4096
+)
+
+// The types of the stream messages, subscribe and unsubscribe are sent by the client.
+const (
+	StreamSubscribe    = "subscribe"
+	StreamUnsubscribe  = "unsubscribe"
+	StreamSubscribed   = "subscribed"
+	StreamUnsubscribed = "unsubscribed"
+	StreamPrice        = "price"
+	StreamError        = "error"
+)
+
+var streamSymbolPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+var streamUpgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024}
+
+// StreamMessage is a message of the /api/v1/stream WebSocket.
+type StreamMessage struct {
+	Type   string        `json:"type"`
+	Symbol string        `json:"symbol,omitempty"`
+	Price  float64       `json:"price,omitempty"`
+	Ts     int64         `json:"ts,omitempty"`
+	Error  *ErrorPayload `json:"error,omitempty"`
+}
+
+// streamHub fans the prices out to the subscribed clients, a symbol is streamed while it
+// has subscribers.
+type streamHub struct {
+	mu          sync.Mutex
+	streamer    ds.PriceStreamer
+	granularity ds.Granularity
+	topics      map[string]*streamTopic
+	clients     map[*streamClient]struct{}
+	closed      bool
+}
+
+type streamTopic struct {
+	subscribers map[*streamClient]struct{}
+	cancel      context.CancelFunc
+}
+
+func newStreamHub(streamer ds.PriceStreamer, granularity ds.Granularity) *streamHub {
+	return &streamHub{
+		streamer:    streamer,
+		granularity: granularity,
+		topics:      make(map[string]*streamTopic),
+		clients:     make(map[*streamClient]struct{}),
+	}
+}
+
+func (hub *streamHub) add(client *streamClient) bool {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if hub.closed {
+		return false
+	}
+	hub.clients[client] = struct{}{}
+	metrics.StreamClients.Inc()
+	return true
+}
+
+// remove unsubscribes client from every symbol.
+func (hub *streamHub) remove(client *streamClient) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if _, ok := hub.clients[client]; !ok {
+		return
+	}
+	delete(hub.clients, client)
+	metrics.StreamClients.Dec()
+	for symbol := range client.symbols {
+		hub.unsubscribeLocked(client, symbol)
+	}
+}
+
+func (hub *streamHub) subscribe(client *streamClient, symbol string) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	topic, ok := hub.topics[symbol]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		topic = &streamTopic{subscribers: make(map[*streamClient]struct{}), cancel: cancel}
+		hub.topics[symbol] = topic
+		go hub.feed(ctx, symbol)
+	}
+	topic.subscribers[client] = struct{}{}
+}
+
+func (hub *streamHub) unsubscribe(client *streamClient, symbol string) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.unsubscribeLocked(client, symbol)
+}
+
+func (hub *streamHub) unsubscribeLocked(client *streamClient, symbol string) {
+	topic, ok := hub.topics[symbol]
+	if !ok {
+		return
+	}
+	delete(topic.subscribers, client)
+	if len(topic.subscribers) == 0 {
+		topic.cancel()
+		delete(hub.topics, symbol)
+	}
+}
+
+// feed streams the prices of symbol until ctx is done, a failed stream is retried.
+func (hub *streamHub) feed(ctx context.Context, symbol string) {
+	for {
+		err := hub.streamer.StreamPrice(ctx, symbol, hub.granularity, hub.publish)
+		if ctx.Err() != nil {
+			return
+		}
+
+		slog.Warn("price stream fail, retry", "symbol", symbol, "retry_in", streamRetryDelay, "err", err)
+		payload := NewErrorPayload(ErrStreamFailed.WithAttrs(map[string]any{"reason": err.Error()}))
+		hub.broadcast(symbol, StreamMessage{Type: StreamError, Symbol: symbol, Error: &payload})
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(streamRetryDelay):
+		}
+	}
+}
+
+func (hub *streamHub) publish(tick ds.PriceTick) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if topic, ok := hub.topics[tick.Symbol]; ok {
+		for client := range topic.subscribers {
+			client.pushPrice(tick)
+		}
+	}
+}
+
+func (hub *streamHub) broadcast(symbol string, message StreamMessage) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if topic, ok := hub.topics[symbol]; ok {
+		for client := range topic.subscribers {
+			client.send(message)
+		}
+	}
+}
+
+// close stops every stream and disconnects the clients, the hub accepts no client afterwards.
+func (hub *streamHub) close() {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.closed = true
+	for symbol, topic := range hub.topics {
+		topic.cancel()
+		delete(hub.topics, symbol)
+	}
+	for client := range hub.clients {
+		client.close(websocket.CloseGoingAway, "server shutdown")
+	}
+}
+
+// streamClient is a WebSocket connection of the stream. Its writes never block the hub: the
+// replies are queued and only the latest undelivered price of a symbol is kept, so a slow
+// client skips prices instead of falling behind.
+type streamClient struct {
+	conn *websocket.Conn
+	// symbols is only used by the read loop and, after it ended, by streamHub.remove
+	symbols map[string]bool
+
+	mu     sync.Mutex
+	queued []StreamMessage
+	prices map[string]ds.PriceTick
+	wake   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+	// closeCode and closeText are sent in the close message once done is closed
+	closeCode int
+	closeText string
+}
+
+func newStreamClient(conn *websocket.Conn) *streamClient {
+	return &streamClient{
+		conn:    conn,
+		symbols: make(map[string]bool),
+		prices:  make(map[string]ds.PriceTick),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+func (client *streamClient) notify() {
+	select {
+	case client.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (client *streamClient) pushPrice(tick ds.PriceTick) {
+	client.mu.Lock()
+	if _, ok := client.prices[tick.Symbol]; ok {
+		metrics.StreamPricesSkipped.Inc()
+	}
+	client.prices[tick.Symbol] = tick
+	client.mu.Unlock()
+	client.notify()
+}
+
+func (client *streamClient) send(message StreamMessage) {
+	client.mu.Lock()
+	if len(client.queued) >= streamMaxQueued {
+		client.mu.Unlock()
+		client.close(websocket.ClosePolicyViolation, "too many unread messages")
+		return
+	}
+	client.queued = append(client.queued, message)
+	client.mu.Unlock()
+	client.notify()
+}
+
+// forget drops the undelivered price of symbol, so no price follows its unsubscribed reply.
+func (client *streamClient) forget(symbol string) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	delete(client.prices, symbol)
+}
+
+// take returns the pending messages, the replies first, then the prices by symbol.
+func (client *streamClient) take() []StreamMessage {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	messages := client.queued
+	client.queued = nil
+	symbols := make([]string, 0, len(client.prices))
+	for symbol := range client.prices {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	for _, symbol := range symbols {
+		tick := client.prices[symbol]
+		messages = append(messages, StreamMessage{Type: StreamPrice, Symbol: tick.Symbol, Price: tick.Price, Ts: tick.Ts})
+	}
+	client.prices = make(map[string]ds.PriceTick)
+	return messages
+}
+
+func (client *streamClient) close(code int, text string) {
+	client.once.Do(func() {
+		client.mu.Lock()
+		client.closeCode, client.closeText = code, text
+		client.mu.Unlock()
+		close(client.done)
+	})
+}
+
+func (client *streamClient) writeLoop() {
+	ping := time.NewTicker(streamPingPeriod)
+	defer ping.Stop()
+	defer client.conn.Close()
+
+	for {
+		select {
+		case <-client.done:
+			client.mu.Lock()
+			message := websocket.FormatCloseMessage(client.closeCode, client.closeText)
+			client.mu.Unlock()
+			_ = client.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(streamWriteWait))
+			return
+		case <-ping.C:
+			if err := client.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteWait)); err != nil {
+				return
+			}
+		case <-client.wake:
+			for _, message := range client.take() {
+				_ = client.conn.SetWriteDeadline(time.Now().Add(streamWriteWait))
+				if err := client.conn.WriteJSON(message); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// SetPriceStreamer replaces the source of the stream prices, by default the price streams of the
+// upstreams, see StreamPrice. It must be called before the server is started.
+func (server *DataSourceApiGw) SetPriceStreamer(streamer ds.PriceStreamer) {
+	server.hub = newStreamHub(streamer, server.hub.granularity)
+}
+
+// SetStreamGranularity sets the step of the stream prices, DefaultStreamGranularity by default.
+// It must be called before the server is started.
+func (server *DataSourceApiGw) SetStreamGranularity(granularity ds.Granularity) {
+	server.hub = newStreamHub(server.hub.streamer, granularity)
+}
+
+// stream serves the /api/v1/stream WebSocket. The client subscribes with
+// {"type":"subscribe","symbol":"BTCUSD"}, or with the query string symbols=BTCUSD,ETHUSD,
+// and receives {"type":"price","symbol":"BTCUSD","price":...,"ts":...} for every new price.
+// Every subscription is charged to the API key of the connection like a request.
+func (server *DataSourceApiGw) stream(w http.ResponseWriter, r *http.Request) {
+	conn, err := streamUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has responded with the error
+		return
+	}
+
+	client := newStreamClient(conn)
+	if !server.hub.add(client) {
+		client.close(websocket.CloseGoingAway, "server shutdown")
+		client.writeLoop()
+		return
+	}
+	defer server.hub.remove(client)
+	defer client.close(websocket.CloseNormalClosure, "")
+	go client.writeLoop()
+
+	conn.SetReadLimit(streamMessageLimit)
+	_ = conn.SetReadDeadline(time.Now().Add(streamPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(streamPongWait))
+	})
+
+	if symbols := r.URL.Query().Get("symbols"); symbols != "" {
+		for _, symbol := range strings.Split(symbols, ",") {
+			server.handleStreamMessage(r.Context(), client, StreamMessage{Type: StreamSubscribe, Symbol: strings.TrimSpace(symbol)})
+		}
+	}
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var message StreamMessage
+		if err = json.Unmarshal(data, &message); err != nil {
+			payload := NewErrorPayload(ErrInvalidStreamMessage.WithAttrs(map[string]any{"reason": err.Error()}))
+			client.send(StreamMessage{Type: StreamError, Error: &payload})
+			continue
+		}
+		server.handleStreamMessage(r.Context(), client, message)
+	}
+}
+
+func (server *DataSourceApiGw) handleStreamMessage(ctx context.Context, client *streamClient, message StreamMessage) {
+	fail := func(err error) {
+		payload := NewErrorPayload(err)
+		client.send(StreamMessage{Type: StreamError, Symbol: message.Symbol, Error: &payload})
+	}
+
+	switch message.Type {
+	case StreamSubscribe:
+		if !streamSymbolPattern.MatchString(message.Symbol) {
+			fail(ds.ErrInvalidSymbol.WithAttrs(map[string]any{"symbol": message.Symbol}))
+			return
+		}
+		if !client.symbols[message.Symbol] {
+			if !server.streamsSymbol(message.Symbol) {
+				fail(ErrSymbolNotServed.WithAttrs(map[string]any{"symbol": message.Symbol}))
+				return
+			}
+			if len(client.symbols) >= streamMaxSymbols {
+				fail(ErrTooManySubscriptions.WithAttrs(map[string]any{"max": streamMaxSymbols}))
+				return
+			}
+			if _, err := server.charge(ctx, 1, 1); err != nil {
+				fail(err)
+				return
+			}
+			client.symbols[message.Symbol] = true
+			server.hub.subscribe(client, message.Symbol)
+		}
+		client.send(StreamMessage{Type: StreamSubscribed, Symbol: message.Symbol})
+	case StreamUnsubscribe:
+		if client.symbols[message.Symbol] {
+			delete(client.symbols, message.Symbol)
+			server.hub.unsubscribe(client, message.Symbol)
+			client.forget(message.Symbol)
+		}
+		client.send(StreamMessage{Type: StreamUnsubscribed, Symbol: message.Symbol})
+	default:
+		fail(ErrInvalidStreamMessage.WithAttrs(map[string]any{"field": "type", "value": message.Type}))
+	}
+}
+
+// streamsSymbol reports whether symbol is the symbol of the gateway or one listed by an enabled
+// price upstream, the streams are limited to them.
+func (server *DataSourceApiGw) streamsSymbol(symbol string) bool {
+	if symbol == server.symbol {
+		return true
+	}
+	for _, u := range server.loadUpstreams().price {
+		if u.config.Disabled {
+			continue
+		}
+		for _, s := range u.config.Symbols {
+			if s == symbol {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// StreamPrice streams the prices of symbol from the first enabled upstream of the price list which
+// streams them, a failed stream is continued by the next upstream. It returns once ctx is done or
+// the streams of every upstream failed, so the gateway is a ds.PriceStreamer itself.
+func (server *DataSourceApiGw) StreamPrice(ctx context.Context, symbol string, granularity ds.Granularity, onTick func(ds.PriceTick)) error {
+	errs := make(map[string]error)
+	for i, u := range server.loadUpstreams().price {
+		streamer, ok := u.price.(ds.PriceStreamer)
+		if !ok || !u.candidate(symbol) {
+			continue
+		}
+		label := u.label(i)
+		// a stream does not take the trial request of a half-open breaker
+		if u.breaker.status().state != BreakerClosed {
+			errs[label] = &ErrCircuitOpen
+			continue
+		}
+
+		streaming := false
+		err := streamer.StreamPrice(ctx, symbol, granularity, func(tick ds.PriceTick) {
+			if !streaming {
+				streaming = true
+				u.breaker.record(nil)
+			}
+			onTick(tick)
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		u.breaker.record(breakerError(err))
+		errs[label] = err
+	}
+	return ErrNoDataSourceAvailable.WithAttrs(map[string]any{"errs": errs})
+}
+
+// PriceContext returns the price of symbol at ts from the first upstream of the price list
+// which has it, so the gateway is a ds.PriceDataSource itself, e.g. of a ds.PriceEvents.
+func (server *DataSourceApiGw) PriceContext(ctx context.Context, symbol string, ts time.Time) (float64, error) {
+	result, _, errs := server.failover(ctx, listPrice, symbol, func(ctx context.Context, u *upstream) (any, error) {
+		return ds.PriceWithContext(ctx, u.price, symbol, ts)
+	})
+	if errs != nil {
+		return 0, ErrNoDataSourceAvailable.WithAttrs(map[string]any{"errs": errs})
+	}
+	return result.(ds.PriceApiModel).Price, nil
+}
+
+func (server *DataSourceApiGw) Price(symbol string, ts time.Time) (float64, error) {
+	return server.PriceContext(context.Background(), symbol, ts)
+}
@@ -0,0 +1,248 @@
+package gw
+
+import (
+	"bufio"
+	"context"
+	"cti/config"
+	"cti/ds"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakePriceStreamer streams the ticks sent to it and reports the started and stopped symbols.
+type fakePriceStreamer struct {
+	ticks   chan ds.PriceTick
+	started chan string
+	stopped chan string
+}
+
+func newFakePriceStreamer() *fakePriceStreamer {
+	return &fakePriceStreamer{ticks: make(chan ds.PriceTick), started: make(chan string, 10), stopped: make(chan string, 10)}
+}
+
+func (streamer *fakePriceStreamer) StreamPrice(ctx context.Context, symbol string, granularity ds.Granularity, onTick func(ds.PriceTick)) error {
+	streamer.started <- symbol
+	for {
+		select {
+		case <-ctx.Done():
+			streamer.stopped <- symbol
+			return ctx.Err()
+		case tick := <-streamer.ticks:
+			onTick(tick)
+		}
+	}
+}
+
+func dialStream(t *testing.T, server *httptest.Server, query string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/v1/stream"+query, nil)
+	require.NoError(t, err)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	return conn
+}
+
+func readStream(t *testing.T, conn *websocket.Conn) StreamMessage {
+	var message StreamMessage
+	require.NoError(t, conn.ReadJSON(&message))
+	return message
+}
+
+func TestStream(t *testing.T) {
+	streamer := newFakePriceStreamer()
+	gw := NewDataSourceApiGw(nil, nil, "BTCUSD", ":0")
+	gw.SetPriceStreamer(streamer)
+	server := httptest.NewServer(gw.router)
+	defer server.Close()
+
+	conn := dialStream(t, server, "?symbols=BTCUSD")
+	defer conn.Close()
+	assert.Equal(t, StreamMessage{Type: StreamSubscribed, Symbol: "BTCUSD"}, readStream(t, conn))
+	assert.Equal(t, "BTCUSD", <-streamer.started)
+
+	// a second subscriber shares the stream of the symbol
+	other := dialStream(t, server, "")
+	defer other.Close()
+	require.NoError(t, other.WriteJSON(StreamMessage{Type: StreamSubscribe, Symbol: "BTCUSD"}))
+	assert.Equal(t, StreamMessage{Type: StreamSubscribed, Symbol: "BTCUSD"}, readStream(t, other))
+
+	streamer.ticks <- ds.PriceTick{Symbol: "BTCUSD", Price: 16000.5, Ts: 1667457091}
+	expected := StreamMessage{Type: StreamPrice, Symbol: "BTCUSD", Price: 16000.5, Ts: 1667457091}
+	assert.Equal(t, expected, readStream(t, conn))
+	assert.Equal(t, expected, readStream(t, other))
+
+	require.NoError(t, conn.WriteJSON(StreamMessage{Type: StreamUnsubscribe, Symbol: "BTCUSD"}))
+	assert.Equal(t, StreamMessage{Type: StreamUnsubscribed, Symbol: "BTCUSD"}, readStream(t, conn))
+	require.NoError(t, other.WriteJSON(StreamMessage{Type: StreamUnsubscribe, Symbol: "BTCUSD"}))
+	assert.Equal(t, StreamMessage{Type: StreamUnsubscribed, Symbol: "BTCUSD"}, readStream(t, other))
+	// the stream stops with its last subscriber
+	assert.Equal(t, "BTCUSD", <-streamer.stopped)
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"subscribe","symbol":"BTC/USD"}`)))
+	assert.Equal(t, ds.ErrInvalidSymbol.Code, readStream(t, conn).Error.Code)
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"ping"}`)))
+	assert.Equal(t, ErrInvalidStreamMessage.Code, readStream(t, conn).Error.Code)
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`not json`)))
+	assert.Equal(t, ErrInvalidStreamMessage.Code, readStream(t, conn).Error.Code)
+
+	// shutdown closes the stream connections
+	assert.NoError(t, gw.Shutdown(context.Background()))
+	_, _, err := conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway))
+}
+
+func TestStreamServedSymbols(t *testing.T) {
+	gw := NewDataSourceApiGw(nil, nil, "BTCUSD", ":0")
+	require.NoError(t, gw.SetConfigDataSources(config.DataSources{{Id: "served", Url: "http://served", Symbols: []string{"BTCUSD", "ETHUSD"}}}, nil))
+	gw.SetPriceStreamer(newFakePriceStreamer())
+	gw.EnableAuth([]config.ApiKey{{Name: "stream-charge", Hash: HashApiKey("stream-key"), Rate: 0.001, Burst: 2}})
+	server := httptest.NewServer(gw.router)
+	defer server.Close()
+
+	header := http.Header{ApiKeyHeader: []string{"stream-key"}}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/v1/stream", header)
+	require.NoError(t, err)
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+
+	// the upgrade is the first request of the key, the subscription the second
+	require.NoError(t, conn.WriteJSON(StreamMessage{Type: StreamSubscribe, Symbol: "ETHUSD"}))
+	assert.Equal(t, StreamMessage{Type: StreamSubscribed, Symbol: "ETHUSD"}, readStream(t, conn))
+	require.NoError(t, conn.WriteJSON(StreamMessage{Type: StreamSubscribe, Symbol: "DOGEUSD"}))
+	assert.Equal(t, ErrSymbolNotServed.Code, readStream(t, conn).Error.Code)
+	require.NoError(t, conn.WriteJSON(StreamMessage{Type: StreamSubscribe, Symbol: "BTCUSD"}))
+	assert.Equal(t, ErrRateLimited.Code, readStream(t, conn).Error.Code)
+}
+
+func TestStreamClientSkipsPricesOfSlowClient(t *testing.T) {
+	client := newStreamClient(nil)
+	client.send(StreamMessage{Type: StreamSubscribed, Symbol: "ETHUSD"})
+	client.pushPrice(ds.PriceTick{Symbol: "ETHUSD", Price: 1, Ts: 1})
+	client.pushPrice(ds.PriceTick{Symbol: "BTCUSD", Price: 2, Ts: 1})
+	client.pushPrice(ds.PriceTick{Symbol: "ETHUSD", Price: 3, Ts: 2})
+
+	assert.Equal(t, []StreamMessage{
+		{Type: StreamSubscribed, Symbol: "ETHUSD"},
+		{Type: StreamPrice, Symbol: "BTCUSD", Price: 2, Ts: 1},
+		{Type: StreamPrice, Symbol: "ETHUSD", Price: 3, Ts: 2},
+	}, client.take())
+	assert.Empty(t, client.take())
+
+	client.pushPrice(ds.PriceTick{Symbol: "ETHUSD", Price: 4, Ts: 3})
+	client.forget("ETHUSD")
+	assert.Empty(t, client.take())
+
+	// a client which does not read its replies is disconnected
+	for i := 0; i <= streamMaxQueued; i++ {
+		client.send(StreamMessage{Type: StreamError})
+	}
+	select {
+	case <-client.done:
+	default:
+		assert.Fail(t, "client is not closed")
+	}
+}
+
+func TestGatewayPriceDataSource(t *testing.T) {
+	down := &fakeDataSourceApiClient{id: "stream-down", err: &ds.ErrSourceError}
+	up := &fakeDataSourceApiClient{id: "stream-up", price: 3}
+	gw := NewDataSourceApiGw([]ds.PriceDataSourceApi{down, up}, nil, "BTCUSD", ":0")
+
+	price, err := gw.Price("ETHUSD", time.Unix(1667457091, 0))
+	assert.NoError(t, err)
+	assert.Equal(t, 3.0, price)
+
+	gw.SetDataSources([]ds.PriceDataSourceApi{down}, nil)
+	_, err = gw.Price("ETHUSD", time.Unix(1667457091, 0))
+	assert.True(t, ds.IsErrorCode(err, ErrNoDataSourceAvailable.Code))
+}
+
+func TestPriceEvents(t *testing.T) {
+	up := &fakeDataSourceApiClient{id: "events-up", price: 3}
+	gw := NewDataSourceApiGw([]ds.PriceDataSourceApi{up}, nil, "BTCUSD", ":0")
+	server := httptest.NewServer(gw.router)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/v1/events?granularity=1s")
+	require.NoError(t, err)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	reader := bufio.NewReader(resp.Body)
+	var data string
+	for !strings.HasPrefix(data, "data: ") {
+		data, err = reader.ReadString('\n')
+		require.NoError(t, err)
+	}
+	var tick ds.PriceTick
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(data, "data: ")), &tick))
+	assert.Equal(t, "BTCUSD", tick.Symbol)
+	assert.Equal(t, 3.0, tick.Price)
+
+	// Shutdown ends the stream
+	require.NoError(t, gw.Shutdown(context.Background()))
+	_, err = io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	resp, err = http.Get(server.URL + "/api/v1/events?symbol=BTC%2FUSD")
+	require.NoError(t, err)
+	assert.Equal(t, 400, resp.StatusCode)
+	resp.Body.Close()
+	resp, err = http.Get(server.URL + "/api/v1/events?symbol=ETHUSD")
+	require.NoError(t, err)
+	assert.Equal(t, 404, resp.StatusCode)
+	resp.Body.Close()
+}
+
+// streamingDataSourceApiClient streams the price of the client for every tick of ticks.
+type streamingDataSourceApiClient struct {
+	fakeDataSourceApiClient
+	ticks chan int64
+}
+
+func (client *streamingDataSourceApiClient) StreamPrice(ctx context.Context, symbol string, granularity ds.Granularity, onTick func(ds.PriceTick)) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ts, ok := <-client.ticks:
+			if !ok {
+				return &ds.ErrStreamClosed
+			}
+			onTick(ds.PriceTick{Symbol: symbol, Price: client.price, Ts: ts})
+		}
+	}
+}
+
+func TestGatewayStreamPrice(t *testing.T) {
+	polled := &fakeDataSourceApiClient{id: "stream-polled", price: 1}
+	first := &streamingDataSourceApiClient{fakeDataSourceApiClient{id: "stream-first", price: 2}, make(chan int64, 1)}
+	second := &streamingDataSourceApiClient{fakeDataSourceApiClient{id: "stream-second", price: 3}, make(chan int64, 1)}
+	gw := NewDataSourceApiGw([]ds.PriceDataSourceApi{polled, first, second}, nil, "BTCUSD", ":0")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ticks := make(chan ds.PriceTick, 2)
+	done := make(chan error, 1)
+	go func() {
+		done <- gw.StreamPrice(ctx, "BTCUSD", ds.Granularity1m, func(tick ds.PriceTick) { ticks <- tick })
+	}()
+
+	// an upstream without stream is skipped, a closed stream is continued by the next upstream
+	first.ticks <- 1667457060
+	assert.Equal(t, ds.PriceTick{Symbol: "BTCUSD", Price: 2, Ts: 1667457060}, <-ticks)
+	close(first.ticks)
+	second.ticks <- 1667457120
+	assert.Equal(t, ds.PriceTick{Symbol: "BTCUSD", Price: 3, Ts: 1667457120}, <-ticks)
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+
+	close(second.ticks)
+	err := gw.StreamPrice(context.Background(), "BTCUSD", ds.Granularity1m, func(ds.PriceTick) {})
+	assert.True(t, ds.IsErrorCode(err, ErrNoDataSourceAvailable.Code))
+}
@@ -0,0 +1,92 @@
+package gw
+
+import (
+	"cti/ds"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeDataSource struct {
+	price float64
+}
+
+func (dataSource *fakeDataSource) Price(symbol string, ts time.Time) (float64, error) {
+	return dataSource.price, nil
+}
+
+func (dataSource *fakeDataSource) Average(symbol string, from time.Time, until time.Time, granularity ds.Granularity) (float64, time.Time, time.Time, error) {
+	return dataSource.price, from, until, nil
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTracerProvider(previous)
+
+	dsServer := httptest.NewServer(ds.NewDataSourceApiServer(&fakeDataSource{price: 2}, ":0").Router)
+	defer dsServer.Close()
+
+	apiClient, err := ds.NewDefaultDataSourceApiClient(dsServer.URL)
+	require.NoError(t, err)
+	down := &fakeDataSourceApiClient{id: "tracing-down", err: &ds.ErrSourceError}
+	up := NewDefaultDataSourceApiClient("tracing-up", apiClient)
+	server := NewDataSourceApiGw([]ds.PriceDataSourceApi{down, up}, []ds.AverageDataSourceApi{down, up}, "BTCUSD", ":0")
+
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/price?ts=1667457091", nil))
+	require.Equal(t, 200, w.Code)
+
+	spans := make(map[string][]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = append(spans[span.Name()], span)
+	}
+
+	require.Len(t, spans["GET /api/v1/price"], 2)
+	require.Len(t, spans["upstream price"], 2)
+	require.Len(t, spans["DataSourceApiClient.Price"], 1)
+
+	var gwSpan, dsSpan sdktrace.ReadOnlySpan
+	for _, span := range spans["GET /api/v1/price"] {
+		if hasAttribute(span, attribute.String("service", "gw")) {
+			gwSpan = span
+		} else {
+			dsSpan = span
+		}
+	}
+	require.NotNil(t, gwSpan)
+	require.NotNil(t, dsSpan)
+
+	for i, attempt := range spans["upstream price"] {
+		assert.Equal(t, gwSpan.SpanContext().SpanID(), attempt.Parent().SpanID())
+		assert.True(t, hasAttribute(attempt, attribute.Int("attempt", i)))
+	}
+	assert.Equal(t, "Error", spans["upstream price"][0].Status().Code.String())
+	assert.True(t, hasAttribute(spans["upstream price"][1], attribute.String("datasource", "tracing-up")))
+
+	clientSpan := spans["DataSourceApiClient.Price"][0]
+	assert.Equal(t, spans["upstream price"][1].SpanContext().SpanID(), clientSpan.Parent().SpanID())
+	// the trace continues in the datasource through the traceparent header
+	assert.Equal(t, gwSpan.SpanContext().TraceID(), dsSpan.SpanContext().TraceID())
+	assert.Equal(t, clientSpan.SpanContext().SpanID(), dsSpan.Parent().SpanID())
+	assert.True(t, dsSpan.Parent().IsRemote())
+}
+
+func hasAttribute(span sdktrace.ReadOnlySpan, kv attribute.KeyValue) bool {
+	for _, attr := range span.Attributes() {
+		if attr == kv {
+			return true
+		}
+	}
+	return false
+}
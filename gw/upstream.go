@@ -0,0 +1,318 @@
+package gw
+
+import (
+	"context"
+	"cti/config"
+	"cti/ds"
+	"golang.org/x/exp/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// grpcClientCloseDelay is how long the connection of a removed grpc upstream stays open for
+// the requests still using the previous lists.
+const grpcClientCloseDelay = time.Minute
+
+// upstream is a datasource in a list of the gateway. It is never modified once stored,
+// a change stores a modified copy, only the breaker is shared between the copies.
+type upstream struct {
+	config config.DataSource
+	// named is false for a datasource without Id, it is labeled by its position
+	named   bool
+	serves  bool
+	price   ds.PriceDataSourceApi
+	average ds.AverageDataSourceApi
+	breaker *breaker
+}
+
+func (u *upstream) label(i int) string {
+	if u.named {
+		return u.config.Id
+	}
+	return strconv.Itoa(i)
+}
+
+func (u *upstream) sourceId() *string {
+	if !u.named {
+		return nil
+	}
+	id := u.config.Id
+	return &id
+}
+
+// candidate reports whether the requests of symbol go to the upstream.
+func (u *upstream) candidate(symbol string) bool {
+	return u.config.Serves(symbol) && !u.config.Disabled
+}
+
+// attemptContext applies the timeout of the upstream to one attempt.
+func (u *upstream) attemptContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if u.config.Timeout > 0 {
+		return context.WithTimeout(ctx, u.config.Timeout.Duration())
+	}
+	return context.WithCancel(ctx)
+}
+
+// upstreams is a snapshot of the datasource lists, it is never modified once stored.
+type upstreams struct {
+	price   []*upstream
+	average []*upstream
+}
+
+const (
+	listPrice   = "price"
+	listAverage = "average"
+)
+
+func (u *upstreams) list(name string) []*upstream {
+	if name == listPrice {
+		return u.price
+	}
+	return u.average
+}
+
+func (u *upstreams) set(name string, list []*upstream) {
+	if name == listPrice {
+		u.price = list
+	} else {
+		u.average = list
+	}
+}
+
+func (server *DataSourceApiGw) loadUpstreams() *upstreams {
+	return server.upstreams.Load().(*upstreams)
+}
+
+// breakerOf returns the breaker shared by the upstreams of id, in both lists and across reloads.
+func (server *DataSourceApiGw) breakerOf(id string, named bool) *breaker {
+	if !named {
+		return newBreaker()
+	}
+	if b, ok := server.breakers[id]; ok {
+		return b
+	}
+	b := newBreaker()
+	server.breakers[id] = b
+	return b
+}
+
+func (server *DataSourceApiGw) wrap(dataSource any) *upstream {
+	u := &upstream{serves: true}
+	if d, ok := dataSource.(DataSourceApiClient); ok {
+		u.config.Id = d.Id()
+		u.named = true
+	}
+	u.price, _ = dataSource.(ds.PriceDataSourceApi)
+	u.average, _ = dataSource.(ds.AverageDataSourceApi)
+	u.breaker = server.breakerOf(u.config.Id, u.named)
+	return u
+}
+
+// SetDataSources swaps the datasource lists atomically, the in-flight requests finish with the previous lists.
+func (server *DataSourceApiGw) SetDataSources(priceDataSource []ds.PriceDataSourceApi, averageDataSource []ds.AverageDataSourceApi) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	next := &upstreams{}
+	for _, dataSource := range priceDataSource {
+		next.price = append(next.price, server.wrap(dataSource))
+	}
+	for _, dataSource := range averageDataSource {
+		next.average = append(next.average, server.wrap(dataSource))
+	}
+	server.upstreams.Store(next)
+}
+
+// SetUpstreamOptions sets the options of the clients created for the configured datasources,
+// e.g. their TLS config. It applies to the clients created afterwards.
+func (server *DataSourceApiGw) SetUpstreamOptions(options ...ds.DefaultDataSourceApiClientOption) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.upstreamOptions = options
+}
+
+// SetUpstreamGrpcOptions sets the options of the clients created for the configured grpc:// and
+// grpcs:// datasources, e.g. their TLS config. It applies to the clients created afterwards.
+func (server *DataSourceApiGw) SetUpstreamGrpcOptions(options ...ds.GrpcDataSourceApiClientOption) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.upstreamGrpcOptions = options
+}
+
+// SetConfigDataSources swaps the datasource lists for clients of the configured datasources.
+// The higher weights come first, the datasources not serving the symbol of the gateway stay
+// in the lists, so they can be persisted again, but get no requests. The admin changes which
+// are not persisted are applied again, a change which no longer applies is dropped.
+func (server *DataSourceApiGw) SetConfigDataSources(priceDataSources config.DataSources, averageDataSources config.DataSources) error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	price, err := server.newUpstreams(priceDataSources)
+	if err != nil {
+		return err
+	}
+	average, err := server.newUpstreams(averageDataSources)
+	if err != nil {
+		return err
+	}
+
+	next := &upstreams{price: price, average: average}
+	changes := server.adminChanges[:0]
+	for _, change := range server.adminChanges {
+		changed, err := change(next)
+		if err != nil {
+			slog.Warn("admin change dropped on reload", "err", err)
+			continue
+		}
+		next = changed
+		changes = append(changes, change)
+	}
+	server.adminChanges = changes
+
+	server.upstreams.Store(next)
+	server.releaseGrpcClients(next)
+	return nil
+}
+
+func (server *DataSourceApiGw) newUpstreams(dataSources config.DataSources) ([]*upstream, error) {
+	sorted := append(config.DataSources(nil), dataSources...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Weight > sorted[j].Weight })
+
+	var result []*upstream
+	for _, dataSource := range sorted {
+		u, err := server.newUpstream(dataSource)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, u)
+	}
+	return result, nil
+}
+
+func (server *DataSourceApiGw) newUpstream(dataSource config.DataSource) (*upstream, error) {
+	apiClient, err := server.newApiClient(dataSource.Url)
+	if err != nil {
+		return nil, err
+	}
+	client := NewDefaultDataSourceApiClient(dataSource.Id, apiClient)
+
+	return &upstream{
+		config:  dataSource,
+		named:   true,
+		serves:  dataSource.Serves(server.symbol),
+		price:   client,
+		average: client,
+		breaker: server.breakerOf(dataSource.Id, true),
+	}, nil
+}
+
+// newApiClient returns the client of url, the gRPC clients are shared by the upstreams of
+// the same url, so their connection is kept across reloads.
+func (server *DataSourceApiGw) newApiClient(url string) (ds.DataSourceApiClient, error) {
+	if !strings.HasPrefix(url, "grpc://") && !strings.HasPrefix(url, "grpcs://") {
+		return ds.NewDefaultDataSourceApiClient(url, server.upstreamOptions...)
+	}
+
+	if client, ok := server.grpcClients[url]; ok {
+		return client, nil
+	}
+	client, err := ds.NewGrpcDataSourceApiClient(url, server.upstreamGrpcOptions...)
+	if err != nil {
+		return nil, err
+	}
+	server.grpcClients[url] = client
+	return client, nil
+}
+
+// releaseGrpcClients closes the gRPC clients no upstream of next uses anymore, after the
+// requests of the previous lists had the time to finish.
+func (server *DataSourceApiGw) releaseGrpcClients(next *upstreams) {
+	used := make(map[string]bool)
+	for _, u := range append(copyList(next.price), next.average...) {
+		used[u.config.Url] = true
+	}
+	for url, client := range server.grpcClients {
+		if !used[url] {
+			delete(server.grpcClients, url)
+			time.AfterFunc(grpcClientCloseDelay, func() { _ = client.Close() })
+		}
+	}
+}
+
+// configDataSources returns the lists as config, in their current order.
+func (u *upstreams) configDataSources() (price config.DataSources, average config.DataSources) {
+	for _, p := range u.price {
+		price = append(price, p.config)
+	}
+	for _, a := range u.average {
+		average = append(average, a.config)
+	}
+	return price, average
+}
+
+type UpstreamStatus struct {
+	Id                  string       `json:"id"`
+	Url                 string       `json:"url,omitempty"`
+	Enabled             bool         `json:"enabled"`
+	ServesSymbol        bool         `json:"serves_symbol"`
+	Timeout             string       `json:"timeout,omitempty"`
+	Health              string       `json:"health"`
+	Breaker             BreakerState `json:"breaker"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	LastSuccess         *time.Time   `json:"last_success,omitempty"`
+	LastError           string       `json:"last_error,omitempty"`
+	LastErrorAt         *time.Time   `json:"last_error_at,omitempty"`
+}
+
+type UpstreamsStatus struct {
+	Price   []UpstreamStatus `json:"price"`
+	Average []UpstreamStatus `json:"average"`
+}
+
+// Upstreams returns the state of the datasource lists in the order they are tried.
+func (server *DataSourceApiGw) Upstreams() UpstreamsStatus {
+	snapshot := server.loadUpstreams()
+	return UpstreamsStatus{Price: upstreamStatuses(snapshot.price), Average: upstreamStatuses(snapshot.average)}
+}
+
+func upstreamStatuses(list []*upstream) []UpstreamStatus {
+	statuses := make([]UpstreamStatus, 0, len(list))
+	for i, u := range list {
+		b := u.breaker.status()
+		status := UpstreamStatus{
+			Id:                  u.label(i),
+			Url:                 u.config.Url,
+			Enabled:             !u.config.Disabled,
+			ServesSymbol:        u.serves,
+			Breaker:             b.state,
+			ConsecutiveFailures: b.failures,
+		}
+		if u.config.Timeout > 0 {
+			status.Timeout = u.config.Timeout.String()
+		}
+		if !b.lastSuccess.IsZero() {
+			t := b.lastSuccess
+			status.LastSuccess = &t
+		}
+		if b.lastErr != nil {
+			t := b.lastErrAt
+			status.LastError = b.lastErr.Error()
+			status.LastErrorAt = &t
+		}
+
+		switch {
+		case b.state != BreakerClosed:
+			status.Health = "down"
+		case b.lastSuccess.IsZero() && b.lastErr == nil:
+			status.Health = "unknown"
+		case b.failures > 0:
+			status.Health = "degraded"
+		default:
+			status.Health = "up"
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
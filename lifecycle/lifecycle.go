@@ -0,0 +1,114 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"golang.org/x/exp/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// DefaultDrainTimeout fits into the 10s docker waits after SIGTERM before it kills the container.
+const DefaultDrainTimeout = time.Second * 8
+
+// SignalContext returns a context which is cancelled on SIGINT or SIGTERM.
+// A second signal is not caught, so it kills the process the usual way.
+func SignalContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(parent, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
+type Server interface {
+	ListenAndServe() error
+	Shutdown(ctx context.Context) error
+}
+
+// Group runs several servers as one, e.g. the HTTP and the gRPC server of a datasource.
+type Group []Server
+
+// ListenAndServe runs every server until all of them stopped. When one fails the others are
+// shut down, the error of the first server which stopped is returned.
+func (group Group) ListenAndServe() error {
+	errCh := make(chan error, len(group))
+	for _, server := range group {
+		go func(server Server) {
+			errCh <- server.ListenAndServe()
+		}(server)
+	}
+
+	err := <-errCh
+	if !errors.Is(err, http.ErrServerClosed) {
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultDrainTimeout)
+		defer cancel()
+		_ = group.Shutdown(ctx)
+	}
+	for i := 1; i < len(group); i++ {
+		<-errCh
+	}
+	return err
+}
+
+// Shutdown shuts every server down at once and returns the first error.
+func (group Group) Shutdown(ctx context.Context) error {
+	errCh := make(chan error, len(group))
+	for _, server := range group {
+		go func(server Server) {
+			errCh <- server.Shutdown(ctx)
+		}(server)
+	}
+
+	var first error
+	for range group {
+		if err := <-errCh; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Serve runs server until ctx is cancelled, then stops accepting connections and
+// waits up to drainTimeout for the in-flight requests to finish.
+// It returns nil after a clean shutdown.
+func Serve(ctx context.Context, server Server, drainTimeout time.Duration) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down, draining requests", "drain_timeout", drainTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	err := server.Shutdown(shutdownCtx)
+	if err != nil {
+		return err
+	}
+
+	err = <-errCh
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// DrainTimeout reads the drain timeout from the env, DefaultDrainTimeout is used when it is not set.
+func DrainTimeout(env string) (time.Duration, error) {
+	value := os.Getenv(env)
+	if value == "" {
+		return DefaultDrainTimeout, nil
+	}
+	return time.ParseDuration(value)
+}
@@ -0,0 +1,157 @@
+package lifecycle
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type ServeTestSuite struct {
+	listenAddr string
+	started    chan struct{}
+	release    chan struct{}
+	server     *http.Server
+	suite.Suite
+}
+
+func (suite *ServeTestSuite) SetupTest() {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	suite.Nil(err)
+	suite.listenAddr = listener.Addr().String()
+	suite.Nil(listener.Close())
+
+	// a request left over from the previous test may still run the handler
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	suite.started = started
+	suite.release = release
+	suite.server = &http.Server{Addr: suite.listenAddr, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Write([]byte("done"))
+	})}
+}
+
+func (suite *ServeTestSuite) serve(ctx context.Context, drainTimeout time.Duration) chan error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- Serve(ctx, suite.server, drainTimeout)
+	}()
+
+	suite.Eventually(func() bool {
+		conn, err := net.Dial("tcp", suite.listenAddr)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}, time.Second*2, time.Millisecond*10)
+
+	return errCh
+}
+
+func (suite *ServeTestSuite) TestDrainInFlightRequest() {
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := suite.serve(ctx, time.Second*5)
+
+	bodyCh := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + suite.listenAddr)
+		if err != nil {
+			bodyCh <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		bodyCh <- string(b)
+	}()
+	<-suite.started
+
+	cancel()
+
+	// the server keeps serving the in-flight request until it is finished
+	select {
+	case <-errCh:
+		suite.Fail("returned before the in-flight request finished")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	close(suite.release)
+	suite.Equal("done", <-bodyCh)
+	suite.Nil(<-errCh)
+
+	_, err := http.Get("http://" + suite.listenAddr)
+	suite.NotNil(err)
+}
+
+func (suite *ServeTestSuite) TestDrainTimeout() {
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := suite.serve(ctx, time.Millisecond*50)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := http.Get("http://" + suite.listenAddr)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-suite.started
+
+	cancel()
+	suite.ErrorIs(<-errCh, context.DeadlineExceeded)
+	close(suite.release)
+	<-done
+}
+
+func (suite *ServeTestSuite) TestListenFail() {
+	listener, err := net.Listen("tcp", suite.listenAddr)
+	suite.Nil(err)
+	defer listener.Close()
+
+	suite.NotNil(Serve(context.Background(), suite.server, time.Second))
+}
+
+func TestServeTestSuite(t *testing.T) {
+	suite.Run(t, new(ServeTestSuite))
+}
+
+func TestDrainTimeout(t *testing.T) {
+	t.Setenv("TEST_DRAIN_TIMEOUT", "")
+	timeout, err := DrainTimeout("TEST_DRAIN_TIMEOUT")
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultDrainTimeout, timeout)
+
+	t.Setenv("TEST_DRAIN_TIMEOUT", "3s")
+	timeout, err = DrainTimeout("TEST_DRAIN_TIMEOUT")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Second*3, timeout)
+}
+
+func TestGroup(t *testing.T) {
+	first := &http.Server{Addr: "127.0.0.1:0"}
+	second := &http.Server{Addr: "127.0.0.1:0"}
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- Serve(ctx, Group{first, second}, time.Second)
+	}()
+
+	time.Sleep(time.Millisecond * 50)
+	cancel()
+	assert.Nil(t, <-errCh)
+
+	// a server which cannot listen stops the others
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	third := &http.Server{Addr: "127.0.0.1:0"}
+	err = Serve(context.Background(), Group{third, &http.Server{Addr: listener.Addr().String()}}, time.Second)
+	assert.NotNil(t, err)
+	assert.NotErrorIs(t, err, http.ErrServerClosed)
+}
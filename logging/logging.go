@@ -0,0 +1,206 @@
+// Package logging sets up structured logging and carries the request id and the
+// per-request log fields in the request context.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"golang.org/x/exp/slog"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const RequestIdHeader = "X-Request-ID"
+
+// Setup makes a logger writing to stderr the default, also for the standard log package.
+// level is debug, info, warn or error and format is json or text, see New.
+func Setup(service string, level string, format string) error {
+	logger, err := New(os.Stderr, service, level, format)
+	if err != nil {
+		return err
+	}
+
+	slog.SetDefault(logger)
+	return nil
+}
+
+func New(w io.Writer, service string, level string, format string) (*slog.Logger, error) {
+	var l slog.Level
+	switch strings.ToLower(level) {
+	case "debug":
+		l = slog.LevelDebug
+	case "", "info":
+		l = slog.LevelInfo
+	case "warn":
+		l = slog.LevelWarn
+	case "error":
+		l = slog.LevelError
+	default:
+		return nil, fmt.Errorf("log level is not supported: %s", level)
+	}
+
+	options := slog.HandlerOptions{Level: l}
+	var handler slog.Handler
+	switch format {
+	case "", "json":
+		handler = options.NewJSONHandler(w)
+	case "text":
+		handler = options.NewTextHandler(w)
+	default:
+		return nil, fmt.Errorf("log format is not supported: %s", format)
+	}
+
+	return slog.New(handler).With("service", service), nil
+}
+
+type contextKey int
+
+const (
+	requestIdKey contextKey = iota
+	fieldsKey
+)
+
+func WithRequestId(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, requestIdKey, requestId)
+}
+
+// RequestId returns the request id of ctx, or "" outside a request.
+func RequestId(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdKey).(string)
+	return requestId
+}
+
+func newRequestId() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestId accepts the ids of other services as long as they are short printable ASCII.
+func validRequestId(requestId string) bool {
+	if requestId == "" || len(requestId) > 128 {
+		return false
+	}
+	for _, c := range requestId {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+type fields struct {
+	mu    sync.Mutex
+	attrs []any
+}
+
+// AddFields adds key value pairs to the request log line of ctx, it does nothing outside a request.
+func AddFields(ctx context.Context, args ...any) {
+	f, ok := ctx.Value(fieldsKey).(*fields)
+	if !ok {
+		return
+	}
+
+	f.mu.Lock()
+	f.attrs = append(f.attrs, args...)
+	f.mu.Unlock()
+}
+
+// FromContext returns the default logger with the request id of ctx.
+func FromContext(ctx context.Context) *slog.Logger {
+	if requestId := RequestId(ctx); requestId != "" {
+		return slog.Default().With("request_id", requestId)
+	}
+	return slog.Default()
+}
+
+// Request is the log line of a request which is not served by Middleware, e.g. a gRPC call.
+type Request struct {
+	Id     string
+	start  time.Time
+	fields *fields
+}
+
+// StartRequest keeps requestId when it is valid, or generates one, and returns the context
+// which collects the fields of the request log line.
+func StartRequest(ctx context.Context, requestId string) (context.Context, *Request) {
+	if !validRequestId(requestId) {
+		requestId = newRequestId()
+	}
+	request := &Request{Id: requestId, start: time.Now(), fields: &fields{}}
+	return context.WithValue(WithRequestId(ctx, requestId), fieldsKey, request.fields), request
+}
+
+// End writes the request log line with attrs, the latency and the fields added to the request.
+func (request *Request) End(ctx context.Context, level slog.Level, attrs ...any) {
+	request.fields.mu.Lock()
+	attrs = append(append([]any{"request_id", request.Id}, attrs...), "latency", time.Since(request.start))
+	attrs = append(attrs, request.fields.attrs...)
+	request.fields.mu.Unlock()
+
+	slog.Default().Log(ctx, level, "request", attrs...)
+}
+
+// Middleware propagates the X-Request-ID header, or generates one, and writes one log line
+// per request with the fields added by the handlers. It replaces chi's middleware.Logger.
+func Middleware(service string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestId := r.Header.Get(RequestIdHeader)
+			if !validRequestId(requestId) {
+				requestId = newRequestId()
+			}
+			w.Header().Set(RequestIdHeader, requestId)
+
+			f := &fields{}
+			ctx := context.WithValue(WithRequestId(r.Context(), requestId), fieldsKey, f)
+
+			start := time.Now()
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r.WithContext(ctx))
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			route := r.URL.Path
+			if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+				route = rctx.RoutePattern()
+			}
+
+			level := slog.LevelInfo
+			switch {
+			case status >= 500:
+				level = slog.LevelError
+			case status >= 400:
+				level = slog.LevelWarn
+			}
+
+			f.mu.Lock()
+			attrs := append([]any{
+				"request_id", requestId,
+				"service", service,
+				"method", r.Method,
+				"route", route,
+				"path", r.URL.RequestURI(),
+				"status", status,
+				"latency", time.Since(start),
+				"bytes", ww.BytesWritten(),
+			}, f.attrs...)
+			f.mu.Unlock()
+
+			slog.Default().Log(ctx, level, "request", attrs...)
+		})
+	}
+}
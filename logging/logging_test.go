@@ -0,0 +1,92 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func captureLogs(t *testing.T, level string) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	logger, err := New(buf, "test", level, "")
+	require.NoError(t, err)
+
+	previous := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	return buf
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(&bytes.Buffer{}, "test", "verbose", "")
+	assert.Error(t, err)
+	_, err = New(&bytes.Buffer{}, "test", "", "xml")
+	assert.Error(t, err)
+
+	buf := &bytes.Buffer{}
+	logger, err := New(buf, "test", "warn", "")
+	require.NoError(t, err)
+	logger.Info("hidden")
+	logger.Warn("shown", "symbol", "BTCUSD")
+
+	var line map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "WARN", line["level"])
+	assert.Equal(t, "shown", line["msg"])
+	assert.Equal(t, "test", line["service"])
+	assert.Equal(t, "BTCUSD", line["symbol"])
+}
+
+func TestMiddleware(t *testing.T) {
+	buf := captureLogs(t, "info")
+
+	var requestId string
+	r := chi.NewRouter()
+	r.Use(Middleware("test"))
+	r.Get("/price/{symbol}", func(w http.ResponseWriter, r *http.Request) {
+		requestId = RequestId(r.Context())
+		AddFields(r.Context(), "symbol", chi.URLParam(r, "symbol"), "error_code", "NO_DATA")
+		w.WriteHeader(http.StatusBadRequest)
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/price/BTCUSD", nil))
+	assert.Len(t, requestId, 32)
+	assert.Equal(t, requestId, w.Header().Get(RequestIdHeader))
+
+	var line map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "WARN", line["level"])
+	assert.Equal(t, requestId, line["request_id"])
+	assert.Equal(t, "/price/{symbol}", line["route"])
+	assert.Equal(t, float64(400), line["status"])
+	assert.Equal(t, "BTCUSD", line["symbol"])
+	assert.Equal(t, "NO_DATA", line["error_code"])
+	assert.Contains(t, line, "latency")
+
+	req := httptest.NewRequest("GET", "/price/BTCUSD", nil)
+	req.Header.Set(RequestIdHeader, "upstream-id")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, "upstream-id", requestId)
+	assert.Equal(t, "upstream-id", w.Header().Get(RequestIdHeader))
+
+	req = httptest.NewRequest("GET", "/price/BTCUSD", nil)
+	req.Header.Set(RequestIdHeader, "bad id\n")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	assert.NotEqual(t, "bad id\n", requestId)
+}
+
+func TestOutsideRequest(t *testing.T) {
+	AddFields(context.Background(), "symbol", "BTCUSD")
+	assert.Equal(t, "", RequestId(context.Background()))
+	assert.Equal(t, slog.Default(), FromContext(context.Background()))
+}
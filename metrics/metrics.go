@@ -0,0 +1,151 @@
+// Package metrics holds the Prometheus metrics of all services. Every process registers
+// them on the default registry and exposes them with Handler on /metrics.
+package metrics
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const Route = "/metrics"
+
+var (
+	HttpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cti_http_requests_total",
+		Help: "Number of handled HTTP requests.",
+	}, []string{"service", "method", "route", "status"})
+
+	HttpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cti_http_request_duration_seconds",
+		Help:    "Latency of the handled HTTP requests.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"service", "method", "route", "status"})
+
+	UpstreamRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cti_upstream_request_duration_seconds",
+		Help:    "Latency of the gateway requests to its datasources.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"datasource", "operation", "result"})
+
+	Failovers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cti_gateway_failovers_total",
+		Help: "Number of gateway requests which fell over to the next datasource.",
+	}, []string{"operation", "from"})
+
+	ApiKeyRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cti_gateway_api_key_requests_total",
+		Help: "Number of gateway API requests per API key by result (allowed, rate_limited, quota_exceeded).",
+	}, []string{"key", "result"})
+
+	ApiKeyQuotaUsed = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cti_gateway_api_key_quota_used",
+		Help: "Number of requests counted against the daily quota of an API key in the current UTC day.",
+	}, []string{"key"})
+
+	StreamClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cti_gateway_stream_clients",
+		Help: "Number of connected clients of the gateway price stream.",
+	})
+
+	StreamPricesSkipped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cti_gateway_stream_prices_skipped_total",
+		Help: "Number of stream prices replaced by a newer price before a slow client received them.",
+	})
+
+	CacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cti_cache_requests_total",
+		Help: "Number of cache lookups by result (hit or miss).",
+	}, []string{"cache", "result"})
+
+	BinanceUsedWeight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cti_binance_used_weight_1m",
+		Help: "Request weight used in the current minute, as reported by Binance.",
+	})
+
+	BinanceStreamReconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cti_binance_stream_reconnects_total",
+		Help: "Number of reconnects of the Binance kline stream after a lost connection.",
+	})
+
+	CollectorLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cti_collector_last_success_timestamp_seconds",
+		Help: "Timestamp of the last successfully collected point per symbol.",
+	}, []string{"symbol"})
+
+	CollectorCollections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cti_collector_collections_total",
+		Help: "Number of collected symbols by result.",
+	}, []string{"symbol", "result"})
+
+	SchedulerJobLastRun = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cti_scheduler_job_last_run_timestamp_seconds",
+		Help: "Activation time of the last finished run of a scheduler job.",
+	}, []string{"job"})
+
+	SchedulerJobLastDuration = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cti_scheduler_job_last_duration_seconds",
+		Help: "Duration of the last finished run of a scheduler job.",
+	}, []string{"job"})
+
+	SchedulerJobRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cti_scheduler_job_runs_total",
+		Help: "Number of finished runs of a scheduler job by result (success or error).",
+	}, []string{"job", "result"})
+
+	SchedulerJobSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cti_scheduler_job_skipped_total",
+		Help: "Number of activations of a scheduler job skipped because the previous run was still running.",
+	}, []string{"job"})
+)
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Middleware records the count and latency of the requests to a chi router by route pattern,
+// so path parameters do not create new series.
+func Middleware(service string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+
+			route := "unmatched"
+			if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+				route = rctx.RoutePattern()
+			}
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			labels := prometheus.Labels{"service": service, "method": r.Method, "route": route, "status": strconv.Itoa(status)}
+			HttpRequests.With(labels).Inc()
+			HttpRequestDuration.With(labels).Observe(time.Since(start).Seconds())
+		})
+	}
+}
+
+// ObserveUpstream records the latency of one datasource request since start.
+func ObserveUpstream(datasource string, operation string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	UpstreamRequestDuration.WithLabelValues(datasource, operation, result).Observe(time.Since(start).Seconds())
+}
+
+// NewServer returns a server for /metrics only, for processes without an HTTP API like the collector.
+func NewServer(listenAddr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle(Route, Handler())
+	return &http.Server{Addr: listenAddr, Handler: mux}
+}
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMiddleware(t *testing.T) {
+	r := chi.NewRouter()
+	r.Use(Middleware("test"))
+	r.Get("/api/v1/items/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if chi.URLParam(r, "id") == "missing" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	r.Handle(Route, Handler())
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	for _, path := range []string{"/api/v1/items/1", "/api/v1/items/2", "/api/v1/items/missing"} {
+		resp, err := http.Get(server.URL + path)
+		assert.Nil(t, err)
+		resp.Body.Close()
+	}
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(HttpRequests.WithLabelValues("test", "GET", "/api/v1/items/{id}", "200")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(HttpRequests.WithLabelValues("test", "GET", "/api/v1/items/{id}", "404")))
+
+	resp, err := http.Get(server.URL + Route)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), `cti_http_request_duration_seconds_count{method="GET",route="/api/v1/items/{id}",service="test",status="200"} 2`)
+}
+
+func scrape() string {
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", Route, nil))
+	return w.Body.String()
+}
+
+func TestObserveUpstream(t *testing.T) {
+	ObserveUpstream("binance", "price", time.Now(), nil)
+	ObserveUpstream("binance", "price", time.Now(), errors.New("down"))
+	ObserveUpstream("binance", "price", time.Now(), errors.New("down"))
+
+	body := scrape()
+	assert.Contains(t, body, `cti_upstream_request_duration_seconds_count{datasource="binance",operation="price",result="success"} 1`)
+	assert.Contains(t, body, `cti_upstream_request_duration_seconds_count{datasource="binance",operation="price",result="error"} 2`)
+}
+
+func TestNewServer(t *testing.T) {
+	server := NewServer(":0")
+	w := httptest.NewRecorder()
+	server.Handler.ServeHTTP(w, httptest.NewRequest("GET", Route, nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), "go_goroutines")
+
+	w = httptest.NewRecorder()
+	server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, 404, w.Code)
+}
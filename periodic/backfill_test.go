@@ -0,0 +1,141 @@
+package periodic
+
+import (
+	"context"
+	"cti/ds"
+	"github.com/stretchr/testify/suite"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type BackfillTestSuite struct {
+	datasource *fakeDataSourceApiClient
+	dbWriter   *fakePointsWriter
+	now        time.Time
+	symbol     string
+	suite.Suite
+}
+
+func (suite *BackfillTestSuite) SetupTest() {
+	suite.symbol = "BTCUSD"
+	suite.datasource = &fakeDataSourceApiClient{prices: map[string]float64{suite.symbol: 1}}
+	suite.dbWriter = &fakePointsWriter{}
+	suite.now = time.Date(2022, 11, 1, 10, 0, 30, 0, time.UTC)
+}
+
+func (suite *BackfillTestSuite) newCollector(options ...CollectorOption) *Collector {
+	options = append([]CollectorOption{CollectorBackfillOption(4, 0, time.Hour)}, options...)
+	collector, err := NewCollector(suite.datasource, suite.dbWriter, []string{suite.symbol}, options...)
+	suite.Nil(err)
+	collector.now = func() time.Time { return suite.now }
+	return collector
+}
+
+func (suite *BackfillTestSuite) writtenMinutes() []int64 {
+	seen := make(map[int64]bool)
+	var minutes []int64
+	for _, point := range suite.dbWriter.written() {
+		if !seen[point.Ts.Unix()] {
+			seen[point.Ts.Unix()] = true
+			minutes = append(minutes, point.Ts.Unix())
+		}
+	}
+	return minutes
+}
+
+func (suite *BackfillTestSuite) assertContiguous(from time.Time, until time.Time) {
+	written := make(map[int64]bool)
+	for _, ts := range suite.writtenMinutes() {
+		written[ts] = true
+	}
+
+	for t := from; !t.After(until); t = t.Add(time.Minute) {
+		suite.True(written[t.Unix()], "missing %s", t)
+	}
+}
+
+func (suite *BackfillTestSuite) TestBackfillAfterFailure() {
+	collector := suite.newCollector()
+	start := suite.now.Add(-time.Minute).Truncate(time.Minute)
+
+	suite.Nil(collector.collect(context.Background()))
+
+	suite.datasource.setDown(true)
+	for i := 0; i < 3; i++ {
+		suite.now = suite.now.Add(time.Minute)
+		suite.NotNil(collector.collect(context.Background()))
+	}
+
+	suite.datasource.setDown(false)
+	suite.now = suite.now.Add(time.Minute)
+	suite.Nil(collector.collect(context.Background()))
+
+	suite.assertContiguous(start, start.Add(time.Minute*4))
+	suite.Len(suite.writtenMinutes(), 5)
+}
+
+func (suite *BackfillTestSuite) TestBackfillOnStartupFromFile() {
+	path := filepath.Join(suite.T().TempDir(), "checkpoint.json")
+	checkpoint, err := NewFileCheckpoint(path)
+	suite.Nil(err)
+	start := suite.now.Add(-time.Minute).Truncate(time.Minute)
+
+	collector := suite.newCollector(CollectorCheckpointOption(checkpoint))
+	suite.Nil(collector.collect(context.Background()))
+
+	// restart 10 minutes later
+	suite.now = suite.now.Add(time.Minute * 10)
+	checkpoint, err = NewFileCheckpoint(path)
+	suite.Nil(err)
+	collector = suite.newCollector(CollectorCheckpointOption(checkpoint))
+	suite.Nil(collector.collect(context.Background()))
+
+	suite.assertContiguous(start, start.Add(time.Minute*10))
+
+	last, err := checkpoint.Last(suite.symbol)
+	suite.Nil(err)
+	suite.Equal(start.Add(time.Minute*10).Unix(), last.Unix())
+}
+
+func (suite *BackfillTestSuite) TestBackfillFromStore() {
+	store, err := ds.NewLocalStore(suite.T().TempDir())
+	suite.Nil(err)
+	start := suite.now.Add(-time.Minute * 6).Truncate(time.Minute)
+	suite.Nil(store.WritePrice(suite.symbol, 1, start))
+
+	collector, err := NewCollector(suite.datasource, store, []string{suite.symbol},
+		CollectorBackfillOption(2, 0, time.Hour),
+		CollectorCheckpointOption(NewStoreCheckpoint(store)))
+	suite.Nil(err)
+	collector.now = func() time.Time { return suite.now }
+	suite.Nil(collector.collect(context.Background()))
+
+	for t := start; !t.After(start.Add(time.Minute * 5)); t = t.Add(time.Minute) {
+		_, err := store.Price(suite.symbol, t)
+		suite.Nil(err, "missing %s", t)
+	}
+}
+
+func (suite *BackfillTestSuite) TestBackfillMaxAge() {
+	collector := suite.newCollector()
+	suite.Nil(collector.collect(context.Background()))
+
+	suite.now = suite.now.Add(time.Hour * 3)
+	suite.Nil(collector.collect(context.Background()))
+
+	// the point before the outage, the current point and one hour of backfill
+	suite.Len(suite.writtenMinutes(), 1+1+60)
+}
+
+func (suite *BackfillTestSuite) TestInvalidOptions() {
+	_, err := NewCollector(suite.datasource, suite.dbWriter, []string{suite.symbol}, CollectorBackfillOption(0, 0, time.Hour))
+	suite.NotNil(err)
+
+	_, err = NewCollector(suite.datasource, suite.dbWriter, []string{suite.symbol}, CollectorBackfillOption(1, 0, -time.Hour))
+	suite.NotNil(err)
+}
+
+func TestBackfillTestSuite(t *testing.T) {
+	suite.Run(t, new(BackfillTestSuite))
+}
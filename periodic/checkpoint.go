@@ -0,0 +1,119 @@
+package periodic
+
+import (
+	"cti/db"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Checkpoint keeps the last timestamp up to which a symbol is collected without gaps.
+// Last returns the zero time when nothing is known about the symbol.
+type Checkpoint interface {
+	Last(symbol string) (time.Time, error)
+	Save(symbol string, ts time.Time) error
+}
+
+type memoryCheckpoint struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+func newMemoryCheckpoint() *memoryCheckpoint {
+	return &memoryCheckpoint{last: make(map[string]time.Time)}
+}
+
+func (checkpoint *memoryCheckpoint) Last(symbol string) (time.Time, error) {
+	checkpoint.mu.Lock()
+	defer checkpoint.mu.Unlock()
+
+	return checkpoint.last[symbol], nil
+}
+
+func (checkpoint *memoryCheckpoint) Save(symbol string, ts time.Time) error {
+	checkpoint.mu.Lock()
+	defer checkpoint.mu.Unlock()
+
+	checkpoint.last[symbol] = ts
+	return nil
+}
+
+// FileCheckpoint persists the checkpoints as a JSON object of symbol to unix time.
+type FileCheckpoint struct {
+	path string
+
+	mu   sync.Mutex
+	last map[string]int64
+}
+
+func NewFileCheckpoint(path string) (*FileCheckpoint, error) {
+	checkpoint := &FileCheckpoint{path: path, last: make(map[string]int64)}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return checkpoint, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, &checkpoint.last)
+	if err != nil {
+		return nil, err
+	}
+
+	return checkpoint, nil
+}
+
+func (checkpoint *FileCheckpoint) Last(symbol string) (time.Time, error) {
+	checkpoint.mu.Lock()
+	defer checkpoint.mu.Unlock()
+
+	ts, ok := checkpoint.last[symbol]
+	if !ok {
+		return time.Time{}, nil
+	}
+
+	return time.Unix(ts, 0), nil
+}
+
+func (checkpoint *FileCheckpoint) Save(symbol string, ts time.Time) error {
+	checkpoint.mu.Lock()
+	defer checkpoint.mu.Unlock()
+
+	checkpoint.last[symbol] = ts.Unix()
+
+	b, err := json.Marshal(checkpoint.last)
+	if err != nil {
+		return err
+	}
+
+	tmp := checkpoint.path + ".tmp"
+	err = os.WriteFile(tmp, b, 0o644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Clean(checkpoint.path))
+}
+
+// StoreCheckpoint uses the latest point in the storage as the checkpoint,
+// so nothing needs to be saved.
+type StoreCheckpoint struct {
+	reader db.LatestReader
+}
+
+func NewStoreCheckpoint(reader db.LatestReader) *StoreCheckpoint {
+	return &StoreCheckpoint{reader: reader}
+}
+
+func (checkpoint *StoreCheckpoint) Last(symbol string) (time.Time, error) {
+	return checkpoint.reader.LatestTime(symbol)
+}
+
+func (checkpoint *StoreCheckpoint) Save(symbol string, ts time.Time) error {
+	return nil
+}
@@ -0,0 +1,36 @@
+package periodic
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	checkpoint, err := NewFileCheckpoint(path)
+	assert.Nil(t, err)
+
+	last, err := checkpoint.Last("BTCUSD")
+	assert.Nil(t, err)
+	assert.True(t, last.IsZero())
+
+	now := time.Now().Truncate(time.Second)
+	assert.Nil(t, checkpoint.Save("BTCUSD", now))
+
+	checkpoint, err = NewFileCheckpoint(path)
+	assert.Nil(t, err)
+	last, err = checkpoint.Last("BTCUSD")
+	assert.Nil(t, err)
+	assert.True(t, now.Equal(last))
+}
+
+func TestFileCheckpointInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	assert.Nil(t, os.WriteFile(path, []byte("{"), 0o644))
+
+	_, err := NewFileCheckpoint(path)
+	assert.NotNil(t, err)
+}
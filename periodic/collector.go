@@ -1,90 +1,714 @@
 package periodic
 
 import (
+	"context"
 	"cti/db"
 	"cti/ds"
+	"cti/metrics"
 	"fmt"
-	"log"
+	"golang.org/x/exp/slog"
+	"sort"
 	"sync"
 	"time"
 )
 
+const (
+	defaultCollectorWorkers   = 4
+	defaultBackfillBatchSize  = 60
+	defaultBackfillBatchDelay = time.Second
+	defaultBackfillMaxAge     = time.Hour * 24
+	feedRetryDelay            = time.Second * 5
+	feedBatchSize             = 100
+)
+
+type CollectorField string
+
+const (
+	// CollectorFieldPrice collects the price at the start of every interval.
+	CollectorFieldPrice CollectorField = "price"
+	// CollectorFieldAverage collects the average price over every interval at the collector granularity.
+	CollectorFieldAverage CollectorField = "average"
+)
+
+type CollectResult struct {
+	Ts        time.Time
+	Collected []string
+	Errors    map[string]error
+}
+
+func (result CollectResult) Err() error {
+	if len(result.Errors) == 0 {
+		return nil
+	}
+
+	errs := make(map[string]any, len(result.Errors))
+	symbols := make([]string, 0, len(result.Errors))
+	for symbol, err := range result.Errors {
+		errs[symbol] = err.Error()
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+
+	return fmt.Errorf("%w: %v", ErrCollectFailed.WithAttrs(map[string]any{"errs": errs}), symbols)
+}
+
 type Collector struct {
-	datasource ds.DataSourceApiClient
-	dbWriter   db.Writer
-	symbol     string
-	stopCh     chan struct{}
-	startOnce  *sync.Once
-	stopOnce   *sync.Once
-	interval   time.Duration
+	datasource  ds.DataSourceApiClient
+	dbWriter    db.Writer
+	symbols     []string
+	workers     int
+	interval    time.Duration
+	offset      time.Duration
+	granularity ds.Granularity
+	field       CollectorField
+	now         func() time.Time
+	feed        Feed
+
+	elector Elector
+	leading bool
+
+	checkpoint         Checkpoint
+	watermarks         map[string]time.Time
+	backfillBatchSize  int
+	backfillBatchDelay time.Duration
+	backfillMaxAge     time.Duration
+
+	resultMu   sync.Mutex
+	lastResult CollectResult
+
+	runMu  sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
-func NewCollector(datasource ds.DataSourceApiClient, dbWriter db.Writer, symbol string) *Collector {
+func NewCollector(datasource ds.DataSourceApiClient, dbWriter db.Writer, symbols []string, options ...CollectorOption) (*Collector, error) {
 	collector := &Collector{
-		datasource: datasource,
-		dbWriter:   dbWriter,
-		symbol:     symbol,
-		interval:   time.Minute,
+		datasource:         datasource,
+		dbWriter:           dbWriter,
+		symbols:            symbols,
+		workers:            defaultCollectorWorkers,
+		interval:           time.Minute,
+		granularity:        ds.Granularity1m,
+		field:              CollectorFieldPrice,
+		now:                time.Now,
+		checkpoint:         newMemoryCheckpoint(),
+		watermarks:         make(map[string]time.Time),
+		backfillBatchSize:  defaultBackfillBatchSize,
+		backfillBatchDelay: defaultBackfillBatchDelay,
+		backfillMaxAge:     defaultBackfillMaxAge,
 	}
 
-	collector.reset()
+	for _, option := range options {
+		err := option(collector)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	return collector
+	err := collector.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return collector, nil
 }
 
-func (collector *Collector) reset() {
-	collector.stopCh = make(chan struct{}, 1)
-	collector.startOnce = &sync.Once{}
-	collector.stopOnce = &sync.Once{}
+func (collector *Collector) validate() error {
+	if collector.offset >= collector.interval {
+		return ErrInvalidCollectorConfig.WithAttrs(map[string]any{"field": "offset", "details": "offset must be less than interval"})
+	}
+
+	step := collector.granularity.Duration()
+	if step == 0 || step > collector.interval || collector.interval%step != 0 {
+		return ErrInvalidCollectorConfig.WithAttrs(map[string]any{"field": "granularity", "details": "interval must be a multiple of granularity"})
+	}
+
+	if collector.feed != nil && collector.field != CollectorFieldPrice {
+		return ErrInvalidCollectorConfig.WithAttrs(map[string]any{"field": "field", "details": "a feed collects the price only"})
+	}
+
+	return nil
 }
 
+// Start runs the collector until Stop is called.
 func (collector *Collector) Start() {
-	collector.startOnce.Do(collector.start)
+	err := collector.Run(context.Background())
+	if err != nil {
+		slog.Error("collector run fail", err)
+	}
+}
+
+// Run collects at every interval until ctx is cancelled or Stop is called. A running
+// collection is finished, then the buffered writes of the db writer are flushed.
+func (collector *Collector) Run(ctx context.Context) error {
+	collector.runMu.Lock()
+	if collector.done != nil {
+		collector.runMu.Unlock()
+		return &ErrCollectorRunning
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	collector.cancel = cancel
+	collector.done = done
+	collector.runMu.Unlock()
+
+	defer func() {
+		cancel()
+		collector.runMu.Lock()
+		collector.cancel = nil
+		collector.done = nil
+		collector.runMu.Unlock()
+		close(done)
+	}()
+
+	if collector.elector != nil {
+		electorDone := make(chan struct{})
+		go func() {
+			defer close(electorDone)
+			err := collector.elector.Run(ctx)
+			if err != nil {
+				slog.Error("elector fail", err)
+			}
+		}()
+		defer func() { <-electorDone }()
+	}
+
+	collector.run(ctx)
+
+	if flusher, ok := collector.dbWriter.(interface{ Flush() error }); ok {
+		err := flusher.Flush()
+		if err != nil {
+			return fmt.Errorf("flush writes fail: %w", err)
+		}
+	}
+
+	return nil
 }
 
-func (collector *Collector) start() {
-	err := collector.collect()
+func (collector *Collector) run(ctx context.Context) {
+	if collector.feed != nil {
+		collector.runFeed(ctx)
+		return
+	}
+
+	err := collector.collect(ctx)
 	if err != nil {
-		log.Println(err)
+		slog.Error("collect fail", err)
+	}
+
+	// align the ticks to the interval boundaries plus offset
+	timer := time.NewTimer(collector.untilNextTick())
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return
 	}
 
 	ticker := time.NewTicker(collector.interval)
+	defer ticker.Stop()
 	for {
+		err := collector.collect(ctx)
+		if err != nil {
+			slog.Error("collect fail", err)
+		}
+
 		select {
 		case <-ticker.C:
-			err := collector.collect()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// runFeed writes the points pushed by the feed until ctx is done. A failed feed is restarted
+// after feedRetryDelay, the points missed meanwhile are backfilled from the datasource.
+func (collector *Collector) runFeed(ctx context.Context) {
+	granularity, _ := ds.GranularityOf(collector.interval)
+	points := make(chan db.Point, feedBatchSize)
+	feedDone := make(chan struct{})
+	go func() {
+		defer close(feedDone)
+		for {
+			err := collector.feed.Run(ctx, collector.symbols, granularity, func(point db.Point) {
+				select {
+				case points <- point:
+				case <-ctx.Done():
+				}
+			})
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error("feed fail", err, "retry_in", feedRetryDelay)
+
+			select {
+			case <-time.After(feedRetryDelay):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	defer func() { <-feedDone }()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case point := <-points:
+			batch := []db.Point{point}
+		drain:
+			for len(batch) < feedBatchSize {
+				select {
+				case point = <-points:
+					batch = append(batch, point)
+				default:
+					break drain
+				}
+			}
+
+			err := collector.collectPoints(ctx, batch)
 			if err != nil {
-				log.Println(err)
+				slog.Error("collect fail", err)
+			}
+		}
+	}
+}
+
+// Collect collects the last complete interval once, it can be run as a scheduler Job.
+// It must not be called concurrently with itself or Run.
+func (collector *Collector) Collect(ctx context.Context) error {
+	return collector.collect(ctx)
+}
+
+// isLeader reports whether this collector collects. The cached watermarks are dropped
+// when the leadership is gained, the last leader may have moved the checkpoints.
+func (collector *Collector) isLeader() bool {
+	if collector.elector == nil {
+		return true
+	}
+
+	leader := collector.elector.IsLeader()
+	if leader && !collector.leading {
+		collector.watermarks = make(map[string]time.Time)
+	}
+	if leader != collector.leading {
+		slog.Info("collector leadership changed", "leader", leader)
+	}
+	collector.leading = leader
+
+	return leader
+}
+
+func (collector *Collector) untilNextTick() time.Duration {
+	now := collector.now()
+	next := now.Add(-collector.offset).Truncate(collector.interval).Add(collector.interval + collector.offset)
+	return next.Sub(now)
+}
+
+// collect collects the last complete interval, the offset gives the datasource
+// time to settle the interval before it is requested.
+func (collector *Collector) collect(ctx context.Context) error {
+	if !collector.isLeader() {
+		return nil
+	}
+
+	ts := collector.now().Add(-collector.offset).Add(-collector.interval).Truncate(collector.interval)
+
+	// read the checkpoints before writing, a store checkpoint would see ts otherwise
+	for _, symbol := range collector.symbols {
+		_, err := collector.watermark(symbol)
+		if err != nil {
+			slog.Warn("read checkpoint fail", "symbol", symbol, "err", err)
+		}
+	}
+
+	result := collector.collectAt(ts)
+	collector.backfill(ctx, ts, result, collector.symbols)
+
+	collector.resultMu.Lock()
+	collector.lastResult = result
+	collector.resultMu.Unlock()
+
+	return result.Err()
+}
+
+// collectAt fetches the price of every symbol at ts with a bounded number of
+// concurrent requests and writes the fetched prices in one batch. A failing
+// symbol does not stop the others.
+func (collector *Collector) collectAt(ts time.Time) CollectResult {
+	result := CollectResult{Ts: ts, Errors: make(map[string]error)}
+
+	workers := collector.workers
+	if workers > len(collector.symbols) {
+		workers = len(collector.symbols)
+	}
+
+	symbolCh := make(chan string)
+	var mu sync.Mutex
+	var points []db.Point
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for symbol := range symbolCh {
+				price, err := collector.fetch(symbol, ts)
+
+				mu.Lock()
+				if err != nil {
+					result.Errors[symbol] = fmt.Errorf("%s request fail: %w", collector.field, err)
+				} else {
+					points = append(points, db.Point{Symbol: symbol, Price: price, Ts: ts})
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, symbol := range collector.symbols {
+		symbolCh <- symbol
+	}
+	close(symbolCh)
+	wg.Wait()
+
+	collector.store(&result, points)
+	return result
+}
+
+// collectPoints writes the points pushed by the feed, grouped by their timestamp, and backfills
+// the gaps before them. A duplicate or a point which is not after the watermark of its symbol is dropped, the
+// feed may push it again after a reconnect.
+func (collector *Collector) collectPoints(ctx context.Context, points []db.Point) error {
+	if !collector.isLeader() {
+		return nil
+	}
+
+	sort.Slice(points, func(i, j int) bool {
+		if !points[i].Ts.Equal(points[j].Ts) {
+			return points[i].Ts.Before(points[j].Ts)
+		}
+		return points[i].Symbol < points[j].Symbol
+	})
+
+	var err error
+	for start := 0; start < len(points); {
+		ts := points[start].Ts
+		end := start
+		var fresh []db.Point
+		var symbols []string
+		for ; end < len(points) && points[end].Ts.Equal(ts); end++ {
+			point := points[end]
+			if len(symbols) > 0 && symbols[len(symbols)-1] == point.Symbol {
 				continue
 			}
-		case <-collector.stopCh:
-			break
+			last, readErr := collector.watermark(point.Symbol)
+			if readErr != nil {
+				slog.Warn("read checkpoint fail", "symbol", point.Symbol, "err", readErr)
+			} else if !last.IsZero() && !last.Before(ts) {
+				continue
+			}
+			fresh = append(fresh, point)
+			symbols = append(symbols, point.Symbol)
+		}
+		start = end
+
+		if len(fresh) == 0 {
+			continue
+		}
+
+		result := CollectResult{Ts: ts, Errors: make(map[string]error)}
+		collector.store(&result, fresh)
+		collector.backfill(ctx, ts, result, symbols)
+
+		collector.resultMu.Lock()
+		collector.lastResult = result
+		collector.resultMu.Unlock()
+
+		if resultErr := result.Err(); resultErr != nil {
+			err = resultErr
 		}
 	}
+
+	return err
 }
 
-func (collector *Collector) collect() error {
-	ts := time.Now().Add(-collector.interval).Truncate(collector.interval)
+// store writes points in one batch and records the outcome of every symbol in result.
+func (collector *Collector) store(result *CollectResult, points []db.Point) {
+	sort.Slice(points, func(i, j int) bool { return points[i].Symbol < points[j].Symbol })
+
+	for symbol, err := range collector.write(points) {
+		result.Errors[symbol] = fmt.Errorf("db write fail: %w", err)
+	}
 
-	price, err := collector.datasource.Price(collector.symbol, ts)
+	for _, point := range points {
+		if _, ok := result.Errors[point.Symbol]; !ok {
+			result.Collected = append(result.Collected, point.Symbol)
+			metrics.CollectorLastSuccess.WithLabelValues(point.Symbol).Set(float64(point.Ts.Unix()))
+			metrics.CollectorCollections.WithLabelValues(point.Symbol, "success").Inc()
+		}
+	}
+	for symbol := range result.Errors {
+		metrics.CollectorCollections.WithLabelValues(symbol, "error").Inc()
+	}
+}
+
+func (collector *Collector) fetch(symbol string, ts time.Time) (float64, error) {
+	if collector.field == CollectorFieldAverage {
+		until := ts.Add(collector.interval - collector.granularity.Duration())
+		average, err := collector.datasource.Average(symbol, ts, until, collector.granularity)
+		if err != nil {
+			return 0, err
+		}
+		return average.Average, nil
+	}
+
+	price, err := collector.datasource.Price(symbol, ts)
 	if err != nil {
-		return fmt.Errorf("price request fail: %w", err)
+		return 0, err
+	}
+	return price.Price, nil
+}
+
+func (collector *Collector) write(points []db.Point) map[string]error {
+	errs := make(map[string]error)
+	if len(points) == 0 {
+		return errs
 	}
 
-	err = collector.dbWriter.WritePrice(collector.symbol, price.Price, ts)
+	if pointsWriter, ok := collector.dbWriter.(db.PointsWriter); ok {
+		err := pointsWriter.WritePoints(points)
+		if err != nil {
+			for _, point := range points {
+				errs[point.Symbol] = err
+			}
+		}
+		return errs
+	}
+
+	for _, point := range points {
+		err := collector.dbWriter.WritePrice(point.Symbol, point.Price, point.Ts)
+		if err != nil {
+			errs[point.Symbol] = err
+		}
+	}
+
+	return errs
+}
+
+func (collector *Collector) watermark(symbol string) (time.Time, error) {
+	if ts, ok := collector.watermarks[symbol]; ok {
+		return ts, nil
+	}
+
+	ts, err := collector.checkpoint.Last(symbol)
 	if err != nil {
-		return fmt.Errorf("db write fail: %w", err)
+		return time.Time{}, err
 	}
 
-	return nil
+	collector.watermarks[symbol] = ts
+	return ts, nil
 }
 
+func (collector *Collector) advance(symbol string, ts time.Time) {
+	collector.watermarks[symbol] = ts
+
+	err := collector.checkpoint.Save(symbol, ts)
+	if err != nil {
+		slog.Warn("save checkpoint fail", "symbol", symbol, "err", err)
+	}
+}
+
+// backfill fills the gap between the watermark of every symbol of symbols and ts, oldest first.
+// The watermark only moves over timestamps which are written, so a failed backfill
+// is retried at the next collection.
+func (collector *Collector) backfill(ctx context.Context, ts time.Time, result CollectResult, symbols []string) {
+	for _, symbol := range symbols {
+		if ctx.Err() != nil {
+			return
+		}
+
+		last, err := collector.watermark(symbol)
+		if err != nil {
+			slog.Warn("read checkpoint fail", "symbol", symbol, "err", err)
+			continue
+		}
+
+		_, failed := result.Errors[symbol]
+		if last.IsZero() || !last.Before(ts) {
+			if !failed {
+				collector.advance(symbol, ts)
+			}
+			continue
+		}
+
+		from := last.Add(collector.interval)
+		oldest := ts.Add(-collector.backfillMaxAge).Truncate(collector.interval)
+		if from.Before(oldest) {
+			slog.Warn("backfill gap is older than max age, skip", "symbol", symbol, "from", from, "max_age", collector.backfillMaxAge, "skip_to", oldest)
+			from = oldest
+			collector.advance(symbol, oldest.Add(-collector.interval))
+		}
+
+		if from.Before(ts) {
+			slog.Info("backfill gap", "symbol", symbol, "from", from, "until", ts)
+			if !collector.backfillSymbol(ctx, symbol, from, ts) {
+				continue
+			}
+		}
+
+		if !failed {
+			collector.advance(symbol, ts)
+		}
+	}
+}
+
+// backfillSymbol collects [from, until) in batches with a delay between the batches
+// to keep the datasource request rate limited. It returns whether the whole range is written.
+func (collector *Collector) backfillSymbol(ctx context.Context, symbol string, from time.Time, until time.Time) bool {
+	first := true
+	for batchFrom := from; batchFrom.Before(until); {
+		if !first {
+			select {
+			case <-time.After(collector.backfillBatchDelay):
+			case <-ctx.Done():
+				return false
+			}
+		}
+		first = false
+
+		var points []db.Point
+		t := batchFrom
+		for ; t.Before(until) && len(points) < collector.backfillBatchSize; t = t.Add(collector.interval) {
+			price, err := collector.fetch(symbol, t)
+			if err != nil {
+				slog.Warn("backfill request fail", "symbol", symbol, "ts", t, "field", collector.field, "err", err)
+				break
+			}
+			points = append(points, db.Point{Symbol: symbol, Price: price, Ts: t})
+		}
+
+		if len(points) > 0 {
+			if err, ok := collector.write(points)[symbol]; ok {
+				slog.Error("backfill db write fail", err, "symbol", symbol)
+				return false
+			}
+			collector.advance(symbol, points[len(points)-1].Ts)
+		}
+
+		if t.Before(until) && len(points) < collector.backfillBatchSize {
+			return false
+		}
+		batchFrom = t
+	}
+
+	return true
+}
+
+// LastResult returns the per-symbol result of the latest collection.
+func (collector *Collector) LastResult() CollectResult {
+	collector.resultMu.Lock()
+	defer collector.resultMu.Unlock()
+
+	return collector.lastResult
+}
+
+// Stop stops a running collector and waits until Run returns.
 func (collector *Collector) Stop() {
-	collector.stopOnce.Do(collector.stop)
+	collector.runMu.Lock()
+	cancel, done := collector.cancel, collector.done
+	collector.runMu.Unlock()
+
+	if cancel == nil {
+		return
+	}
+
+	cancel()
+	<-done
+}
+
+type CollectorOption func(*Collector) error
+
+func CollectorCheckpointOption(checkpoint Checkpoint) CollectorOption {
+	return func(collector *Collector) error {
+		collector.checkpoint = checkpoint
+		return nil
+	}
+}
+
+func CollectorBackfillOption(batchSize int, batchDelay time.Duration, maxAge time.Duration) CollectorOption {
+	return func(collector *Collector) error {
+		if batchSize <= 0 {
+			return fmt.Errorf("backfill batch size must be positive: %d", batchSize)
+		}
+		if maxAge < 0 {
+			return fmt.Errorf("backfill max age must not be negative: %s", maxAge)
+		}
+		collector.backfillBatchSize = batchSize
+		collector.backfillBatchDelay = batchDelay
+		collector.backfillMaxAge = maxAge
+		return nil
+	}
+}
+
+// CollectorIntervalOption sets how often is collected, the interval must be the step of
+// a ds.Granularity. The granularity follows the interval unless CollectorGranularityOption is given after it.
+func CollectorIntervalOption(interval time.Duration) CollectorOption {
+	return func(collector *Collector) error {
+		granularity, ok := ds.GranularityOf(interval)
+		if !ok {
+			return ErrInvalidCollectorConfig.WithAttrs(map[string]any{"field": "interval", "details": fmt.Sprintf("%s is not a supported granularity", interval)})
+		}
+		collector.interval = interval
+		collector.granularity = granularity
+		return nil
+	}
+}
+
+// CollectorOffsetOption delays every collection by offset after the interval boundary.
+func CollectorOffsetOption(offset time.Duration) CollectorOption {
+	return func(collector *Collector) error {
+		if offset < 0 {
+			return ErrInvalidCollectorConfig.WithAttrs(map[string]any{"field": "offset", "details": "offset must not be negative"})
+		}
+		collector.offset = offset
+		return nil
+	}
 }
 
-func (collector *Collector) stop() {
-	collector.stopCh <- struct{}{}
-	close(collector.stopCh)
-	collector.reset()
+func CollectorGranularityOption(granularity ds.Granularity) CollectorOption {
+	return func(collector *Collector) error {
+		if !granularity.IsValid() {
+			return ErrInvalidCollectorConfig.WithAttrs(map[string]any{"field": "granularity", "details": fmt.Sprintf("%s is not a supported granularity", granularity)})
+		}
+		collector.granularity = granularity
+		return nil
+	}
+}
+
+func CollectorFieldOption(field CollectorField) CollectorOption {
+	return func(collector *Collector) error {
+		if field != CollectorFieldPrice && field != CollectorFieldAverage {
+			return ErrInvalidCollectorConfig.WithAttrs(map[string]any{"field": "field", "details": fmt.Sprintf("%s is not supported", field)})
+		}
+		collector.field = field
+		return nil
+	}
+}
+
+// CollectorFeedOption collects the points pushed by feed instead of polling the datasource at
+// every interval, the datasource still backfills the gaps. The feed collects the price field only.
+func CollectorFeedOption(feed Feed) CollectorOption {
+	return func(collector *Collector) error {
+		collector.feed = feed
+		return nil
+	}
+}
+
+// CollectorElectorOption runs the collector as one of redundant replicas, only the leader collects.
+// Run runs the elector, it has to be run separately when Collect is scheduled.
+func CollectorElectorOption(elector Elector) CollectorOption {
+	return func(collector *Collector) error {
+		collector.elector = elector
+		return nil
+	}
 }
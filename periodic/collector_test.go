@@ -1,8 +1,12 @@
 package periodic
 
 import (
+	"context"
 	"cti/db"
 	"cti/ds"
+	"cti/metrics"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/suite"
 	"net/http/httptest"
 	"os"
@@ -42,7 +46,8 @@ func (suite *CollectorTestSuite) TestCollector() {
 	suite.Nil(err)
 
 	dbWriter := db.NewInfluxDbWriter(serverUrl, org, bucket, token)
-	collector := NewCollector(apiClient, dbWriter, suite.symbol)
+	collector, err := NewCollector(apiClient, dbWriter, []string{suite.symbol})
+	suite.Nil(err)
 	collector.interval = time.Second
 	go collector.Start()
 	time.Sleep(time.Second * 5)
@@ -51,8 +56,9 @@ func (suite *CollectorTestSuite) TestCollector() {
 
 func (suite *CollectorTestSuite) TestCollectorCollect() {
 	dbWriter := db.NewInfluxDbWriter(serverUrl, org, bucket, token)
-	collector := NewCollector(suite.apiClient, dbWriter, suite.symbol)
-	err := collector.collect()
+	collector, err := NewCollector(suite.apiClient, dbWriter, []string{suite.symbol})
+	suite.Nil(err)
+	err = collector.collect(context.Background())
 	suite.Nil(err)
 }
 
@@ -63,3 +69,67 @@ func (suite *CollectorTestSuite) TearDownTestSuite() {
 func TestBinanceDataSourceTestSuite(t *testing.T) {
 	suite.Run(t, new(CollectorTestSuite))
 }
+
+type MultiSymbolCollectorTestSuite struct {
+	datasource *fakeDataSourceApiClient
+	symbols    []string
+	suite.Suite
+}
+
+func (suite *MultiSymbolCollectorTestSuite) SetupTest() {
+	suite.symbols = []string{"BTCUSD", "ETHUSD", "DELISTED", "SOLUSD", "ADAUSD"}
+	suite.datasource = &fakeDataSourceApiClient{prices: map[string]float64{
+		"BTCUSD": 1,
+		"ETHUSD": 2,
+		"SOLUSD": 3,
+		"ADAUSD": 4,
+	}}
+}
+
+func (suite *MultiSymbolCollectorTestSuite) TestCollect() {
+	dbWriter := &fakePointsWriter{}
+	collector, err := NewCollector(suite.datasource, dbWriter, suite.symbols)
+	suite.Nil(err)
+
+	err = collector.collect(context.Background())
+	suite.NotNil(err)
+
+	result := collector.LastResult()
+	suite.Equal([]string{"ADAUSD", "BTCUSD", "ETHUSD", "SOLUSD"}, result.Collected)
+	suite.Len(result.Errors, 1)
+	suite.Contains(result.Errors, "DELISTED")
+
+	// written in one batch
+	suite.Equal(1, dbWriter.batches)
+	suite.Len(dbWriter.written(), 4)
+	for _, point := range dbWriter.written() {
+		suite.Equal(result.Ts, point.Ts)
+	}
+
+	suite.Equal(float64(result.Ts.Unix()), testutil.ToFloat64(metrics.CollectorLastSuccess.WithLabelValues("BTCUSD")))
+}
+
+func (suite *MultiSymbolCollectorTestSuite) TestCollectWithWriter() {
+	dbWriter := &fakeWriter{}
+	collector, err := NewCollector(suite.datasource, dbWriter, suite.symbols[:2])
+	suite.Nil(err)
+
+	suite.Nil(collector.collect(context.Background()))
+	suite.Len(dbWriter.written(), 2)
+	suite.Equal([]string{"BTCUSD", "ETHUSD"}, collector.LastResult().Collected)
+}
+
+func (suite *MultiSymbolCollectorTestSuite) TestCollectWriteFail() {
+	dbWriter := &fakePointsWriter{fakeWriter: fakeWriter{err: errors.New("write failed")}}
+	collector, err := NewCollector(suite.datasource, dbWriter, suite.symbols)
+	suite.Nil(err)
+
+	suite.NotNil(collector.collect(context.Background()))
+	result := collector.LastResult()
+	suite.Empty(result.Collected)
+	suite.Len(result.Errors, len(suite.symbols))
+}
+
+func TestMultiSymbolCollectorTestSuite(t *testing.T) {
+	suite.Run(t, new(MultiSymbolCollectorTestSuite))
+}
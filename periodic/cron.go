@@ -0,0 +1,229 @@
+package periodic
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule returns the next activation time strictly after t.
+type Schedule interface {
+	Next(t time.Time) time.Time
+}
+
+type cronField struct {
+	name string
+	min  int
+	max  int
+}
+
+var cronFields = []cronField{
+	{"second", 0, 59},
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 6},
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 0 1 1 *",
+	"@annually": "0 0 0 1 1 *",
+	"@monthly":  "0 0 0 1 * *",
+	"@weekly":   "0 0 0 * * 0",
+	"@daily":    "0 0 0 * * *",
+	"@midnight": "0 0 0 * * *",
+	"@hourly":   "0 0 * * * *",
+}
+
+// CronSchedule is a parsed cron expression, evaluated in UTC.
+type CronSchedule struct {
+	expr   string
+	second uint64
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	// day of month and day of week are OR-ed when both are restricted, like in cron
+	domAny bool
+	dowAny bool
+}
+
+// ParseCron parses a cron expression with an optional leading seconds field:
+//
+//	second minute hour day-of-month month day-of-week
+//	       minute hour day-of-month month day-of-week
+//
+// A field is `*`, a value, a range `a-b`, a step `*/n` or `a-b/n`, or a comma separated list of them.
+// Day of week is 0-6 starting at Sunday, 7 is Sunday as well.
+// The descriptors @yearly, @monthly, @weekly, @daily, @hourly and `@every <duration>` are supported.
+func ParseCron(expr string) (Schedule, error) {
+	expr = strings.TrimSpace(expr)
+
+	if strings.HasPrefix(expr, "@every ") {
+		interval, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(expr, "@every ")))
+		if err != nil || interval < time.Second {
+			return nil, ErrInvalidCronExpr.WithAttrs(map[string]any{"expr": expr, "details": "@every needs a duration of at least 1s"})
+		}
+		return EverySchedule{Interval: interval}, nil
+	}
+
+	fields := strings.Fields(expr)
+	if descriptor, ok := cronDescriptors[expr]; ok {
+		fields = strings.Fields(descriptor)
+	}
+
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, ErrInvalidCronExpr.WithAttrs(map[string]any{"expr": expr, "details": "expect 5 or 6 fields"})
+	}
+
+	schedule := &CronSchedule{expr: expr}
+	bits := []*uint64{&schedule.second, &schedule.minute, &schedule.hour, &schedule.dom, &schedule.month, &schedule.dow}
+	for i, field := range fields {
+		b, err := parseCronField(field, cronFields[i])
+		if err != nil {
+			return nil, ErrInvalidCronExpr.WithAttrs(map[string]any{"expr": expr, "field": cronFields[i].name, "details": err.Error()})
+		}
+		*bits[i] = b
+	}
+	schedule.domAny = fields[3] == "*" || fields[3] == "?"
+	schedule.dowAny = fields[5] == "*" || fields[5] == "?"
+
+	return schedule, nil
+}
+
+func parseCronField(field string, spec cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step: %s", part)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		low, high := spec.min, spec.max
+		switch {
+		case part == "*" || part == "?":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			low, err = parseCronValue(bounds[0], spec)
+			if err != nil {
+				return 0, err
+			}
+			high, err = parseCronValue(bounds[1], spec)
+			if err != nil {
+				return 0, err
+			}
+			if low > high {
+				return 0, fmt.Errorf("invalid range: %s", part)
+			}
+		default:
+			value, err := parseCronValue(part, spec)
+			if err != nil {
+				return 0, err
+			}
+			low = value
+			if step == 1 {
+				high = value
+			}
+		}
+
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	// 7 is sunday as well
+	if spec.name == "day of week" && bits&(1<<7) != 0 {
+		bits = bits&^(1<<7) | 1
+	}
+
+	return bits, nil
+}
+
+func parseCronValue(value string, spec cronField) (int, error) {
+	v, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value: %s", value)
+	}
+
+	max := spec.max
+	if spec.name == "day of week" {
+		max = 7
+	}
+	if v < spec.min || v > max {
+		return 0, fmt.Errorf("%d out of range [%d, %d]", v, spec.min, max)
+	}
+	return v, nil
+}
+
+func (schedule *CronSchedule) String() string {
+	return schedule.expr
+}
+
+func (schedule *CronSchedule) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Second).Add(time.Second)
+	// no match within 5 years means the expression can never match, e.g. 30th of February
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if schedule.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !schedule.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if schedule.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if schedule.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Truncate(time.Minute).Add(time.Minute)
+			continue
+		}
+		if schedule.second&(1<<uint(t.Second())) == 0 {
+			t = t.Add(time.Second)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
+
+func (schedule *CronSchedule) matchDay(t time.Time) bool {
+	domMatch := schedule.dom&(1<<uint(t.Day())) != 0
+	dowMatch := schedule.dow&(1<<uint(t.Weekday())) != 0
+
+	if schedule.domAny || schedule.dowAny {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// EverySchedule activates at every multiple of Interval since the unix epoch,
+// so the activations stay aligned across restarts.
+type EverySchedule struct {
+	Interval time.Duration
+}
+
+func (schedule EverySchedule) Next(t time.Time) time.Time {
+	return t.Truncate(schedule.Interval).Add(schedule.Interval)
+}
+
+func (schedule EverySchedule) String() string {
+	return fmt.Sprintf("@every %s", schedule.Interval)
+}
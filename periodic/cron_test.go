@@ -0,0 +1,75 @@
+package periodic
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseCronNext(t *testing.T) {
+	from := time.Date(2022, 11, 1, 10, 3, 12, 0, time.UTC) // tuesday
+	cases := []struct {
+		expr   string
+		expect time.Time
+	}{
+		{"* * * * *", time.Date(2022, 11, 1, 10, 4, 0, 0, time.UTC)},
+		{"* * * * * *", time.Date(2022, 11, 1, 10, 3, 13, 0, time.UTC)},
+		// every 5 minutes at second 10
+		{"10 */5 * * * *", time.Date(2022, 11, 1, 10, 5, 10, 0, time.UTC)},
+		{"@daily", time.Date(2022, 11, 2, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * *", time.Date(2022, 11, 2, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2022, 11, 1, 11, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2022, 12, 1, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2022, 11, 6, 0, 0, 0, 0, time.UTC)},
+		{"30 9-17/4 * * 1-5", time.Date(2022, 11, 1, 13, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2022, 11, 6, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * *", time.Date(2022, 11, 15, 0, 0, 0, 0, time.UTC)},
+		// day of month or day of week when both are restricted
+		{"0 0 15 * 3", time.Date(2022, 11, 2, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 1 *", time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@every 90s", time.Date(2022, 11, 1, 10, 4, 30, 0, time.UTC)},
+	}
+
+	for _, c := range cases {
+		schedule, err := ParseCron(c.expr)
+		assert.Nil(t, err, c.expr)
+		assert.Equal(t, c.expect, schedule.Next(from), c.expr)
+	}
+}
+
+func TestParseCronNextIsStrictlyAfter(t *testing.T) {
+	schedule, err := ParseCron("0 * * * * *")
+	assert.Nil(t, err)
+
+	ts := time.Date(2022, 11, 1, 10, 3, 0, 0, time.UTC)
+	assert.Equal(t, ts.Add(time.Minute), schedule.Next(ts))
+}
+
+func TestParseCronNeverMatches(t *testing.T) {
+	schedule, err := ParseCron("0 0 30 2 *")
+	assert.Nil(t, err)
+	assert.True(t, schedule.Next(time.Now()).IsZero())
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"@every",
+		"@every 10ms",
+		"@yesterday",
+	} {
+		_, err := ParseCron(expr)
+		assert.NotNil(t, err, expr)
+	}
+}
@@ -0,0 +1,126 @@
+package periodic
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/exp/slog"
+	"math/rand"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultLeaseTtl          = time.Second * 30
+	defaultFileLockRetryTime = time.Second
+)
+
+// Elector decides which one of redundant collectors collects. Run campaigns for the
+// leadership until ctx is done and gives it up before it returns.
+type Elector interface {
+	Run(ctx context.Context) error
+	IsLeader() bool
+}
+
+// LeaseStore keeps named leases which are held by one holder until they expire.
+type LeaseStore interface {
+	AcquireLease(name string, holder string, ttl time.Duration) (bool, error)
+	ReleaseLease(name string, holder string) error
+}
+
+// LeaseElector is the leader while it holds a lease in a LeaseStore shared by all replicas.
+// The lease is renewed every third of its ttl, a standby takes over at most ttl plus
+// a third of ttl after the leader died.
+type LeaseElector struct {
+	store  LeaseStore
+	name   string
+	holder string
+	ttl    time.Duration
+	leader int32
+}
+
+func NewLeaseElector(store LeaseStore, name string, options ...LeaseElectorOption) (*LeaseElector, error) {
+	elector := &LeaseElector{store: store, name: name, holder: defaultHolder(), ttl: defaultLeaseTtl}
+
+	for _, option := range options {
+		err := option(elector)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return elector, nil
+}
+
+func defaultHolder() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), rand.Int63())
+}
+
+func (elector *LeaseElector) Run(ctx context.Context) error {
+	ticker := time.NewTicker(elector.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		elector.campaign()
+
+		select {
+		case <-ctx.Done():
+			if elector.IsLeader() {
+				atomic.StoreInt32(&elector.leader, 0)
+				return elector.store.ReleaseLease(elector.name, elector.holder)
+			}
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (elector *LeaseElector) campaign() {
+	ok, err := elector.store.AcquireLease(elector.name, elector.holder, elector.ttl)
+	if err != nil {
+		// the lease can not be renewed, another replica may take it over
+		slog.Warn("elector acquire lease fail", "name", elector.name, "err", err)
+		ok = false
+	}
+	elector.set(ok)
+}
+
+func (elector *LeaseElector) set(leader bool) {
+	var v int32
+	if leader {
+		v = 1
+	}
+	if atomic.SwapInt32(&elector.leader, v) != v {
+		slog.Info("elector leadership changed", "name", elector.name, "holder", elector.holder, "leader", leader)
+	}
+}
+
+func (elector *LeaseElector) IsLeader() bool {
+	return atomic.LoadInt32(&elector.leader) == 1
+}
+
+type LeaseElectorOption func(*LeaseElector) error
+
+func LeaseElectorTtlOption(ttl time.Duration) LeaseElectorOption {
+	return func(elector *LeaseElector) error {
+		if ttl < time.Millisecond*3 {
+			return fmt.Errorf("lease ttl is too short: %s", ttl)
+		}
+		elector.ttl = ttl
+		return nil
+	}
+}
+
+func LeaseElectorHolderOption(holder string) LeaseElectorOption {
+	return func(elector *LeaseElector) error {
+		if holder == "" {
+			return fmt.Errorf("lease holder must not be empty")
+		}
+		elector.holder = holder
+		return nil
+	}
+}
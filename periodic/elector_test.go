@@ -0,0 +1,212 @@
+package periodic
+
+import (
+	"context"
+	"cti/db"
+	"cti/db/dbtest"
+	"errors"
+	"github.com/stretchr/testify/suite"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// killableLeaseStore fails every request after kill, like a replica which lost its connection or died.
+type killableLeaseStore struct {
+	LeaseStore
+	mu     sync.Mutex
+	killed bool
+}
+
+func (store *killableLeaseStore) kill() {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.killed = true
+}
+
+func (store *killableLeaseStore) AcquireLease(name string, holder string, ttl time.Duration) (bool, error) {
+	store.mu.Lock()
+	killed := store.killed
+	store.mu.Unlock()
+
+	if killed {
+		return false, errors.New("connection refused")
+	}
+	return store.LeaseStore.AcquireLease(name, holder, ttl)
+}
+
+type staticElector struct {
+	mu     sync.Mutex
+	leader bool
+}
+
+func (elector *staticElector) Run(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (elector *staticElector) IsLeader() bool {
+	elector.mu.Lock()
+	defer elector.mu.Unlock()
+
+	return elector.leader
+}
+
+func (elector *staticElector) set(leader bool) {
+	elector.mu.Lock()
+	defer elector.mu.Unlock()
+
+	elector.leader = leader
+}
+
+type ElectorTestSuite struct {
+	store LeaseStore
+	suite.Suite
+}
+
+func (suite *ElectorTestSuite) SetupTest() {
+	database, err := dbtest.Open()
+	suite.Nil(err)
+	suite.Nil(db.MigratePostgres(database))
+	suite.store = db.NewPostgresLeaseStore(database)
+}
+
+func (suite *ElectorTestSuite) newLeaseElector(store LeaseStore, holder string) *LeaseElector {
+	elector, err := NewLeaseElector(store, "collector", LeaseElectorTtlOption(time.Millisecond*150), LeaseElectorHolderOption(holder))
+	suite.Nil(err)
+	return elector
+}
+
+func (suite *ElectorTestSuite) TestLeaseRelease() {
+	a := suite.newLeaseElector(suite.store, "a")
+	b := suite.newLeaseElector(suite.store, "b")
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	doneA := make(chan error, 1)
+	go func() { doneA <- a.Run(ctxA) }()
+	suite.Eventually(a.IsLeader, time.Second, time.Millisecond*5)
+
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+	go b.Run(ctxB)
+	time.Sleep(time.Millisecond * 200)
+	suite.False(b.IsLeader())
+
+	// a released lease is taken over at the next renewal
+	cancelA()
+	suite.Nil(<-doneA)
+	suite.False(a.IsLeader())
+	suite.Eventually(b.IsLeader, time.Millisecond*100, time.Millisecond*5)
+}
+
+func (suite *ElectorTestSuite) TestLeaseExpire() {
+	storeA := &killableLeaseStore{LeaseStore: suite.store}
+	a := suite.newLeaseElector(storeA, "a")
+	b := suite.newLeaseElector(suite.store, "b")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	suite.Eventually(a.IsLeader, time.Second, time.Millisecond*5)
+	go b.Run(ctx)
+
+	storeA.kill()
+	killedAt := time.Now()
+	suite.Eventually(b.IsLeader, time.Second, time.Millisecond*5)
+	// ttl plus one renewal period
+	suite.Less(time.Since(killedAt), time.Millisecond*250)
+	suite.False(a.IsLeader())
+}
+
+func (suite *ElectorTestSuite) TestFileLock() {
+	path := filepath.Join(suite.T().TempDir(), "collector.lock")
+	a := NewFileLockElector(path)
+	b := NewFileLockElector(path)
+	b.retryTime = time.Millisecond * 10
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	doneA := make(chan error, 1)
+	go func() { doneA <- a.Run(ctxA) }()
+	suite.Eventually(a.IsLeader, time.Second, time.Millisecond*5)
+
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+	go b.Run(ctxB)
+	time.Sleep(time.Millisecond * 50)
+	suite.False(b.IsLeader())
+
+	cancelA()
+	suite.Nil(<-doneA)
+	suite.Eventually(b.IsLeader, time.Second, time.Millisecond*5)
+}
+
+func (suite *ElectorTestSuite) TestCollectOnlyAsLeader() {
+	datasource := &fakeDataSourceApiClient{prices: map[string]float64{"BTCUSD": 1}}
+	dbWriter := &fakePointsWriter{}
+	elector := &staticElector{}
+
+	collector, err := NewCollector(datasource, dbWriter, []string{"BTCUSD"}, CollectorElectorOption(elector))
+	suite.Nil(err)
+	now := time.Date(2022, 11, 1, 10, 0, 30, 0, time.UTC)
+	collector.now = func() time.Time { return now }
+
+	suite.Nil(collector.collect(context.Background()))
+	suite.Empty(dbWriter.written())
+	suite.Empty(datasource.requests)
+
+	elector.set(true)
+	suite.Nil(collector.collect(context.Background()))
+	suite.Len(dbWriter.written(), 1)
+
+	// the watermarks are read again after the leadership was lost and gained
+	elector.set(false)
+	suite.Nil(collector.collect(context.Background()))
+	suite.Equal(time.Date(2022, 11, 1, 9, 59, 0, 0, time.UTC), collector.watermarks["BTCUSD"])
+	elector.set(true)
+	now = now.Add(time.Minute)
+	suite.Nil(collector.collect(context.Background()))
+	suite.Equal(time.Date(2022, 11, 1, 10, 0, 0, 0, time.UTC), collector.watermarks["BTCUSD"])
+}
+
+func (suite *ElectorTestSuite) TestStandbyTakesOver() {
+	datasource := &fakeDataSourceApiClient{prices: map[string]float64{"BTCUSD": 1}}
+	dbWriter := &fakePointsWriter{}
+
+	newCollector := func(holder string) *Collector {
+		collector, err := NewCollector(datasource, dbWriter, []string{"BTCUSD"},
+			CollectorIntervalOption(time.Second),
+			CollectorElectorOption(suite.newLeaseElector(suite.store, holder)))
+		suite.Nil(err)
+		return collector
+	}
+	a := newCollector("a")
+	b := newCollector("b")
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	doneA := make(chan error, 1)
+	go func() { doneA <- a.Run(ctxA) }()
+	suite.Eventually(func() bool { return len(dbWriter.written()) >= 1 }, time.Second*3, time.Millisecond*10)
+
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+	go b.Run(ctxB)
+
+	cancelA()
+	suite.Nil(<-doneA)
+	written := len(dbWriter.written())
+
+	// the standby collects within one interval
+	suite.Eventually(func() bool { return len(dbWriter.written()) > written }, time.Millisecond*1500, time.Millisecond*10)
+
+	seen := make(map[int64]bool)
+	for _, point := range dbWriter.written() {
+		suite.False(seen[point.Ts.Unix()], "written twice: %s", point.Ts)
+		seen[point.Ts.Unix()] = true
+	}
+}
+
+func TestElectorTestSuite(t *testing.T) {
+	suite.Run(t, new(ElectorTestSuite))
+}
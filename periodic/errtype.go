@@ -0,0 +1,13 @@
+package periodic
+
+import "cti/erro"
+
+var (
+	ErrCollectFailed          = erro.NewError("COLLECT_FAILED", "collect failed", nil)
+	ErrInvalidCollectorConfig = erro.NewError("INVALID_COLLECTOR_CONFIG", "invalid collector config", nil)
+	ErrCollectorRunning       = erro.NewError("COLLECTOR_RUNNING", "collector is already running", nil)
+	ErrInvalidCronExpr        = erro.NewError("INVALID_CRON_EXPR", "invalid cron expression", nil)
+	ErrDuplicateJob           = erro.NewError("DUPLICATE_JOB", "job name is already used", nil)
+	ErrSchedulerRunning       = erro.NewError("SCHEDULER_RUNNING", "scheduler is already running", nil)
+	ErrElectionNotSupported   = erro.NewError("ELECTION_NOT_SUPPORTED", "leader election is not supported on this platform", nil)
+)
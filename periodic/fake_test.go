@@ -0,0 +1,96 @@
+package periodic
+
+import (
+	"cti/db"
+	"cti/ds"
+	"sync"
+	"time"
+)
+
+type fakeDataSourceApiClient struct {
+	mu       sync.Mutex
+	prices   map[string]float64
+	requests []time.Time
+	averages []ds.Granularity
+	down     bool
+}
+
+func (client *fakeDataSourceApiClient) setDown(down bool) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	client.down = down
+}
+
+func (client *fakeDataSourceApiClient) Price(symbol string, ts time.Time) (ds.PriceApiModel, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	client.requests = append(client.requests, ts)
+	if client.down {
+		return ds.PriceApiModel{}, &ds.ErrSourceError
+	}
+
+	price, ok := client.prices[symbol]
+	if !ok {
+		return ds.PriceApiModel{}, &ds.ErrNoData
+	}
+
+	return ds.PriceApiModel{Price: price}, nil
+}
+
+func (client *fakeDataSourceApiClient) Average(symbol string, from time.Time, until time.Time, granularity ds.Granularity) (ds.PriceAverageApiModel, error) {
+	client.mu.Lock()
+	client.averages = append(client.averages, granularity)
+	client.mu.Unlock()
+
+	price, err := client.Price(symbol, from)
+	if err != nil {
+		return ds.PriceAverageApiModel{}, err
+	}
+
+	return ds.PriceAverageApiModel{Average: price.Price, From: from.Unix(), Until: until.Unix()}, nil
+}
+
+type fakeWriter struct {
+	mu     sync.Mutex
+	points []db.Point
+	err    error
+}
+
+func (writer *fakeWriter) WritePrice(symbol string, price float64, ts time.Time) error {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+
+	if writer.err != nil {
+		return writer.err
+	}
+
+	writer.points = append(writer.points, db.Point{Symbol: symbol, Price: price, Ts: ts})
+	return nil
+}
+
+func (writer *fakeWriter) written() []db.Point {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+
+	return append([]db.Point(nil), writer.points...)
+}
+
+type fakePointsWriter struct {
+	fakeWriter
+	batches int
+}
+
+func (writer *fakePointsWriter) WritePoints(points []db.Point) error {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+
+	if writer.err != nil {
+		return writer.err
+	}
+
+	writer.batches++
+	writer.points = append(writer.points, points...)
+	return nil
+}
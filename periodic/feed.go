@@ -0,0 +1,28 @@
+package periodic
+
+import (
+	"context"
+	"cti/db"
+	"cti/ds"
+)
+
+// Feed pushes the point of every symbol and interval once it is final, it replaces the polling
+// of the datasource by a Collector. Run returns when ctx is done or the feed fails.
+type Feed interface {
+	Run(ctx context.Context, symbols []string, granularity ds.Granularity, onPoint func(db.Point)) error
+}
+
+// BinanceKlineFeed pushes the open price of the closed Binance klines.
+type BinanceKlineFeed struct {
+	stream *ds.BinanceStream
+}
+
+func NewBinanceKlineFeed(stream *ds.BinanceStream) *BinanceKlineFeed {
+	return &BinanceKlineFeed{stream: stream}
+}
+
+func (feed *BinanceKlineFeed) Run(ctx context.Context, symbols []string, granularity ds.Granularity, onPoint func(db.Point)) error {
+	return feed.stream.Klines(ctx, symbols, ds.BinanceApiInterval(granularity), func(kline ds.BinanceKline) {
+		onPoint(db.Point{Symbol: kline.Symbol, Price: kline.Open, Ts: kline.OpenTime})
+	})
+}
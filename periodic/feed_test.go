@@ -0,0 +1,100 @@
+package periodic
+
+import (
+	"context"
+	"cti/db"
+	"cti/ds"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// fakeFeed pushes the points sent to points, its first run fails when fail is set.
+type fakeFeed struct {
+	points chan db.Point
+	runs   chan ds.Granularity
+	fail   bool
+}
+
+func (feed *fakeFeed) Run(ctx context.Context, symbols []string, granularity ds.Granularity, onPoint func(db.Point)) error {
+	feed.runs <- granularity
+	if feed.fail {
+		feed.fail = false
+		return errors.New("feed failed")
+	}
+
+	for {
+		select {
+		case point := <-feed.points:
+			onPoint(point)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func TestCollectorFeed(t *testing.T) {
+	datasource := &fakeDataSourceApiClient{prices: map[string]float64{"BTCUSD": 1, "ETHUSD": 2}}
+	dbWriter := &fakePointsWriter{}
+	feed := &fakeFeed{points: make(chan db.Point), runs: make(chan ds.Granularity, 2)}
+	checkpoint := newMemoryCheckpoint()
+	t0 := time.Unix(1700000000, 0).Truncate(time.Minute)
+	require.NoError(t, checkpoint.Save("BTCUSD", t0))
+
+	collector, err := NewCollector(datasource, dbWriter, []string{"BTCUSD", "ETHUSD"}, CollectorCheckpointOption(checkpoint), CollectorFeedOption(feed))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- collector.Run(ctx) }()
+	assert.Equal(t, ds.Granularity1m, <-feed.runs)
+
+	// the gap of BTCUSD is backfilled from the datasource, ETHUSD has no watermark yet
+	ts := t0.Add(time.Minute * 3)
+	feed.points <- db.Point{Symbol: "BTCUSD", Price: 10, Ts: ts}
+	feed.points <- db.Point{Symbol: "ETHUSD", Price: 20, Ts: ts}
+	// pushed again after a reconnect
+	feed.points <- db.Point{Symbol: "BTCUSD", Price: 10, Ts: ts}
+	feed.points <- db.Point{Symbol: "BTCUSD", Price: 11, Ts: ts.Add(time.Minute)}
+
+	assert.Eventually(t, func() bool { return len(dbWriter.written()) == 5 }, time.Second, time.Millisecond*10)
+	cancel()
+	assert.NoError(t, <-done)
+
+	byTs := make(map[int64][]float64)
+	for _, point := range dbWriter.written() {
+		byTs[point.Ts.Unix()] = append(byTs[point.Ts.Unix()], point.Price)
+	}
+	assert.Equal(t, map[int64][]float64{
+		t0.Add(time.Minute).Unix():     {1},
+		t0.Add(time.Minute * 2).Unix(): {1},
+		ts.Unix():                      {10, 20},
+		ts.Add(time.Minute).Unix():     {11},
+	}, byTs)
+
+	last, err := checkpoint.Last("BTCUSD")
+	require.NoError(t, err)
+	assert.Equal(t, ts.Add(time.Minute), last)
+	assert.Equal(t, []string{"BTCUSD"}, collector.LastResult().Collected)
+}
+
+func TestCollectorFeedRestart(t *testing.T) {
+	datasource := &fakeDataSourceApiClient{prices: map[string]float64{"BTCUSD": 1}}
+	feed := &fakeFeed{points: make(chan db.Point), runs: make(chan ds.Granularity, 2), fail: true}
+	collector, err := NewCollector(datasource, &fakeWriter{}, []string{"BTCUSD"}, CollectorFeedOption(feed), CollectorIntervalOption(time.Second))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), feedRetryDelay*2)
+	defer cancel()
+	go collector.Run(ctx)
+	assert.Equal(t, ds.Granularity1s, <-feed.runs)
+	assert.Equal(t, ds.Granularity1s, <-feed.runs)
+	collector.Stop()
+}
+
+func TestCollectorFeedOption(t *testing.T) {
+	_, err := NewCollector(&fakeDataSourceApiClient{}, &fakeWriter{}, []string{"BTCUSD"}, CollectorFeedOption(&fakeFeed{}), CollectorFieldOption(CollectorFieldAverage))
+	assert.True(t, ds.IsErrorCode(err, ErrInvalidCollectorConfig.Code))
+}
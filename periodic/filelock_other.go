@@ -0,0 +1,26 @@
+//go:build !(linux || darwin || freebsd)
+
+package periodic
+
+import (
+	"context"
+	"time"
+)
+
+// FileLockElector needs flock, which is not available on this platform.
+type FileLockElector struct {
+	path      string
+	retryTime time.Duration
+}
+
+func NewFileLockElector(path string) *FileLockElector {
+	return &FileLockElector{path: path, retryTime: defaultFileLockRetryTime}
+}
+
+func (elector *FileLockElector) Run(ctx context.Context) error {
+	return &ErrElectionNotSupported
+}
+
+func (elector *FileLockElector) IsLeader() bool {
+	return false
+}
@@ -0,0 +1,63 @@
+//go:build linux || darwin || freebsd
+
+package periodic
+
+import (
+	"context"
+	"errors"
+	"golang.org/x/exp/slog"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// FileLockElector is the leader while it holds an exclusive flock on path. The lock is
+// released by the OS when the process dies, so it works for replicas on a single host.
+type FileLockElector struct {
+	path      string
+	retryTime time.Duration
+	leader    int32
+}
+
+func NewFileLockElector(path string) *FileLockElector {
+	return &FileLockElector{path: path, retryTime: defaultFileLockRetryTime}
+}
+
+func (elector *FileLockElector) Run(ctx context.Context) error {
+	f, err := os.OpenFile(elector.path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ticker := time.NewTicker(elector.retryTime)
+	defer ticker.Stop()
+
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+
+	atomic.StoreInt32(&elector.leader, 1)
+	slog.Info("elector lock acquired, is leader", "path", elector.path)
+
+	<-ctx.Done()
+	atomic.StoreInt32(&elector.leader, 0)
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
+
+func (elector *FileLockElector) IsLeader() bool {
+	return atomic.LoadInt32(&elector.leader) == 1
+}
@@ -0,0 +1,90 @@
+package periodic
+
+import (
+	"context"
+	"cti/ds"
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+)
+
+type IntervalTestSuite struct {
+	datasource *fakeDataSourceApiClient
+	dbWriter   *fakePointsWriter
+	now        time.Time
+	suite.Suite
+}
+
+func (suite *IntervalTestSuite) SetupTest() {
+	suite.datasource = &fakeDataSourceApiClient{prices: map[string]float64{"BTCUSD": 1}}
+	suite.dbWriter = &fakePointsWriter{}
+	suite.now = time.Date(2022, 11, 1, 10, 0, 3, 0, time.UTC)
+}
+
+func (suite *IntervalTestSuite) newCollector(options ...CollectorOption) (*Collector, error) {
+	collector, err := NewCollector(suite.datasource, suite.dbWriter, []string{"BTCUSD"}, options...)
+	if err != nil {
+		return nil, err
+	}
+	collector.now = func() time.Time { return suite.now }
+	return collector, nil
+}
+
+func (suite *IntervalTestSuite) TestSecondInterval() {
+	collector, err := suite.newCollector(CollectorIntervalOption(time.Second))
+	suite.Nil(err)
+
+	suite.Nil(collector.collect(context.Background()))
+	suite.Equal(suite.now.Add(-time.Second), collector.LastResult().Ts)
+	suite.Equal(time.Second, collector.untilNextTick())
+}
+
+func (suite *IntervalTestSuite) TestOffset() {
+	collector, err := suite.newCollector(CollectorIntervalOption(time.Minute), CollectorOffsetOption(time.Second*5))
+	suite.Nil(err)
+
+	// 10:00:03 is before the offset of 10:00, so 09:58 is the last settled minute
+	suite.Nil(collector.collect(context.Background()))
+	suite.Equal(time.Date(2022, 11, 1, 9, 58, 0, 0, time.UTC), collector.LastResult().Ts)
+	suite.Equal(time.Second*2, collector.untilNextTick())
+
+	suite.now = suite.now.Add(time.Second * 2)
+	suite.Nil(collector.collect(context.Background()))
+	suite.Equal(time.Date(2022, 11, 1, 9, 59, 0, 0, time.UTC), collector.LastResult().Ts)
+	suite.Equal(time.Minute, collector.untilNextTick())
+}
+
+func (suite *IntervalTestSuite) TestAverageField() {
+	collector, err := suite.newCollector(
+		CollectorIntervalOption(time.Hour),
+		CollectorGranularityOption(ds.Granularity1m),
+		CollectorFieldOption(CollectorFieldAverage))
+	suite.Nil(err)
+
+	suite.Nil(collector.collect(context.Background()))
+	suite.Equal(time.Date(2022, 11, 1, 9, 0, 0, 0, time.UTC), collector.LastResult().Ts)
+	suite.Equal([]ds.Granularity{ds.Granularity1m}, suite.datasource.averages)
+	suite.Len(suite.dbWriter.written(), 1)
+}
+
+func (suite *IntervalTestSuite) TestInvalidOptions() {
+	invalid := [][]CollectorOption{
+		{CollectorIntervalOption(time.Minute * 5)},
+		{CollectorIntervalOption(time.Hour * 24 * 30)},
+		{CollectorOffsetOption(-time.Second)},
+		{CollectorOffsetOption(time.Minute)},
+		{CollectorIntervalOption(time.Minute), CollectorGranularityOption(ds.Granularity1h)},
+		{CollectorGranularityOption(ds.Granularity1M)},
+		{CollectorGranularityOption("5m")},
+		{CollectorFieldOption("volume")},
+	}
+
+	for _, options := range invalid {
+		_, err := suite.newCollector(options...)
+		suite.NotNil(err)
+	}
+}
+
+func TestIntervalTestSuite(t *testing.T) {
+	suite.Run(t, new(IntervalTestSuite))
+}
@@ -0,0 +1,136 @@
+package periodic
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+)
+
+type flushWriter struct {
+	fakePointsWriter
+	flushed int
+}
+
+func (writer *flushWriter) Flush() error {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+
+	writer.flushed++
+	return writer.err
+}
+
+type LifecycleTestSuite struct {
+	datasource *fakeDataSourceApiClient
+	dbWriter   *flushWriter
+	suite.Suite
+}
+
+func (suite *LifecycleTestSuite) SetupTest() {
+	suite.datasource = &fakeDataSourceApiClient{prices: map[string]float64{"BTCUSD": 1}}
+	suite.dbWriter = &flushWriter{}
+}
+
+func (suite *LifecycleTestSuite) newCollector(options ...CollectorOption) *Collector {
+	options = append([]CollectorOption{CollectorIntervalOption(time.Second)}, options...)
+	collector, err := NewCollector(suite.datasource, suite.dbWriter, []string{"BTCUSD"}, options...)
+	suite.Nil(err)
+	return collector
+}
+
+func (suite *LifecycleTestSuite) TestRunCancel() {
+	collector := suite.newCollector()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- collector.Run(ctx)
+	}()
+
+	suite.Eventually(func() bool { return len(suite.dbWriter.written()) > 0 }, time.Second*2, time.Millisecond*10)
+	cancel()
+
+	select {
+	case err := <-errCh:
+		suite.Nil(err)
+	case <-time.After(time.Second * 2):
+		suite.FailNow("run does not return after cancel")
+	}
+	suite.Equal(1, suite.dbWriter.flushed)
+}
+
+func (suite *LifecycleTestSuite) TestRunFlushFail() {
+	suite.dbWriter.err = errors.New("write failed")
+	collector := suite.newCollector()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	suite.NotNil(collector.Run(ctx))
+}
+
+func (suite *LifecycleTestSuite) TestStop() {
+	collector := suite.newCollector()
+
+	doneCh := make(chan struct{})
+	go func() {
+		collector.Start()
+		close(doneCh)
+	}()
+	suite.Eventually(func() bool { return len(suite.dbWriter.written()) > 0 }, time.Second*2, time.Millisecond*10)
+
+	collector.Stop()
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second * 2):
+		suite.FailNow("start does not return after stop")
+	}
+
+	// a stopped collector can be started again
+	go collector.Start()
+	suite.Eventually(func() bool {
+		collector.runMu.Lock()
+		defer collector.runMu.Unlock()
+		return collector.done != nil
+	}, time.Second*2, time.Millisecond*10)
+	collector.Stop()
+
+	// stop without a running collector is a no-op
+	collector.Stop()
+}
+
+func (suite *LifecycleTestSuite) TestRunTwice() {
+	collector := suite.newCollector()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go collector.Run(ctx)
+	suite.Eventually(func() bool { return len(suite.dbWriter.written()) > 0 }, time.Second*2, time.Millisecond*10)
+
+	err := collector.Run(ctx)
+	suite.True(errors.Is(err, &ErrCollectorRunning))
+}
+
+func (suite *LifecycleTestSuite) TestCancelDuringBackfill() {
+	collector := suite.newCollector(CollectorBackfillOption(1, time.Hour, time.Hour))
+	collector.watermarks["BTCUSD"] = time.Now().Add(-time.Minute * 10).Truncate(time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- collector.Run(ctx)
+	}()
+	suite.Eventually(func() bool { return len(suite.dbWriter.written()) > 0 }, time.Second*2, time.Millisecond*10)
+	cancel()
+
+	select {
+	case err := <-errCh:
+		suite.Nil(err)
+	case <-time.After(time.Second * 2):
+		suite.FailNow("run does not return while waiting between backfill batches")
+	}
+}
+
+func TestLifecycleTestSuite(t *testing.T) {
+	suite.Run(t, new(LifecycleTestSuite))
+}
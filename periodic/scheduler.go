@@ -0,0 +1,191 @@
+package periodic
+
+import (
+	"context"
+	"cti/metrics"
+	"fmt"
+	"golang.org/x/exp/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Job func(ctx context.Context) error
+
+type JobStatus struct {
+	Name         string
+	Schedule     string
+	Next         time.Time
+	LastRun      time.Time
+	LastDuration time.Duration
+	LastErr      error
+	Running      bool
+	Runs         int
+	// Skipped counts the activations dropped because the previous run was still running.
+	Skipped int
+}
+
+type scheduledJob struct {
+	name     string
+	schedule Schedule
+	job      Job
+
+	mu     sync.Mutex
+	status JobStatus
+}
+
+// Scheduler runs named jobs on their own schedules in one process.
+// A job never overlaps with itself, an activation during a running job is skipped.
+type Scheduler struct {
+	mu      sync.Mutex
+	jobs    map[string]*scheduledJob
+	running bool
+}
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{jobs: make(map[string]*scheduledJob)}
+}
+
+// AddJob registers job under name, jobs can only be added before Run.
+func (scheduler *Scheduler) AddJob(name string, schedule Schedule, job Job) error {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	if scheduler.running {
+		return &ErrSchedulerRunning
+	}
+	if _, ok := scheduler.jobs[name]; ok {
+		return ErrDuplicateJob.WithAttrs(map[string]any{"name": name})
+	}
+
+	scheduler.jobs[name] = &scheduledJob{
+		name:     name,
+		schedule: schedule,
+		job:      job,
+		status:   JobStatus{Name: name, Schedule: fmt.Sprint(schedule)},
+	}
+	return nil
+}
+
+// Run runs the jobs until ctx is cancelled, then waits for the running jobs to return.
+func (scheduler *Scheduler) Run(ctx context.Context) error {
+	scheduler.mu.Lock()
+	if scheduler.running {
+		scheduler.mu.Unlock()
+		return &ErrSchedulerRunning
+	}
+	scheduler.running = true
+	jobs := make([]*scheduledJob, 0, len(scheduler.jobs))
+	for _, job := range scheduler.jobs {
+		jobs = append(jobs, job)
+	}
+	scheduler.mu.Unlock()
+
+	defer func() {
+		scheduler.mu.Lock()
+		scheduler.running = false
+		scheduler.mu.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		wg.Add(1)
+		go func(job *scheduledJob) {
+			defer wg.Done()
+			scheduler.loop(ctx, job, &wg)
+		}(job)
+	}
+	wg.Wait()
+
+	return nil
+}
+
+func (scheduler *Scheduler) loop(ctx context.Context, job *scheduledJob, wg *sync.WaitGroup) {
+	for {
+		now := time.Now()
+		next := job.schedule.Next(now)
+		if next.IsZero() {
+			slog.Warn("scheduler job has no next activation", "job", job.name)
+			return
+		}
+
+		job.mu.Lock()
+		job.status.Next = next
+		job.mu.Unlock()
+
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		job.mu.Lock()
+		if job.status.Running {
+			job.status.Skipped++
+			job.mu.Unlock()
+			metrics.SchedulerJobSkipped.WithLabelValues(job.name).Inc()
+			slog.Warn("scheduler job is still running, skip", "job", job.name, "ts", next)
+			continue
+		}
+		job.status.Running = true
+		job.mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			scheduler.runJob(ctx, job, next)
+		}()
+	}
+}
+
+func (scheduler *Scheduler) runJob(ctx context.Context, job *scheduledJob, ts time.Time) {
+	start := time.Now()
+	err := job.job(ctx)
+	if err != nil {
+		slog.Error("scheduler job fail", err, "job", job.name)
+	}
+
+	job.mu.Lock()
+	job.status.Running = false
+	job.status.LastRun = ts
+	job.status.LastDuration = time.Since(start)
+	job.status.LastErr = err
+	job.status.Runs++
+	status := job.status
+	job.mu.Unlock()
+
+	observeJob(status)
+}
+
+// observeJob publishes the status of a finished run in the metrics.
+func observeJob(status JobStatus) {
+	result := "success"
+	if status.LastErr != nil {
+		result = "error"
+	}
+	metrics.SchedulerJobLastRun.WithLabelValues(status.Name).Set(float64(status.LastRun.Unix()))
+	metrics.SchedulerJobLastDuration.WithLabelValues(status.Name).Set(status.LastDuration.Seconds())
+	metrics.SchedulerJobRuns.WithLabelValues(status.Name, result).Inc()
+}
+
+// Status returns the status of every job sorted by name.
+func (scheduler *Scheduler) Status() []JobStatus {
+	scheduler.mu.Lock()
+	jobs := make([]*scheduledJob, 0, len(scheduler.jobs))
+	for _, job := range scheduler.jobs {
+		jobs = append(jobs, job)
+	}
+	scheduler.mu.Unlock()
+
+	statuses := make([]JobStatus, 0, len(jobs))
+	for _, job := range jobs {
+		job.mu.Lock()
+		statuses = append(statuses, job.status)
+		job.mu.Unlock()
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+	return statuses
+}
@@ -0,0 +1,149 @@
+package periodic
+
+import (
+	"context"
+	"cti/metrics"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/suite"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type SchedulerTestSuite struct {
+	scheduler *Scheduler
+	suite.Suite
+}
+
+func (suite *SchedulerTestSuite) SetupTest() {
+	suite.scheduler = NewScheduler()
+}
+
+func (suite *SchedulerTestSuite) status(name string) JobStatus {
+	for _, status := range suite.scheduler.Status() {
+		if status.Name == name {
+			return status
+		}
+	}
+	suite.FailNow("job not found", name)
+	return JobStatus{}
+}
+
+func (suite *SchedulerTestSuite) TestRunJobs() {
+	var fast, slow int32
+	suite.Nil(suite.scheduler.AddJob("fast", EverySchedule{Interval: time.Millisecond * 20}, func(ctx context.Context) error {
+		atomic.AddInt32(&fast, 1)
+		return nil
+	}))
+	suite.Nil(suite.scheduler.AddJob("failing", EverySchedule{Interval: time.Millisecond * 50}, func(ctx context.Context) error {
+		atomic.AddInt32(&slow, 1)
+		return errors.New("job failed")
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- suite.scheduler.Run(ctx)
+	}()
+
+	suite.Eventually(func() bool {
+		return atomic.LoadInt32(&fast) >= 3 && atomic.LoadInt32(&slow) >= 1
+	}, time.Second*2, time.Millisecond*10)
+	cancel()
+	suite.Nil(<-errCh)
+
+	statuses := suite.scheduler.Status()
+	suite.Len(statuses, 2)
+	suite.Equal("failing", statuses[0].Name)
+	suite.Equal("fast", statuses[1].Name)
+
+	suite.NotNil(statuses[0].LastErr)
+	suite.False(statuses[0].LastRun.IsZero())
+	suite.Nil(statuses[1].LastErr)
+	suite.GreaterOrEqual(statuses[1].Runs, 3)
+	suite.Equal("@every 20ms", statuses[1].Schedule)
+
+	suite.GreaterOrEqual(testutil.ToFloat64(metrics.SchedulerJobRuns.WithLabelValues("failing", "error")), 1.0)
+	suite.Equal(float64(statuses[1].LastRun.Unix()), testutil.ToFloat64(metrics.SchedulerJobLastRun.WithLabelValues("fast")))
+}
+
+func (suite *SchedulerTestSuite) TestNoOverlap() {
+	var running, maxRunning, runs int32
+	release := make(chan struct{})
+	suite.Nil(suite.scheduler.AddJob("slow", EverySchedule{Interval: time.Millisecond * 10}, func(ctx context.Context) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		if n > atomic.LoadInt32(&maxRunning) {
+			atomic.StoreInt32(&maxRunning, n)
+		}
+		atomic.AddInt32(&runs, 1)
+		<-release
+		return nil
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- suite.scheduler.Run(ctx)
+	}()
+
+	suite.Eventually(func() bool { return suite.status("slow").Skipped >= 3 }, time.Second*2, time.Millisecond*10)
+	suite.True(suite.status("slow").Running)
+	// cancel first, a released job could be activated again before the cancel otherwise
+	cancel()
+	close(release)
+	suite.Nil(<-errCh)
+
+	suite.Equal(int32(1), atomic.LoadInt32(&maxRunning))
+	suite.Equal(int32(1), atomic.LoadInt32(&runs))
+	suite.False(suite.status("slow").Running)
+}
+
+func (suite *SchedulerTestSuite) TestRunWaitsForRunningJob() {
+	started := make(chan struct{})
+	var finished int32
+	suite.Nil(suite.scheduler.AddJob("job", EverySchedule{Interval: time.Millisecond * 10}, func(ctx context.Context) error {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-ctx.Done()
+		time.Sleep(time.Millisecond * 50)
+		atomic.StoreInt32(&finished, 1)
+		return ctx.Err()
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- suite.scheduler.Run(ctx)
+	}()
+
+	<-started
+	cancel()
+	suite.Nil(<-errCh)
+	suite.Equal(int32(1), atomic.LoadInt32(&finished))
+}
+
+func (suite *SchedulerTestSuite) TestAddJob() {
+	schedule, err := ParseCron("@daily")
+	suite.Nil(err)
+
+	job := func(ctx context.Context) error { return nil }
+	suite.Nil(suite.scheduler.AddJob("daily-close", schedule, job))
+	suite.NotNil(suite.scheduler.AddJob("daily-close", schedule, job))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go suite.scheduler.Run(ctx)
+	suite.Eventually(func() bool { return !suite.status("daily-close").Next.IsZero() }, time.Second*2, time.Millisecond*10)
+
+	suite.NotNil(suite.scheduler.AddJob("collect", schedule, job))
+	suite.NotNil(suite.scheduler.Run(ctx))
+	suite.Equal("@daily", suite.status("daily-close").Schedule)
+	cancel()
+}
+
+func TestSchedulerTestSuite(t *testing.T) {
+	suite.Run(t, new(SchedulerTestSuite))
+}
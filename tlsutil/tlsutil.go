@@ -0,0 +1,155 @@
+// Package tlsutil builds the TLS configs of the servers and clients, the certificates are
+// reloaded from their files when they are rotated.
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"golang.org/x/exp/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultCheckInterval is how often the certificate files are checked for a rotation.
+const DefaultCheckInterval = time.Second * 10
+
+// CertReloader serves a certificate and reloads it when its files change. A rotation which
+// fails to load, e.g. while only one of the files is replaced, keeps the previous certificate.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+	now      func() time.Time
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	version   string
+	checkedAt time.Time
+}
+
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+	reloader := &CertReloader{certFile: certFile, keyFile: keyFile, interval: DefaultCheckInterval, now: time.Now}
+
+	version, err := reloader.fileVersion()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	reloader.cert = &cert
+	reloader.version = version
+	reloader.checkedAt = reloader.now()
+
+	return reloader, nil
+}
+
+// fileVersion identifies the content of the files by their modification time and size.
+func (reloader *CertReloader) fileVersion() (string, error) {
+	var version string
+	for _, name := range []string{reloader.certFile, reloader.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return "", err
+		}
+		version += fmt.Sprintf("%d:%d;", info.ModTime().UnixNano(), info.Size())
+	}
+	return version, nil
+}
+
+// Certificate returns the current certificate, the files are checked at most once per interval.
+func (reloader *CertReloader) Certificate() *tls.Certificate {
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+
+	now := reloader.now()
+	if now.Sub(reloader.checkedAt) < reloader.interval {
+		return reloader.cert
+	}
+	reloader.checkedAt = now
+
+	version, err := reloader.fileVersion()
+	if err != nil || version == reloader.version {
+		return reloader.cert
+	}
+	cert, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		slog.Error("certificate reload failed, keep the previous certificate", err, "cert_file", reloader.certFile)
+		return reloader.cert
+	}
+
+	slog.Info("certificate reloaded", "cert_file", reloader.certFile)
+	reloader.cert = &cert
+	reloader.version = version
+	return reloader.cert
+}
+
+func (reloader *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return reloader.Certificate(), nil
+}
+
+func (reloader *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return reloader.Certificate(), nil
+}
+
+// ServerConfig returns the config of a server with the certificate of certFile and keyFile.
+// With clientCaFile the clients must present a certificate signed by one of its CAs.
+func ServerConfig(certFile string, keyFile string, clientCaFile string) (*tls.Config, error) {
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if clientCaFile != "" {
+		config.ClientCAs, err = LoadCertPool(clientCaFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// ClientConfig returns the config of a client which trusts the CAs of caFile, or the system
+// CAs when it is empty, and presents the certificate of certFile and keyFile when they are set.
+func ClientConfig(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	var err error
+	if caFile != "" {
+		config.RootCAs, err = LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		reloader, err := NewCertReloader(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = reloader.GetClientCertificate
+	}
+
+	return config, nil
+}
+
+// LoadCertPool reads the PEM encoded certificates of a CA bundle.
+func LoadCertPool(caFile string) (*x509.CertPool, error) {
+	content, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("%s: no PEM certificate found", caFile)
+	}
+	return pool, nil
+}
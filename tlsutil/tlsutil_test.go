@@ -0,0 +1,164 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCa struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func newTestCa(t *testing.T, dir string) *testCa {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cti test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	file := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	return &testCa{cert: cert, key: key, file: file}
+}
+
+// issue writes a certificate of name signed by the ca to dir and returns its cert and key files.
+func (ca *testCa) issue(t *testing.T, dir string, name string, serial int64) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func serial(t *testing.T, cert *tls.Certificate) int64 {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	return leaf.SerialNumber.Int64()
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCa(t, dir)
+	certFile, keyFile := ca.issue(t, dir, "server", 10)
+
+	reloader, err := NewCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+	now := time.Now()
+	reloader.now = func() time.Time { return now }
+	assert.Equal(t, int64(10), serial(t, reloader.Certificate()))
+
+	// rotated, picked up after the check interval
+	rotatedDir := t.TempDir()
+	rotatedCert, rotatedKey := ca.issue(t, rotatedDir, "server", 11)
+	for _, file := range [][2]string{{rotatedCert, certFile}, {rotatedKey, keyFile}} {
+		content, err := os.ReadFile(file[0])
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(file[1], content, 0600))
+		require.NoError(t, os.Chtimes(file[1], now.Add(time.Minute), now.Add(time.Minute)))
+	}
+	assert.Equal(t, int64(10), serial(t, reloader.Certificate()))
+	now = now.Add(DefaultCheckInterval)
+	assert.Equal(t, int64(11), serial(t, reloader.Certificate()))
+
+	// a broken rotation keeps the previous certificate
+	require.NoError(t, os.WriteFile(keyFile, []byte("broken"), 0600))
+	now = now.Add(DefaultCheckInterval)
+	assert.Equal(t, int64(11), serial(t, reloader.Certificate()))
+
+	_, err = NewCertReloader(certFile, filepath.Join(dir, "missing.pem"))
+	assert.Error(t, err)
+}
+
+func TestMutualTls(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCa(t, dir)
+	serverCert, serverKey := ca.issue(t, dir, "server", 20)
+	clientCert, clientKey := ca.issue(t, dir, "client", 21)
+
+	serverConfig, err := ServerConfig(serverCert, serverKey, ca.file)
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &http.Server{TLSConfig: serverConfig, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	})}
+	go server.ServeTLS(listener, "", "")
+	defer server.Close()
+	url := "https://" + listener.Addr().String()
+
+	get := func(config *tls.Config) (string, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		resp, err := client.Get(url)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body := make([]byte, 64)
+		n, _ := resp.Body.Read(body)
+		return string(body[:n]), nil
+	}
+
+	clientConfig, err := ClientConfig(ca.file, clientCert, clientKey)
+	require.NoError(t, err)
+	name, err := get(clientConfig)
+	require.NoError(t, err)
+	assert.Equal(t, "client", name)
+
+	// without a client certificate the handshake fails
+	clientConfig, err = ClientConfig(ca.file, "", "")
+	require.NoError(t, err)
+	_, err = get(clientConfig)
+	assert.Error(t, err)
+
+	// the system CAs do not trust the test CA
+	clientConfig, err = ClientConfig("", clientCert, clientKey)
+	require.NoError(t, err)
+	_, err = get(clientConfig)
+	assert.Error(t, err)
+
+	_, err = LoadCertPool(serverKey)
+	assert.ErrorContains(t, err, "no PEM certificate found")
+}